@@ -0,0 +1,374 @@
+package protosort
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Anonymize rewrites proto files so they can be shared, e.g. attached to a
+// bug report, without giving away the schema they come from. Identifiers
+// are renamed by what they declare (Msg1, Enum1, Svc1, Rpc1, field_1,
+// VALUE_1, pkg1, ...), consistently across all of contents, so references
+// between the files still resolve, and numbered so that names of one kind
+// keep their alphabetical order. RPC verbs such as Get and the Request and
+// Response suffixes are kept, so GetTripRequest becomes GetRes1Request and
+// is still paired and grouped the way it was. String values and import
+// paths are replaced, except for the syntax and edition and the google/
+// imports, and comment words other than proto keywords become "x";
+// protosort directives are kept as they are. Keywords, scalar types,
+// numbers, standard options, and the layout are unchanged, so the files
+// are classified the way the originals are.
+func Anonymize(contents []string) ([]string, error) {
+	a := &anonymizer{
+		defs:     make(map[string]string),
+		names:    make(map[string]string),
+		strings:  make(map[string]string),
+		counters: make(map[string]int),
+	}
+	files := make([][]anonToken, len(contents))
+	for i, content := range contents {
+		if _, err := ScanFile(content); err != nil {
+			return nil, &ParseError{Err: err}
+		}
+		files[i] = anonTokens(content)
+		a.define(files[i])
+	}
+	a.number()
+	result := make([]string, len(contents))
+	for i, tokens := range files {
+		result[i] = a.rewrite(tokens)
+	}
+	return result, nil
+}
+
+type anonTokenKind int
+
+const (
+	anonOther anonTokenKind = iota
+	anonSpace
+	anonIdent
+	anonString
+	anonComment
+)
+
+type anonToken struct {
+	kind anonTokenKind
+	text string
+}
+
+// anonTokens splits content into tokens that together spell it exactly.
+// Identifiers include qualified names; numbers are "other" tokens.
+func anonTokens(content string) []anonToken {
+	var tokens []anonToken
+	s := &scanner{content: content}
+	for !s.atEnd() {
+		start := s.pos
+		c := s.peek()
+		kind := anonOther
+		switch {
+		case c == '"' || c == '\'':
+			s.skipString(c)
+			kind = anonString
+		case c == '/' && s.peekAt(1) == '/':
+			s.skipToEndOfLine()
+			kind = anonComment
+		case c == '/' && s.peekAt(1) == '*':
+			s.skipBlockComment()
+			kind = anonComment
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			for !s.atEnd() && strings.IndexByte(" \t\r\n", s.peek()) >= 0 {
+				s.pos++
+			}
+			kind = anonSpace
+		case isIdentChar(c) || c == '.' && isIdentChar(s.peekAt(1)):
+			for !s.atEnd() && (isIdentChar(s.peek()) || s.peek() == '.') {
+				s.pos++
+			}
+			if c < '0' || c > '9' {
+				kind = anonIdent
+			}
+		default:
+			s.pos++
+		}
+		tokens = append(tokens, anonToken{kind, content[start:s.pos]})
+	}
+	return tokens
+}
+
+// anonymizer holds the renaming shared by the files Anonymize rewrites.
+type anonymizer struct {
+	defs     map[string]string // declared name → prefix of its new name
+	names    map[string]string // identifier → new name
+	strings  map[string]string // string literal → replacement
+	counters map[string]int    // prefix → names given so far
+}
+
+// define records the kind of every name the tokens declare.
+func (a *anonymizer) define(tokens []anonToken) {
+	var stack []string // what each open brace belongs to
+	stmt := ""         // keyword starting the current statement
+	brackets := 0
+	prev := ""
+	for i, t := range tokens {
+		if t.kind == anonSpace || t.kind == anonComment {
+			continue
+		}
+		switch t.text {
+		case "{":
+			stack = append(stack, stmt)
+			stmt = ""
+		case "}":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			stmt = ""
+		case ";":
+			stmt = ""
+		case "[":
+			brackets++
+		case "]":
+			brackets--
+		}
+		if t.kind != anonIdent {
+			prev = t.text
+			continue
+		}
+		if stmt == "" {
+			stmt = t.text
+		}
+		switch prev {
+		case "message", "enum", "service", "rpc", "oneof":
+			a.declare(t.text, declPrefixes[prev])
+		case "package":
+			for _, part := range strings.Split(t.text, ".") {
+				a.declare(part, "pkg")
+			}
+		default:
+			if nextSignificant(tokens, i) != "=" || brackets > 0 || stmt == "option" || len(stack) == 0 || strings.Contains(t.text, ".") {
+				break
+			}
+			switch stack[len(stack)-1] {
+			case "enum":
+				a.declare(t.text, "VALUE_")
+			case "message", "oneof", "extend":
+				a.declare(t.text, "field_")
+			}
+		}
+		prev = t.text
+	}
+}
+
+// declPrefixes are the new name prefixes of what a keyword declares.
+var declPrefixes = map[string]string{
+	"message": "Msg",
+	"enum":    "Enum",
+	"service": "Svc",
+	"rpc":     "Rpc",
+	"oneof":   "choice_",
+}
+
+func (a *anonymizer) declare(name, prefix string) {
+	if _, ok := a.defs[name]; !ok {
+		a.defs[name] = prefix
+	}
+}
+
+// nextSignificant returns the text of the first token after tokens[i] that
+// isn't space or a comment.
+func nextSignificant(tokens []anonToken, i int) string {
+	for _, t := range tokens[i+1:] {
+		if t.kind != anonSpace && t.kind != anonComment {
+			return t.text
+		}
+	}
+	return ""
+}
+
+// rewrite renames and blanks out the tokens of one file.
+func (a *anonymizer) rewrite(tokens []anonToken) string {
+	var b strings.Builder
+	var prev []string // significant tokens of the current statement
+	for _, t := range tokens {
+		text := t.text
+		switch t.kind {
+		case anonIdent:
+			text = a.qualifiedName(text)
+		case anonString:
+			text = a.stringValue(text, prev)
+		case anonComment:
+			text = anonymizeComment(text)
+		}
+		b.WriteString(text)
+		switch {
+		case t.kind == anonSpace || t.kind == anonComment:
+		case t.text == ";" || t.text == "{" || t.text == "}":
+			prev = prev[:0]
+		default:
+			prev = append(prev, t.text)
+		}
+	}
+	return b.String()
+}
+
+// qualifiedName renames each part of a possibly qualified name. Names
+// under google, such as the well-known types, are kept.
+func (a *anonymizer) qualifiedName(name string) string {
+	if strings.HasPrefix(strings.TrimPrefix(name, "."), "google.") {
+		return name
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = a.name(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// number names the declared identifiers. Names with the same prefix are
+// numbered in their original order, zero-padded, so that declarations of
+// one kind keep their alphabetical order.
+func (a *anonymizer) number() {
+	composed := make(map[string]bool)
+	for _, id := range slices.Sorted(maps.Keys(a.defs)) {
+		if _, core, _, ok := splitComposed(id); ok {
+			composed[id] = true
+			if singular, plural := strings.CutSuffix(core, "s"); !plural || a.defs[singular] == "" {
+				a.declare(core, "Res")
+			}
+		}
+	}
+	groups := make(map[string][]string)
+	for id, prefix := range a.defs {
+		if !composed[id] && !anonKeep[id] {
+			groups[prefix] = append(groups[prefix], id)
+		}
+	}
+	for prefix, ids := range groups {
+		slices.Sort(ids)
+		width := len(strconv.Itoa(len(ids)))
+		for i, id := range ids {
+			a.names[id] = fmt.Sprintf("%s%0*d", prefix, width, i+1)
+		}
+		a.counters[prefix] = len(ids)
+	}
+}
+
+// name returns the new name of an unqualified identifier.
+func (a *anonymizer) name(id string) string {
+	if anonKeep[id] {
+		return id
+	}
+	if n, ok := a.names[id]; ok {
+		return n
+	}
+	var n string
+	if verb, core, suffix, ok := splitComposed(id); ok {
+		// A plural resource is renamed with its singular, as in ListTrips
+		if singular, plural := strings.CutSuffix(core, "s"); plural && a.defs[core] == "" && a.defs[singular] != "" {
+			n = verb + a.name(singular) + "s" + suffix
+		} else {
+			n = verb + a.name(core) + suffix
+		}
+	} else {
+		a.counters["Name"]++
+		n = fmt.Sprintf("Name%d", a.counters["Name"])
+	}
+	a.names[id] = n
+	return n
+}
+
+// splitComposed splits a name such as GetTripRequest into an RPC verb, a
+// resource, and a Request or Response suffix. It reports false for names
+// with neither a verb nor a suffix.
+func splitComposed(id string) (verb, core, suffix string, ok bool) {
+	core = id
+	for _, s := range []string{"Request", "Response"} {
+		if rest, ok := strings.CutSuffix(core, s); ok && rest != "" {
+			core, suffix = rest, s
+			break
+		}
+	}
+	if key := rpcGroupKey(core); key != core {
+		verb, core = core[:len(core)-len(key)], key
+	}
+	if verb == "" && suffix == "" || !unicode.IsUpper(rune(core[0])) {
+		return "", "", "", false
+	}
+	return verb, core, suffix, true
+}
+
+// stringValue returns the replacement of the string literal lit, given the
+// tokens of its statement before it.
+func (a *anonymizer) stringValue(lit string, stmt []string) string {
+	if len(lit) <= 2 {
+		return lit
+	}
+	if len(stmt) > 0 {
+		switch stmt[0] {
+		case "syntax", "edition":
+			return lit
+		case "import":
+			if strings.HasPrefix(lit[1:], "google/") {
+				return lit
+			}
+			return a.replaceString(lit, "dep", ".proto")
+		}
+	}
+	return a.replaceString(lit, "s", "")
+}
+
+func (a *anonymizer) replaceString(lit, prefix, suffix string) string {
+	if r, ok := a.strings[lit]; ok {
+		return r
+	}
+	a.counters[`"`+prefix]++
+	quote := lit[:1]
+	r := fmt.Sprintf("%s%s%d%s%s", quote, prefix, a.counters[`"`+prefix], suffix, quote)
+	a.strings[lit] = r
+	return r
+}
+
+// commentWordRe matches the words anonymizeComment replaces.
+var commentWordRe = regexp.MustCompile(`[A-Za-z0-9_]+`)
+
+// anonymizeComment replaces the words of a comment other than keywords with
+// "x", keeping its punctuation, so banners, dividers, and commented-out code
+// keep their shape. Comments holding a protosort directive are kept.
+func anonymizeComment(comment string) string {
+	if strings.Contains(comment, "protosort:") {
+		return comment
+	}
+	return commentWordRe.ReplaceAllStringFunc(comment, func(word string) string {
+		if anonKeep[word] {
+			return word
+		}
+		return "x"
+	})
+}
+
+// anonKeep are the identifiers Anonymize never renames: keywords, scalar
+// types, and the standard options and their values.
+var anonKeep = make(map[string]bool)
+
+func init() {
+	for _, words := range []string{
+		// Keywords
+		"syntax edition package import public weak option message enum service rpc returns stream extend extensions reserved to max oneof map repeated optional required group true false inf nan",
+		// Scalar types
+		"double float int32 int64 uint32 uint64 sint32 sint64 fixed32 fixed64 sfixed32 sfixed64 bool string bytes",
+		// Standard options
+		"java_package java_outer_classname java_multiple_files java_generate_equals_and_hash java_string_check_utf8 optimize_for go_package cc_generic_services java_generic_services py_generic_services deprecated cc_enable_arenas objc_class_prefix csharp_namespace swift_prefix php_class_prefix php_namespace php_metadata_namespace ruby_package features message_set_wire_format no_standard_descriptor_accessor map_entry ctype packed jstype lazy unverified_lazy debug_redact retention targets allow_alias idempotency_level json_name default",
+		// Their values, and edition features
+		"SPEED CODE_SIZE LITE_RUNTIME STRING CORD STRING_PIECE JS_NORMAL JS_STRING JS_NUMBER IDEMPOTENCY_UNKNOWN NO_SIDE_EFFECTS IDEMPOTENT field_presence enum_type repeated_field_encoding utf8_validation message_encoding json_format EXPLICIT IMPLICIT LEGACY_REQUIRED OPEN CLOSED PACKED EXPANDED VERIFY NONE LENGTH_PREFIXED DELIMITED ALLOW LEGACY_BEST_EFFORT",
+	} {
+		for _, w := range strings.Fields(words) {
+			anonKeep[w] = true
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package protosort
+
+import (
+	"strings"
+)
+
+// ParsedFile is a proto file as a syntax tree, as returned by Parse.
+type ParsedFile struct {
+	Header []*Node // syntax or edition, package, imports, and file options, in file order
+	Decls  []*Node // messages, enums, services, and extends, in file order
+	// TrailingComments are the comments after the last declaration
+	TrailingComments string
+}
+
+// Node is a declaration in a ParsedFile: a top-level statement, or a
+// member of a message, enum, service, oneof, extend, or rpc body.
+type Node struct {
+	// Kind is the keyword the declaration starts with, e.g. "message",
+	// "import", "option", "oneof", "reserved", or "rpc", or "field" for a
+	// field and "value" for an enum value.
+	Kind string
+	// Name is the declared name. It is the path of an import, the version
+	// of syntax or edition, the name of an option, and the type extended
+	// by an extend. Reserved and extensions statements have none.
+	Name string
+	// Type is a field's type as written, e.g. "string", "pkg.Foo", or
+	// "map<string, Foo>" ("group" for a proto2 group), and an rpc's
+	// request type, prefixed with "stream " for a stream.
+	Type    string
+	Returns string // an rpc's response type, prefixed with "stream " for a stream
+	Label   string // a field's "optional", "repeated", or "required", if any
+	Number  string // a field's or enum value's number, as written
+
+	// Comments is the text before the declaration: blank lines,
+	// indentation, and the comments above it.
+	Comments string
+	// Text is the declaration from its first word through its closing ;
+	// or }.
+	Text string
+	// TrailingComment is the comment on the line Text ends on, if any.
+	TrailingComment string
+	Line            int // 1-based line Text starts on
+	EndLine         int // 1-based line Text ends on
+
+	Members []*Node // the declarations in its body, for those with one
+}
+
+// Parse parses content into a syntax tree. It is as tolerant as Sort:
+// anything ScanFile accepts parses, and members it can't make sense of are
+// kept as fields with whatever names and types they have. It returns a
+// *ParseError when ScanFile fails.
+func Parse(content string) (*ParsedFile, error) {
+	blocks, err := ScanFile(content)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	f := &ParsedFile{}
+	for _, b := range blocks {
+		if b.Kind == BlockComment {
+			f.TrailingComments += b.Comments
+			continue
+		}
+		decl, trailing := splitTrailingComment(b.DeclText)
+		n := &Node{
+			Kind:            leadingIdent(decl),
+			Name:            b.Name,
+			Comments:        b.Comments,
+			Text:            decl,
+			TrailingComment: strings.TrimSpace(trailing),
+			Line:            b.Line,
+			EndLine:         b.EndLine,
+		}
+		switch b.Kind {
+		case BlockSyntax, BlockPackage, BlockImport, BlockOption:
+			f.Header = append(f.Header, n)
+			continue
+		case BlockService:
+			n.Members = parseMembers(decl, n.Line, "service")
+		case BlockEnum:
+			n.Members = parseMembers(decl, n.Line, "enum")
+		default:
+			n.Members = parseMembers(decl, n.Line, "message")
+		}
+		f.Decls = append(f.Decls, n)
+	}
+	return f, nil
+}
+
+// parseMembers parses the body of decl, which starts on line and is a
+// declaration of kind: "message" for messages, oneofs, extends, and
+// groups, whose members are fields and nested declarations, "enum", or
+// "service".
+func parseMembers(decl string, line int, kind string) []*Node {
+	body, ok := splitMessageBody(decl)
+	if !ok {
+		return nil
+	}
+	var nodes []*Node
+	off := len(body.head)
+	for _, m := range body.members {
+		off += len(m.gap) + len(m.comments)
+		n := &Node{
+			Kind:            m.keyword,
+			Comments:        m.gap + m.comments,
+			Text:            m.decl,
+			TrailingComment: strings.TrimSpace(m.trailing),
+			Line:            line + strings.Count(decl[:off], "\n"),
+		}
+		n.EndLine = n.Line + strings.Count(m.decl, "\n")
+		off += len(m.decl) + len(m.trailing)
+
+		switch m.keyword {
+		case "":
+			continue // a stray ;
+		case "message", "enum", "oneof", "extend", "service":
+			n.Name = extractDeclName(m.keyword, m.decl)
+			sub := "message"
+			if m.keyword == "enum" || m.keyword == "service" {
+				sub = m.keyword
+			}
+			n.Members = parseMembers(m.decl, n.Line, sub)
+		case "option":
+			n.Name = extractDeclName(m.keyword, m.decl)
+		case "reserved", "extensions":
+		case "rpc":
+			if kind != "service" {
+				parseField(n)
+				break
+			}
+			parseRPC(n)
+			n.Members = parseMembers(m.decl, n.Line, "rpc")
+		default:
+			if kind == "enum" {
+				parseEnumValue(n)
+			} else {
+				parseField(n)
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// fieldLabels are the words that can precede a field's type.
+var fieldLabels = map[string]bool{"optional": true, "repeated": true, "required": true}
+
+// parseField fills in a field's kind, label, type, name, and number from
+// its text, and parses the members of a group.
+func parseField(n *Node) {
+	n.Kind = "field"
+	toks := tokens(n.Text)
+	i := 0
+	if i < len(toks) && fieldLabels[toks[i]] {
+		n.Label = toks[i]
+		i++
+	}
+	if i+1 < len(toks) && toks[i] == "map" && toks[i+1] == "<" {
+		// map<K, V>
+		j := i + 2
+		var parts []string
+		for j < len(toks) && toks[j] != ">" {
+			if toks[j] != "," {
+				parts = append(parts, toks[j])
+			}
+			j++
+		}
+		n.Type = "map<" + strings.Join(parts, ", ") + ">"
+		i = min(j+1, len(toks)) // an unclosed map< runs to the end
+	} else if i < len(toks) {
+		n.Type = toks[i]
+		i++
+	}
+	if i < len(toks) {
+		n.Name = toks[i]
+		i++
+	}
+	n.Number = numberAfterEquals(toks[i:])
+	if n.Type == "group" {
+		n.Members = parseMembers(n.Text, n.Line, "message")
+	}
+}
+
+// parseEnumValue fills in an enum value's name and number from its text.
+func parseEnumValue(n *Node) {
+	n.Kind = "value"
+	toks := tokens(n.Text)
+	if len(toks) > 0 {
+		n.Name = toks[0]
+		n.Number = numberAfterEquals(toks[1:])
+	}
+}
+
+// numberAfterEquals returns the number toks start with after an "=",
+// keeping a leading minus sign.
+func numberAfterEquals(toks []string) string {
+	if len(toks) < 2 || toks[0] != "=" {
+		return ""
+	}
+	if toks[1] == "-" && len(toks) > 2 {
+		return "-" + toks[2]
+	}
+	return toks[1]
+}
+
+// parseRPC fills in an rpc's name, request type, and response type from
+// its text: rpc Name ([stream] Request) returns ([stream] Response).
+func parseRPC(n *Node) {
+	toks := tokens(n.Text)
+	if len(toks) > 1 {
+		n.Name = toks[1]
+	}
+	// The types are the parenthesized lists after the name and after returns
+	var lists []string
+	for i := 2; i < len(toks) && len(lists) < 2; i++ {
+		if toks[i] != "(" {
+			continue
+		}
+		var words []string
+		for i++; i < len(toks) && toks[i] != ")"; i++ {
+			words = append(words, toks[i])
+		}
+		lists = append(lists, strings.Join(words, " "))
+	}
+	if len(lists) > 0 {
+		n.Type = lists[0]
+	}
+	if len(lists) > 1 {
+		n.Returns = lists[1]
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package protosort
 
 // BlockKind represents the type of a top-level proto element.
 type BlockKind int
@@ -52,17 +52,52 @@ const (
 	SectionUnreferenced                   // types referenced by 0 declarations
 )
 
+func (s Section) String() string {
+	switch s {
+	case SectionHeader:
+		return "header"
+	case SectionService:
+		return "service"
+	case SectionRequestResponse:
+		return "request/response"
+	case SectionCore:
+		return "core"
+	case SectionHelper:
+		return "helper"
+	case SectionUnreferenced:
+		return "unreferenced"
+	default:
+		return "unknown"
+	}
+}
+
 // Block represents a top-level element in a proto file with its raw text.
 type Block struct {
 	Kind     BlockKind
 	Name     string // name of the declaration (for message, enum, service, extend)
 	Comments string // leading/detached comments (may include blank lines)
 	DeclText string // the declaration text (from keyword to closing ; or })
-	Section  Section
+	Line     int    // 1-based line of the keyword in the scanned content
+	EndLine  int    // 1-based line of the closing ; or }
+	// Package is the file's package, set by ScanFile on every block, so
+	// that references qualified by it resolve to the file's own types
+	Package string
+	// TrailingComments are emitted on their own line after DeclText
+	// (e.g. a region end marker)
+	TrailingComments string
+	Section          Section
 	// Extracted from service blocks
 	RPCs []RPC
 	// For sorting helpers: the single consumer of this type (if Section == SectionHelper)
 	Consumer string
+	// Verbatim marks a verbatim region (see Options.VerbatimBegin): Kind
+	// and Name are its first declaration's, and DeclText holds all of its
+	// declarations as written.
+	Verbatim bool
+	// Floating marks Comments that a blank line separates from DeclText,
+	// which Emit then keeps, so that they stay detached rather than become
+	// the declaration's doc comment. Set with Options.KeepFloatingComments.
+	Floating bool
 }
 
 // RPC represents an RPC method in a service.
@@ -72,23 +107,148 @@ type RPC struct {
 	ResponseType string
 }
 
+// Verifiers for the descriptor comparison run by Verify.
+const (
+	VerifierProtocompile = "protocompile" // in-process, the default
+	VerifierProtoc       = "protoc"       // shells out to protoc
+)
+
+// VerifyGRPCCompat is the VerifyLevel that also checks gRPC services resolve
+// identically through a protobuf runtime registry.
+const VerifyGRPCCompat = "grpc-compat"
+
 // Options holds the configuration for sorting.
 type Options struct {
 	Write            bool
 	Check            bool
+	CheckLevel       string // CLI: changes --check fails on: "" or "all", "cosmetic", or "semantic"
 	Diff             bool
 	Verify           bool
+	VerifyLevel      string // "" or VerifyGRPCCompat; extra checks run by Verify
+	Verifier         string // "" or VerifierProtocompile (in-process), or VerifierProtoc
+	RequireVerify    bool   // fail Verify instead of skipping when protoc is missing
+	Paranoid         bool   // Verify also requires every non-whitespace character to survive
 	ProtocPath       string
 	ProtoPaths       []string
 	SharedOrder      string // "alpha" or "dependency"
+	KindOrder        string // "" or "mixed" (by name), "enums-first", or "messages-first"; enums and messages within a section
 	SortRPCs         string // "" (disabled), "alpha", or "grouped"
+	RPCGroupHeaders  bool   // with SortRPCs "grouped", add a comment header above each resource group
+	RPCFingerprint   bool   // with SortRPCs, record each service's RPC order and warn when RPCs are later misplaced
+	SortFieldOptions bool   // sort and respace bracketed field options
+	SortNested       bool   // alphabetize nested messages and enums inside messages
+	SortFields       bool   // order message fields by field number
+	PairStrict       bool   // follow each XxxRequest directly with its XxxResponse
+	GroupByService   bool   // with several services, follow each directly by its own RPC types
+	GroupExtends     bool   // sort extends by extended type, each followed by the types only it uses
+	GroupImports     bool   // separate well-known, third-party, and local imports with blank lines
 	PreserveDividers bool
+	PreserveSpacing  bool // keep the input's blank lines between declarations that stay adjacent
 	StripCommented   bool
-	DryRun           bool
-	Verbose          bool
-	Quiet            bool
-	Recursive        bool
-	Annotate         bool
-	SectionHeaders   bool
-	ConfigFile       string
+	// NormalizeComments rewrites /* */ leading comments as // lines and,
+	// with CommentWidth > 0, splits // lines of prose longer than that many
+	// columns. Comment words are never changed.
+	NormalizeComments bool
+	CommentWidth      int
+	DryRun            bool
+	Format            string // CLI report format: "text" (default), "json", or "sarif"
+	Verbose           bool
+	Quiet             bool
+	Strict            bool // treat unsupported file structure as an error
+	AllowProto2       bool // sort proto2 files instead of rejecting them
+	Recursive         bool
+	IgnoreMissing     bool   // CLI: skip file arguments that don't exist
+	Output            string // CLI: write the sorted result of a single input here instead of to stdout
+	Annotate          bool
+	SectionHeaders    bool   // see also HeaderStyle
+	SectionStats      bool   // append declaration counts to section header labels
+	TOC               bool   // insert a table-of-contents comment after the header
+	InlineHelpers     bool   // emit single-consumer helpers directly above their consumer
+	Regions           string // "" (disabled), "keep", or "strip"
+	RegionBegin       string // begin fold marker (default "// region")
+	RegionEnd         string // end fold marker (default "// endregion")
+	Indent            string // "" (keep), IndentSpaces, IndentTabs, or spaces per level, e.g. "4"; see ParseIndent
+	IndentWidth       int    // columns a tab stands for when rewriting indentation; 0 infers it
+	EndOfLine         string // "" or EndOfLineAuto (the input's dominant), EndOfLineLF, or EndOfLineCRLF
+	NoFinalNewline    bool   // end the output without a trailing newline
+	NoEditorConfig    bool   // CLI: ignore .editorconfig files
+	ConfigFile        string
+	Preset            string // built-in preset name (see presets.go)
+	// LikeOrder is a template's declaration order (see DeclarationOrder).
+	// Declarations it names come first in that order; the rest follow.
+	LikeOrder []string
+	// CodePatterns and ProsePatterns are regular expressions matched against
+	// comment text after "//". For StripCommented, a line matching a code
+	// pattern counts as code, and a line matching a prose pattern keeps its
+	// whole comment block.
+	CodePatterns  []string
+	ProsePatterns []string
+	// DividerPatterns are regular expressions for section divider lines
+	// beyond the built-in ASCII ones (e.g. "^// ═+"), matched against a
+	// whole comment line, "//" included, with surrounding space trimmed.
+	DividerPatterns []string
+	// Exclude holds gitignore-style patterns, relative to the working
+	// directory, for files the CLI never processes.
+	Exclude []string
+	// LocalImports are the path prefixes of local imports for GroupImports,
+	// e.g. "acme/". If empty, imports under the directory named for the
+	// first component of the file's package are local.
+	LocalImports []string
+	// RemoveUnusedImports drops imports that define no message, enum, or
+	// extension the file references, resolving them through ProtoPaths and
+	// the well-known types. Public and weak imports, and imports that can't
+	// be resolved, are kept.
+	RemoveUnusedImports bool
+	// RPCOrder ranks RPCs, when SortRPCs is set, by the first glob they
+	// match (e.g. "Create*", "Get*", "*"). RPCs matching no glob come last,
+	// and ties sort by name. In grouped mode it orders RPCs within a group.
+	RPCOrder []string
+	// PreWrite and PostWrite are shell commands the CLI runs before and
+	// after writing each file, with "{file}" replaced by its path. A failing
+	// PreWrite leaves the file unwritten. Hooks are killed after HookTimeout
+	// (a duration such as "30s"; one minute if empty) and get HookEnv
+	// ("NAME=value" entries) on top of the environment.
+	PreWrite    string
+	PostWrite   string
+	HookTimeout string
+	HookEnv     []string
+	// BlankLinesBetweenSections and BlankLinesWithinSection are the blank
+	// lines Emit writes above a body declaration that starts a new section
+	// and above one in the same section as the declaration before it. Zero
+	// means one.
+	BlankLinesBetweenSections int
+	BlankLinesWithinSection   int
+	// HeaderStyle customizes the labels and banners of SectionHeaders.
+	HeaderStyle HeaderStyle
+	// VerbatimBegin and VerbatimEnd are regular expressions matched against
+	// comment text after "//". The messages, enums, and services between a
+	// comment line matching VerbatimBegin and one matching VerbatimEnd, such
+	// as a section a generator owns, are kept exactly as written and move as
+	// a unit, sorted as the first of them.
+	VerbatimBegin string
+	VerbatimEnd   string
+	// LicenseTemplate is the path of a license header template, a Go
+	// template that gets the year as {{.Year}}. A file without the header
+	// gets it above its other header comments; one that has it, with any
+	// year, gets the current year added to its years (2019 becomes
+	// 2019-2026). LicenseYear stands in for the current year when set.
+	LicenseTemplate string
+	LicenseYear     int
+	// KeepFloatingComments keeps a comment separated by a blank line from
+	// the declaration below it separated as it moves with that declaration.
+	// By default the blank line is dropped.
+	KeepFloatingComments bool
+	// CoreMinRefs, when positive, makes a type core only once at least
+	// that many declarations reference it; types with fewer consumers go
+	// with the helpers even if they reference other types. Types nothing
+	// references stay core when they reference others. Zero keeps the
+	// default: a type is core when it references other local types.
+	CoreMinRefs int
+	// Exceptions excuse files from failing Check until they expire. The
+	// CLI matches their File patterns against absolute paths.
+	Exceptions []Exception
+	// Size thresholds reported as warnings; zero disables the check.
+	MaxRPCsPerService   int
+	MaxFieldsPerMessage int
+	MaxMessagesPerFile  int
 }
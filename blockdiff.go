@@ -0,0 +1,94 @@
+package protosort
+
+import "strconv"
+
+// BlockMove describes one declaration of a file before and after sorting.
+type BlockMove struct {
+	Kind BlockKind
+	Name string
+	// OldIndex and NewIndex are the declaration's positions among the
+	// original's and the sorted file's declarations (comment blocks aside),
+	// and OldLine and NewLine the 1-based lines of its keyword. They are -1
+	// and 0 when the declaration is missing from that side.
+	OldIndex, NewIndex int
+	OldLine, NewLine   int
+	Section            Section // the declaration's section; SectionHeader for header blocks
+	Changed            bool    // the declaration's text differs, not just its place
+}
+
+// DiffBlocks compares a file with its sorted output declaration by
+// declaration, rather than line by line as DiffStrings does. It returns a
+// BlockMove for every declaration in sorted, in sorted's order, followed by
+// those only in original, in original's order. Declarations are matched by
+// kind and name.
+func DiffBlocks(original, sorted string) ([]BlockMove, error) {
+	origBlocks, err := ScanFile(original)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	sortedBlocks, err := ScanFile(sorted)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	// Sections don't depend on the options, only the order within them
+	Classify(sortedBlocks, Options{})
+
+	origDecls, sortedDecls := declarations(origBlocks), declarations(sortedBlocks)
+	pairs := matchBlocks(origDecls, sortedDecls)
+	oldIndex := make(map[*Block]int)
+	for i, b := range origDecls {
+		oldIndex[b] = i
+	}
+
+	var moves []BlockMove
+	for i, b := range sortedDecls {
+		m := BlockMove{Kind: b.Kind, Name: b.Name, OldIndex: -1, NewIndex: i, NewLine: b.Line, Section: b.Section}
+		if orig := pairs[b]; orig != nil {
+			m.OldIndex, m.OldLine = oldIndex[orig], orig.Line
+			m.Changed = orig.DeclText != b.DeclText
+		}
+		moves = append(moves, m)
+	}
+	for i, b := range origDecls {
+		if pairs[b] == nil {
+			moves = append(moves, BlockMove{Kind: b.Kind, Name: b.Name, OldIndex: i, NewIndex: -1, OldLine: b.Line})
+		}
+	}
+	return moves, nil
+}
+
+// declarations returns blocks without the freestanding comment blocks.
+func declarations(blocks []*Block) []*Block {
+	var decls []*Block
+	for _, b := range blocks {
+		if b.Kind != BlockComment {
+			decls = append(decls, b)
+		}
+	}
+	return decls
+}
+
+// matchBlocks pairs the blocks of an original file with those of its sorted
+// output by blockKey, matching same-keyed blocks in order. The result maps
+// each paired block, from either side, to its counterpart.
+func matchBlocks(orig, sorted []*Block) map[*Block]*Block {
+	byKey := make(map[string]*Block)
+	seen := make(map[string]int)
+	occurrenceKey := func(b *Block) string {
+		k := blockKey(b)
+		seen[k]++
+		return k + "#" + strconv.Itoa(seen[k])
+	}
+	for _, b := range orig {
+		byKey[occurrenceKey(b)] = b
+	}
+	clear(seen)
+
+	pairs := make(map[*Block]*Block)
+	for _, b := range sorted {
+		if o := byKey[occurrenceKey(b)]; o != nil {
+			pairs[b], pairs[o] = o, b
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tallhamn/protosort"
+)
+
+// runAnonymize prints the files with their identifiers, strings, and
+// comment text replaced (see protosort.Anonymize), renamed consistently
+// across them, for attaching to bug reports. Nothing is written.
+func runAnonymize(files []string) int {
+	contents := make([]string, len(files))
+	for i, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", file, err)
+			return 4
+		}
+		contents[i] = string(content)
+	}
+	anonymized, err := protosort.Anonymize(contents)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 3
+	}
+	writeAnonymized(os.Stdout, anonymized)
+	return 0
+}
+
+// writeAnonymized prints the anonymized files in order. Several files are
+// each introduced by a comment line numbering them, since their paths
+// aren't anonymized.
+func writeAnonymized(w io.Writer, anonymized []string) {
+	for i, content := range anonymized {
+		if len(anonymized) > 1 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "// file %d of %d\n", i+1, len(anonymized))
+		}
+		io.WriteString(w, content)
+	}
+}
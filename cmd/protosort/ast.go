@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/tallhamn/protosort"
+)
+
+// astSchemaVersion is the schema_version of the ast command's JSON output.
+// It changes when a field is removed, renamed, or changes meaning; fields
+// may be added without changing it.
+const astSchemaVersion = 1
+
+// astDump is the JSON output of the ast command.
+type astDump struct {
+	SchemaVersion int       `json:"schema_version"`
+	Files         []astFile `json:"files"`
+}
+
+// astFile is one file's blocks, in file order.
+type astFile struct {
+	File   string     `json:"file"`
+	Blocks []astBlock `json:"blocks"`
+}
+
+// astBlock is a protosort.Block. Section is the one it is classified into,
+// and is empty for freestanding comments; Consumer is set for helpers and
+// for types used only by one RPC's messages.
+type astBlock struct {
+	Kind             string   `json:"kind"`
+	Name             string   `json:"name"`
+	Line             int      `json:"line"`
+	Section          string   `json:"section"`
+	Consumer         string   `json:"consumer,omitempty"`
+	Comments         string   `json:"comments"`
+	Decl             string   `json:"decl"`
+	TrailingComments string   `json:"trailing_comments,omitempty"`
+	RPCs             []astRPC `json:"rpcs,omitempty"`
+}
+
+// astRPC is a protosort.RPC.
+type astRPC struct {
+	Name     string `json:"name"`
+	Request  string `json:"request"`
+	Response string `json:"response"`
+}
+
+// runAST prints the blocks protosort sees in each file, classified as for
+// sorting, as JSON with --format json (or --json) and as an outline
+// otherwise. Nothing is written.
+func runAST(files []string, opts protosort.Options) int {
+	exitCode := 0
+	dump := astDump{SchemaVersion: astSchemaVersion, Files: []astFile{}}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", file, err)
+			exitCode = 4
+			continue
+		}
+		f, err := astOf(string(content), opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", file, err)
+			exitCode = max(exitCode, 3)
+			continue
+		}
+		f.File = file
+		dump.Files = append(dump.Files, f)
+	}
+
+	if opts.Format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(dump); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 4
+		}
+		return exitCode
+	}
+	writeASTOutline(os.Stdout, dump)
+	return exitCode
+}
+
+// astOf scans and classifies content.
+func astOf(content string, opts protosort.Options) (astFile, error) {
+	blocks, err := protosort.ScanFile(content)
+	if err != nil {
+		return astFile{}, &protosort.ParseError{Err: err}
+	}
+	protosort.Classify(blocks, opts)
+
+	f := astFile{Blocks: make([]astBlock, 0, len(blocks))}
+	for _, b := range blocks {
+		block := astBlock{
+			Kind:             b.Kind.String(),
+			Name:             b.Name,
+			Line:             b.Line,
+			Section:          b.Section.String(),
+			Consumer:         b.Consumer,
+			Comments:         b.Comments,
+			Decl:             b.DeclText,
+			TrailingComments: b.TrailingComments,
+		}
+		if b.Kind == protosort.BlockComment {
+			block.Section = ""
+		}
+		for _, rpc := range b.RPCs {
+			block.RPCs = append(block.RPCs, astRPC{Name: rpc.Name, Request: rpc.RequestType, Response: rpc.ResponseType})
+		}
+		f.Blocks = append(f.Blocks, block)
+	}
+	return f, nil
+}
+
+// writeASTOutline prints each file's blocks one per line, with their line,
+// if known, kind, name, and section.
+func writeASTOutline(w io.Writer, dump astDump) {
+	for i, f := range dump.Files {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, f.File)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, b := range f.Blocks {
+			section := b.Section
+			if b.Consumer != "" {
+				section += " (" + b.Consumer + ")"
+			}
+			line := ""
+			if b.Line > 0 {
+				line = strconv.Itoa(b.Line)
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", line, b.Kind, b.Name, section)
+			for _, rpc := range b.RPCs {
+				fmt.Fprintf(tw, "  \t\t  rpc %s\t(%s) returns (%s)\n", rpc.Name, rpc.Request, rpc.Response)
+			}
+		}
+		tw.Flush()
+	}
+}
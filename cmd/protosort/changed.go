@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// defaultChangedBase is the ref --changed compares against when given no value.
+const defaultChangedBase = "origin/main"
+
+// changedFlag implements --changed: a boolean that compares against
+// defaultChangedBase, or --changed=<ref> to name the base ref.
+type changedFlag struct {
+	base *string
+}
+
+func (f changedFlag) String() string {
+	if f.base == nil {
+		return ""
+	}
+	return *f.base
+}
+
+func (f changedFlag) Set(value string) error {
+	if b, err := strconv.ParseBool(value); err == nil {
+		*f.base = ""
+		if b {
+			*f.base = defaultChangedBase
+		}
+		return nil
+	}
+	*f.base = value
+	return nil
+}
+
+func (f changedFlag) IsBoolFlag() bool {
+	return true
+}
+
+// changedFiles returns the .proto files below the working directory that
+// differ from the merge base of base and HEAD: committed, staged, and
+// unstaged changes, plus untracked files that aren't ignored. Deleted files
+// are left out. With args, only files collectFiles would pick from them are
+// kept; without, every changed file is, minus opts.Exclude.
+func changedFiles(base string, args []string, opts protosort.Options) ([]string, error) {
+	mergeBase, err := git("merge-base", base, "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("--changed: %w", err)
+	}
+	diff, err := git("diff", "--name-only", "--relative", "--diff-filter=ACMR", "-z", strings.TrimSpace(mergeBase))
+	if err != nil {
+		return nil, fmt.Errorf("--changed: %w", err)
+	}
+	untracked, err := git("ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("--changed: %w", err)
+	}
+
+	return selectFiles(protoNames(diff+untracked), args, opts)
+}
+
+// stagedFiles returns the .proto files below the working directory that are
+// staged for commit, other than deletions, selected by args as in
+// changedFiles. partial holds the staged content of those that also have
+// unstaged changes, which is what gets committed, by file.
+func stagedFiles(args []string, opts protosort.Options) (files []string, partial map[string]string, err error) {
+	staged, err := git("diff", "--cached", "--name-only", "--relative", "--diff-filter=ACMR", "-z")
+	if err != nil {
+		return nil, nil, fmt.Errorf("--staged: %w", err)
+	}
+	unstaged, err := git("diff", "--name-only", "--relative", "-z")
+	if err != nil {
+		return nil, nil, fmt.Errorf("--staged: %w", err)
+	}
+	files, err = selectFiles(protoNames(staged), args, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	changed := make(map[string]bool)
+	for _, name := range protoNames(unstaged) {
+		if abs, err := filepath.Abs(name); err == nil {
+			changed[abs] = true
+		}
+	}
+	partial = make(map[string]string)
+	for _, file := range files {
+		if abs, err := filepath.Abs(file); err != nil || !changed[abs] {
+			continue
+		}
+		content, err := git("cat-file", "blob", ":./"+filepath.ToSlash(file))
+		if err != nil {
+			return nil, nil, fmt.Errorf("--staged: %w", err)
+		}
+		partial[file] = content
+	}
+	return files, partial, nil
+}
+
+// skipPartial drops the files in partial from files, since --staged
+// --write can't sort them without staging their unstaged changes too. Each
+// one whose staged content needs sorting is reported, and fails the run as
+// --check would, so that the commit stops until the file is staged or
+// stashed whole. It returns the remaining files and the exit code.
+func skipPartial(files []string, partial map[string]string, opts protosort.Options) ([]string, int) {
+	var kept []string
+	code := 0
+	for _, file := range files {
+		content, ok := partial[file]
+		if !ok {
+			kept = append(kept, file)
+			continue
+		}
+		p := &pendingFile{file: file, original: content, opts: withEditorConfig(file, opts)}
+		sortContent(p, p.opts, nil)
+		switch {
+		case p.code != 0:
+			fmt.Fprintln(os.Stderr, p.errMsg)
+			code = max(code, p.code)
+		case p.sorted != p.original:
+			fmt.Fprintf(os.Stderr, "error: %s needs sorting but has unstaged changes; stage or stash them, then commit again\n", file)
+			code = max(code, 1)
+		}
+	}
+	return kept, code
+}
+
+// restage adds files back to the index after --staged --write sorted them.
+func restage(files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if _, err := git(append([]string{"add", "--"}, files...)...); err != nil {
+		return fmt.Errorf("--staged: %w", err)
+	}
+	return nil
+}
+
+// protoNames returns the .proto paths in NUL-separated git output.
+func protoNames(out string) []string {
+	var names []string
+	for _, name := range strings.Split(out, "\x00") {
+		if strings.HasSuffix(name, ".proto") {
+			names = append(names, filepath.FromSlash(name))
+		}
+	}
+	return names
+}
+
+// selectFiles narrows the files git reported to those args select: with
+// args, the ones collectFiles would pick from them; without, all of them,
+// minus opts.Exclude.
+func selectFiles(names, args []string, opts protosort.Options) ([]string, error) {
+	if len(args) == 0 {
+		return collectFiles(names, opts)
+	}
+
+	// Keep the named files among those the arguments expand to
+	named := make(map[string]bool, len(names))
+	for _, name := range names {
+		if abs, err := filepath.Abs(name); err == nil {
+			named[abs] = true
+		}
+	}
+	candidates, err := collectFiles(args, opts)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, file := range candidates {
+		if abs, err := filepath.Abs(file); err == nil && named[abs] {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// git runs a git command in the working directory and returns its stdout.
+func git(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
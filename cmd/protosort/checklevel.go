@@ -0,0 +1,52 @@
+package main
+
+import "strings"
+
+// checkLevels ranks the --check-level values from the fewest changes they
+// fail --check on to the most.
+var checkLevels = map[string]int{
+	"semantic": 1, // declarations or comments move or change
+	"cosmetic": 2, // also whitespace within lines, such as indentation
+	"all":      3, // also blank lines, trailing whitespace, and line endings
+}
+
+// checkFails reports whether --check at level fails a file sorted from
+// original to sorted. The empty level is "all".
+func checkFails(original, sorted, level string) bool {
+	if level == "" {
+		level = "all"
+	}
+	return original != sorted && checkLevels[changeLevel(original, sorted)] <= checkLevels[level]
+}
+
+// changeLevel returns the lowest --check-level at which sorted counts as a
+// change from original.
+func changeLevel(original, sorted string) string {
+	switch {
+	case strings.Join(strings.Fields(original), " ") != strings.Join(strings.Fields(sorted), " "):
+		return "semantic"
+	case layoutFree(original) != layoutFree(sorted):
+		return "cosmetic"
+	}
+	return "all"
+}
+
+// changeDescription describes the changes that only the levels above
+// "semantic" count.
+var changeDescription = map[string]string{
+	"cosmetic": "whitespace",
+	"all":      "blank lines or line endings",
+}
+
+// layoutFree returns text without blank lines, trailing whitespace, or
+// carriage returns.
+func layoutFree(text string) string {
+	var b strings.Builder
+	for line := range strings.Lines(text) {
+		if line = strings.TrimRight(line, " \t\r\n"); line != "" {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
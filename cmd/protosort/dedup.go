@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/tallhamn/protosort"
+)
+
+// sortResult is the outcome of Sort for one input.
+type sortResult struct {
+	sorted   string
+	warnings []protosort.Warning
+	err      error
+}
+
+// duplicateFile records a file whose contents matched an earlier file.
+type duplicateFile struct {
+	File     string `json:"file"`
+	Original string `json:"original"`
+}
+
+// sortCache remembers Sort results by input content hash, so identical
+// copies of a file (e.g. vendored protos) are sorted only once per run.
+type sortCache struct {
+	results    map[[sha256.Size]byte]sortResult
+	firstFile  map[[sha256.Size]byte]string
+	duplicates []duplicateFile
+}
+
+func newSortCache() *sortCache {
+	return &sortCache{
+		results:   make(map[[sha256.Size]byte]sortResult),
+		firstFile: make(map[[sha256.Size]byte]string),
+	}
+}
+
+// sort returns Sort(content, opts), reusing the result of an earlier file
+// with identical contents and formatting options (which .editorconfig may
+// set per file). A nil cache always sorts.
+func (c *sortCache) sort(file, content string, opts protosort.Options) (string, []protosort.Warning, error) {
+	if c == nil {
+		return safeSort(content, opts)
+	}
+
+	format := fmt.Sprintf("%s %d %s %t\x00", opts.Indent, opts.IndentWidth, opts.EndOfLine, opts.NoFinalNewline)
+	key := sha256.Sum256([]byte(format + content))
+	if r, ok := c.results[key]; ok {
+		c.duplicates = append(c.duplicates, duplicateFile{File: file, Original: c.firstFile[key]})
+		return r.sorted, r.warnings, r.err
+	}
+
+	sorted, warnings, err := safeSort(content, opts)
+	c.results[key] = sortResult{sorted: sorted, warnings: warnings, err: err}
+	c.firstFile[key] = file
+	return sorted, warnings, err
+}
+
+// writeDuplicateReport lists the files whose sorted result was reused.
+func writeDuplicateReport(w io.Writer, duplicates []duplicateFile) {
+	if len(duplicates) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d duplicate file(s) sorted once:\n", len(duplicates))
+	for _, d := range duplicates {
+		fmt.Fprintf(w, "  %s (same as %s)\n", d.File, d.Original)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// editorConfigFile is the name of the EditorConfig files searched for above
+// each processed file.
+const editorConfigFile = ".editorconfig"
+
+// editorConfigSection is one "[glob]" section of an .editorconfig file.
+type editorConfigSection struct {
+	glob  string
+	props map[string]string // lowercased names and values
+}
+
+// withEditorConfig returns opts with the formatting options still at their
+// defaults, after flags and the config file, taken from the .editorconfig
+// properties for file: indent_style, indent_size (or tab_width),
+// end_of_line, and insert_final_newline. opts.NoEditorConfig turns this off.
+func withEditorConfig(file string, opts protosort.Options) protosort.Options {
+	if opts.NoEditorConfig {
+		return opts
+	}
+	props := editorConfigProps(file)
+
+	if opts.Indent == "" {
+		switch props["indent_style"] {
+		case "space":
+			opts.Indent = protosort.IndentSpaces
+		case "tab":
+			opts.Indent = protosort.IndentTabs
+		}
+	}
+	if opts.IndentWidth == 0 {
+		size := props["indent_size"]
+		if size == "" || size == "tab" {
+			size = props["tab_width"]
+		}
+		if n, err := strconv.Atoi(size); err == nil && n > 0 {
+			opts.IndentWidth = n
+		}
+	}
+	if opts.EndOfLine == "" {
+		// "cr" has no protosort equivalent and is ignored
+		if eol := props["end_of_line"]; eol == protosort.EndOfLineLF || eol == protosort.EndOfLineCRLF {
+			opts.EndOfLine = eol
+		}
+	}
+	if props["insert_final_newline"] == "false" {
+		opts.NoFinalNewline = true
+	}
+	return opts
+}
+
+// editorConfigProps returns the EditorConfig properties that apply to file.
+// .editorconfig files are read from the file's directory upward until one
+// says root = true; nearer files, and later sections within a file, win.
+// A property set to "unset" is dropped.
+func editorConfigProps(file string) map[string]string {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil
+	}
+	target := filepath.ToSlash(abs)
+
+	// Collect the files from the nearest up, then apply them farthest first
+	var chain [][]editorConfigSection
+	var dirs []string
+	for dir := filepath.Dir(abs); ; {
+		sections, root, err := readEditorConfig(filepath.Join(dir, editorConfigFile))
+		if err == nil {
+			chain = append(chain, sections)
+			dirs = append(dirs, filepath.ToSlash(dir))
+			if root {
+				break
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	props := make(map[string]string)
+	for i := len(chain) - 1; i >= 0; i-- {
+		rel, ok := strings.CutPrefix(target, strings.TrimSuffix(dirs[i], "/")+"/")
+		if !ok {
+			continue
+		}
+		for _, s := range chain[i] {
+			if !editorConfigMatch(s.glob, rel) {
+				continue
+			}
+			for k, v := range s.props {
+				if v == "unset" {
+					delete(props, k)
+				} else {
+					props[k] = v
+				}
+			}
+		}
+	}
+	return props
+}
+
+// readEditorConfig parses an .editorconfig file into its sections, and
+// reports whether its preamble declares root = true.
+func readEditorConfig(name string) (sections []editorConfigSection, root bool, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			sections = append(sections, editorConfigSection{glob: line[1 : len(line)-1], props: make(map[string]string)})
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.ToLower(strings.TrimSpace(value))
+		if len(sections) == 0 {
+			if key == "root" {
+				root = value == "true"
+			}
+			continue
+		}
+		sections[len(sections)-1].props[key] = value
+	}
+	return sections, root, sc.Err()
+}
+
+// editorConfigMatch reports whether an EditorConfig section glob matches
+// rel, a slash-separated path relative to the .editorconfig's directory. A
+// glob without "/" matches the file name in any directory; "{a,b}" lists
+// alternatives.
+func editorConfigMatch(glob, rel string) bool {
+	for _, g := range expandBraces(glob) {
+		if strings.Contains(g, "/") {
+			if globMatch(strings.TrimPrefix(g, "/"), rel) {
+				return true
+			}
+		} else if globMatch(g, path.Base(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandBraces expands the first "{a,b,...}" in glob, recursively, into
+// one glob per alternative. Braces without a comma are kept as is.
+func expandBraces(glob string) []string {
+	open := strings.IndexByte(glob, '{')
+	if open < 0 {
+		return []string{glob}
+	}
+	end := strings.IndexByte(glob[open:], '}')
+	if end < 0 || !strings.Contains(glob[open:open+end], ",") {
+		return []string{glob}
+	}
+	end += open
+	var globs []string
+	for _, alt := range strings.Split(glob[open+1:end], ",") {
+		globs = append(globs, expandBraces(glob[:open]+alt+glob[end+1:])...)
+	}
+	return globs
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tallhamn/protosort"
+)
+
+// dirEstimate aggregates the impact of sorting the files in one directory.
+type dirEstimate struct {
+	Files      int // .proto files examined
+	Changed    int // files that would change
+	Lines      int // total lines across all files
+	MovedLines int // original lines that would not stay in place
+}
+
+// runEstimate sorts every file in memory and prints, per directory, how many
+// files and lines would move if write mode were enabled. Nothing is written.
+func runEstimate(files []string, opts protosort.Options) int {
+	exitCode := 0
+	estimates := make(map[string]*dirEstimate)
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", file, err)
+			exitCode = 4
+			continue
+		}
+		original := string(content)
+		sorted, _, err := safeSort(original, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", file, err)
+			if exitCode < 3 {
+				exitCode = 3
+			}
+			continue
+		}
+
+		dir := filepath.Dir(file)
+		est := estimates[dir]
+		if est == nil {
+			est = &dirEstimate{}
+			estimates[dir] = est
+		}
+		est.Files++
+		est.Lines += strings.Count(original, "\n")
+		if sorted != original {
+			est.Changed++
+			est.MovedLines += protosort.MovedLines(original, sorted)
+		}
+	}
+
+	writeEstimateReport(os.Stdout, estimates)
+	return exitCode
+}
+
+// writeEstimateReport prints one row per directory (sorted by path) and a total row.
+func writeEstimateReport(w io.Writer, estimates map[string]*dirEstimate) {
+	dirs := make([]string, 0, len(estimates))
+	for dir := range estimates {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIRECTORY\tFILES\tCHANGED\tLINES MOVED\tTOTAL LINES")
+	var total dirEstimate
+	for _, dir := range dirs {
+		est := estimates[dir]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", dir, est.Files, est.Changed, est.MovedLines, est.Lines)
+		total.Files += est.Files
+		total.Changed += est.Changed
+		total.MovedLines += est.MovedLines
+		total.Lines += est.Lines
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t%d\t%d\t%d\n", total.Files, total.Changed, total.MovedLines, total.Lines)
+	tw.Flush()
+}
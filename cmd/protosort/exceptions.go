@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/tallhamn/protosort"
+)
+
+// checkException looks up the exception that matches file for a --check
+// failure. excused is true while it applies; note describes it either way,
+// and is empty when no exception matches.
+func checkException(file string, opts protosort.Options) (excused bool, note string) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return false, ""
+	}
+	for _, e := range opts.Exceptions {
+		if ok, _ := filepath.Match(e.File, abs); !ok {
+			continue
+		}
+		if e.Expired(time.Now()) {
+			return false, fmt.Sprintf("exception expired on %s (%s)", e.Expires, e.Reason)
+		}
+		return true, fmt.Sprintf("excused until %s (%s)", e.Expires, e.Reason)
+	}
+	return false, ""
+}
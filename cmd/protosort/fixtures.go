@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// fixtureResult is the outcome of one fixture pair.
+type fixtureResult struct {
+	Name string
+	Code int    // 0 when the output matched, else the exit code it fails with
+	Diff string // expected against actual output, for a mismatch
+	Err  string // why the pair couldn't be run
+}
+
+// runFixtures sorts each NAME_input.proto in dir and compares the result
+// with NAME_expected.proto, like protosort's own golden-file tests. A pair's
+// options are the run's, overridden by NAME_options.toml when present. It
+// returns 1 when an output doesn't match, like --check.
+func runFixtures(dir string, opts protosort.Options) int {
+	if dir == "" {
+		fmt.Fprintf(os.Stderr, "error: test needs a fixture directory, e.g. protosort test --fixtures testdata/\n")
+		return 4
+	}
+	inputs, err := filepath.Glob(filepath.Join(dir, "*_input.proto"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 4
+	}
+	if len(inputs) == 0 {
+		fmt.Fprintf(os.Stderr, "error: no *_input.proto fixtures found in %s\n", dir)
+		return 4
+	}
+	sort.Strings(inputs)
+
+	var results []fixtureResult
+	for _, input := range inputs {
+		results = append(results, runFixture(strings.TrimSuffix(input, "_input.proto"), opts))
+	}
+	return writeFixtureReport(os.Stdout, results)
+}
+
+// runFixture runs the pair whose files start with prefix.
+func runFixture(prefix string, opts protosort.Options) fixtureResult {
+	result := fixtureResult{Name: filepath.Base(prefix)}
+	fail := func(code int, err error) fixtureResult {
+		result.Code, result.Err = code, err.Error()
+		return result
+	}
+
+	if optionsFile := prefix + "_options.toml"; fileExists(optionsFile) {
+		cfg, err := protosort.ResolveConfig(optionsFile, "")
+		if err != nil {
+			return fail(4, err)
+		}
+		// The pair's options override the run's, flags included
+		protosort.MergeConfig(&opts, cfg, nil)
+		if err := validateOptions(opts); err != nil {
+			return fail(4, fmt.Errorf("%s: %v", optionsFile, err))
+		}
+	}
+	input, err := readFixture(prefix + "_input.proto")
+	if err != nil {
+		return fail(4, err)
+	}
+	expected, err := readFixture(prefix + "_expected.proto")
+	if err != nil {
+		return fail(4, err)
+	}
+
+	opts.Quiet = true
+	output, _, err := protosort.Sort(input, opts)
+	if err != nil {
+		return fail(3, err)
+	}
+	if output != expected {
+		result.Code = 1
+		result.Diff = protosort.DiffStrings(expected, output, "expected", "got")
+	}
+	return result
+}
+
+// readFixture reads a fixture file with its line endings normalized to LF,
+// so that fixtures checked out with CRLF line endings still match.
+func readFixture(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(string(data), "\r\n", "\n"), nil
+}
+
+// fileExists reports whether path names an existing file.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// writeFixtureReport prints a line for each fixture, with the diff of each
+// mismatch, and a summary, and returns the highest exit code.
+func writeFixtureReport(w io.Writer, results []fixtureResult) int {
+	exitCode, failed := 0, 0
+	for _, r := range results {
+		switch {
+		case r.Err != "":
+			fmt.Fprintf(w, "ERROR %s: %s\n", r.Name, r.Err)
+		case r.Code != 0:
+			fmt.Fprintf(w, "FAIL  %s\n%s", r.Name, r.Diff)
+		default:
+			fmt.Fprintf(w, "ok    %s\n", r.Name)
+		}
+		if r.Code != 0 {
+			failed++
+		}
+		exitCode = max(exitCode, r.Code)
+	}
+	fmt.Fprintf(w, "\n%d passed, %d failed\n", len(results)-failed, failed)
+	return exitCode
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hookMarker identifies a pre-commit hook written by install-hook, which is
+// safe to overwrite.
+const hookMarker = "# Installed by protosort install-hook"
+
+// preCommitHook sorts the staged .proto files and re-stages them. Options
+// come from the repository's config file.
+const preCommitHook = `#!/bin/sh
+` + hookMarker + `: sorts staged .proto files and
+# re-stages them, with options from .protosort.toml.
+exec protosort --staged --write
+`
+
+// runInstallHook writes the pre-commit hook of the repository containing
+// the working directory. A hook that install-hook didn't write is left
+// alone, so existing setups aren't clobbered.
+func runInstallHook(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "error: install-hook takes no arguments\n")
+		return 4
+	}
+
+	hooks, err := git("rev-parse", "--git-path", "hooks")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: install-hook: %v\n", err)
+		return 4
+	}
+	path := filepath.Join(strings.TrimSpace(hooks), "pre-commit")
+
+	if existing, err := os.ReadFile(path); err == nil && !strings.Contains(string(existing), hookMarker) {
+		fmt.Fprintf(os.Stderr, "error: %s already exists; add \"protosort --staged --write\" to it instead\n", path)
+		return 4
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 4
+	}
+	if err := os.WriteFile(path, []byte(preCommitHook), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 4
+	}
+	// WriteFile keeps the mode of an existing file
+	if err := os.Chmod(path, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 4
+	}
+	fmt.Printf("installed %s\n", path)
+	return 0
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is one pattern from a .gitignore file or --exclude, in
+// gitignore syntax.
+type ignoreRule struct {
+	base     string // absolute, slash-separated directory the pattern is relative to
+	pattern  string // without the "!", leading "/", or trailing "/"
+	negate   bool   // "!pattern" re-includes what earlier rules ignored
+	dirOnly  bool   // "pattern/" only matches directories
+	anchored bool   // a pattern containing "/" matches the path below base, not any name
+}
+
+// parseIgnoreRules parses gitignore lines relative to the directory base.
+func parseIgnoreRules(base string, lines []string) []ignoreRule {
+	base = filepath.ToSlash(base)
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`) // "\#" and "\!" escape a literal first character
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// matches reports whether the rule applies to the absolute, slash-separated
+// path p.
+func (r ignoreRule) matches(p string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	prefix := strings.TrimSuffix(r.base, "/") + "/"
+	rel, ok := strings.CutPrefix(p, prefix)
+	if !ok {
+		return false // not below base
+	}
+	if !r.anchored {
+		return globMatch(r.pattern, path.Base(rel))
+	}
+	return globMatch(r.pattern, rel)
+}
+
+// globMatch matches a slash-separated path against a gitignore pattern,
+// where "**" spans any number of directories.
+func globMatch(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// ignoredBy reports whether rules ignore the absolute path p. The last
+// matching rule wins, so a negated pattern can re-include a path.
+func ignoredBy(rules []ignoreRule, p string, isDir bool) bool {
+	p = filepath.ToSlash(p)
+	ignored := false
+	for _, r := range rules {
+		if r.matches(p, isDir) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// ignoredPath is ignoredBy for a path reached without walking down to it,
+// such as a file named on the command line: it is also ignored when one of
+// its parent directories is.
+func ignoredPath(rules []ignoreRule, p string, isDir bool) bool {
+	for dir := filepath.Dir(p); filepath.Dir(dir) != dir; dir = filepath.Dir(dir) {
+		if ignoredBy(rules, dir, true) {
+			return true
+		}
+	}
+	return ignoredBy(rules, p, isDir)
+}
+
+// excludeRules parses --exclude patterns, which are relative to the working
+// directory.
+func excludeRules(patterns []string) ([]ignoreRule, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return parseIgnoreRules(wd, patterns), nil
+}
+
+// ignorer holds the .gitignore rules for a recursive walk. Later rules take
+// precedence, so they are added from the outermost directory inward.
+type ignorer struct {
+	rules []ignoreRule
+}
+
+// newIgnorer returns the rules that apply under root: the .gitignore files
+// from root up to the repository root (the directory containing .git).
+// Outside a repository only root's own .gitignore is read; those below root
+// are loaded by enterDir during the walk.
+func newIgnorer(root string) *ignorer {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		abs = root
+	}
+
+	// Collect the ancestors up to the repository root, innermost first
+	var ancestors []string
+	if !isRepoRoot(abs) {
+		for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+			ancestors = append(ancestors, dir)
+			if isRepoRoot(dir) {
+				break
+			}
+			if filepath.Dir(dir) == dir {
+				ancestors = nil // not in a repository
+				break
+			}
+		}
+	}
+
+	ig := &ignorer{}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		ig.enterDir(ancestors[i])
+	}
+	ig.enterDir(abs)
+	return ig
+}
+
+// enterDir adds the rules of dir's .gitignore, if it has one.
+func (ig *ignorer) enterDir(dir string) {
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return
+	}
+	ig.rules = append(ig.rules, parseIgnoreRules(dir, strings.Split(string(data), "\n"))...)
+}
+
+// ignored reports whether the absolute path p is ignored.
+func (ig *ignorer) ignored(p string, isDir bool) bool {
+	return ignoredBy(ig.rules, p, isDir)
+}
+
+// isRepoRoot reports whether dir contains .git.
+func isRepoRoot(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// initConfigFile is the config file init writes.
+const initConfigFile = ".protosort.toml"
+
+// initPresets are the presets init tries, "" being none.
+var initPresets = []string{"", "aip", "buf-default", "uber"}
+
+// vendoredDirs are directory names whose protos init excludes as
+// third-party code.
+var vendoredDirs = []string{"third_party", "vendor"}
+
+// generatedRe matches the comment marking a generated file.
+var generatedRe = regexp.MustCompile(`(?m)^\s*//.*\bDO NOT EDIT\b`)
+
+// projectProfile is what init infers about a proto tree.
+type projectProfile struct {
+	files       int               // .proto files found
+	sortable    map[string]string // content of the files to be sorted, by path
+	exclude     []string          // patterns for the rest, relative to the tree
+	excludeWhy  map[string]string // reason for each exclude pattern
+	indent      string
+	indentFiles int // files indented in that style
+	dividers    int // files with hand-written section dividers
+	headers     int // files with protosort section headers
+	protoPaths  []string
+	preset      string
+	moved       map[string]int // lines each candidate preset moves
+	changed     int            // files the inferred config changes
+}
+
+// runInit inspects the proto tree at the directory in args (default the
+// working directory), writes a .protosort.toml there with the settings it
+// infers, and prints them with an adoption plan. With --dry-run the config
+// is printed instead of written.
+func runInit(args []string, opts protosort.Options) int {
+	if len(args) > 1 {
+		fmt.Fprintf(os.Stderr, "error: init takes at most one directory\n")
+		return 4
+	}
+	root := "."
+	if len(args) == 1 {
+		root = args[0]
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "error: init: %s is not a directory\n", root)
+		return 4
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 4
+	}
+	if existing := protosort.FindConfigFile(root); existing != "" && filepath.Dir(existing) == abs {
+		fmt.Fprintf(os.Stderr, "error: %s already exists\n", existing)
+		return 4
+	}
+
+	walk := opts
+	walk.Recursive = true
+	files, err := collectFiles([]string{root}, walk)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 4
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "error: no .proto files found under %s\n", root)
+		return 4
+	}
+
+	p, err := inferProfile(root, files, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 4
+	}
+	config := p.config()
+	if opts.DryRun {
+		fmt.Print(config)
+		fmt.Println()
+	} else {
+		path := filepath.Join(root, initConfigFile)
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 4
+		}
+		fmt.Printf("wrote %s\n", path)
+	}
+	writeInitPlan(os.Stdout, root, p)
+	return 0
+}
+
+// inferProfile reads files, all below root, and infers a config for them
+// on top of opts.
+func inferProfile(root string, files []string, opts protosort.Options) (*projectProfile, error) {
+	p := &projectProfile{
+		files:      len(files),
+		sortable:   make(map[string]string),
+		excludeWhy: make(map[string]string),
+		moved:      make(map[string]int),
+	}
+	var tabs, spaces int
+	roots := make(map[string]bool)
+	var imports []string
+	var rels []string
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+		rels = append(rels, rel)
+		text := string(content)
+
+		if blocks, err := protosort.ScanFile(text); err == nil {
+			for _, b := range blocks {
+				if b.Kind == protosort.BlockImport {
+					imports = append(imports, b.Name)
+				}
+			}
+		}
+
+		if dir := vendoredDir(rel); dir != "" {
+			p.addExclude(dir+"/", "vendored")
+			continue
+		}
+		if generatedRe.MatchString(text) {
+			p.addExclude(rel, "generated")
+			continue
+		}
+		if _, _, err := protosort.Sort(text, opts); err != nil {
+			p.addExclude(rel, err.Error())
+			continue
+		}
+		p.sortable[file] = text
+
+		switch indentOf(text) {
+		case protosort.IndentTabs:
+			tabs++
+		case protosort.IndentSpaces:
+			spaces++
+		}
+		if protosort.HasSectionDividers(text) {
+			p.dividers++
+		}
+		if protosort.HasSectionHeaders(text) {
+			p.headers++
+		}
+	}
+
+	switch {
+	case tabs > spaces:
+		p.indent, p.indentFiles = protosort.IndentTabs, tabs
+	case spaces > 0:
+		p.indent, p.indentFiles = protosort.IndentSpaces, spaces
+	}
+
+	// A file imported by a path that is a suffix of its own path sits
+	// below a proto path: the rest of its path
+	for _, rel := range rels {
+		for _, imp := range imports {
+			if dir, ok := strings.CutSuffix(rel, "/"+imp); ok {
+				roots[dir] = true
+			}
+		}
+	}
+	for dir := range roots {
+		p.protoPaths = append(p.protoPaths, dir)
+	}
+	sort.Strings(p.protoPaths)
+
+	// The preset that moves the fewest lines matches the existing style best
+	best := -1
+	for _, preset := range initPresets {
+		o := p.options(opts, preset)
+		moved, changed := 0, 0
+		for _, text := range p.sortable {
+			sorted, _, err := protosort.Sort(text, o)
+			if err != nil || sorted == text {
+				continue
+			}
+			changed++
+			moved += protosort.MovedLines(text, sorted)
+		}
+		p.moved[preset] = moved
+		if best < 0 || moved < best {
+			best, p.preset, p.changed = moved, preset, changed
+		}
+	}
+	return p, nil
+}
+
+// addExclude records an exclude pattern once, with its reason.
+func (p *projectProfile) addExclude(pattern, why string) {
+	if _, ok := p.excludeWhy[pattern]; ok {
+		return
+	}
+	p.exclude = append(p.exclude, pattern)
+	p.excludeWhy[pattern] = why
+}
+
+// options returns opts with the inferred settings and preset applied.
+func (p *projectProfile) options(opts protosort.Options, preset string) protosort.Options {
+	if preset != "" {
+		cfg, _ := protosort.LookupPreset(preset)
+		protosort.MergeConfig(&opts, cfg, map[string]bool{})
+	}
+	opts.Indent = p.indent
+	if p.dividers > 0 {
+		opts.PreserveDividers, opts.SectionHeaders = true, true
+	}
+	if p.headers > 0 {
+		opts.SectionHeaders = true
+	}
+	return opts
+}
+
+// config renders the inferred settings as a .protosort.toml.
+func (p *projectProfile) config() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by protosort init from the %d .proto files below this directory.\n", p.files)
+	b.WriteString("# Paths are relative to this directory; run protosort from here.\n")
+	if p.preset != "" {
+		fmt.Fprintf(&b, "\npreset = %s\n", strconv.Quote(p.preset))
+	}
+	if len(p.exclude) > 0 {
+		b.WriteString("\nexclude = [\n")
+		for _, pattern := range p.exclude {
+			fmt.Fprintf(&b, "  %s, # %s\n", strconv.Quote(pattern), oneLine(p.excludeWhy[pattern]))
+		}
+		b.WriteString("]\n")
+	}
+
+	var ordering []string
+	if p.indent != "" {
+		ordering = append(ordering, "indent = "+strconv.Quote(p.indent))
+	}
+	if p.dividers > 0 {
+		ordering = append(ordering, "preserve_dividers = true")
+	}
+	if p.dividers > 0 || p.headers > 0 {
+		ordering = append(ordering, "section_headers = true")
+	}
+	if len(ordering) > 0 {
+		fmt.Fprintf(&b, "\n[ordering]\n%s\n", strings.Join(ordering, "\n"))
+	}
+
+	if len(p.protoPaths) > 0 {
+		quoted := make([]string, len(p.protoPaths))
+		for i, dir := range p.protoPaths {
+			quoted[i] = strconv.Quote(dir)
+		}
+		fmt.Fprintf(&b, "\n[verify]\nproto_paths = [%s]\n", strings.Join(quoted, ", "))
+	}
+	return b.String()
+}
+
+// writeInitPlan prints what init inferred and the steps to adopt it.
+func writeInitPlan(w io.Writer, root string, p *projectProfile) {
+	preset := p.preset
+	if preset == "" {
+		preset = "none"
+	}
+	fmt.Fprintf(w, "\nInferred from %d .proto files:\n", p.files)
+	fmt.Fprintf(w, "  preset             %s (moves %d lines", preset, p.moved[p.preset])
+	for _, other := range initPresets {
+		if other != p.preset {
+			name := other
+			if name == "" {
+				name = "none"
+			}
+			fmt.Fprintf(w, "; %s %d", name, p.moved[other])
+		}
+	}
+	fmt.Fprintln(w, ")")
+	if p.indent != "" {
+		fmt.Fprintf(w, "  indent             %s (%d of %d files)\n", p.indent, p.indentFiles, len(p.sortable))
+	}
+	fmt.Fprintf(w, "  preserve_dividers  %t (%d files have section dividers)\n", p.dividers > 0, p.dividers)
+	if p.headers > 0 {
+		fmt.Fprintf(w, "  section_headers    true (%d files have protosort section headers)\n", p.headers)
+	}
+	if len(p.protoPaths) > 0 {
+		fmt.Fprintf(w, "  proto_paths        %s\n", strings.Join(p.protoPaths, ", "))
+	}
+	for i, pattern := range p.exclude {
+		label := ""
+		if i == 0 {
+			label = "exclude"
+		}
+		fmt.Fprintf(w, "  %-18s %s (%s)\n", label, pattern, oneLine(p.excludeWhy[pattern]))
+	}
+
+	fmt.Fprintf(w, "\nAdoption plan:\n")
+	if p.changed == 0 {
+		fmt.Fprintf(w, "  All %d files are already sorted; no baseline commit is needed.\n", len(p.sortable))
+		fmt.Fprintf(w, "  Keep them sorted with protosort install-hook and protosort --check --recursive . in CI.\n")
+		return
+	}
+	fmt.Fprintf(w, "  %d of %d files would change, moving %d lines.\n", p.changed, len(p.sortable), p.moved[p.preset])
+	fmt.Fprintf(w, "  1. In %s, run protosort --write --recursive . (review with --diff first).\n", root)
+	fmt.Fprintf(w, "  2. Commit the result on its own as the baseline, and add that commit to\n")
+	fmt.Fprintf(w, "     .git-blame-ignore-revs so git blame skips it.\n")
+	fmt.Fprintf(w, "  3. Keep the tree sorted with protosort install-hook and\n")
+	fmt.Fprintf(w, "     protosort --check --recursive . in CI.\n")
+}
+
+// vendoredDir returns the path of the vendored directory rel is in, or "".
+func vendoredDir(rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts[:len(parts)-1] {
+		for _, name := range vendoredDirs {
+			if part == name {
+				return strings.Join(parts[:i+1], "/")
+			}
+		}
+	}
+	return ""
+}
+
+// indentOf returns the indentation style most of content's indented lines
+// use: protosort.IndentTabs, protosort.IndentSpaces, or "" if none are
+// indented.
+func indentOf(content string) string {
+	tabs, spaces := 0, 0
+	for line := range strings.Lines(content) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		switch line[0] {
+		case '\t':
+			tabs++
+		case ' ':
+			spaces++
+		}
+	}
+	switch {
+	case tabs > spaces:
+		return protosort.IndentTabs
+	case spaces > 0:
+		return protosort.IndentSpaces
+	}
+	return ""
+}
+
+// oneLine returns the first line of s.
+func oneLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// issuesURL is where internal errors ask to be reported.
+const issuesURL = "https://github.com/tallhamn/protosort/issues"
+
+// internalError is a panic recovered while processing one file, which is
+// then failed on its own while the rest of the run goes on.
+type internalError struct {
+	value any
+	// report is the path of a bug report written for the panic: the panic,
+	// its stack, and the file anonymized. It is empty if none was written.
+	report string
+}
+
+func (e *internalError) Error() string {
+	msg := fmt.Sprintf("internal error: %v; please report it at %s", e.value, issuesURL)
+	if e.report != "" {
+		msg += ", attaching " + e.report
+	}
+	return msg
+}
+
+// newInternalError records the panic value r, recovered while processing
+// content, in a bug report. content may be empty when the panic can't be
+// tied to one file.
+func newInternalError(r any, content string) *internalError {
+	e := &internalError{value: r}
+	stack := debug.Stack()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// protosort %s: internal error: %v\n//\n", Version, r)
+	for line := range strings.Lines(string(stack)) {
+		b.WriteString("// " + line)
+	}
+	if anonymized := anonymizeForReport(content); anonymized != "" {
+		b.WriteString("\n" + anonymized)
+	}
+
+	f, err := os.CreateTemp("", "protosort-bug-*.proto")
+	if err != nil {
+		return e
+	}
+	defer f.Close()
+	if _, err := f.WriteString(b.String()); err == nil {
+		e.report = f.Name()
+	}
+	return e
+}
+
+// anonymizeForReport returns content anonymized for a bug report, or ""
+// if it is empty or can't be anonymized, which may well be the case for
+// the content that made protosort panic.
+func anonymizeForReport(content string) (anonymized string) {
+	if content == "" {
+		return ""
+	}
+	defer func() {
+		if recover() != nil {
+			anonymized = ""
+		}
+	}()
+	out, err := protosort.Anonymize([]string{content})
+	if err != nil {
+		return ""
+	}
+	return out[0]
+}
+
+// safeSort is protosort.Sort, with a panic returned as an internalError.
+func safeSort(content string, opts protosort.Options) (sorted string, warnings []protosort.Warning, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			sorted, warnings, err = "", nil, newInternalError(r, content)
+		}
+	}()
+	return protosort.Sort(content, opts)
+}
+
+// safeVerify is protosort.Verify, with a panic returned as an
+// internalError.
+func safeVerify(original, sorted string, opts protosort.Options) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newInternalError(r, original)
+		}
+	}()
+	return protosort.Verify(original, sorted, opts)
+}
+
+// finishSafely reports p, adding it to report if that is set and with
+// finishFile otherwise, and returns its exit code. A panic fails the file
+// with an internalError.
+func finishSafely(p *pendingFile, opts protosort.Options, report *runReport) (code int) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := newInternalError(r, p.original)
+			if report != nil {
+				report.Files = append(report.Files, fileReport{Path: p.file, Warnings: []string{}, Types: []classifiedDecl{}, Error: err.Error(), ExitCode: 4})
+			} else {
+				fmt.Fprintf(os.Stderr, "error: %s: %v\n", p.file, err)
+			}
+			code = 4
+		}
+	}()
+	if report != nil {
+		return report.add(p, opts)
+	}
+	return finishFile(p, opts)
+}
+
+// safeVerifyBatch is protosort.VerifyBatch. A panic fails every file of the
+// batch with one internalError, as it can't be tied to one of them.
+func safeVerifyBatch(files []protosort.VerifyFile, opts protosort.Options) (errs []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := newInternalError(r, "")
+			errs = make([]error, len(files))
+			for i := range errs {
+				errs[i] = err
+			}
+		}
+	}()
+	return protosort.VerifyBatch(files, opts)
+}
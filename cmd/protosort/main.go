@@ -0,0 +1,901 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tallhamn/protosort"
+)
+
+// Version is set via ldflags during build: -ldflags "-X main.Version=x.y.z"
+var Version = "0.2.1"
+
+// subcommands lists the commands accepted as the first argument. They take
+// the same options as a plain run.
+var subcommands = map[string]bool{
+	"anonymize":      true,
+	"ast":            true,
+	"classify-image": true,
+	"estimate":       true,
+	"init":           true,
+	"install-hook":   true,
+	"ownership":      true,
+	"parity":         true,
+	"serve":          true,
+	"test":           true,
+}
+
+func main() {
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && subcommands[args[0]] {
+		command = args[0]
+		args = args[1:]
+	}
+
+	opts := protosort.Options{}
+	var cli cliFlags
+	defineFlags(flag.CommandLine, &opts, &cli)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: protosort [COMMAND] [OPTIONS] <FILE|DIR|->...\n\n")
+		fmt.Fprintf(os.Stderr, "Reorder top-level declarations in proto3 and editions .proto files.\n\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  anonymize       Print the files with identifiers, strings, and comments replaced, for bug reports\n")
+		fmt.Fprintf(os.Stderr, "  ast             Print the declarations of each file as classified for sorting (--json for JSON)\n")
+		fmt.Fprintf(os.Stderr, "  classify-image  Classify the files of compiled descriptor sets, as ast does (classify-image IMAGE...)\n")
+		fmt.Fprintf(os.Stderr, "  estimate        Report per directory how many files and lines would move\n")
+		fmt.Fprintf(os.Stderr, "  init            Infer a .protosort.toml for a proto tree and print an adoption plan\n")
+		fmt.Fprintf(os.Stderr, "  install-hook    Install a git pre-commit hook that runs --staged --write\n")
+		fmt.Fprintf(os.Stderr, "  ownership       Group each package's types by the services that use them\n")
+		fmt.Fprintf(os.Stderr, "  parity          Compare the declarations of two API versions (parity DIR DIR)\n")
+		fmt.Fprintf(os.Stderr, "  serve           Serve a read-only HTTP API for sorting (see --http)\n")
+		fmt.Fprintf(os.Stderr, "  test            Check sorting against expected-output fixtures (see --fixtures)\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.CommandLine.Parse(args)
+
+	if cli.showVersion {
+		fmt.Println(Version)
+		os.Exit(0)
+	}
+
+	if cli.printConfigSchema {
+		if err := printConfigSchema(os.Stdout, flag.CommandLine); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(4)
+		}
+		os.Exit(0)
+	}
+
+	opts.ProtoPaths = []string(cli.protoPaths)
+	opts.Exclude = []string(cli.exclude)
+
+	if cli.like != "" {
+		template, err := os.ReadFile(cli.like)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --like: %v\n", err)
+			os.Exit(4)
+		}
+		opts.LikeOrder, err = protosort.DeclarationOrder(string(template))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --like: %s: %v\n", cli.like, err)
+			os.Exit(4)
+		}
+	}
+
+	// When preserve-dividers is enabled, automatically enable section headers
+	if opts.PreserveDividers {
+		opts.SectionHeaders = true
+	}
+
+	// Track which flags were explicitly set on the command line
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	if cli.json {
+		if setFlags["format"] && opts.Format != "json" {
+			fmt.Fprintf(os.Stderr, "error: --json can't be combined with --format %s\n", opts.Format)
+			os.Exit(4)
+		}
+		opts.Format = "json"
+	}
+
+	if opts.Preset != "" {
+		if _, err := protosort.LookupPreset(opts.Preset); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --preset: %v\n", err)
+			os.Exit(4)
+		}
+	}
+
+	// Load .protosort.toml config if available
+	configPath := opts.ConfigFile
+	if configPath == "" {
+		// Piped content is configured like the file it stands in for
+		configDir := "."
+		if cli.stdinFilepath != "" {
+			configDir = filepath.Dir(cli.stdinFilepath)
+		}
+		configPath = protosort.FindConfigFile(configDir)
+	}
+	cfg, err := protosort.ResolveConfig(configPath, opts.Preset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to load config %s: %v\n", configPath, err)
+	} else {
+		protosort.MergeConfig(&opts, cfg, setFlags)
+	}
+
+	if err := validateOptions(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(4)
+	}
+
+	if command != "" && opts.Output != "" {
+		fmt.Fprintf(os.Stderr, "error: --output doesn't apply to %s\n", command)
+		os.Exit(4)
+	}
+
+	if command == "serve" {
+		os.Exit(runServe(cli.httpAddr, opts))
+	}
+
+	args = flag.Args()
+
+	if command == "install-hook" {
+		os.Exit(runInstallHook(args))
+	}
+	if command == "init" {
+		os.Exit(runInit(args, opts))
+	}
+	if command == "test" {
+		os.Exit(runFixtures(cli.fixtures, opts))
+	}
+
+	if cli.staged && cli.changed != "" {
+		fmt.Fprintf(os.Stderr, "error: --staged and --changed can't be combined\n")
+		os.Exit(4)
+	}
+	fromGit := cli.staged || cli.changed != ""
+	if cli.against != "" && !cli.newWarningsOnly {
+		fmt.Fprintf(os.Stderr, "error: --against only applies with --new-warnings-only\n")
+		os.Exit(4)
+	}
+
+	if cli.stdinFilepath != "" && len(args) > 0 && !(len(args) == 1 && args[0] == "-") {
+		fmt.Fprintf(os.Stderr, "error: --stdin-filepath only applies when reading stdin\n")
+		os.Exit(4)
+	}
+
+	// "-" or no arguments with piped input: act as a filter on stdin.
+	// --staged and --changed find their own files, since git hooks run
+	// with stdin piped.
+	if (len(args) == 1 && args[0] == "-") || (len(args) == 0 && !fromGit && (stdinIsPiped() || cli.stdinFilepath != "")) {
+		if opts.Write {
+			fmt.Fprintf(os.Stderr, "error: --write can't be used with stdin\n")
+			os.Exit(4)
+		}
+		if command != "" {
+			fmt.Fprintf(os.Stderr, "error: %s doesn't read stdin\n", command)
+			os.Exit(4)
+		}
+		if cli.newWarningsOnly {
+			fmt.Fprintf(os.Stderr, "error: --new-warnings-only can't be used with stdin\n")
+			os.Exit(4)
+		}
+		os.Exit(processStdin(os.Stdin, cli.stdinFilepath, opts))
+	}
+
+	if command == "parity" {
+		os.Exit(runParity(args))
+	}
+	if command == "classify-image" {
+		os.Exit(runClassifyImage(args, cli.packages, opts))
+	}
+
+	if len(args) == 0 && !fromGit {
+		flag.Usage()
+		os.Exit(4)
+	}
+
+	// Collect all .proto files
+	var files []string
+	var partial map[string]string
+	switch {
+	case cli.staged:
+		files, partial, err = stagedFiles(args, opts)
+	case cli.changed != "":
+		files, err = changedFiles(cli.changed, args, opts)
+	default:
+		files, err = collectFiles(args, opts)
+	}
+	if err == nil && len(cli.packages) > 0 {
+		files, err = filterByPackage(files, cli.packages)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(4)
+	}
+
+	// An empty change set is a successful run with nothing to do, and so is
+	// an empty list left by exclusion, such as when a hook passes only
+	// excluded files
+	if len(files) == 0 && !fromGit {
+		if len(cli.packages) > 0 {
+			fmt.Fprintf(os.Stderr, "error: no .proto files found in package %s\n", strings.Join(cli.packages, ", "))
+			os.Exit(4)
+		}
+		if allExcluded(args, opts) {
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "error: no .proto files found\n")
+		os.Exit(4)
+	}
+
+	if opts.Output != "" && len(files) != 1 {
+		fmt.Fprintf(os.Stderr, "error: --output needs exactly one input file, got %d\n", len(files))
+		os.Exit(4)
+	}
+
+	if command == "anonymize" {
+		os.Exit(runAnonymize(files))
+	}
+	if command == "ast" {
+		os.Exit(runAST(files, opts))
+	}
+	if command == "estimate" {
+		os.Exit(runEstimate(files, opts))
+	}
+	if command == "ownership" {
+		os.Exit(runOwnership(files, opts))
+	}
+
+	var vcache *verifyCache
+	if !cli.noCache {
+		vcache = loadVerifyCache(verifyCacheFile, opts)
+	}
+	// Files with unstaged changes too are checked as staged, but --write
+	// leaves them alone rather than sort in changes that aren't committed
+	restageFiles := cli.staged && opts.Write && !opts.DryRun
+	code := 0
+	if restageFiles {
+		files, code = skipPartial(files, partial, opts)
+		partial = nil
+	}
+	var baseline *warningBaseline
+	if cli.newWarningsOnly {
+		against := cli.against
+		if against == "" {
+			against = cmp.Or(cli.changed, defaultChangedBase)
+		}
+		if baseline, err = newWarningBaseline(against); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(4)
+		}
+	}
+	var metrics *runMetrics
+	if cli.metricsFile != "" {
+		metrics = newRunMetrics()
+	}
+	code = max(code, processFiles(files, opts, vcache, baseline, metrics, partial))
+	if metrics != nil {
+		if err := metrics.write(cli.metricsFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --metrics-file: %v\n", err)
+			code = max(code, 4)
+		}
+	}
+	if restageFiles {
+		if err := restage(files); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			code = max(code, 4)
+		}
+	}
+	os.Exit(code)
+}
+
+// validateOptions rejects option values outside their enumerations, and
+// options that depend on another one that isn't set.
+func validateOptions(opts protosort.Options) error {
+	if opts.SharedOrder != "alpha" && opts.SharedOrder != "dependency" {
+		return fmt.Errorf("--shared-order must be \"alpha\" or \"dependency\", got %q", opts.SharedOrder)
+	}
+	if opts.KindOrder != "" && opts.KindOrder != "mixed" && opts.KindOrder != "enums-first" && opts.KindOrder != "messages-first" {
+		return fmt.Errorf("--kind-order must be \"mixed\", \"enums-first\", or \"messages-first\", got %q", opts.KindOrder)
+	}
+	if opts.SortRPCs != "" && opts.SortRPCs != "alpha" && opts.SortRPCs != "grouped" {
+		return fmt.Errorf("--sort-rpcs must be \"alpha\" or \"grouped\", got %q", opts.SortRPCs)
+	}
+	if opts.RPCFingerprint && opts.SortRPCs == "" {
+		return fmt.Errorf("--rpc-fingerprint needs --sort-rpcs")
+	}
+	if opts.Verifier != "" && opts.Verifier != protosort.VerifierProtocompile && opts.Verifier != protosort.VerifierProtoc {
+		return fmt.Errorf("--verifier must be %q or %q, got %q", protosort.VerifierProtocompile, protosort.VerifierProtoc, opts.Verifier)
+	}
+	if _, _, ok := protosort.ParseIndent(opts.Indent); opts.Indent != "" && !ok {
+		return fmt.Errorf("--indent must be %q, %q, or a number of spaces, got %q", protosort.IndentSpaces, protosort.IndentTabs, opts.Indent)
+	}
+	if err := opts.HeaderStyle.Validate(); err != nil {
+		return err
+	}
+	if opts.BlankLinesBetweenSections < 0 || opts.BlankLinesWithinSection < 0 {
+		return fmt.Errorf("blank_lines_between_sections and blank_lines_within_section must not be negative")
+	}
+	if opts.CoreMinRefs < 0 {
+		return fmt.Errorf("--core-min-refs must not be negative, got %d", opts.CoreMinRefs)
+	}
+	if opts.CommentWidth < 0 {
+		return fmt.Errorf("--comment-width must not be negative, got %d", opts.CommentWidth)
+	}
+	if opts.IndentWidth < 0 {
+		return fmt.Errorf("--indent-width must not be negative, got %d", opts.IndentWidth)
+	}
+	if opts.EndOfLine != "" && opts.EndOfLine != protosort.EndOfLineLF && opts.EndOfLine != protosort.EndOfLineCRLF && opts.EndOfLine != protosort.EndOfLineAuto {
+		return fmt.Errorf("--end-of-line must be %q, %q, or %q, got %q", protosort.EndOfLineLF, protosort.EndOfLineCRLF, protosort.EndOfLineAuto, opts.EndOfLine)
+	}
+	if opts.Regions != "" && opts.Regions != "keep" && opts.Regions != "strip" {
+		return fmt.Errorf("--regions must be \"keep\" or \"strip\", got %q", opts.Regions)
+	}
+	for _, p := range append(append([]string{}, opts.CodePatterns...), opts.ProsePatterns...) {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("invalid comment pattern %q: %v", p, err)
+		}
+	}
+	for _, p := range opts.DividerPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("invalid divider pattern %q: %v", p, err)
+		}
+	}
+	if (opts.VerbatimBegin == "") != (opts.VerbatimEnd == "") {
+		return fmt.Errorf("verbatim regions need both a begin and an end pattern")
+	}
+	for _, p := range []string{opts.VerbatimBegin, opts.VerbatimEnd} {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("invalid verbatim pattern %q: %v", p, err)
+		}
+	}
+	for _, p := range opts.RPCOrder {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid rpc order pattern %q: %v", p, err)
+		}
+	}
+	if opts.HookTimeout != "" {
+		if d, err := time.ParseDuration(opts.HookTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid hook timeout %q", opts.HookTimeout)
+		}
+	}
+	if opts.CheckLevel != "" && checkLevels[opts.CheckLevel] == 0 {
+		return fmt.Errorf("--check-level must be \"semantic\", \"cosmetic\", or \"all\", got %q", opts.CheckLevel)
+	}
+	for _, e := range opts.Exceptions {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	if opts.Format != "" && opts.Format != "text" && opts.Format != "json" && opts.Format != "sarif" {
+		return fmt.Errorf("--format must be \"text\", \"json\", or \"sarif\", got %q", opts.Format)
+	}
+	if opts.Output != "" && (opts.Write || opts.Check || opts.DryRun || opts.Diff) {
+		return fmt.Errorf("--output can't be combined with --write, --check, --dry-run, or --diff")
+	}
+	if opts.Output != "" && (opts.Format == "json" || opts.Format == "sarif") {
+		return fmt.Errorf("--output can't be combined with --format %s", opts.Format)
+	}
+	return nil
+}
+
+// cliFlags holds flag values that control the run itself rather than Options.
+type cliFlags struct {
+	showVersion       bool
+	printConfigSchema bool
+	protoPaths        multiFlag
+	exclude           multiFlag
+	packages          multiFlag
+	httpAddr          string // listen address for serve
+	stdinFilepath     string // path that piped content stands in for
+	like              string // template file whose declaration order to follow
+	noCache           bool   // verify every file, ignoring and not updating the verify cache
+	changed           string // base ref whose changed files are the only ones processed
+	staged            bool   // process only git-staged files, re-staging them after --write
+	newWarningsOnly   bool   // report only warnings the base revision doesn't have
+	against           string // base ref for --new-warnings-only
+	json              bool   // shorthand for --format json
+	metricsFile       string // where to write Prometheus metrics for the run
+	fixtures          string // directory of fixture pairs for the test command
+}
+
+// defineFlags registers all command-line flags on fs, binding them to opts and cli.
+func defineFlags(fs *flag.FlagSet, opts *protosort.Options, cli *cliFlags) {
+	fs.BoolVar(&cli.showVersion, "version", false, "Print version and exit")
+	fs.BoolVar(&cli.printConfigSchema, "print-config-schema", false, "Print the config file JSON Schema and exit")
+	fs.StringVar(&cli.httpAddr, "http", ":8080", "Listen address for the serve command")
+	fs.StringVar(&cli.fixtures, "fixtures", "", "Directory of NAME_input.proto and NAME_expected.proto pairs for the test command")
+	fs.StringVar(&cli.stdinFilepath, "stdin-filepath", "", "Path of the file piped on stdin, for config discovery and messages")
+	fs.BoolVar(&opts.Recursive, "r", false, "Recursively process all .proto files in directories")
+	fs.BoolVar(&opts.Recursive, "recursive", false, "Recursively process all .proto files in directories")
+	fs.BoolVar(&opts.IgnoreMissing, "ignore-missing", false, "Skip file arguments that do not exist instead of failing")
+	fs.BoolVar(&cli.staged, "staged", false, "Only process git-staged .proto files, and re-stage them after --write")
+	fs.Var(changedFlag{&cli.changed}, "changed", "Only process .proto files changed relative to a base ref; =<ref> names it (default "+defaultChangedBase+")")
+	fs.BoolVar(&cli.newWarningsOnly, "new-warnings-only", false, "Only report warnings and unreferenced types that the --against revision doesn't have")
+	fs.StringVar(&cli.against, "against", "", "Base ref for --new-warnings-only, compared from its merge base with HEAD (default --changed's ref, or "+defaultChangedBase+")")
+	fs.BoolVar(&opts.Write, "w", false, "Write changes in-place")
+	fs.BoolVar(&opts.Write, "write", false, "Write changes in-place")
+	fs.BoolVar(&opts.Check, "c", false, "Exit non-zero if file would change (for CI)")
+	fs.StringVar(&opts.Output, "o", "", "Write the sorted file to this path instead of stdout (one input only)")
+	fs.StringVar(&opts.Output, "output", "", "Write the sorted file to this path instead of stdout (one input only)")
+	fs.BoolVar(&opts.Check, "check", false, "Exit non-zero if file would change (for CI)")
+	fs.StringVar(&opts.CheckLevel, "check-level", "all", "Changes --check fails on: semantic (order and content), cosmetic (also spacing within lines), or all")
+	fs.BoolVar(&opts.Diff, "d", false, "Print unified diff of changes")
+	fs.BoolVar(&opts.Diff, "diff", false, "Print unified diff of changes")
+	fs.Var(verifyFlag{opts}, "verify", "Verify declaration integrity and compiled descriptors after sorting; =grpc-compat also resolves services through a protobuf registry")
+	fs.StringVar(&opts.Verifier, "verifier", protosort.VerifierProtocompile, "Descriptor comparison for --verify: protocompile (in-process) or protoc")
+	fs.BoolVar(&opts.RequireVerify, "require-verify", false, "With --verifier=protoc, fail verification instead of skipping it when protoc is not found")
+	fs.BoolVar(&cli.noCache, "no-cache", false, "Verify every file, ignoring the "+verifyCacheFile+" record of earlier passes")
+	fs.BoolVar(&opts.Paranoid, "paranoid", false, "Fail if sorting drops any non-whitespace character, beyond enabled strip options")
+	fs.StringVar(&opts.ProtocPath, "protoc", "", "Path to protoc binary")
+	fs.Var(&cli.protoPaths, "proto-path", "Additional proto include paths (repeatable)")
+	fs.Var(&cli.packages, "package", "Only process files whose package matches this name or glob, e.g. acme.billing.* (repeatable)")
+	fs.Var(&cli.exclude, "exclude", "Skip files matching this gitignore-style pattern, relative to the working directory (repeatable)")
+	fs.StringVar(&opts.SharedOrder, "shared-order", "alpha", "Ordering for core types: alpha or dependency")
+	fs.StringVar(&opts.KindOrder, "kind-order", "mixed", "Order of enums and messages within a section: mixed, enums-first, or messages-first")
+	fs.StringVar(&opts.SortRPCs, "sort-rpcs", "", "Sort RPCs within services: alpha or grouped")
+	fs.BoolVar(&opts.RPCGroupHeaders, "rpc-group-headers", false, "With --sort-rpcs grouped, add a comment header above each resource group")
+	fs.BoolVar(&opts.RPCFingerprint, "rpc-fingerprint", false, "With --sort-rpcs, record each service's RPC order and warn when RPCs are later misplaced")
+	fs.StringVar(&cli.like, "like", "", "Order declarations like the same-named ones in this template file")
+	fs.BoolVar(&opts.SortFieldOptions, "sort-field-options", false, "Sort bracketed field options by name and normalize their spacing")
+	fs.BoolVar(&opts.SortNested, "sort-nested", false, "Alphabetize nested messages and enums inside messages, leaving fields in place")
+	fs.BoolVar(&opts.SortFields, "sort-fields", false, "Order fields within each message by field number")
+	fs.BoolVar(&opts.GroupImports, "group-imports", false, "Separate well-known, third-party, and local imports with blank lines")
+	fs.BoolVar(&opts.PairStrict, "pair-strict", false, "Follow each XxxRequest directly with its XxxResponse, warning where that's impossible")
+	fs.BoolVar(&opts.GroupByService, "group-by-service", false, "In files with several services, follow each service by its own RPC types")
+	fs.BoolVar(&opts.GroupExtends, "group-extends", false, "Sort extend blocks by extended type, each followed by the types only it uses")
+	fs.IntVar(&opts.CoreMinRefs, "core-min-refs", 0, "Make a type core only once this many declarations reference it (0 = when it references other types)")
+	fs.BoolVar(&opts.RemoveUnusedImports, "remove-unused-imports", false, "Drop imports that define nothing the file references")
+	fs.BoolVar(&opts.PreserveDividers, "preserve-dividers", false, "Keep section divider comments")
+	fs.BoolVar(&opts.KeepFloatingComments, "keep-floating-comments", false, "Keep freestanding comments detached from the declaration below them")
+	fs.BoolVar(&opts.PreserveSpacing, "preserve-spacing", false, "Keep the input's blank lines between declarations that stay adjacent")
+	fs.BoolVar(&opts.StripCommented, "strip-commented-code", false, "Remove commented-out protobuf declarations")
+	fs.BoolVar(&opts.NormalizeComments, "normalize-comments", false, "Rewrite /* */ leading comments as // lines")
+	fs.IntVar(&opts.CommentWidth, "comment-width", 0, "With --normalize-comments, split longer // prose lines at this column (0 = no rewrap)")
+	fs.StringVar(&opts.Format, "format", "text", "Output format: text, or json or sarif for a per-file report on stdout")
+	fs.BoolVar(&cli.json, "json", false, "Shorthand for --format json")
+	fs.StringVar(&cli.metricsFile, "metrics-file", "", "Write counts of processed, changed, and failed files, warnings, and verify durations to this file in Prometheus text format")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Report what would change without writing")
+	fs.BoolVar(&opts.Verbose, "v", false, "Print reference counts and classification")
+	fs.BoolVar(&opts.Verbose, "verbose", false, "Print reference counts and classification")
+	fs.BoolVar(&opts.Quiet, "q", false, "Suppress warnings")
+	fs.BoolVar(&opts.Quiet, "quiet", false, "Suppress warnings")
+	fs.BoolVar(&opts.Strict, "strict", false, "Fail on file structure that can't be reordered losslessly")
+	fs.BoolVar(&opts.AllowProto2, "allow-proto2", false, "Sort proto2 files instead of rejecting them")
+	fs.BoolVar(&opts.Annotate, "annotate", false, "Add classification annotations to comments")
+	fs.BoolVar(&opts.SectionHeaders, "section-headers", false, "Insert section header comments")
+	fs.BoolVar(&opts.TOC, "toc", false, "Insert a table-of-contents comment listing services, RPCs, and types")
+	fs.BoolVar(&opts.SectionStats, "section-stats", false, "Append declaration counts to section header labels")
+	fs.StringVar(&opts.Regions, "regions", "", "Handle // region fold markers: keep (group contents) or strip")
+	fs.BoolVar(&opts.InlineHelpers, "inline-helpers", false, "Place single-consumer helpers directly above their consumer")
+	fs.StringVar(&opts.Indent, "indent", "", "Rewrite indentation inside declarations: spaces, tabs, or a number of spaces per level")
+	fs.IntVar(&opts.IndentWidth, "indent-width", 0, "Columns a tab stands for when rewriting indentation (0 = infer)")
+	fs.StringVar(&opts.EndOfLine, "end-of-line", "", "Rewrite line endings: lf, crlf, or auto for the ending most lines have (default auto)")
+	fs.BoolVar(&opts.NoFinalNewline, "no-final-newline", false, "End output without a trailing newline")
+	fs.BoolVar(&opts.NoEditorConfig, "no-editorconfig", false, "Ignore .editorconfig files")
+	fs.IntVar(&opts.MaxRPCsPerService, "max-rpcs", 0, "Warn when a service has more RPCs than this (0 = no limit)")
+	fs.IntVar(&opts.MaxFieldsPerMessage, "max-fields", 0, "Warn when a message has more fields than this (0 = no limit)")
+	fs.IntVar(&opts.MaxMessagesPerFile, "max-messages", 0, "Warn when a file has more messages than this (0 = no limit)")
+	fs.StringVar(&opts.Preset, "preset", "", "Built-in style preset: aip, uber, or buf-default")
+	fs.StringVar(&opts.ConfigFile, "config", "", "Path to config file (.toml, .textproto, or .json)")
+}
+
+// processFile sorts, verifies, and outputs a single file, returning its exit
+// code.
+func processFile(file string, opts protosort.Options) int {
+	p := sortFile(file, opts, nil, nil)
+	if p.needsVerify(opts) {
+		p.verified = make(chan error, 1)
+		p.verified <- safeVerify(p.original, p.sorted, p.opts)
+	}
+	return finishFile(p, opts)
+}
+
+// stdinName stands in for the file name when sorting stdin without
+// --stdin-filepath.
+const stdinName = "<stdin>"
+
+// processStdin sorts a proto read from r and prints the result to stdout,
+// like gofmt with no file arguments. Messages name the content as path, or
+// as stdinName when path is empty. It returns the exit code.
+func processStdin(r io.Reader, path string, opts protosort.Options) int {
+	if path == "" {
+		path = stdinName
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading %s: %v\n", path, err)
+		return 4
+	}
+	p := &pendingFile{file: path, original: string(content), stdin: true, opts: opts}
+	if path != stdinName {
+		p.opts = withEditorConfig(path, opts)
+	}
+	sortContent(p, p.opts, nil)
+	if p.needsVerify(opts) {
+		p.verified = make(chan error, 1)
+		p.verified <- safeVerify(p.original, p.sorted, p.opts)
+	}
+	if opts.Format == "json" || opts.Format == "sarif" {
+		report := &runReport{}
+		code := report.add(p, opts)
+		report.ExitCode = code
+		if err := writeReport(os.Stdout, report, opts.Format); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 4
+		}
+		return code
+	}
+	return finishFile(p, opts)
+}
+
+// stdinIsPiped reports whether stdin is a pipe or file rather than a terminal.
+func stdinIsPiped() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
+}
+
+// sortFile reads and sorts file, reusing a cached result for contents seen
+// before when cache is non-nil. The content comes from staged if it has the
+// file. Nothing is printed yet, so that files sorted ahead of a running
+// verification still report in order.
+func sortFile(file string, opts protosort.Options, cache *sortCache, staged map[string]string) *pendingFile {
+	p := &pendingFile{file: file}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		p.errMsg = fmt.Sprintf("error reading %s: %v", file, err)
+		p.code = 4
+		return p
+	}
+	p.mode = info.Mode()
+
+	content, ok := staged[file]
+	if !ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			p.errMsg = fmt.Sprintf("error reading %s: %v", file, err)
+			p.code = 4
+			return p
+		}
+		content = string(data)
+	}
+
+	p.original = content
+	p.opts = withEditorConfig(file, opts)
+	sortContent(p, p.opts, cache)
+	return p
+}
+
+// sortContent sorts p.original, recording the result or the error's exit code.
+func sortContent(p *pendingFile, opts protosort.Options, cache *sortCache) {
+	var err error
+	p.skipped = protosort.HasSkipFileDirective(p.original)
+	p.sorted, p.warnings, err = cache.sort(p.file, p.original, opts)
+	if err != nil {
+		p.errMsg = fmt.Sprintf("error: %s: %v", p.file, err)
+		var proto2Err *protosort.Proto2Error
+		var parseErr *protosort.ParseError
+		var unsupportedErr *protosort.UnsupportedError
+		var conflictErr *protosort.ConflictError
+		if errors.As(err, &parseErr) {
+			p.errLine, _ = parseErr.Position()
+		}
+		if errors.As(err, &conflictErr) {
+			p.code = 5
+			p.errLine = conflictErr.Line
+		} else if errors.As(err, &proto2Err) || parseErr != nil || errors.As(err, &unsupportedErr) {
+			p.code = 3
+		} else {
+			p.code = 4
+		}
+	}
+}
+
+// finishFile reports a sorted file, waiting for its verification if one is
+// running, and writes or prints the result. It returns the file's exit code.
+func finishFile(p *pendingFile, opts protosort.Options) int {
+	file, original, sorted := p.file, p.original, p.sorted
+
+	if p.code != 0 {
+		fmt.Fprintln(os.Stderr, p.errMsg)
+		return p.code
+	}
+
+	// Print warnings
+	for _, w := range p.warnings {
+		if w.Line > 0 {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", file, w.Line, w)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, w)
+		}
+	}
+
+	// Verbose output
+	if opts.Verbose {
+		blocks, _ := protosort.ScanFile(original)
+		fmt.Fprint(os.Stderr, protosort.VerboseReport(blocks))
+	}
+
+	// No changes needed
+	if original == sorted {
+		if !opts.Quiet {
+			if p.skipped {
+				fmt.Fprintf(os.Stderr, "%s: skipped (protosort:skip-file)\n", file)
+			} else if opts.Check || opts.DryRun {
+				fmt.Fprintf(os.Stderr, "%s: no changes needed\n", file)
+			}
+		}
+		// A filter echoes its input even when there is nothing to change,
+		// as does a file sorted to --output
+		if (p.stdin || opts.Output != "") && !opts.Check && !opts.DryRun && !opts.Diff {
+			return printSorted(p, opts)
+		}
+		return 0
+	}
+
+	// Verify (if requested)
+	if p.verified != nil {
+		if err := <-p.verified; err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: verification failed: %v\n", file, err)
+			return 2
+		}
+	}
+
+	// Check mode
+	if opts.Check && !checkFails(original, sorted, opts.CheckLevel) {
+		if !opts.Quiet {
+			fmt.Fprintf(os.Stderr, "%s: would change %s only, ignored at --check-level %s\n", file, changeDescription[changeLevel(original, sorted)], opts.CheckLevel)
+		}
+		return 0
+	}
+	if opts.Check {
+		excused, note := checkException(file, opts)
+		if excused {
+			if !opts.Quiet {
+				fmt.Fprintf(os.Stderr, "%s: would change, %s\n", file, note)
+			}
+			return 0
+		}
+		if note != "" {
+			fmt.Fprintf(os.Stderr, "%s: would change; %s\n", file, note)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: would change\n", file)
+		}
+		if opts.Diff {
+			fmt.Print(protosort.DiffSorted(original, sorted, file+" (original)", file+" (sorted)", opts))
+		}
+		return 1
+	}
+
+	// Dry run
+	if opts.DryRun {
+		fmt.Fprintf(os.Stderr, "%s: would change\n", file)
+		if opts.Diff {
+			fmt.Print(protosort.DiffSorted(original, sorted, file+" (original)", file+" (sorted)", opts))
+		}
+		return 0
+	}
+
+	// Write mode
+	if opts.Write {
+		if _, err := writeSorted(p, opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 4
+		}
+		if opts.Diff {
+			fmt.Print(protosort.DiffSorted(original, sorted, file+" (original)", file+" (sorted)", opts))
+		}
+		if !opts.Quiet {
+			fmt.Fprintf(os.Stderr, "%s: sorted\n", file)
+		}
+		return 0
+	}
+
+	// Diff mode (without write)
+	if opts.Diff {
+		fmt.Print(protosort.DiffSorted(original, sorted, file+" (original)", file+" (sorted)", opts))
+		return 0
+	}
+
+	// Default: print to stdout
+	return printSorted(p, opts)
+}
+
+// printSorted prints the sorted file to stdout, or writes it to
+// opts.Output, with the input's permissions if it has any. It returns the
+// exit code.
+func printSorted(p *pendingFile, opts protosort.Options) int {
+	if opts.Output == "" {
+		fmt.Print(p.sorted)
+		return 0
+	}
+	perm := p.mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	if err := os.WriteFile(opts.Output, []byte(p.sorted), perm); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s: %v\n", opts.Output, err)
+		return 4
+	}
+	return 0
+}
+
+// collectFiles expands args into .proto files. Directories contribute their
+// own .proto files, or with opts.Recursive every .proto file below them that
+// isn't ignored by a .gitignore. Files matching opts.Exclude are dropped
+// wherever they come from, including explicit arguments. A missing argument
+// is an error naming likely intended paths, or with opts.IgnoreMissing a
+// warning.
+func collectFiles(args []string, opts protosort.Options) ([]string, error) {
+	exclude, err := excludeRules(opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	excluded := func(path string, isDir bool) bool {
+		abs, err := filepath.Abs(path)
+		return err == nil && ignoredPath(exclude, abs, isDir)
+	}
+
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if errors.Is(err, fs.ErrNotExist) {
+			if opts.IgnoreMissing {
+				if !opts.Quiet {
+					fmt.Fprintf(os.Stderr, "warning: %s does not exist, skipped\n", arg)
+				}
+				continue
+			}
+			if hint := didYouMean(suggestPaths(arg)); hint != "" {
+				return nil, fmt.Errorf("%s does not exist; %s", arg, hint)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot access %s: %w", arg, err)
+		}
+
+		if !info.IsDir() {
+			if !strings.HasSuffix(arg, ".proto") {
+				return nil, fmt.Errorf("%s is not a .proto file", arg)
+			}
+			if !excluded(arg, false) {
+				files = append(files, arg)
+			}
+			continue
+		}
+
+		if !opts.Recursive {
+			// Non-recursive: only immediate .proto files
+			entries, err := os.ReadDir(arg)
+			if err != nil {
+				return nil, fmt.Errorf("reading directory %s: %w", arg, err)
+			}
+			for _, entry := range entries {
+				path := filepath.Join(arg, entry.Name())
+				if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".proto") && !excluded(path, false) {
+					files = append(files, path)
+				}
+			}
+		} else {
+			// Recursive walk, skipping what .gitignore or --exclude covers
+			ig := newIgnorer(arg)
+			err := filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if path == arg {
+					return nil
+				}
+				abs, err := filepath.Abs(path)
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					if d.Name() == ".git" || ig.ignored(abs, true) || ignoredBy(exclude, abs, true) {
+						return filepath.SkipDir
+					}
+					ig.enterDir(abs)
+					return nil
+				}
+				if strings.HasSuffix(d.Name(), ".proto") && !ig.ignored(abs, false) && !ignoredBy(exclude, abs, false) {
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("walking directory %s: %w", arg, err)
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// allExcluded reports whether collectFiles found no files in args only
+// because opts.Exclude dropped them all.
+func allExcluded(args []string, opts protosort.Options) bool {
+	if len(opts.Exclude) == 0 {
+		return false
+	}
+	opts.Exclude, opts.Quiet = nil, true
+	files, err := collectFiles(args, opts)
+	return err == nil && len(files) > 0
+}
+
+// verifyFlag implements --verify: a boolean, or a level such as
+// --verify=grpc-compat that also turns verification on.
+type verifyFlag struct {
+	opts *protosort.Options
+}
+
+func (f verifyFlag) String() string {
+	if f.opts == nil {
+		return "false"
+	}
+	if f.opts.VerifyLevel != "" {
+		return f.opts.VerifyLevel
+	}
+	return strconv.FormatBool(f.opts.Verify)
+}
+
+func (f verifyFlag) Set(value string) error {
+	if value == protosort.VerifyGRPCCompat {
+		f.opts.Verify = true
+		f.opts.VerifyLevel = value
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("must be true, false, or %q", protosort.VerifyGRPCCompat)
+	}
+	f.opts.Verify = b
+	f.opts.VerifyLevel = ""
+	return nil
+}
+
+func (f verifyFlag) IsBoolFlag() bool {
+	return true
+}
+
+// multiFlag implements flag.Value for repeatable string flags.
+type multiFlag []string
+
+func (f *multiFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// printConfigSchema writes the config file's JSON Schema to w.
+func printConfigSchema(w io.Writer, fs *flag.FlagSet) error {
+	schema, err := protosort.ConfigSchema(fs)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schema)
+}
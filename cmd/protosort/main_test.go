@@ -0,0 +1,1802 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tallhamn/protosort"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	descriptorpb "google.golang.org/protobuf/types/descriptorpb"
+)
+
+// ============================================================
+// CLI integration tests
+// ============================================================
+
+func TestCLI_CheckExitCode(t *testing.T) {
+	// --check should return exit code 1 if file would change
+	input := `syntax = "proto3";
+
+message B { string v = 1; }
+message A { string v = 1; }
+`
+	tmpDir := t.TempDir()
+	inputFile := filepath.Join(tmpDir, "test.proto")
+	if err := os.WriteFile(inputFile, []byte(input), 0644); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	code := processFile(inputFile, protosort.Options{Check: true, Quiet: true})
+	if code != 1 {
+		t.Errorf("check mode should return 1 for changed file, got %d", code)
+	}
+}
+
+func TestCLI_CheckExitCode_NoChange(t *testing.T) {
+	// Already sorted — should return 0
+	input := `syntax = "proto3";
+
+message A { string v = 1; }
+
+message B { string v = 1; }
+`
+	tmpDir := t.TempDir()
+	inputFile := filepath.Join(tmpDir, "test.proto")
+	if err := os.WriteFile(inputFile, []byte(input), 0644); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	code := processFile(inputFile, protosort.Options{Check: true, Quiet: true})
+	if code != 0 {
+		t.Errorf("check mode should return 0 for already-sorted file, got %d", code)
+	}
+}
+
+func TestCLI_WriteInPlace(t *testing.T) {
+	input := `syntax = "proto3";
+
+message B { string v = 1; }
+
+message A { string v = 1; }
+`
+	tmpDir := t.TempDir()
+	inputFile := filepath.Join(tmpDir, "test.proto")
+	if err := os.WriteFile(inputFile, []byte(input), 0644); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	code := processFile(inputFile, protosort.Options{Write: true, Quiet: true})
+	if code != 0 {
+		t.Errorf("write mode should return 0, got %d", code)
+	}
+
+	content, err := os.ReadFile(inputFile)
+	if err != nil {
+		t.Fatalf("reading back file: %v", err)
+	}
+	if !strings.Contains(string(content), "message A") {
+		t.Error("file should have been written with sorted content")
+	}
+	assertOrder(t, string(content), "message A", "message B")
+}
+
+func TestCLI_DryRun(t *testing.T) {
+	input := `syntax = "proto3";
+
+message B { string v = 1; }
+
+message A { string v = 1; }
+`
+	tmpDir := t.TempDir()
+	inputFile := filepath.Join(tmpDir, "test.proto")
+	if err := os.WriteFile(inputFile, []byte(input), 0644); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	code := processFile(inputFile, protosort.Options{DryRun: true, Quiet: true})
+	if code != 0 {
+		t.Errorf("dry-run should return 0, got %d", code)
+	}
+
+	// File should NOT be modified
+	content, err := os.ReadFile(inputFile)
+	if err != nil {
+		t.Fatalf("reading back file: %v", err)
+	}
+	if string(content) != input {
+		t.Error("dry-run should not modify the file")
+	}
+}
+
+func TestCLI_ExitCodeMatrix(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		opts     protosort.Options
+		wantCode int
+	}{
+		{
+			name:     "proto2 returns 3",
+			input:    `syntax = "proto2"; message Foo { required string v = 1; }`,
+			opts:     protosort.Options{},
+			wantCode: 3,
+		},
+		{
+			name:     "success returns 0",
+			input:    "syntax = \"proto3\";\n\nmessage Foo { string v = 1; }\n",
+			opts:     protosort.Options{Quiet: true},
+			wantCode: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			inputFile := filepath.Join(tmpDir, "test.proto")
+			if err := os.WriteFile(inputFile, []byte(tt.input), 0644); err != nil {
+				t.Fatalf("writing test file: %v", err)
+			}
+
+			code := processFile(inputFile, tt.opts)
+			if code != tt.wantCode {
+				t.Errorf("want exit code %d, got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestCLI_WritePreservesPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix file permissions not supported on Windows")
+	}
+	input := `syntax = "proto3";
+
+message B { string v = 1; }
+
+message A { string v = 1; }
+`
+	tmpDir := t.TempDir()
+	inputFile := filepath.Join(tmpDir, "test.proto")
+	if err := os.WriteFile(inputFile, []byte(input), 0755); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	code := processFile(inputFile, protosort.Options{Write: true, Quiet: true})
+	if code != 0 {
+		t.Fatalf("write failed with code %d", code)
+	}
+
+	info, _ := os.Stat(inputFile)
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("file permissions changed: want 0755, got %o", info.Mode().Perm())
+	}
+}
+
+func TestCLI_WriteHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks run through sh")
+	}
+	input := "syntax = \"proto3\";\n\nmessage B { string v = 1; }\n\nmessage A { string v = 1; }\n"
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "it's.proto")
+	log := filepath.Join(tmpDir, "hooks.log")
+	write := func() {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(input), 0644); err != nil {
+			t.Fatalf("writing test file: %v", err)
+		}
+	}
+
+	// The post-write hook sees the sorted file; both see the environment
+	write()
+	opts := protosort.Options{
+		Write:     true,
+		Quiet:     true,
+		PreWrite:  "grep -c 'message B' {file} > " + log + "; echo \"$STAGE $PROTOSORT_FILE\" >> " + log,
+		PostWrite: "head -3 {file} | tail -1 >> " + log,
+		HookEnv:   []string{"STAGE=pre"},
+	}
+	if code := processFile(file, opts); code != 0 {
+		t.Fatalf("exit code = %d, want 0", code)
+	}
+	got, _ := os.ReadFile(log)
+	if want := "1\npre " + file + "\nmessage A { string v = 1; }\n"; string(got) != want {
+		t.Errorf("hook log = %q, want %q", got, want)
+	}
+
+	// A failing or slow pre-write hook leaves the file unwritten
+	for _, hook := range []protosort.Options{{PreWrite: "exit 3"}, {PreWrite: "sleep 5", HookTimeout: "100ms"}} {
+		write()
+		hook.Write, hook.Quiet = true, true
+		if code := processFile(file, hook); code != 4 {
+			t.Errorf("%s: exit code = %d, want 4", hook.PreWrite, code)
+		}
+		if got, _ := os.ReadFile(file); string(got) != input {
+			t.Errorf("%s: file was written", hook.PreWrite)
+		}
+	}
+
+	// A failing post-write hook fails the file after writing it
+	write()
+	if code := processFile(file, protosort.Options{Write: true, Quiet: true, PostWrite: "false"}); code != 4 {
+		t.Errorf("exit code = %d, want 4", code)
+	}
+	if got, _ := os.ReadFile(file); string(got) == input {
+		t.Error("file should be written before its post-write hook runs")
+	}
+}
+
+func TestCLI_EditorConfig(t *testing.T) {
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		".editorconfig":  "root = true\n\n[*.{proto,txt}]\nindent_style = tab\nindent_size = 4\ninsert_final_newline = true\n\n[legacy/**]\nindent_style = unset\nend_of_line = crlf\n",
+		"api/a.proto":    "syntax = \"proto3\";\n\nmessage B {\n    string v = 1;\n}\n\nmessage A {\n    B b = 1;\n}\n",
+		"legacy/b.proto": "syntax = \"proto3\";\n\nmessage B {\n    string v = 1;\n}\n\nmessage A {\n    B b = 1;\n}\n",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := filepath.Join(root, "api", "a.proto"), filepath.Join(root, "legacy", "b.proto")
+
+	if code := processFiles([]string{a, b}, protosort.Options{Write: true, Verify: true, Quiet: true}, nil, nil, nil, nil); code != 0 {
+		t.Fatalf("exit code = %d, want 0", code)
+	}
+	got, _ := os.ReadFile(a)
+	if !strings.Contains(string(got), "\n\tB b = 1;\n") || strings.Contains(string(got), "\r") {
+		t.Errorf("api/a.proto should be tab-indented with LF endings:\n%q", got)
+	}
+	got, _ = os.ReadFile(b)
+	if !strings.Contains(string(got), "\r\n    B b = 1;\r\n") {
+		t.Errorf("legacy/b.proto should keep its indentation with CRLF endings:\n%q", got)
+	}
+
+	// Flags and the config file win, and --no-editorconfig turns it off
+	opts := withEditorConfig(b, protosort.Options{EndOfLine: protosort.EndOfLineLF})
+	if opts.EndOfLine != protosort.EndOfLineLF || opts.IndentWidth != 4 {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	if opts := withEditorConfig(a, protosort.Options{NoEditorConfig: true}); opts.Indent != "" {
+		t.Errorf("--no-editorconfig should ignore .editorconfig, got indent %q", opts.Indent)
+	}
+}
+
+func TestCLI_Stdin(t *testing.T) {
+	unsorted := "syntax = \"proto3\";\n\nmessage B { string v = 1; }\n\nmessage A { string v = 1; }\n"
+	sorted := "syntax = \"proto3\";\n\nmessage A { string v = 1; }\n\nmessage B { string v = 1; }\n"
+
+	tests := []struct {
+		name     string
+		input    string
+		opts     protosort.Options
+		wantCode int
+		wantOut  string
+	}{
+		{"sorts to stdout", unsorted, protosort.Options{}, 0, sorted},
+		{"echoes sorted input", sorted, protosort.Options{}, 0, sorted},
+		{"check", unsorted, protosort.Options{Check: true, Quiet: true}, 1, ""},
+		{"proto2", "syntax = \"proto2\";\n", protosort.Options{}, 3, ""},
+		{"merge conflict", "syntax = \"proto3\";\n\n<<<<<<< HEAD\nmessage B { string v = 1; }\n=======\nmessage B { int32 v = 1; }\n>>>>>>> feature\n", protosort.Options{}, 5, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var code int
+			out := captureStdout(t, func() {
+				code = processStdin(strings.NewReader(tt.input), "", tt.opts)
+			})
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			if out != tt.wantOut {
+				t.Errorf("stdout:\n%s\nwant:\n%s", out, tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestCLI_Output(t *testing.T) {
+	unsorted := "syntax = \"proto3\";\n\nmessage B { string v = 1; }\n\nmessage A { string v = 1; }\n"
+	sorted := "syntax = \"proto3\";\n\nmessage A { string v = 1; }\n\nmessage B { string v = 1; }\n"
+	tmpDir := t.TempDir()
+
+	for _, tt := range []struct {
+		name  string
+		input string
+	}{
+		{"unsorted", unsorted},
+		{"already sorted", sorted},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			inputFile := filepath.Join(tmpDir, "in.proto")
+			outFile := filepath.Join(tmpDir, "out.proto")
+			os.Remove(outFile)
+			if err := os.WriteFile(inputFile, []byte(tt.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var code int
+			out := captureStdout(t, func() {
+				code = processFile(inputFile, protosort.Options{Quiet: true, Output: outFile})
+			})
+			if code != 0 || out != "" {
+				t.Errorf("exit code = %d, stdout %q; want 0 and nothing", code, out)
+			}
+			if got, _ := os.ReadFile(outFile); string(got) != sorted {
+				t.Errorf("output file:\n%s\nwant:\n%s", got, sorted)
+			}
+			if got, _ := os.ReadFile(inputFile); string(got) != tt.input {
+				t.Errorf("input file changed:\n%s", got)
+			}
+		})
+	}
+
+	// Nothing is written for a file that can't be sorted
+	outFile := filepath.Join(tmpDir, "proto2.out.proto")
+	code := processStdin(strings.NewReader("syntax = \"proto2\";\n"), "", protosort.Options{Output: outFile})
+	if _, err := os.Stat(outFile); code != 3 || err == nil {
+		t.Errorf("exit code = %d, output file stat error %v; want 3 and no file", code, err)
+	}
+
+	if err := validateOptions(protosort.Options{SharedOrder: "alpha", Output: outFile, Write: true}); err == nil {
+		t.Error("--output with --write should be rejected")
+	}
+}
+
+func TestCLI_CheckExceptions(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputFile := filepath.Join(tmpDir, "old.proto")
+	if err := os.WriteFile(inputFile, []byte("syntax = \"proto3\";\n\nmessage B {}\n\nmessage A {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		file     string
+		expires  string
+		wantCode int
+		wantNote string
+	}{
+		{"current", "old.proto", "2999-12-31", 0, "excused until 2999-12-31 (frozen)"},
+		{"glob", "*.proto", "2999-12-31", 0, "excused until 2999-12-31 (frozen)"},
+		{"expired", "old.proto", "2000-01-01", 1, "exception expired on 2000-01-01 (frozen)"},
+		{"other file", "new.proto", "2999-12-31", 1, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := protosort.Options{Check: true, Quiet: true, Format: "json", Exceptions: []protosort.Exception{
+				{File: filepath.Join(tmpDir, tt.file), Reason: "frozen", Expires: tt.expires},
+			}}
+			var code int
+			out := captureStdout(t, func() {
+				code = processFiles([]string{inputFile}, opts, nil, nil, nil, nil)
+			})
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tt.wantCode)
+			}
+			var report runReport
+			if err := json.Unmarshal([]byte(out), &report); err != nil {
+				t.Fatalf("invalid JSON: %v\n%s", err, out)
+			}
+			if got := report.Files[0].Exception; got != tt.wantNote {
+				t.Errorf("exception = %q, want %q", got, tt.wantNote)
+			}
+		})
+	}
+
+	if err := validateOptions(protosort.Options{SharedOrder: "alpha", Exceptions: []protosort.Exception{{File: "a.proto", Expires: "someday"}}}); err == nil {
+		t.Error("an exception without a date should be rejected")
+	}
+}
+
+func TestValidateOptions_RPCFingerprint(t *testing.T) {
+	if err := validateOptions(protosort.Options{SharedOrder: "alpha", RPCFingerprint: true}); err == nil {
+		t.Error("--rpc-fingerprint without --sort-rpcs should be rejected")
+	}
+	if err := validateOptions(protosort.Options{SharedOrder: "alpha", RPCFingerprint: true, SortRPCs: "alpha"}); err != nil {
+		t.Errorf("--rpc-fingerprint with --sort-rpcs: %v", err)
+	}
+}
+
+func TestCLI_VerifyFlag(t *testing.T) {
+	for _, tt := range []struct {
+		args      []string
+		wantOn    bool
+		wantLevel string
+	}{
+		{nil, false, ""},
+		{[]string{"--verify"}, true, ""},
+		{[]string{"--verify=false"}, false, ""},
+		{[]string{"--verify=grpc-compat"}, true, protosort.VerifyGRPCCompat},
+	} {
+		var opts protosort.Options
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		defineFlags(fs, &opts, &cliFlags{})
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+		if opts.Verify != tt.wantOn || opts.VerifyLevel != tt.wantLevel {
+			t.Errorf("%v: Verify=%v VerifyLevel=%q, want %v %q", tt.args, opts.Verify, opts.VerifyLevel, tt.wantOn, tt.wantLevel)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	defineFlags(fs, &protosort.Options{}, &cliFlags{})
+	if err := fs.Parse([]string{"--verify=bogus"}); err == nil {
+		t.Error("expected an error for an unknown verify level")
+	}
+}
+
+func TestCLI_CollectFilesIgnore(t *testing.T) {
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		".git/HEAD":                   "",
+		".gitignore":                  "node_modules/\n*.gen.proto\n!keep.gen.proto\n/build/\n",
+		"api/v1/api.proto":            "",
+		"api/v1/api.gen.proto":        "",
+		"api/v1/keep.gen.proto":       "",
+		"api/v1/.gitignore":           "local.proto\n",
+		"api/v1/local.proto":          "",
+		"api/v1/build/b.proto":        "", // /build/ is anchored to the root
+		"build/out.proto":             "",
+		"node_modules/x/x.proto":      "",
+		"third_party/vendor/v.proto":  "",
+		"third_party/google/g.proto":  "",
+		"third_party/google/g2.proto": "",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Exclude patterns are relative to the working directory
+	t.Chdir(root)
+	opts := protosort.Options{Recursive: true, Exclude: []string{"vendor/", "third_party/**/g2.proto"}}
+	files, err := collectFiles([]string{root}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		rel, _ := filepath.Rel(root, f)
+		got = append(got, filepath.ToSlash(rel))
+	}
+	want := []string{"api/v1/api.proto", "api/v1/build/b.proto", "api/v1/keep.gen.proto", "third_party/google/g.proto"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collected %v, want %v", got, want)
+	}
+
+	// The parent's .gitignore applies when walking a subdirectory, and a
+	// file named explicitly is included unless it is excluded
+	files, err = collectFiles([]string{
+		filepath.Join(root, "api"),
+		filepath.Join(root, "api/v1/api.gen.proto"),
+		filepath.Join(root, "third_party/google/g2.proto"),
+		filepath.Join(root, "third_party/vendor/v.proto"),
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 || !strings.HasSuffix(files[3], "api.gen.proto") {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	// Excluded files are dropped from a non-recursive listing too
+	opts.Recursive = false
+	files, err = collectFiles([]string{"third_party/google"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(files[0]) != "g.proto" {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	// Only excluded files, as a hook may pass, is an empty run rather than
+	// a failure to find any
+	if !allExcluded([]string{"third_party/google/g2.proto", "third_party/vendor/v.proto"}, opts) {
+		t.Error("expected explicit files all to count as excluded")
+	}
+	if allExcluded([]string{"node_modules"}, opts) {
+		t.Error("a directory without .proto files found nothing to exclude")
+	}
+}
+
+func TestCLI_FilterByPackage(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.proto":      "syntax = \"proto3\";\npackage acme.billing.v1;\n",
+		"b/b.proto":    "syntax = \"proto3\";\npackage acme.billing.v2;\n",
+		"c.proto":      "syntax = \"proto3\";\npackage acme.trips.v1;\n",
+		"none.proto":   "syntax = \"proto3\";\n",
+		"broken.proto": "message {",
+	}
+	var paths []string
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	tests := []struct {
+		patterns []string
+		want     []string
+	}{
+		{[]string{"acme.billing.v1"}, []string{"a.proto"}},
+		{[]string{"acme.billing.*"}, []string{"a.proto", "b.proto"}},
+		{[]string{"acme.trips.v1", "acme.billing.v2"}, []string{"b.proto", "c.proto"}},
+		{[]string{"acme"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := filterByPackage(paths, tt.patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, p := range got {
+			names = append(names, filepath.Base(p))
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.patterns, names, tt.want)
+		}
+	}
+
+	if _, err := filterByPackage(paths, []string{"acme.["}); err == nil {
+		t.Error("want an error for a malformed pattern")
+	}
+}
+
+func TestCLI_CollectFilesMissing(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"api/user/v1/user.proto", "api/user/v2/user.proto", "api/order/v1/order.proto"} {
+		p := filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(""), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(root)
+
+	tests := []struct {
+		arg, want string
+	}{
+		{"api/users/v1/user.proto", "did you mean api/user/v1/user.proto or api/user/v2/user.proto?"},
+		{"api/order/v1/ordr.proto", "did you mean api/order/v1/order.proto?"},
+		{"api/user/v3/user.proto", "did you mean api/user/v1/user.proto or api/user/v2/user.proto?"},
+	}
+	for _, tt := range tests {
+		_, err := collectFiles([]string{filepath.FromSlash(tt.arg)}, protosort.Options{})
+		if err == nil || !strings.Contains(err.Error(), filepath.FromSlash(tt.want)) {
+			t.Errorf("%s: got error %v, want %q", tt.arg, err, tt.want)
+		}
+	}
+
+	// Nothing close: the plain error
+	_, err := collectFiles([]string{"zzz/nothing.proto"}, protosort.Options{})
+	if err == nil || strings.Contains(err.Error(), "did you mean") {
+		t.Errorf("got error %v, want no suggestion", err)
+	}
+
+	files, err := collectFiles([]string{"api/gone.proto", "api/order/v1/order.proto"}, protosort.Options{IgnoreMissing: true, Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(files[0]) != "order.proto" {
+		t.Errorf("unexpected files: %v", files)
+	}
+}
+
+func TestCLI_ChangedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	t.Chdir(root)
+	run := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(path, content string) {
+		t.Helper()
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("init", "-q")
+	run("config", "user.email", "test@example.com")
+	run("config", "user.name", "test")
+	for _, path := range []string{"a.proto", "api/b.proto", "api/c.proto", "vendor/v.proto", "gone.proto"} {
+		write(path, "syntax = \"proto3\";\n")
+	}
+	run("add", ".")
+	run("commit", "-q", "-m", "base")
+	run("branch", "base")
+
+	// A committed change, an unstaged one, an untracked file, a change to
+	// an excluded file, and a deletion
+	write("api/b.proto", "syntax = \"proto3\";\nmessage B {}\n")
+	run("commit", "-q", "-am", "change b")
+	write("api/c.proto", "syntax = \"proto3\";\nmessage C {}\n")
+	write("api/new.proto", "syntax = \"proto3\";\n")
+	write("vendor/v.proto", "syntax = \"proto3\";\nmessage V {}\n")
+	write("notes.txt", "")
+	os.Remove("gone.proto")
+
+	opts := protosort.Options{Exclude: []string{"vendor/"}}
+	files, err := changedFiles("base", nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	want := []string{filepath.Join("api", "b.proto"), filepath.Join("api", "c.proto"), filepath.Join("api", "new.proto")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("changed files %v, want %v", files, want)
+	}
+
+	// Arguments narrow the changed files to the ones they name
+	files, err = changedFiles("base", []string{filepath.Join("api", "c.proto"), "a.proto"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != filepath.Join("api", "c.proto") {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	if _, err := changedFiles("no-such-ref", nil, opts); err == nil || !strings.Contains(err.Error(), "--changed") {
+		t.Errorf("expected a --changed error for an unknown ref, got %v", err)
+	}
+}
+
+func TestCLI_NewWarningsOnly(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	t.Chdir(root)
+	run := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	base := `syntax = "proto3";
+
+message Legacy {
+  string a = 1;
+  string b = 2;
+}
+`
+	run("init", "-q")
+	run("config", "user.email", "test@example.com")
+	run("config", "user.name", "test")
+	os.WriteFile("api.proto", []byte(base), 0644)
+	run("add", ".")
+	run("commit", "-q", "-m", "base")
+	run("branch", "base")
+	os.WriteFile("api.proto", []byte(base+"\nmessage Zed {\n  string a = 1;\n  string b = 2;\n}\n"), 0644)
+	os.WriteFile("new.proto", []byte(base), 0644)
+
+	baseline, err := newWarningBaseline("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := protosort.Options{Check: true, Format: "sarif", MaxFieldsPerMessage: 1}
+	out := captureStdout(t, func() {
+		processFiles([]string{"api.proto", "new.proto"}, opts, nil, baseline, nil, nil)
+	})
+	var log sarifLog
+	if err := json.Unmarshal([]byte(out), &log); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out)
+	}
+	var got []string
+	for _, r := range log.Runs[0].Results {
+		got = append(got, r.Locations[0].PhysicalLocation.ArtifactLocation.URI+": "+r.Message.Text)
+	}
+	// Legacy is reported only in the file that's new since the base
+	want := []string{
+		"api.proto: message Zed has 2 fields (max 1)",
+		"api.proto: message Zed is not referenced in this file",
+		"new.proto: message Legacy has 2 fields (max 1)",
+		"new.proto: message Legacy is not referenced in this file",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %q, want %q", got, want)
+	}
+
+	if _, err := newWarningBaseline("no-such-ref"); err == nil || !strings.Contains(err.Error(), "--against") {
+		t.Errorf("expected an --against error for an unknown ref, got %v", err)
+	}
+}
+
+func TestCLI_StagedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	t.Chdir(root)
+	gitOut := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return string(out)
+	}
+	unsorted := "syntax = \"proto3\";\n\nmessage B {}\n\nmessage A {}\n"
+
+	gitOut("init", "-q")
+	for _, name := range []string{"a.proto", "b.proto", "c.proto"} {
+		os.WriteFile(name, []byte("syntax = \"proto3\";\n"), 0644)
+	}
+	gitOut("add", ".")
+	gitOut("-c", "user.email=test@example.com", "-c", "user.name=test", "commit", "-q", "-m", "base")
+
+	// a is staged, b is staged sorted with unsorted unstaged changes, c
+	// is unstaged
+	sorted := "syntax = \"proto3\";\n\nmessage A {}\n\nmessage B {}\n"
+	os.WriteFile("a.proto", []byte(unsorted), 0644)
+	os.WriteFile("b.proto", []byte(sorted), 0644)
+	gitOut("add", "a.proto", "b.proto")
+	os.WriteFile("b.proto", []byte(unsorted+"// wip\n"), 0644)
+	os.WriteFile("c.proto", []byte(unsorted), 0644)
+
+	files, partial, err := stagedFiles(nil, protosort.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{"a.proto", "b.proto"}) {
+		t.Fatalf("staged files %v, want [a.proto b.proto]", files)
+	}
+	if !reflect.DeepEqual(partial, map[string]string{"b.proto": sorted}) {
+		t.Fatalf("partially staged %q, want b.proto's staged content", partial)
+	}
+
+	// --check reads b as staged, which is what gets committed
+	if code := processFiles([]string{"b.proto"}, protosort.Options{Check: true, Quiet: true}, nil, nil, nil, partial); code != 0 {
+		t.Errorf("expected b.proto's staged content to pass --check, got exit code %d", code)
+	}
+
+	// --write leaves b alone, as its staged content is already sorted
+	opts := protosort.Options{Write: true, Quiet: true}
+	files, code := skipPartial(files, partial, opts)
+	if code != 0 || !reflect.DeepEqual(files, []string{"a.proto"}) {
+		t.Fatalf("skipPartial: got %v with exit code %d, want [a.proto] and 0", files, code)
+	}
+	if code := processFiles(files, opts, nil, nil, nil, nil); code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if err := restage(files); err != nil {
+		t.Fatal(err)
+	}
+
+	// a's sorted version is staged; b's unstaged work is neither sorted
+	// nor staged
+	if staged := gitOut("show", ":a.proto"); strings.Index(staged, "message A") > strings.Index(staged, "message B") {
+		t.Errorf("expected the sorted a.proto to be staged:\n%s", staged)
+	}
+	if staged := gitOut("show", ":b.proto"); staged != sorted {
+		t.Errorf("b.proto's unstaged changes should not be staged:\n%s", staged)
+	}
+	if data, _ := os.ReadFile("b.proto"); string(data) != unsorted+"// wip\n" {
+		t.Errorf("b.proto's working tree should be left alone:\n%s", data)
+	}
+
+	// Staged content that needs sorting fails the run instead
+	if _, code := skipPartial([]string{"b.proto"}, map[string]string{"b.proto": unsorted}, opts); code != 1 {
+		t.Errorf("expected exit code 1 for unsorted staged content, got %d", code)
+	}
+
+	// install-hook writes its own hook, but not over someone else's
+	if code := runInstallHook(nil); code != 0 {
+		t.Fatalf("install-hook: exit code %d", code)
+	}
+	hook := filepath.Join(".git", "hooks", "pre-commit")
+	if data, _ := os.ReadFile(hook); !strings.Contains(string(data), "protosort --staged --write") {
+		t.Errorf("unexpected hook:\n%s", data)
+	}
+	if code := runInstallHook(nil); code != 0 {
+		t.Errorf("reinstalling should succeed, got exit code %d", code)
+	}
+	os.WriteFile(hook, []byte("#!/bin/sh\nmake lint\n"), 0755)
+	if code := runInstallHook(nil); code != 4 {
+		t.Errorf("expected exit code 4 for an existing hook, got %d", code)
+	}
+}
+
+// ============================================================
+// Pipeline tests
+// ============================================================
+
+func TestCLI_ProcessFilesVerifyPipeline(t *testing.T) {
+	// Many files with --verify: each is written, and the worst exit code wins
+	unsorted := `syntax = "proto3";
+
+message B { string v = 1; }
+
+message A { string v = 1; }
+`
+	tmpDir := t.TempDir()
+	var files []string
+	for i := 0; i < 40; i++ {
+		f := filepath.Join(tmpDir, "f"+strconv.Itoa(i)+".proto")
+		if err := os.WriteFile(f, []byte(unsorted), 0644); err != nil {
+			t.Fatalf("writing test file: %v", err)
+		}
+		files = append(files, f)
+	}
+	proto2 := filepath.Join(tmpDir, "p2.proto")
+	if err := os.WriteFile(proto2, []byte("syntax = \"proto2\";\n"), 0644); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+	files = append(files[:20], append([]string{proto2}, files[20:]...)...)
+
+	code := processFiles(files, protosort.Options{Write: true, Verify: true, Quiet: true, ProtocPath: "protoc-not-installed"}, nil, nil, nil, nil)
+	if code != 3 {
+		t.Errorf("expected exit code 3 from the proto2 file, got %d", code)
+	}
+	for _, f := range files {
+		if f == proto2 {
+			continue
+		}
+		got, _ := os.ReadFile(f)
+		if !strings.Contains(string(got), "message A { string v = 1; }\n\nmessage B") {
+			t.Errorf("%s was not sorted:\n%s", f, got)
+		}
+	}
+}
+
+// writeStubProtoc writes a protoc stand-in to dir that logs each
+// invocation and writes an empty descriptor set. It returns the stub's path
+// and a function counting its runs so far.
+func writeStubProtoc(t *testing.T, dir string) (string, func() int) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub protoc is a shell script")
+	}
+	calls := filepath.Join(dir, "calls")
+	stub := filepath.Join(dir, "protoc")
+	script := "#!/bin/sh\necho run >> " + calls + "\nfor a; do case $a in --descriptor_set_out=*) : > \"${a#*=}\";; esac; done\n"
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatalf("writing stub: %v", err)
+	}
+	return stub, func() int {
+		got, _ := os.ReadFile(calls)
+		return strings.Count(string(got), "run")
+	}
+}
+
+func TestProcessFiles_BatchProtoc(t *testing.T) {
+	tmpDir := t.TempDir()
+	stub, runs := writeStubProtoc(t, tmpDir)
+
+	unsorted := "syntax = \"proto3\";\n\nmessage B { string v = 1; }\n\nmessage A { string v = 1; }\n"
+	var files []string
+	for _, dir := range []string{"a", "b"} {
+		for i := 0; i < 3; i++ {
+			f := filepath.Join(tmpDir, dir, "f"+strconv.Itoa(i)+".proto")
+			if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(f, []byte(unsorted), 0644); err != nil {
+				t.Fatalf("writing test file: %v", err)
+			}
+			files = append(files, f)
+		}
+	}
+
+	opts := protosort.Options{Check: true, Verify: true, Verifier: protosort.VerifierProtoc, ProtocPath: stub, Quiet: true}
+	if code := processFiles(files, opts, nil, nil, nil, nil); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if n := runs(); n != 4 {
+		t.Errorf("expected 2 protoc runs per directory, got %d", n)
+	}
+}
+
+func TestProcessFiles_VerifyImportsLaterFile(t *testing.T) {
+	// A file importing files later in the run, in other directories, is
+	// verified once those have been sorted, with them staged alongside
+	if runtime.GOOS == "windows" {
+		t.Skip("stub protoc is a shell script")
+	}
+	tmpDir := t.TempDir()
+	t.Chdir(tmpDir)
+	stub := filepath.Join(tmpDir, "protoc")
+	script := "#!/bin/sh\nfor a; do case $a in --proto_path=*) root=${a#*=};; --descriptor_set_out=*) out=${a#*=};; esac; done\n[ -f \"$root/c/base.proto\" ] || exit 1\n: > \"$out\"\n"
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatalf("writing stub: %v", err)
+	}
+	contents := map[string]string{
+		"a/api.proto":    "syntax = \"proto3\";\n\nimport \"b/common.proto\";\n\nmessage B { common.Common c = 1; }\n\nmessage A { string v = 1; }\n",
+		"b/common.proto": "syntax = \"proto3\";\n\npackage common;\n\nimport \"c/base.proto\";\n\nmessage D { base.Base b = 1; }\n\nmessage C { string v = 1; }\n",
+		"c/base.proto":   "syntax = \"proto3\";\n\npackage base;\n\nmessage Base { string v = 1; }\n",
+	}
+	files := []string{"a/api.proto", "b/common.proto", "c/base.proto"}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte(contents[f]), 0644); err != nil {
+			t.Fatalf("writing test file: %v", err)
+		}
+	}
+
+	opts := protosort.Options{Check: true, Verify: true, Verifier: protosort.VerifierProtoc, ProtocPath: stub, Quiet: true}
+	if code := processFiles(files, opts, nil, nil, nil, nil); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+}
+
+func TestProcessFiles_VerifyCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	stub, runs := writeStubProtoc(t, tmpDir)
+	file := filepath.Join(tmpDir, "api.proto")
+	unsorted := "syntax = \"proto3\";\n\nmessage B { string v = 1; }\n\nmessage A { string v = 1; }\n"
+	if err := os.WriteFile(file, []byte(unsorted), 0644); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+	cachePath := filepath.Join(tmpDir, verifyCacheFile)
+	opts := protosort.Options{Check: true, Verify: true, Verifier: protosort.VerifierProtoc, ProtocPath: stub, Quiet: true}
+
+	for i, want := range []int{2, 2} {
+		if code := processFiles([]string{file}, opts, loadVerifyCache(cachePath, opts), nil, nil, nil); code != 1 {
+			t.Errorf("run %d: expected exit code 1, got %d", i+1, code)
+		}
+		if n := runs(); n != want {
+			t.Errorf("run %d: expected %d protoc runs in total, got %d", i+1, want, n)
+		}
+	}
+
+	// Different options miss the cache, as does --no-cache (a nil cache)
+	opts.SortRPCs = "alpha"
+	processFiles([]string{file}, opts, loadVerifyCache(cachePath, opts), nil, nil, nil)
+	processFiles([]string{file}, opts, nil, nil, nil, nil)
+	if n := runs(); n != 6 {
+		t.Errorf("expected protoc to run again, got %d runs in total", n)
+	}
+}
+
+func TestProcessFiles_Metrics(t *testing.T) {
+	tmpDir := t.TempDir()
+	stub, _ := writeStubProtoc(t, tmpDir)
+	contents := map[string]string{
+		"changed.proto": "syntax = \"proto3\";\n\noption go_package = \"x\";\noption go_package = \"x\";\n\nmessage B { A a = 1; }\n\nmessage A { string v = 1; }\n\nmessage C { string v = 1; }\n",
+		"sorted.proto":  "syntax = \"proto3\";\n\nmessage A { string v = 1; }\n",
+		"broken.proto":  "syntax = \"proto2\";\n\nmessage A { optional string v = 1; }\n",
+	}
+	var files []string
+	for _, name := range []string{"broken.proto", "changed.proto", "sorted.proto"} {
+		f := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(f, []byte(contents[name]), 0644); err != nil {
+			t.Fatalf("writing test file: %v", err)
+		}
+		files = append(files, f)
+	}
+
+	metrics := newRunMetrics()
+	opts := protosort.Options{Check: true, Verify: true, Verifier: protosort.VerifierProtoc, ProtocPath: stub}
+	if code := processFiles(files, opts, nil, nil, metrics, nil); code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+	path := filepath.Join(tmpDir, "metrics.prom")
+	if err := metrics.write(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, want := range []string{
+		"# TYPE protosort_files_processed_total counter\nprotosort_files_processed_total 3\n",
+		"protosort_files_changed_total 1\n",
+		"protosort_files_failed_total{code=\"3\"} 1\n",
+		"protosort_warnings_total{code=\"duplicate\"} 1\n",
+		"# TYPE protosort_verify_duration_seconds histogram\n",
+		"protosort_verify_duration_seconds_bucket{le=\"+Inf\"} 1\n",
+		"protosort_verify_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q:\n%s", want, out)
+		}
+	}
+	assertOrder(t, out, `le="0.005"`, `le="0.5"`, `le="10"`, `le="+Inf"`)
+}
+
+func TestProcessFiles_CheckLevel(t *testing.T) {
+	sorted := "syntax = \"proto3\";\n\nmessage A {\n  string v = 1;\n}\n\nmessage B {\n  string v = 1;\n}\n"
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"order.proto":  strings.Replace(sorted, "message A", "message C", 1),
+		"indent.proto": strings.ReplaceAll(sorted, "  string", "    string"),
+		"blank.proto":  strings.Replace(sorted, "}\n\nmessage B", "}\n\n\nmessage B", 1),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{"order.proto": "semantic", "indent.proto": "cosmetic", "blank.proto": "all"} {
+		content := files[name]
+		out, _, err := protosort.Sort(content, protosort.Options{Quiet: true, Indent: "2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := changeLevel(content, out); got != want {
+			t.Errorf("%s: change level %q, want %q", name, got, want)
+		}
+	}
+
+	for level, want := range map[string]int{"semantic": 1, "cosmetic": 1, "all": 1} {
+		opts := protosort.Options{Check: true, CheckLevel: level, Quiet: true, Indent: "2"}
+		if code := processFiles([]string{filepath.Join(tmpDir, "order.proto")}, opts, nil, nil, nil, nil); code != want {
+			t.Errorf("order.proto at level %s: exit code %d, want %d", level, code, want)
+		}
+	}
+	for level, want := range map[string]int{"semantic": 0, "cosmetic": 1, "all": 1} {
+		opts := protosort.Options{Check: true, CheckLevel: level, Quiet: true, Indent: "2"}
+		if code := processFiles([]string{filepath.Join(tmpDir, "indent.proto")}, opts, nil, nil, nil, nil); code != want {
+			t.Errorf("indent.proto at level %s: exit code %d, want %d", level, code, want)
+		}
+	}
+	for level, want := range map[string]int{"semantic": 0, "cosmetic": 0, "all": 1} {
+		opts := protosort.Options{Check: true, CheckLevel: level, Quiet: true}
+		if code := processFiles([]string{filepath.Join(tmpDir, "blank.proto")}, opts, nil, nil, nil, nil); code != want {
+			t.Errorf("blank.proto at level %s: exit code %d, want %d", level, code, want)
+		}
+	}
+}
+
+func TestCLI_FormatJSON(t *testing.T) {
+	unsorted := "syntax = \"proto3\";\n\nmessage B { A a = 1; }\n\nmessage A { string v = 1; }\n\nmessage C { string v = 1; }\n"
+	tmpDir := t.TempDir()
+	changed := filepath.Join(tmpDir, "changed.proto")
+	broken := filepath.Join(tmpDir, "broken.proto")
+	for f, content := range map[string]string{changed: unsorted, broken: "syntax = \"proto2\";\n"} {
+		if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatalf("writing test file: %v", err)
+		}
+	}
+
+	opts := protosort.Options{Check: true, Verify: true, Verifier: protosort.VerifierProtoc, Format: "json", ProtocPath: "protoc-not-installed"}
+	var code int
+	out := captureStdout(t, func() {
+		code = processFiles([]string{changed, broken}, opts, nil, nil, nil, nil)
+	})
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+
+	var report runReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out)
+	}
+	if report.ExitCode != 3 || len(report.Files) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	got := report.Files[0]
+	if got.Path != changed || !got.Changed || got.ChangedLine != 3 || got.ExitCode != 1 || got.Verify != "skipped" {
+		t.Errorf("changed file: %+v", got)
+	}
+	wantTypes := []classifiedDecl{
+		{Kind: "message", Name: "C", Section: "unreferenced", Line: 7},
+		{Kind: "message", Name: "B", Section: "core", Line: 3},
+		{Kind: "message", Name: "A", Section: "helper", Consumer: "B", Line: 5, HelperChain: []string{"A", "B"}},
+	}
+	if !reflect.DeepEqual(got.Types, wantTypes) {
+		t.Errorf("types = %+v, want %+v", got.Types, wantTypes)
+	}
+
+	if got := report.Files[1]; got.ExitCode != 3 || got.Error == "" || got.Changed {
+		t.Errorf("proto2 file: %+v", got)
+	}
+}
+
+func TestCLI_SkipFile(t *testing.T) {
+	content := "// protosort:skip-file\nsyntax = \"proto3\";\n\nmessage B { string v = 1; }\n\nmessage A { string v = 1; }\n"
+	file := filepath.Join(t.TempDir(), "gen.proto")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	for _, opts := range []protosort.Options{{Check: true}, {Write: true}, {Diff: true}} {
+		var code int
+		out := captureStdout(t, func() {
+			code = processFiles([]string{file}, opts, nil, nil, nil, nil)
+		})
+		if code != 0 || out != "" {
+			t.Errorf("%+v: exit code %d, output %q", opts, code, out)
+		}
+	}
+	if got, _ := os.ReadFile(file); string(got) != content {
+		t.Error("skipped file was rewritten")
+	}
+
+	var report runReport
+	out := captureStdout(t, func() {
+		processFiles([]string{file}, protosort.Options{Check: true, Format: "json"}, nil, nil, nil, nil)
+	})
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out)
+	}
+	if got := report.Files[0]; !got.Skipped || got.Changed || got.ExitCode != 0 {
+		t.Errorf("unexpected report: %+v", got)
+	}
+}
+
+func TestCLI_FormatSARIF(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Res { string v = 1; }
+
+message Req { string v = 1; }
+
+message Orphan { string v = 1; }
+
+service S {
+  rpc Do(Req) returns (Res);
+}
+`
+	file := filepath.Join(t.TempDir(), "api.proto")
+	if err := os.WriteFile(file, []byte(input), 0644); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	var code int
+	out := captureStdout(t, func() {
+		code = processFiles([]string{file}, protosort.Options{Check: true, Format: "sarif"}, nil, nil, nil, nil)
+	})
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+
+	var log sarifLog
+	if err := json.Unmarshal([]byte(out), &log); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("unexpected log: %+v", log)
+	}
+	var got []string
+	for _, r := range log.Runs[0].Results {
+		loc := r.Locations[0].PhysicalLocation
+		got = append(got, r.RuleID+"@"+strconv.Itoa(loc.Region.StartLine))
+		if loc.ArtifactLocation.URI != filepath.ToSlash(file) {
+			t.Errorf("uri = %q", loc.ArtifactLocation.URI)
+		}
+	}
+	want := []string{ruleWouldChange + "@3", ruleUnreferenced + "@7"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+}
+
+func TestCLI_WarningLines(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.proto")
+	bad := filepath.Join(dir, "bad.proto")
+	os.WriteFile(good, []byte("syntax = \"proto3\";\n\nmessage Big {\n  string a = 1;\n  string b = 2;\n}\n"), 0644)
+	os.WriteFile(bad, []byte("syntax = \"proto3\";\n\nnot a declaration\n"), 0644)
+
+	opts := protosort.Options{Check: true, Format: "sarif", MaxFieldsPerMessage: 1}
+	out := captureStdout(t, func() {
+		processFiles([]string{good, bad}, opts, nil, nil, nil, nil)
+	})
+	var log sarifLog
+	if err := json.Unmarshal([]byte(out), &log); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out)
+	}
+	var got []string
+	for _, r := range log.Runs[0].Results {
+		got = append(got, r.RuleID+"@"+strconv.Itoa(r.Locations[0].PhysicalLocation.Region.StartLine))
+	}
+	want := []string{ruleWarning + "@3", ruleUnreferenced + "@3", ruleError + "@3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+}
+
+func TestSortCache_Duplicates(t *testing.T) {
+	input := `syntax = "proto3";
+
+message B { string v = 1; }
+
+message A { string v = 1; }
+`
+	cache := newSortCache()
+	first, _, err := cache.sort("a/x.proto", input, protosort.Options{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.sort("b/y.proto", input+"\n", protosort.Options{Quiet: true})
+	dup, _, _ := cache.sort("vendor/a/x.proto", input, protosort.Options{Quiet: true})
+	if dup != first {
+		t.Errorf("cached result differs:\n%s", dup)
+	}
+
+	var buf strings.Builder
+	writeDuplicateReport(&buf, cache.duplicates)
+	want := "1 duplicate file(s) sorted once:\n  vendor/a/x.proto (same as a/x.proto)\n"
+	if buf.String() != want {
+		t.Errorf("report = %q, want %q", buf.String(), want)
+	}
+}
+
+// ============================================================
+// Parity tests
+// ============================================================
+
+func TestParity_Compare(t *testing.T) {
+	v1 := map[string][]string{
+		"service.proto": {"service S", "message A", "message B", "message C", "enum Retired"},
+		"common.proto":  {"message Shared"},
+	}
+	v2 := map[string][]string{
+		"service.proto": {"service S", "message B", "message A", "message C", "message Zed"},
+		"types.proto":   {"message Shared"},
+	}
+	result := compareParity(v1, v2)
+
+	if want := []parityDecl{{Key: "enum Retired", File: "service.proto"}}; !reflect.DeepEqual(result.OnlyLeft, want) {
+		t.Errorf("OnlyLeft = %v, want %v", result.OnlyLeft, want)
+	}
+	if want := []parityDecl{{Key: "message Zed", File: "service.proto"}}; !reflect.DeepEqual(result.OnlyRight, want) {
+		t.Errorf("OnlyRight = %v, want %v", result.OnlyRight, want)
+	}
+	// Shared moved files but exists in both; only one of A and B is out of order
+	if want := map[string][]string{"service.proto": {"message A"}}; !reflect.DeepEqual(result.Misordered, want) {
+		t.Errorf("Misordered = %v, want %v", result.Misordered, want)
+	}
+
+	if !compareParity(v1, v1).empty() {
+		t.Error("a tree compared with itself should have no differences")
+	}
+}
+
+// ============================================================
+// Estimate tests
+// ============================================================
+
+func TestClassifyImage(t *testing.T) {
+	msg := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	ref := func(name, typeName string) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(1),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+			TypeName: proto.String(typeName),
+		}
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		{Name: proto.String("google/protobuf/empty.proto"), Package: proto.String("google.protobuf"), MessageType: []*descriptorpb.DescriptorProto{msg("Empty")}},
+		{
+			Name:    proto.String("acme/things.proto"),
+			Package: proto.String("acme.v1"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{
+				msg("Thing", ref("part", ".acme.v1.Part")),
+				msg("Part"),
+				msg("GetThingRequest"),
+				msg("Orphan"),
+			},
+			Service: []*descriptorpb.ServiceDescriptorProto{{
+				Name: proto.String("Things"),
+				Method: []*descriptorpb.MethodDescriptorProto{{
+					Name:       proto.String("GetThing"),
+					InputType:  proto.String(".acme.v1.GetThingRequest"),
+					OutputType: proto.String(".acme.v1.Thing"),
+				}},
+			}},
+		},
+	}}
+	dir := t.TempDir()
+	binary, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := protojson.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "image.binpb"), binary, 0644)
+	os.WriteFile(filepath.Join(dir, "image.json"), text, 0644)
+
+	for _, image := range []string{"image.binpb", "image.json"} {
+		var code int
+		out := captureStdout(t, func() {
+			code = runClassifyImage([]string{filepath.Join(dir, image)}, nil, protosort.Options{Format: "json"})
+		})
+		if code != 0 {
+			t.Fatalf("%s: exit code %d", image, code)
+		}
+		var dump astDump
+		if err := json.Unmarshal([]byte(out), &dump); err != nil {
+			t.Fatalf("%s: invalid JSON: %v\n%s", image, err, out)
+		}
+		if len(dump.Files) != 1 || dump.Files[0].File != "acme/things.proto" {
+			t.Fatalf("%s: expected only acme/things.proto, got %+v", image, dump.Files)
+		}
+		var got []string
+		for _, b := range dump.Files[0].Blocks {
+			if b.Kind != "syntax" && b.Kind != "package" {
+				got = append(got, b.Name+" "+b.Section)
+			}
+		}
+		want := []string{"Thing request/response", "Part request/response", "GetThingRequest request/response", "Orphan unreferenced", "Things service"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: classified as %q, want %q", image, got, want)
+		}
+	}
+
+	// --package selects files, well-known types included
+	out := captureStdout(t, func() {
+		runClassifyImage([]string{filepath.Join(dir, "image.binpb")}, []string{"google.*"}, protosort.Options{})
+	})
+	if !strings.HasPrefix(out, "google/protobuf/empty.proto\n") || strings.Contains(out, "acme") {
+		t.Errorf("expected only the well-known file:\n%s", out)
+	}
+
+	os.WriteFile(filepath.Join(dir, "bad.binpb"), []byte("not a descriptor set"), 0644)
+	captureStdout(t, func() {
+		if code := runClassifyImage([]string{filepath.Join(dir, "bad.binpb")}, nil, protosort.Options{}); code != 3 {
+			t.Errorf("exit code %d for a bad image, want 3", code)
+		}
+	})
+}
+
+func TestAST_JSON(t *testing.T) {
+	content := `syntax = "proto3";
+
+package acme.v1;
+
+// Looks up a thing.
+service Things {
+  rpc GetThing(GetThingRequest) returns (Thing);
+}
+
+message GetThingRequest { string name = 1; }
+
+message Thing { Kind kind = 1; }
+
+enum Kind { KIND_UNSPECIFIED = 0; }
+`
+	f, err := astOf(content, protosort.Options{SharedOrder: "alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(astDump{SchemaVersion: astSchemaVersion, Files: []astFile{f}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump struct {
+		SchemaVersion int `json:"schema_version"`
+		Files         []struct {
+			Blocks []struct {
+				Kind     string `json:"kind"`
+				Name     string `json:"name"`
+				Line     int    `json:"line"`
+				Section  string `json:"section"`
+				Consumer string `json:"consumer"`
+				Comments string `json:"comments"`
+				RPCs     []struct {
+					Name     string `json:"name"`
+					Request  string `json:"request"`
+					Response string `json:"response"`
+				} `json:"rpcs"`
+			} `json:"blocks"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(data, &dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump.SchemaVersion != 1 || len(dump.Files) != 1 {
+		t.Fatalf("unexpected dump: %s", data)
+	}
+	var got []string
+	for _, b := range dump.Files[0].Blocks {
+		got = append(got, strings.Join([]string{strconv.Itoa(b.Line), b.Kind, b.Name, b.Section, b.Consumer}, " "))
+	}
+	want := []string{
+		"1 syntax proto3 header ",
+		"3 package acme.v1 header ",
+		"6 service Things service ",
+		"10 message GetThingRequest request/response GetThing",
+		"12 message Thing request/response GetThing",
+		"14 enum Kind request/response GetThing",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("blocks:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	service := dump.Files[0].Blocks[2]
+	if !strings.Contains(service.Comments, "// Looks up a thing.") {
+		t.Errorf("service comments: %q", service.Comments)
+	}
+	if len(service.RPCs) != 1 || service.RPCs[0].Request != "GetThingRequest" || service.RPCs[0].Response != "Thing" {
+		t.Errorf("service rpcs: %+v", service.RPCs)
+	}
+}
+
+func TestEstimate_Report(t *testing.T) {
+	original := "syntax = \"proto3\";\n\nmessage B { string v = 1; }\n\nmessage A { string v = 1; }\n"
+	sorted, _, err := protosort.Sort(original, protosort.Options{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := protosort.MovedLines(original, sorted); got != 2 {
+		t.Errorf("MovedLines: want 2, got %d", got)
+	}
+	if got := protosort.MovedLines(sorted, sorted); got != 0 {
+		t.Errorf("MovedLines on unchanged input: want 0, got %d", got)
+	}
+
+	var buf strings.Builder
+	writeEstimateReport(&buf, map[string]*dirEstimate{
+		"b": {Files: 2, Changed: 1, Lines: 40, MovedLines: 6},
+		"a": {Files: 1, Changed: 0, Lines: 10},
+	})
+	report := buf.String()
+	assertOrder(t, report, "DIRECTORY", "a ", "b ", "TOTAL")
+	if !strings.Contains(report, "TOTAL      3      1        6            50") {
+		t.Errorf("unexpected total row:\n%s", report)
+	}
+}
+
+func TestOwnership_Report(t *testing.T) {
+	var buf strings.Builder
+	writeOwnershipReport(&buf, []packageOwnership{{
+		Package: "acme.v1",
+		Owned:   map[string][]string{"Trips": {"Trip"}, "Billing": {}},
+		Shared:  map[string][]string{"Money": {"Billing", "Trips"}},
+		Unowned: []string{"Orphan"},
+	}})
+	want := `package acme.v1
+  service Billing (0)
+  service Trips (1)
+    Trip
+  shared (1)
+    Money: Billing, Trips
+  unowned (1)
+    Orphan
+`
+	if got := buf.String(); got != want {
+		t.Errorf("report:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestInit_Config(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"proto/api/v1/svc.proto":    "syntax = \"proto3\";\npackage api.v1;\nimport \"api/v1/common.proto\";\n\n// === Types ===\nmessage B {\n  Common c = 1;\n}\n",
+		"proto/api/v1/common.proto": "syntax = \"proto3\";\npackage api.v1;\n\nmessage Common {\n  string v = 1;\n}\n",
+		"proto/gen.proto":           "// Code generated by protoc-gen-x. DO NOT EDIT.\nsyntax = \"proto3\";\nmessage Z {}\n",
+		"third_party/g/g.proto":     "syntax = \"proto3\";\nmessage G {}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := protosort.Options{Quiet: true, Recursive: true}
+	found, err := collectFiles([]string{dir}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := inferProfile(dir, found, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.sortable) != 2 || p.dividers != 1 || p.indent != protosort.IndentSpaces {
+		t.Errorf("profile: %d sortable, %d with dividers, indent %q", len(p.sortable), p.dividers, p.indent)
+	}
+
+	path := filepath.Join(dir, initConfigFile)
+	if err := os.WriteFile(path, []byte(p.config()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := protosort.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("written config does not load: %v\n%s", err, p.config())
+	}
+	if want := []string{"proto/gen.proto", "third_party/"}; !reflect.DeepEqual(cfg.Exclude, want) {
+		t.Errorf("exclude: want %q, got %q", want, cfg.Exclude)
+	}
+	if want := []string{"proto"}; !reflect.DeepEqual(cfg.Verify.ProtoPaths, want) {
+		t.Errorf("proto_paths: want %q, got %q", want, cfg.Verify.ProtoPaths)
+	}
+	if cfg.Ordering.PreserveDividers == nil || !*cfg.Ordering.PreserveDividers {
+		t.Error("preserve_dividers: want true")
+	}
+
+	if code := runInit([]string{dir}, opts); code != 4 {
+		t.Errorf("init over an existing config: want exit 4, got %d", code)
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	dir := t.TempDir()
+	unsorted := "syntax = \"proto3\";\n\nmessage B {\n  string w = 2;\n  string v = 1;\n}\n\nmessage A { string v = 1; }\n"
+	sorted := "syntax = \"proto3\";\n\nmessage A { string v = 1; }\n\nmessage B {\n  string w = 2;\n  string v = 1;\n}\n"
+	files := map[string]string{
+		"plain_input.proto":     unsorted,
+		"plain_expected.proto":  strings.ReplaceAll(sorted, "\n", "\r\n"),
+		"fields_input.proto":    unsorted,
+		"fields_expected.proto": strings.Replace(sorted, "  string w = 2;\n  string v = 1;", "  string v = 1;\n  string w = 2;", 1),
+		"fields_options.toml":   "[ordering]\nsort_fields = true\n",
+		"stale_input.proto":     unsorted,
+		"stale_expected.proto":  unsorted,
+		"proto2_input.proto":    "syntax = \"proto2\";\n",
+		"proto2_expected.proto": "syntax = \"proto2\";\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var results []fixtureResult
+	for _, name := range []string{"plain", "fields", "stale", "proto2"} {
+		results = append(results, runFixture(filepath.Join(dir, name), protosort.Options{SharedOrder: "alpha"}))
+	}
+	if codes := []int{results[0].Code, results[1].Code, results[2].Code, results[3].Code}; !reflect.DeepEqual(codes, []int{0, 0, 1, 3}) {
+		t.Errorf("exit codes %v, want [0 0 1 3]: %+v", codes, results)
+	}
+	if !strings.Contains(results[2].Diff, "+message A") {
+		t.Errorf("expected a diff for the stale fixture, got %q", results[2].Diff)
+	}
+
+	var out strings.Builder
+	if code := writeFixtureReport(&out, results); code != 3 {
+		t.Errorf("report exit code %d, want 3", code)
+	}
+	assertOrder(t, out.String(), "ok    plain", "ok    fields", "FAIL  stale", "ERROR proto2", "2 passed, 2 failed")
+
+	if code := runFixtures(t.TempDir(), protosort.Options{}); code != 4 {
+		t.Errorf("empty fixture directory: want exit 4, got %d", code)
+	}
+}
+
+// ============================================================
+// Config schema tests
+// ============================================================
+
+func TestConfigSchema(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	defineFlags(fs, &protosort.Options{}, &cliFlags{})
+	schema, err := protosort.ConfigSchema(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ordering := schema["properties"].(map[string]any)["ordering"].(map[string]any)
+	shared := ordering["properties"].(map[string]any)["shared_order"].(map[string]any)
+	if shared["default"] != "alpha" {
+		t.Errorf("shared_order default = %v, want alpha", shared["default"])
+	}
+	if shared["x-flag"] != "--shared-order" {
+		t.Errorf("shared_order x-flag = %v, want --shared-order", shared["x-flag"])
+	}
+	if !reflect.DeepEqual(shared["enum"], []string{"alpha", "dependency"}) {
+		t.Errorf("shared_order enum = %v", shared["enum"])
+	}
+
+	var check func(path string, props map[string]any)
+	check = func(path string, props map[string]any) {
+		for key, p := range props {
+			prop := p.(map[string]any)
+			if prop["description"] == nil {
+				t.Errorf("%s%s has no description", path, key)
+			}
+			if sub, ok := prop["properties"].(map[string]any); ok {
+				check(path+key+".", sub)
+			}
+		}
+	}
+	check("", schema["properties"].(map[string]any))
+}
+
+// ============================================================
+// Serve tests
+// ============================================================
+
+func TestServe_Endpoints(t *testing.T) {
+	srv := httptest.NewServer(newServeMux(protosort.Options{SharedOrder: "alpha"}))
+	defer srv.Close()
+
+	post := func(path string, req any) (int, map[string]any) {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		resp, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatalf("%s: decoding response: %v", path, err)
+		}
+		return resp.StatusCode, out
+	}
+
+	unsorted := map[string]any{"content": `syntax = "proto3";
+
+message B { string v = 1; }
+
+message A { string v = 1; }
+`}
+
+	code, out := post("/sort", unsorted)
+	if code != http.StatusOK || out["changed"] != true {
+		t.Fatalf("/sort: status %d, body %v", code, out)
+	}
+	assertOrder(t, out["sorted"].(string), "message A", "message B")
+
+	code, out = post("/check", unsorted)
+	if code != http.StatusOK || out["changed"] != true || !strings.Contains(out["diff"].(string), "+message B") {
+		t.Errorf("/check: status %d, body %v", code, out)
+	}
+
+	code, out = post("/classify", map[string]any{"content": `service S { rpc Get(Req) returns (Res); }
+message Res {}
+message Req {}
+`})
+	if code != http.StatusOK {
+		t.Fatalf("/classify: status %d, body %v", code, out)
+	}
+	decls := out["declarations"].([]any)
+	if len(decls) != 3 || decls[1].(map[string]any)["name"] != "Req" || decls[1].(map[string]any)["section"] != "request/response" {
+		t.Errorf("/classify: %v", decls)
+	}
+
+	// Per-request config is validated like the CLI's flags
+	code, out = post("/sort", map[string]any{
+		"content": `syntax = "proto3";`,
+		"config":  map[string]any{"ordering": map[string]any{"shared_order": "bogus"}},
+	})
+	if code != http.StatusBadRequest {
+		t.Errorf("invalid config: status %d, body %v", code, out)
+	}
+
+	// A request can't make the server read a file, nor learn whether it
+	// exists
+	secret := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(secret, []byte("do not serve me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []map[string]any{
+		{"license": map[string]any{"template": secret}},
+		{"extends": secret},
+		{"exception": []any{map[string]any{"file": secret, "expires": "2099-01-01"}}},
+		{"verify": map[string]any{"proto_paths": []any{filepath.Dir(secret)}}},
+	} {
+		code, out = post("/sort", map[string]any{"content": `syntax = "proto3";`, "config": config})
+		if code != http.StatusBadRequest || strings.Contains(out["error"].(string), "do not serve me") {
+			t.Errorf("config %v: status %d, body %v", config, code, out)
+		}
+	}
+
+	code, out = post("/sort", map[string]any{"content": `syntax = "proto2";`})
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("proto2: status %d, body %v", code, out)
+	}
+
+	resp, err := http.Get(srv.URL + "/sort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /sort: status %d, want 405", resp.StatusCode)
+	}
+}
+
+// ============================================================
+// Helpers
+// ============================================================
+
+// assertOrder verifies that the given substrings appear in order within text.
+func assertOrder(t *testing.T, text string, substrs ...string) {
+	t.Helper()
+	prev := -1
+	prevStr := ""
+	for _, s := range substrs {
+		idx := strings.Index(text[prev+1:], s)
+		if idx < 0 {
+			t.Errorf("substring %q not found after %q in:\n%s", s, prevStr, text)
+			return
+		}
+		absIdx := prev + 1 + idx
+		prev = absIdx
+		prevStr = s
+	}
+}
+
+// captureStdout returns what fn prints to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestInternalError(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	input := "syntax = \"proto3\";\n\nmessage SecretTrip {\n  string driver = 1;\n}\n"
+	err := newInternalError("index out of range", input)
+
+	if !strings.Contains(err.Error(), "internal error: index out of range") || !strings.Contains(err.Error(), issuesURL) {
+		t.Errorf("error = %q, want the panic and where to report it", err)
+	}
+	if err.report == "" || !strings.Contains(err.Error(), err.report) {
+		t.Fatalf("error = %q, want it to name the bug report", err)
+	}
+	data, readErr := os.ReadFile(err.report)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	report := string(data)
+	if !strings.Contains(report, "// protosort") || !strings.Contains(report, "message ") {
+		t.Errorf("report missing header or content:\n%s", report)
+	}
+	if strings.Contains(report, "SecretTrip") || strings.Contains(report, "driver") {
+		t.Errorf("report isn't anonymized:\n%s", report)
+	}
+	if _, _, err := safeSort(input, protosort.Options{Quiet: true}); err != nil {
+		t.Errorf("safeSort: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// verifyDurationBuckets are the upper bounds, in seconds, of the verify
+// duration histogram: Prometheus's default buckets.
+var verifyDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// runMetrics counts what a run did, for --metrics-file. A nil runMetrics
+// records nothing.
+type runMetrics struct {
+	mu        sync.Mutex
+	processed int
+	changed   int
+	failed    map[int]int    // files by exit code, for codes 2 and up
+	warnings  map[string]int // warnings by Warning.Code
+
+	// verifyCounts holds the number of verifications in each bucket of
+	// verifyDurationBuckets, not cumulatively; the last count is for those
+	// longer than every bound.
+	verifyCounts []int
+	verifySum    float64
+}
+
+// newRunMetrics returns empty metrics.
+func newRunMetrics() *runMetrics {
+	return &runMetrics{
+		failed:       make(map[int]int),
+		warnings:     make(map[string]int),
+		verifyCounts: make([]int, len(verifyDurationBuckets)+1),
+	}
+}
+
+// file records the outcome of p, which was reported with exit code code.
+func (m *runMetrics) file(p *pendingFile, code int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.processed++
+	if code >= 2 {
+		m.failed[code]++
+	}
+	if p.code == 0 && p.original != p.sorted {
+		m.changed++
+	}
+	for _, w := range p.warnings {
+		m.warnings[w.Code]++
+	}
+}
+
+// verify records a verification, of one file or of a --verify batch, that
+// started at start.
+func (m *runMetrics) verify(start time.Time) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, _ := slices.BinarySearch(verifyDurationBuckets, d)
+	m.verifyCounts[i]++
+	m.verifySum += d
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format.
+func (m *runMetrics) writeTo(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP protosort_files_processed_total Files read and sorted.")
+	fmt.Fprintln(w, "# TYPE protosort_files_processed_total counter")
+	fmt.Fprintf(w, "protosort_files_processed_total %d\n", m.processed)
+	fmt.Fprintln(w, "# HELP protosort_files_changed_total Files whose sorted output differs from their content.")
+	fmt.Fprintln(w, "# TYPE protosort_files_changed_total counter")
+	fmt.Fprintf(w, "protosort_files_changed_total %d\n", m.changed)
+	fmt.Fprintln(w, "# HELP protosort_files_failed_total Files that failed, by exit code.")
+	fmt.Fprintln(w, "# TYPE protosort_files_failed_total counter")
+	for _, code := range slices.Sorted(maps.Keys(m.failed)) {
+		fmt.Fprintf(w, "protosort_files_failed_total{code=\"%d\"} %d\n", code, m.failed[code])
+	}
+	fmt.Fprintln(w, "# HELP protosort_warnings_total Warnings, by code.")
+	fmt.Fprintln(w, "# TYPE protosort_warnings_total counter")
+	for _, code := range slices.Sorted(maps.Keys(m.warnings)) {
+		fmt.Fprintf(w, "protosort_warnings_total{code=%q} %d\n", code, m.warnings[code])
+	}
+
+	fmt.Fprintln(w, "# HELP protosort_verify_duration_seconds Time spent verifying a file, or a --verify batch.")
+	fmt.Fprintln(w, "# TYPE protosort_verify_duration_seconds histogram")
+	count := 0
+	for i, bound := range verifyDurationBuckets {
+		count += m.verifyCounts[i]
+		fmt.Fprintf(w, "protosort_verify_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	count += m.verifyCounts[len(verifyDurationBuckets)]
+	fmt.Fprintf(w, "protosort_verify_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "protosort_verify_duration_seconds_sum %s\n", strconv.FormatFloat(m.verifySum, 'g', -1, 64))
+	_, err := fmt.Fprintf(w, "protosort_verify_duration_seconds_count %d\n", count)
+	return err
+}
+
+// write replaces the file at path with the metrics. The file is renamed
+// into place so that a collector never reads it half-written, and is
+// readable by others, like a node_exporter running as another user.
+func (m *runMetrics) write(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".protosort-metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := m.writeTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// warningBaseline implements --new-warnings-only: each file is also sorted
+// as it was at a base revision, and what was reported there already is
+// left out, so that CI annotates only what a change introduced.
+type warningBaseline struct {
+	rev string // merge base of the --against ref and HEAD
+}
+
+// newWarningBaseline resolves the revision --against compares with: the
+// merge base of against and HEAD, as for --changed.
+func newWarningBaseline(against string) (*warningBaseline, error) {
+	mergeBase, err := git("merge-base", against, "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("--against: %w", err)
+	}
+	return &warningBaseline{rev: strings.TrimSpace(mergeBase)}, nil
+}
+
+// filter drops p's warnings that the base revision of its file has as
+// well, and records the types that were unreferenced there, whose SARIF
+// notes are then left out. A file that's new since the base revision
+// keeps everything. It does nothing on a nil baseline.
+func (b *warningBaseline) filter(p *pendingFile) {
+	if b == nil || p.code != 0 {
+		return
+	}
+	// The base revision is only context; if analyzing it panics, every
+	// warning is reported
+	defer func() {
+		if recover() != nil {
+			p.knownUnreferenced = nil
+		}
+	}()
+	p.knownUnreferenced = make(map[string]bool)
+	base, ok := b.content(p.file)
+	if !ok {
+		return
+	}
+
+	_, baseWarnings, err := safeSort(base, p.opts)
+	if err == nil {
+		// Counted, so that a second copy of a known warning is reported
+		known := make(map[string]int)
+		for _, w := range baseWarnings {
+			known[w.Code+"\x00"+w.Message]++
+		}
+		var kept []protosort.Warning
+		for _, w := range p.warnings {
+			if key := w.Code + "\x00" + w.Message; known[key] > 0 {
+				known[key]--
+				continue
+			}
+			kept = append(kept, w)
+		}
+		p.warnings = kept
+	}
+
+	if blocks, err := protosort.ScanFile(base); err == nil {
+		for _, d := range classifyDecls(blocks, p.opts) {
+			if d.Section == "unreferenced" {
+				p.knownUnreferenced[d.Kind+" "+d.Name] = true
+			}
+		}
+	}
+}
+
+// content returns file as it was at the base revision, and false when it
+// didn't exist there.
+func (b *warningBaseline) content(file string) (string, bool) {
+	rel := file
+	if filepath.IsAbs(file) {
+		abs, err := filepath.Abs(".")
+		if err != nil {
+			return "", false
+		}
+		if rel, err = filepath.Rel(abs, file); err != nil {
+			return "", false
+		}
+	}
+	// ./ makes the path relative to the working directory, not the
+	// repository root
+	out, err := git("show", b.rev+":./"+filepath.ToSlash(rel))
+	if err != nil {
+		return "", false
+	}
+	return out, true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// packageOwnership is the ownership report for one proto package.
+type packageOwnership struct {
+	Package string              `json:"package"`
+	Files   []string            `json:"files"`
+	Owned   map[string][]string `json:"owned"`  // service -> types only it reaches
+	Shared  map[string][]string `json:"shared"` // type -> services reaching it
+	Unowned []string            `json:"unowned"`
+}
+
+// runOwnership groups the types of each package in files by the services
+// that reach them (see protosort.ServiceOwnership) and prints the result,
+// as JSON with --format json. Nothing is written.
+func runOwnership(files []string, opts protosort.Options) int {
+	exitCode := 0
+	byPackage := make(map[string][]*protosort.Block)
+	filesOf := make(map[string][]string)
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading %s: %v\n", file, err)
+			exitCode = 4
+			continue
+		}
+		blocks, err := protosort.ScanFile(string(content))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", file, &protosort.ParseError{Err: err})
+			exitCode = max(exitCode, 3)
+			continue
+		}
+		pkg := ""
+		for _, b := range blocks {
+			if b.Kind == protosort.BlockPackage {
+				pkg = b.Name
+			}
+		}
+		byPackage[pkg] = append(byPackage[pkg], blocks...)
+		filesOf[pkg] = append(filesOf[pkg], file)
+	}
+
+	pkgs := make([]string, 0, len(byPackage))
+	for pkg := range byPackage {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	report := make([]packageOwnership, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		o := protosort.ServiceOwnership(byPackage[pkg])
+		// Empty lists are written as [] rather than null
+		for svc, types := range o.Owned {
+			if types == nil {
+				o.Owned[svc] = []string{}
+			}
+		}
+		if o.Unowned == nil {
+			o.Unowned = []string{}
+		}
+		report = append(report, packageOwnership{
+			Package: pkg,
+			Files:   filesOf[pkg],
+			Owned:   o.Owned,
+			Shared:  o.Shared,
+			Unowned: o.Unowned,
+		})
+	}
+
+	if opts.Format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 4
+		}
+		return exitCode
+	}
+	writeOwnershipReport(os.Stdout, report)
+	return exitCode
+}
+
+// writeOwnershipReport prints, per package, each service with the types it
+// owns, then the shared types with the services that reach them, then the
+// types no service reaches.
+func writeOwnershipReport(w io.Writer, report []packageOwnership) {
+	for i, p := range report {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		name := p.Package
+		if name == "" {
+			name = "(no package)"
+		}
+		fmt.Fprintf(w, "package %s\n", name)
+
+		services := make([]string, 0, len(p.Owned))
+		for svc := range p.Owned {
+			services = append(services, svc)
+		}
+		sort.Strings(services)
+		for _, svc := range services {
+			fmt.Fprintf(w, "  service %s (%d)\n", svc, len(p.Owned[svc]))
+			for _, t := range p.Owned[svc] {
+				fmt.Fprintf(w, "    %s\n", t)
+			}
+		}
+
+		shared := make([]string, 0, len(p.Shared))
+		for t := range p.Shared {
+			shared = append(shared, t)
+		}
+		sort.Strings(shared)
+		if len(shared) > 0 {
+			fmt.Fprintf(w, "  shared (%d)\n", len(shared))
+			for _, t := range shared {
+				fmt.Fprintf(w, "    %s: %s\n", t, strings.Join(p.Shared[t], ", "))
+			}
+		}
+		if len(p.Unowned) > 0 {
+			fmt.Fprintf(w, "  unowned (%d)\n", len(p.Unowned))
+			for _, t := range p.Unowned {
+				fmt.Fprintf(w, "    %s\n", t)
+			}
+		}
+	}
+}
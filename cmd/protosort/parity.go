@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// parityDecl is a message, enum, or service found in one version of an API.
+type parityDecl struct {
+	Key  string // "kind name", e.g. "message GetTripRequest"
+	File string // path relative to the version root
+}
+
+// parityResult holds the differences between two versions of an API.
+type parityResult struct {
+	OnlyLeft  []parityDecl
+	OnlyRight []parityDecl
+	// Misordered maps a file present in both versions to the declarations
+	// that appear in a different relative order there.
+	Misordered map[string][]string
+}
+
+func (r *parityResult) empty() bool {
+	return len(r.OnlyLeft) == 0 && len(r.OnlyRight) == 0 && len(r.Misordered) == 0
+}
+
+// runParity compares two versions of an API (directories, or single files)
+// and reports declarations present in only one of them and declarations
+// whose relative order differs between files of the same relative path.
+// It returns 1 when differences are found, like --check.
+func runParity(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "error: parity takes two directories or files, e.g. protosort parity api/v1 api/v2\n")
+		return 4
+	}
+
+	var trees [2]map[string][]string
+	for i, root := range args {
+		tree, err := scanParityTree(root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			var parseErr *protosort.ParseError
+			if errors.As(err, &parseErr) {
+				return 3
+			}
+			return 4
+		}
+		trees[i] = tree
+	}
+
+	result := compareParity(trees[0], trees[1])
+	writeParityReport(os.Stdout, args[0], args[1], result)
+	if result.empty() {
+		return 0
+	}
+	return 1
+}
+
+// scanParityTree returns the declaration keys of every .proto file under
+// root, in file order, keyed by path relative to root. A file root is keyed
+// by "" so that two differently named files can be compared.
+func scanParityTree(root string) (map[string][]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access %s: %w", root, err)
+	}
+
+	tree := make(map[string][]string)
+	if !info.IsDir() {
+		keys, err := scanParityFile(root)
+		if err != nil {
+			return nil, err
+		}
+		tree[""] = keys
+		return tree, nil
+	}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".proto") {
+			return nil
+		}
+		keys, err := scanParityFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		tree[filepath.ToSlash(rel)] = keys
+		return nil
+	})
+	return tree, err
+}
+
+// scanParityFile returns the keys of the messages, enums, and services in file.
+func scanParityFile(file string) ([]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	blocks, err := protosort.ScanFile(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, &protosort.ParseError{Err: err})
+	}
+	var keys []string
+	for _, b := range blocks {
+		switch b.Kind {
+		case protosort.BlockMessage, protosort.BlockEnum, protosort.BlockService:
+			keys = append(keys, b.Kind.String()+" "+b.Name)
+		}
+	}
+	return keys, nil
+}
+
+// compareParity compares two scanned trees. Presence is checked across the
+// whole tree, so a declaration moved to another file isn't reported
+// missing; order is compared within each file present in both trees.
+func compareParity(left, right map[string][]string) *parityResult {
+	result := &parityResult{Misordered: make(map[string][]string)}
+	result.OnlyLeft = missingDecls(left, right)
+	result.OnlyRight = missingDecls(right, left)
+
+	for _, file := range sortedKeys(left) {
+		rightKeys, ok := right[file]
+		if !ok {
+			continue
+		}
+		if moved := misorderedDecls(left[file], rightKeys); len(moved) > 0 {
+			result.Misordered[file] = moved
+		}
+	}
+	return result
+}
+
+// missingDecls returns the declarations in a that are nowhere in b.
+func missingDecls(a, b map[string][]string) []parityDecl {
+	inB := make(map[string]bool)
+	for _, keys := range b {
+		for _, k := range keys {
+			inB[k] = true
+		}
+	}
+	var missing []parityDecl
+	for _, file := range sortedKeys(a) {
+		for _, k := range a[file] {
+			if !inB[k] {
+				missing = append(missing, parityDecl{Key: k, File: file})
+			}
+		}
+	}
+	return missing
+}
+
+// misorderedDecls returns the declarations shared by a and b that fall
+// outside their longest common subsequence, i.e. the fewest declarations
+// that would have to move in b to match the order in a. They are listed in
+// a's order.
+func misorderedDecls(a, b []string) []string {
+	inA, inB := make(map[string]bool), make(map[string]bool)
+	for _, k := range a {
+		inA[k] = true
+	}
+	for _, k := range b {
+		inB[k] = true
+	}
+	var sharedA, sharedB []string
+	for _, k := range a {
+		if inB[k] {
+			sharedA = append(sharedA, k)
+		}
+	}
+	for _, k := range b {
+		if inA[k] {
+			sharedB = append(sharedB, k)
+		}
+	}
+
+	// lcs[i][j] is the LCS length of sharedA[i:] and sharedB[j:]
+	n, m := len(sharedA), len(sharedB)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if sharedA[i] == sharedB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	inOrder := make(map[string]bool)
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case sharedA[i] == sharedB[j]:
+			inOrder[sharedA[i]] = true
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	var moved []string
+	for _, k := range sharedA {
+		if !inOrder[k] {
+			moved = append(moved, k)
+		}
+	}
+	return moved
+}
+
+// writeParityReport prints the differences, one per line, grouped by kind.
+func writeParityReport(w io.Writer, leftRoot, rightRoot string, r *parityResult) {
+	if r.empty() {
+		fmt.Fprintf(w, "%s and %s declare the same types in the same order\n", leftRoot, rightRoot)
+		return
+	}
+	for _, d := range r.OnlyLeft {
+		fmt.Fprintf(w, "only in %s: %s (%s)\n", leftRoot, d.Key, filepath.Join(leftRoot, d.File))
+	}
+	for _, d := range r.OnlyRight {
+		fmt.Fprintf(w, "only in %s: %s (%s)\n", rightRoot, d.Key, filepath.Join(rightRoot, d.File))
+	}
+	for _, file := range sortedKeys(r.Misordered) {
+		label := file
+		if file == "" {
+			// Two single files were compared
+			label = leftRoot + " and " + rightRoot
+		}
+		fmt.Fprintf(w, "order differs in %s: %s\n", label, strings.Join(r.Misordered[file], ", "))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/tallhamn/protosort"
+)
+
+// sortAhead bounds how many files are sorted before the oldest one has been
+// reported, which keeps memory flat on large trees while verification
+// catches up. A --verify run sorts further ahead only while the oldest file
+// waits on a later file it imports.
+const sortAhead = 16
+
+// pendingFile is a sorted file waiting to be reported.
+type pendingFile struct {
+	file     string
+	mode     fs.FileMode
+	original string
+	sorted   string
+	warnings []protosort.Warning
+	code     int    // non-zero when reading or sorting failed
+	errMsg   string // message printed for a non-zero code
+	errLine  int    // 1-based line the error points at, or 0
+	stdin    bool   // read from stdin; output always goes to stdout
+	skipped  bool   // opted out with a protosort:skip-file directive
+
+	// knownUnreferenced holds "kind name" of the types that were already
+	// unreferenced at the --new-warnings-only base revision.
+	knownUnreferenced map[string]bool
+
+	// opts are the options the file was sorted and is verified with: the
+	// run's, plus defaults from its .editorconfig.
+	opts protosort.Options
+
+	// verified receives the verification result. It is nil when the file
+	// is not verified.
+	verified chan error
+}
+
+// needsVerify reports whether p should be checked by Verify.
+func (p *pendingFile) needsVerify(opts protosort.Options) bool {
+	return (opts.Verify || opts.Paranoid) && !opts.DryRun && p.code == 0 && p.original != p.sorted
+}
+
+// processFiles runs every file through sort, verify, and output and returns
+// the highest exit code. Verification runs in the background on up to
+// GOMAXPROCS files at once while later files are sorted; with --verify, a
+// directory's files are verified in one batch once the files of the run
+// they import have been sorted, so that files importing each other are
+// compiled together. Either way, output is produced in file order. A panic
+// while processing a file fails only that file, with an internalError.
+// Files with identical contents are sorted once, and the duplicates are
+// reported at the end. Files that passed verification
+// in an earlier run, per vcache, aren't verified again. With a baseline,
+// only warnings new since its revision are reported. Each file's outcome
+// is recorded in metrics. Files in staged are sorted from the content it
+// holds for them rather than from disk.
+func processFiles(files []string, opts protosort.Options, vcache *verifyCache, baseline *warningBaseline, metrics *runMetrics, staged map[string]string) int {
+	cache := newSortCache()
+	pending := make(chan *pendingFile, sortAhead)
+	go func() {
+		defer close(pending)
+		if batchVerify(opts) {
+			batches := newVerifyBatches(files, opts, vcache, metrics)
+			var sorted []*pendingFile // sorted but not yet handed to the reporter
+			for _, file := range files {
+				p := sortFile(file, opts, cache, staged)
+				baseline.filter(p)
+				if p.needsVerify(opts) {
+					p.verified = make(chan error, 1)
+					if vcache.passed(p, p.opts) {
+						p.verified <- nil
+					} else {
+						batches.add(p)
+					}
+				}
+				batches.stage(p)
+				batches.flush(false)
+				sorted = append(sorted, p)
+				for len(sorted) > 0 {
+					select {
+					case pending <- sorted[0]:
+						sorted = sorted[1:]
+						continue
+					default:
+					}
+					// The reporter may be waiting on a queued file. One that
+					// imports a file not sorted yet can't be verified, so
+					// sort on rather than wait for it.
+					if batches.flush(true) {
+						break
+					}
+					pending <- sorted[0]
+					sorted = sorted[1:]
+				}
+			}
+			batches.flush(true)
+			for _, p := range sorted {
+				pending <- p
+			}
+			return
+		}
+
+		slots := make(chan struct{}, runtime.GOMAXPROCS(0))
+		for _, file := range files {
+			p := sortFile(file, opts, cache, staged)
+			baseline.filter(p)
+			if p.needsVerify(opts) {
+				p.verified = make(chan error, 1)
+				if vcache.passed(p, p.opts) {
+					p.verified <- nil
+				} else {
+					slots <- struct{}{}
+					go func() {
+						start := time.Now()
+						err := safeVerify(p.original, p.sorted, p.opts)
+						metrics.verify(start)
+						if err == nil {
+							vcache.record(p, p.opts)
+						}
+						p.verified <- err
+						<-slots
+					}()
+				}
+			}
+			pending <- p
+		}
+	}()
+
+	var report *runReport
+	if opts.Format == "json" || opts.Format == "sarif" {
+		report = &runReport{Files: []fileReport{}}
+	}
+
+	exitCode := 0
+	for p := range pending {
+		code := finishSafely(p, opts, report)
+		metrics.file(p, code)
+		if code > exitCode {
+			exitCode = code
+		}
+	}
+
+	// The channel is closed, so the sorting goroutine is done with the
+	// caches, and every verification has been received
+	if err := vcache.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: writing %s: %v\n", vcache.path, err)
+	}
+	if report != nil {
+		report.Duplicates = cache.duplicates
+		report.ExitCode = exitCode
+		if err := writeReport(os.Stdout, report, opts.Format); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 4
+		}
+		return exitCode
+	}
+	if !opts.Quiet {
+		writeDuplicateReport(os.Stderr, cache.duplicates)
+	}
+	return exitCode
+}
+
+// batchVerify reports whether a run's files are verified in batches, which
+// the descriptor comparison needs to resolve imports between them.
+func batchVerify(opts protosort.Options) bool {
+	return opts.Verify
+}
+
+// verifyBatches groups the files of a run to verify into batches for
+// protosort.VerifyBatch, a directory at a time, and verifies each batch in
+// the background once every file of the run it imports, directly or not,
+// has been sorted.
+type verifyBatches struct {
+	slots   chan struct{}
+	opts    protosort.Options
+	cache   *verifyCache
+	metrics *runMetrics
+	run     map[string]bool        // import names of the run's files
+	staged  map[string]*stagedFile // the run's files sorted so far, by import name
+	queued  []*verifyBatch         // batches not yet verified; the last one may grow
+}
+
+// stagedFile is a file of the run that others can import. Its original is
+// nil if it couldn't be read or sorted.
+type stagedFile struct {
+	original *string
+	imports  []string
+}
+
+// verifyBatch is files of one directory to verify together.
+type verifyBatch struct {
+	dir   string
+	files []*pendingFile
+}
+
+func newVerifyBatches(files []string, opts protosort.Options, cache *verifyCache, metrics *runMetrics) *verifyBatches {
+	b := &verifyBatches{
+		slots:   make(chan struct{}, runtime.GOMAXPROCS(0)),
+		opts:    opts,
+		cache:   cache,
+		metrics: metrics,
+		run:     make(map[string]bool, len(files)),
+		staged:  make(map[string]*stagedFile, len(files)),
+	}
+	for _, file := range files {
+		b.run[importName(file, opts.ProtoPaths)] = true
+	}
+	return b
+}
+
+// add queues p for verification with the other files of its directory.
+func (b *verifyBatches) add(p *pendingFile) {
+	dir := filepath.Dir(p.file)
+	if n := len(b.queued); n == 0 || b.queued[n-1].dir != dir {
+		b.queued = append(b.queued, &verifyBatch{dir: dir})
+	}
+	last := b.queued[len(b.queued)-1]
+	last.files = append(last.files, p)
+}
+
+// stage makes p's original content available for other files to import.
+func (b *verifyBatches) stage(p *pendingFile) {
+	s := &stagedFile{}
+	if p.code == 0 && !p.stdin {
+		s.original = &p.original
+		s.imports = fileImports(p.original)
+	}
+	b.staged[importName(p.file, b.opts.ProtoPaths)] = s
+}
+
+// flush verifies, in the background, each queued batch whose imports have
+// all been sorted, leaving the last batch to grow unless all is set. It
+// reports whether a batch is still waiting on a file not sorted yet.
+func (b *verifyBatches) flush(all bool) (waiting bool) {
+	var queued []*verifyBatch
+	for i, batch := range b.queued {
+		if !all && i == len(b.queued)-1 {
+			queued = append(queued, batch)
+			break
+		}
+		files, ok := b.closure(batch)
+		if !ok {
+			queued = append(queued, batch)
+			waiting = true
+			continue
+		}
+		b.slots <- struct{}{}
+		go func() {
+			defer func() { <-b.slots }()
+			b.verify(batch.files, files)
+		}()
+	}
+	b.queued = queued
+	return waiting
+}
+
+// closure returns the files to verify batch with: the batch's own files,
+// then the original of every file of the run they import, directly or not.
+// It reports false if one of those hasn't been sorted yet.
+func (b *verifyBatches) closure(batch *verifyBatch) ([]protosort.VerifyFile, bool) {
+	var files []protosort.VerifyFile
+	seen := make(map[string]bool)
+	var imports []string
+	for _, p := range batch.files {
+		name := importName(p.file, b.opts.ProtoPaths)
+		seen[name] = true
+		files = append(files, protosort.VerifyFile{Name: name, Original: p.original, Sorted: p.sorted, Opts: &p.opts})
+		if s := b.staged[name]; s != nil {
+			imports = append(imports, s.imports...)
+		}
+	}
+	for len(imports) > 0 {
+		name := imports[len(imports)-1]
+		imports = imports[:len(imports)-1]
+		if seen[name] || !b.run[name] {
+			continue // resolved from --proto-path
+		}
+		seen[name] = true
+		s := b.staged[name]
+		if s == nil {
+			return nil, false
+		}
+		if s.original != nil {
+			files = append(files, protosort.VerifyFile{Name: name, Original: *s.original, Sorted: *s.original})
+			imports = append(imports, s.imports...)
+		}
+	}
+	return files, true
+}
+
+// verify verifies the pending files, which files starts with, and delivers
+// each result.
+func (b *verifyBatches) verify(pending []*pendingFile, files []protosort.VerifyFile) {
+	start := time.Now()
+	errs := safeVerifyBatch(files, b.opts)
+	b.metrics.verify(start)
+	for i, p := range pending {
+		if errs[i] == nil {
+			b.cache.record(p, p.opts)
+		}
+		p.verified <- errs[i]
+	}
+}
+
+// fileImports returns the paths content imports.
+func fileImports(content string) []string {
+	blocks, err := protosort.ScanFile(content)
+	if err != nil {
+		return nil
+	}
+	var imports []string
+	for _, b := range blocks {
+		if b.Kind == protosort.BlockImport {
+			imports = append(imports, b.Name)
+		}
+	}
+	return imports
+}
+
+// importName returns the name other files import file by: its path relative
+// to the first --proto-path that contains it, or else to the working
+// directory.
+func importName(file string, protoPaths []string) string {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return filepath.ToSlash(file)
+	}
+	for _, root := range append(append([]string{}, protoPaths...), ".") {
+		dir, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(dir, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return strings.TrimPrefix(filepath.ToSlash(abs), "/")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/tallhamn/protosort"
+)
+
+// filterByPackage returns the files whose package statement matches one of
+// patterns: a package name, or a glob such as "acme.billing.*". Files
+// without a package statement, or that can't be read or parsed, don't
+// match.
+func filterByPackage(files []string, patterns []string) ([]string, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("--package %q: %w", pattern, err)
+		}
+	}
+	var matched []string
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if pkg := filePackage(string(content)); pkg != "" && packageMatches(pkg, patterns) {
+			matched = append(matched, file)
+		}
+	}
+	return matched, nil
+}
+
+// filePackage returns the package content declares, or "".
+func filePackage(content string) string {
+	blocks, err := protosort.ScanFile(content)
+	if err != nil {
+		return ""
+	}
+	for _, b := range blocks {
+		if b.Kind == protosort.BlockPackage {
+			return b.Name
+		}
+	}
+	return ""
+}
+
+// packageMatches reports whether pkg matches one of patterns.
+func packageMatches(pkg string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, pkg); ok {
+			return true
+		}
+	}
+	return false
+}
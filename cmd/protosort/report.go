@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tallhamn/protosort"
+)
+
+// runReport is the --format json output: one entry per file, in file order.
+// --format sarif is derived from it.
+type runReport struct {
+	Files      []fileReport    `json:"files"`
+	Duplicates []duplicateFile `json:"duplicates,omitempty"`
+	ExitCode   int             `json:"exit_code"`
+}
+
+// fileReport describes the outcome for one file.
+type fileReport struct {
+	Path        string           `json:"path"`
+	Changed     bool             `json:"changed"`
+	ChangedLine int              `json:"changed_line,omitempty"` // first line of the original that sorting changes
+	Written     bool             `json:"written,omitempty"`
+	Skipped     bool             `json:"skipped,omitempty"`   // opted out with a protosort:skip-file directive
+	Exception   string           `json:"exception,omitempty"` // the config exception that excuses --check, or expired
+	Warnings    []string         `json:"warnings"`
+	Types       []classifiedDecl `json:"types"` // classified from the original, so lines match the file on disk
+	// Verify is "passed", "failed", or "skipped" when the declarations
+	// checked out but protoc (--verifier=protoc) wasn't found for the
+	// descriptor comparison.
+	// It is empty when the file wasn't verified.
+	Verify    string `json:"verify,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorLine int    `json:"error_line,omitempty"` // 1-based line of a parse error or conflict marker
+	Diff      string `json:"diff,omitempty"`
+	ExitCode  int    `json:"exit_code"`
+
+	// knownUnreferenced is the pendingFile's, for SARIF to leave out
+	knownUnreferenced map[string]bool
+	// warningLines are the lines of Warnings, 0 for file-wide ones
+	warningLines []int
+}
+
+// add records p in the report, writing the file in --write mode, and returns
+// its exit code. Nothing is printed.
+func (r *runReport) add(p *pendingFile, opts protosort.Options) int {
+	fr := fileReport{Path: p.file, Warnings: warningMessages(p.warnings), Types: []classifiedDecl{}, knownUnreferenced: p.knownUnreferenced}
+	for _, w := range p.warnings {
+		fr.warningLines = append(fr.warningLines, w.Line)
+	}
+	fr.ExitCode = reportFile(&fr, p, opts)
+	r.Files = append(r.Files, fr)
+	return fr.ExitCode
+}
+
+// reportFile fills in fr for p, following the same mode precedence as
+// finishFile, and returns the file's exit code.
+func reportFile(fr *fileReport, p *pendingFile, opts protosort.Options) int {
+	if p.code != 0 {
+		fr.Error, fr.ErrorLine = p.errMsg, p.errLine
+		return p.code
+	}
+	if p.skipped {
+		fr.Skipped = true
+		return 0
+	}
+
+	if blocks, err := protosort.ScanFile(p.original); err == nil {
+		fr.Types = classifyDecls(blocks, opts)
+	}
+
+	if p.original == p.sorted {
+		return 0
+	}
+	fr.Changed = true
+	fr.ChangedLine = firstChangedLine(p.original, p.sorted)
+
+	if p.verified != nil {
+		if err := <-p.verified; err != nil {
+			fr.Verify = "failed"
+			fr.Error = fmt.Sprintf("verification failed: %v", err)
+			return 2
+		}
+		fr.Verify = "passed"
+		if opts.Verify && opts.Verifier == protosort.VerifierProtoc && !protosort.ProtocAvailable(opts) {
+			fr.Verify = "skipped"
+		}
+	}
+
+	if opts.Diff {
+		fr.Diff = protosort.DiffSorted(p.original, p.sorted, p.file+" (original)", p.file+" (sorted)", opts)
+	}
+
+	switch {
+	case opts.Check:
+		if !checkFails(p.original, p.sorted, opts.CheckLevel) {
+			return 0
+		}
+		excused, note := checkException(p.file, opts)
+		fr.Exception = note
+		if excused {
+			return 0
+		}
+		return 1
+	case opts.DryRun:
+		return 0
+	case opts.Write:
+		written, err := writeSorted(p, opts)
+		fr.Written = written
+		if err != nil {
+			fr.Error = err.Error()
+			return 4
+		}
+	}
+	return 0
+}
+
+// firstChangedLine returns the 1-based line of original where sorted first
+// differs from it.
+func firstChangedLine(original, sorted string) int {
+	a, b := strings.Split(original, "\n"), strings.Split(sorted, "\n")
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i + 1
+		}
+	}
+	return len(a)
+}
+
+// writeReport writes r in the given --format, json or sarif.
+func writeReport(w io.Writer, r *runReport, format string) error {
+	if format == "sarif" {
+		return writeSARIF(w, r)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// SARIF rule IDs. Results carry the file and line they refer to, so code
+// scanning dashboards can show them as annotations.
+const (
+	ruleWouldChange  = "would-change"
+	ruleUnreferenced = "unreferenced-type"
+	ruleWarning      = "warning"
+	ruleError        = "error"
+)
+
+var sarifRules = []sarifRule{
+	{ID: ruleWouldChange, ShortDescription: sarifMessage{Text: "File is not in protosort order"}},
+	{ID: ruleUnreferenced, ShortDescription: sarifMessage{Text: "Type is not referenced by any declaration in its file"}},
+	{ID: ruleWarning, ShortDescription: sarifMessage{Text: "Warning reported while sorting"}},
+	{ID: ruleError, ShortDescription: sarifMessage{Text: "File could not be sorted or verified"}},
+}
+
+// The subset of SARIF 2.1.0 that protosort produces.
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+// writeSARIF writes r as a SARIF 2.1.0 log with one result per changed
+// file, unreferenced type, warning, and error. Warnings and errors without a
+// position point at the first line of their file. Types that were already
+// unreferenced at the --new-warnings-only base revision are left out.
+func writeSARIF(w io.Writer, r *runReport) error {
+	results := []sarifResult{}
+	for _, f := range r.Files {
+		result := func(rule, level, text string, line int) {
+			if line < 1 {
+				line = 1
+			}
+			results = append(results, sarifResult{
+				RuleID:  rule,
+				Level:   level,
+				Message: sarifMessage{Text: text},
+				Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(f.Path)},
+					Region:           sarifRegion{StartLine: line},
+				}}},
+			})
+		}
+
+		if f.Error != "" {
+			line := f.ErrorLine
+			if line == 0 {
+				line = f.ChangedLine
+			}
+			result(ruleError, "error", f.Error, line)
+		}
+		if f.Changed {
+			result(ruleWouldChange, "warning", "declarations are not in protosort order; run protosort --write", f.ChangedLine)
+		}
+		for i, msg := range f.Warnings {
+			line := 0
+			if i < len(f.warningLines) {
+				line = f.warningLines[i]
+			}
+			result(ruleWarning, "warning", msg, line)
+		}
+		for _, t := range f.Types {
+			if t.Section == "unreferenced" && !f.knownUnreferenced[t.Kind+" "+t.Name] {
+				result(ruleUnreferenced, "note", fmt.Sprintf("%s %s is not referenced in this file", t.Kind, t.Name), t.Line)
+			}
+		}
+	}
+
+	log := sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "protosort",
+				Version:        Version,
+				InformationURI: "https://github.com/tallhamn/protosort",
+				Rules:          sarifRules,
+			}},
+			Results: results,
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/tallhamn/protosort"
+)
+
+// maxRequestBytes caps request bodies; real .proto files are far smaller.
+const maxRequestBytes = 4 << 20
+
+// sortRequest is the body accepted by every serve endpoint.
+type sortRequest struct {
+	Content string `json:"content"`
+	// Config overrides the server's options for this request. It uses the
+	// JSON form of the config file; extends is ignored.
+	Config *protosort.Config `json:"config,omitempty"`
+}
+
+type sortResponse struct {
+	Sorted   string   `json:"sorted"`
+	Changed  bool     `json:"changed"`
+	Warnings []string `json:"warnings"`
+}
+
+type checkResponse struct {
+	Changed  bool     `json:"changed"`
+	Diff     string   `json:"diff,omitempty"`
+	Warnings []string `json:"warnings"`
+}
+
+type classifyResponse struct {
+	Declarations []classifiedDecl `json:"declarations"`
+}
+
+// classifiedDecl is one message, enum, or service, in output order.
+type classifiedDecl struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Section  string `json:"section"`
+	Consumer string `json:"consumer,omitempty"`
+	Line     int    `json:"line"` // in the classified content
+	// HelperChain lists a helper, its consumer, and so on up to the first
+	// type that isn't a helper (see protosort.HelperChain). HelperCycle
+	// marks a chain that comes back on itself.
+	HelperChain []string `json:"helper_chain,omitempty"`
+	HelperCycle bool     `json:"helper_cycle,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// runServe serves the sort API on addr until the listener fails. Nothing is
+// written to disk on behalf of a request, and a request's config can't name
+// a file to read or a command to run; only the server's own options can,
+// such as its license template and the proto paths that unused imports are
+// resolved through.
+func runServe(addr string, opts protosort.Options) int {
+	fmt.Fprintf(os.Stderr, "protosort: serving on %s\n", addr)
+	if err := http.ListenAndServe(addr, newServeMux(opts)); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 4
+	}
+	return 0
+}
+
+// newServeMux routes POST /sort, /check, and /classify. opts are the
+// defaults for every request.
+func newServeMux(opts protosort.Options) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /sort", func(w http.ResponseWriter, r *http.Request) {
+		req, reqOpts, ok := decodeSortRequest(w, r, opts)
+		if !ok {
+			return
+		}
+		sorted, warnings, err := protosort.Sort(req.Content, reqOpts)
+		if err != nil {
+			writeSortError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sortResponse{
+			Sorted:   sorted,
+			Changed:  sorted != req.Content,
+			Warnings: warningMessages(warnings),
+		})
+	})
+
+	mux.HandleFunc("POST /check", func(w http.ResponseWriter, r *http.Request) {
+		req, reqOpts, ok := decodeSortRequest(w, r, opts)
+		if !ok {
+			return
+		}
+		sorted, warnings, err := protosort.Sort(req.Content, reqOpts)
+		if err != nil {
+			writeSortError(w, err)
+			return
+		}
+		resp := checkResponse{
+			Changed:  sorted != req.Content,
+			Warnings: warningMessages(warnings),
+		}
+		if resp.Changed {
+			resp.Diff = protosort.DiffSorted(req.Content, sorted, "original", "sorted", reqOpts)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("POST /classify", func(w http.ResponseWriter, r *http.Request) {
+		req, reqOpts, ok := decodeSortRequest(w, r, opts)
+		if !ok {
+			return
+		}
+		blocks, err := protosort.ScanFile(req.Content)
+		if err != nil {
+			writeSortError(w, &protosort.ParseError{Err: err})
+			return
+		}
+		writeJSON(w, http.StatusOK, classifyResponse{Declarations: classifyDecls(blocks, reqOpts)})
+	})
+
+	return mux
+}
+
+// decodeSortRequest parses the request body and applies its config on top
+// of opts. On failure it writes a 400 response and returns false.
+func decodeSortRequest(w http.ResponseWriter, r *http.Request, opts protosort.Options) (sortRequest, protosort.Options, bool) {
+	var req sortRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request: " + err.Error()})
+		return req, opts, false
+	}
+
+	if req.Config != nil {
+		if key := fileConfigKey(req.Config); key != "" {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("config key %s can't be set in a request", key)})
+			return req, opts, false
+		}
+		if req.Config.Preset != "" {
+			preset, err := protosort.LookupPreset(req.Config.Preset)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+				return req, opts, false
+			}
+			protosort.MergeConfig(&opts, preset, nil)
+		}
+		protosort.MergeConfig(&opts, req.Config, nil)
+		if err := validateOptions(opts); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return req, opts, false
+		}
+	}
+
+	// Requests never write files or run protoc
+	opts.Write, opts.Verify = false, false
+	return req, opts, true
+}
+
+// fileConfigKey returns the first key set in cfg that names a file or a
+// command, which would let a request read the server's disk, or "".
+func fileConfigKey(cfg *protosort.Config) string {
+	switch {
+	case cfg.Extends != "":
+		return "extends"
+	case len(cfg.Exceptions) > 0:
+		return "exception"
+	case cfg.License.Template != "":
+		return "license.template"
+	case cfg.Verify.Compiler != "":
+		return "verify.compiler"
+	case len(cfg.Verify.ProtoPaths) > 0:
+		return "verify.proto_paths"
+	case cfg.Hooks.PreWrite != "" || cfg.Hooks.PostWrite != "":
+		return "hooks"
+	}
+	return ""
+}
+
+// writeSortError maps Sort's typed errors to 422 and anything else to 500.
+func writeSortError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var proto2Err *protosort.Proto2Error
+	var parseErr *protosort.ParseError
+	var unsupportedErr *protosort.UnsupportedError
+	var conflictErr *protosort.ConflictError
+	if errors.As(err, &proto2Err) || errors.As(err, &parseErr) || errors.As(err, &unsupportedErr) || errors.As(err, &conflictErr) {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// classifyDecls classifies blocks and describes the results in output order.
+func classifyDecls(blocks []*protosort.Block, opts protosort.Options) []classifiedDecl {
+	decls := []classifiedDecl{}
+	classified := protosort.Classify(blocks, opts)
+	for _, b := range classified {
+		d := classifiedDecl{
+			Kind:     b.Kind.String(),
+			Name:     b.Name,
+			Section:  b.Section.String(),
+			Consumer: b.Consumer,
+			Line:     b.Line,
+		}
+		if b.Section == protosort.SectionHelper {
+			d.HelperChain, d.HelperCycle = protosort.HelperChain(classified, b.Name)
+		}
+		decls = append(decls, d)
+	}
+	return decls
+}
+
+func warningMessages(warnings []protosort.Warning) []string {
+	msgs := make([]string, len(warnings))
+	for i, w := range warnings {
+		msgs[i] = w.Message
+	}
+	return msgs
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxSuggestions caps the paths a did-you-mean hint lists.
+	maxSuggestions = 3
+	// maxSuggestScan bounds the .proto files looked at for a hint, so a
+	// typo at the top of a large tree fails fast.
+	maxSuggestScan = 10000
+)
+
+// suggestPaths returns up to maxSuggestions existing .proto files that arg,
+// a path that does not exist, probably meant: files with the same name, or
+// paths a few edits away. It searches below the nearest existing ancestor
+// of arg's directory, or one level above it when the directory exists, so
+// a file that moved to a sibling directory is found too.
+func suggestPaths(arg string) []string {
+	want := filepath.Clean(arg)
+	root := filepath.Dir(want)
+	for !dirExists(root) {
+		if parent := filepath.Dir(root); parent != root {
+			root = parent
+			continue
+		}
+		return nil
+	}
+	if root == filepath.Dir(want) && root != "." && filepath.Dir(root) != root {
+		root = filepath.Dir(root)
+	}
+
+	type candidate struct {
+		path string
+		dist int
+	}
+	var candidates []candidate
+	limit := max(2, len(want)/5)
+	scanned := 0
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".proto") {
+			return nil
+		}
+		if scanned++; scanned > maxSuggestScan {
+			return filepath.SkipAll
+		}
+		dist := editDistance(want, path)
+		if dist <= limit || filepath.Base(path) == filepath.Base(want) {
+			candidates = append(candidates, candidate{path, dist})
+		}
+		return nil
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].dist != candidates[j].dist {
+			return candidates[i].dist < candidates[j].dist
+		}
+		return candidates[i].path < candidates[j].path
+	})
+	var paths []string
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		paths = append(paths, candidates[i].path)
+	}
+	return paths
+}
+
+// didYouMean phrases paths as a hint: "did you mean a?", "did you mean a
+// or b?", or "did you mean a, b, or c?".
+func didYouMean(paths []string) string {
+	switch len(paths) {
+	case 0:
+		return ""
+	case 1:
+		return "did you mean " + paths[0] + "?"
+	case 2:
+		return "did you mean " + paths[0] + " or " + paths[1] + "?"
+	}
+	return "did you mean " + strings.Join(paths[:len(paths)-1], ", ") + ", or " + paths[len(paths)-1] + "?"
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// editDistance is the Levenshtein distance between a and b, in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
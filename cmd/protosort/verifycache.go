@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/tallhamn/protosort"
+)
+
+// verifyCacheFile is where passed verifications are remembered, relative to
+// the working directory.
+const verifyCacheFile = ".protosort-cache"
+
+// verifyCache records which (input, options) pairs passed verification, so
+// repeat --verify runs skip protoc and the in-process compiler for files
+// that haven't changed. Only passes are recorded. A nil cache remembers
+// nothing.
+type verifyCache struct {
+	path  string
+	mu    sync.Mutex
+	keys  map[string]bool
+	dirty bool
+}
+
+// loadVerifyCache reads the cache at path. It returns nil when opts don't
+// verify, or when the descriptor comparison would be skipped for lack of
+// protoc, since that pass proves less than a cached one should. A missing
+// or unreadable file starts an empty cache.
+func loadVerifyCache(path string, opts protosort.Options) *verifyCache {
+	if !opts.Verify && !opts.Paranoid {
+		return nil
+	}
+	if opts.Verify && opts.Verifier == protosort.VerifierProtoc && !protosort.ProtocAvailable(opts) {
+		return nil
+	}
+
+	c := &verifyCache{path: path, keys: make(map[string]bool)}
+	f, err := os.Open(path)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			c.keys[line] = true
+		}
+	}
+	return c
+}
+
+// verifyCacheKey hashes the protosort version, the options that affect
+// sorting and verification, and the original content. The sorted output is
+// determined by these, so it isn't part of the key.
+func verifyCacheKey(original string, opts protosort.Options) string {
+	// Modes that only change how results are reported don't matter
+	opts.Write, opts.Check, opts.Diff, opts.DryRun = false, false, false, false
+	opts.CheckLevel = ""
+	opts.Format, opts.Verbose, opts.Quiet, opts.Recursive = "", false, false, false
+	opts.ConfigFile = ""
+	optsJSON, _ := json.Marshal(opts)
+
+	h := sha256.New()
+	for _, part := range []string{Version, string(optsJSON), original} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// passed reports whether p's verification passed in an earlier run.
+func (c *verifyCache) passed(p *pendingFile, opts protosort.Options) bool {
+	if c == nil {
+		return false
+	}
+	key := verifyCacheKey(p.original, opts)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keys[key]
+}
+
+// record remembers that p passed verification.
+func (c *verifyCache) record(p *pendingFile, opts protosort.Options) {
+	if c == nil {
+		return
+	}
+	key := verifyCacheKey(p.original, opts)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.keys[key] {
+		c.keys[key] = true
+		c.dirty = true
+	}
+}
+
+// save writes the cache back if anything was recorded.
+func (c *verifyCache) save() error {
+	if c == nil || !c.dirty {
+		return nil
+	}
+	keys := sortedKeys(c.keys)
+	return os.WriteFile(c.path, []byte(strings.Join(keys, "\n")+"\n"), 0644)
+}
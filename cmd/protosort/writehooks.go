@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/tallhamn/protosort"
+)
+
+// defaultHookTimeout bounds a write hook when [hooks] sets no timeout.
+const defaultHookTimeout = time.Minute
+
+// writeSorted writes p's sorted content over its file, running the
+// configured pre- and post-write hooks around the write. written reports
+// whether the file was written, even if its post-write hook then failed.
+func writeSorted(p *pendingFile, opts protosort.Options) (written bool, err error) {
+	if err := runWriteHook("pre_write", opts.PreWrite, p.file, opts); err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(p.file, []byte(p.sorted), p.mode.Perm()); err != nil {
+		return false, fmt.Errorf("error writing %s: %v", p.file, err)
+	}
+	if err := runWriteHook("post_write", opts.PostWrite, p.file, opts); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// runWriteHook runs command through sh with "{file}" replaced by file,
+// shell-quoted. Its output goes to stderr, leaving stdout to diffs and
+// reports. The file is also in $PROTOSORT_FILE.
+func runWriteHook(name, command, file string, opts protosort.Options) error {
+	if command == "" {
+		return nil
+	}
+	timeout := defaultHookTimeout
+	if opts.HookTimeout != "" {
+		timeout, _ = time.ParseDuration(opts.HookTimeout) // checked by validateOptions
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", strings.ReplaceAll(command, "{file}", shellQuote(file)))
+	cmd.Env = append(append(os.Environ(), opts.HookEnv...), "PROTOSORT_FILE="+file)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	killHookGroup(cmd)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("error: %s: %s hook timed out after %s", file, name, timeout)
+		}
+		return fmt.Errorf("error: %s: %s hook failed: %v", file, name, err)
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killHookGroup leaves cmd as is: without process groups, a timeout kills
+// only the hook's shell.
+func killHookGroup(cmd *exec.Cmd) {}
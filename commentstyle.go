@@ -0,0 +1,182 @@
+package protosort
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// normalizeComments rewrites the /* */ comments in a declaration's leading
+// comments as // lines, and with width > 0 splits // lines longer than
+// width columns at spaces. Only the comment markers, the leading "*" of
+// each line of a /** ... */ doc comment, and the spacing around words
+// change; the words themselves stay as they are. A block comment that
+// shares a line with anything else is left alone, as are directives,
+// commented-out code, and preformatted lines when wrapping.
+func normalizeComments(comments string, width int) string {
+	if comments == "" {
+		return comments
+	}
+	lines := strings.Split(comments, "\n")
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		line, cr := strings.CutSuffix(lines[i], "\r")
+		indent := leadingWhitespace(line)
+		if !strings.HasPrefix(line[len(indent):], "/*") {
+			out = append(out, lines[i])
+			continue
+		}
+		end, converted := convertBlockComment(lines[i:], indent)
+		if converted == nil {
+			out = append(out, lines[i])
+			continue
+		}
+		for _, c := range converted {
+			if cr {
+				c += "\r"
+			}
+			out = append(out, c)
+		}
+		i += end
+	}
+	if width > 0 {
+		out = wrapCommentLines(out, width)
+	}
+	return strings.Join(out, "\n")
+}
+
+// convertBlockComment converts the block comment starting lines, indented
+// by indent, to // lines. It returns the index of the comment's last line,
+// and nil if the comment doesn't end a line or never ends.
+func convertBlockComment(lines []string, indent string) (int, []string) {
+	var body []string
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if i == 0 {
+			line = strings.TrimPrefix(line, indent+"/*")
+		}
+		if strings.Contains(line, "/*") {
+			return 0, nil // nested or a second comment
+		}
+		j := strings.Index(line, "*/")
+		if j < 0 {
+			body = append(body, line)
+			continue
+		}
+		if strings.TrimSpace(line[j+2:]) != "" {
+			return 0, nil // code or another comment follows on the line
+		}
+		body = append(body, line[:j])
+		return i, blockCommentLines(body, indent)
+	}
+	return 0, nil
+}
+
+// blockCommentLines turns the text between /* and */, split into lines,
+// into // lines at indent.
+func blockCommentLines(body []string, indent string) []string {
+	// The extra stars of /** and **/ are markers, not text
+	body[0] = strings.TrimLeft(body[0], "*")
+	last := len(body) - 1
+	body[last] = strings.TrimRight(body[last], "*")
+
+	// Later lines lose the " * " of doc comments, if every one has it, or
+	// else the indentation they share
+	rest := body[1:]
+	starred := true
+	common, seen := "", false
+	for _, line := range rest {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "*") {
+			starred = false
+		}
+		if ws := leadingWhitespace(line); !seen {
+			common, seen = ws, true
+		} else {
+			common = commonPrefix(common, ws)
+		}
+	}
+	for k, line := range rest {
+		if starred {
+			line = strings.TrimLeft(line, " \t")
+			line = strings.TrimPrefix(line, "*")
+			line = strings.TrimPrefix(line, " ")
+		} else {
+			line = strings.TrimPrefix(line, common)
+		}
+		rest[k] = line
+	}
+	body[0] = strings.TrimLeft(body[0], " \t")
+
+	var out []string
+	for _, text := range body {
+		text = strings.TrimRight(text, " \t")
+		if text == "" {
+			out = append(out, indent+"//")
+		} else {
+			out = append(out, indent+"// "+text)
+		}
+	}
+	// Drop the empty lines left by the markers on lines of their own
+	for len(out) > 1 && out[0] == indent+"//" {
+		out = out[1:]
+	}
+	for len(out) > 1 && out[len(out)-1] == indent+"//" {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// commonPrefix returns the longest common prefix of a and b.
+func commonPrefix(a, b string) string {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
+
+// wrapCommentLines splits the prose // lines longer than width columns at
+// spaces, continuing them on lines with the same indentation.
+func wrapCommentLines(lines []string, width int) []string {
+	var out []string
+	for _, line := range lines {
+		body, cr := strings.CutSuffix(line, "\r")
+		eol := ""
+		if cr {
+			eol = "\r"
+		}
+		indent := leadingWhitespace(body)
+		text, ok := strings.CutPrefix(body[len(indent):], "// ")
+		if !ok || utf8.RuneCountInString(body) <= width || !wrappable(body, text) {
+			out = append(out, line)
+			continue
+		}
+		prefix := indent + "// "
+		current := ""
+		for _, word := range strings.Fields(text) {
+			if current != "" && utf8.RuneCountInString(prefix+current+" "+word) > width {
+				out = append(out, prefix+current+eol)
+				current = ""
+			}
+			if current != "" {
+				current += " "
+			}
+			current += word
+		}
+		out = append(out, prefix+current+eol)
+	}
+	return out
+}
+
+// wrappable reports whether a // line with the given text after "// " is
+// prose that may be rewrapped: not indented further, as code samples and
+// lists are, and not a directive, a divider, or commented-out code.
+func wrappable(line, text string) bool {
+	if text == "" || text[0] == ' ' || text[0] == '\t' || text[0] == '/' {
+		return false
+	}
+	return !strings.Contains(text, "protosort:") && !isSectionDivider(line) && !codeLineRe.MatchString(line)
+}
@@ -1,46 +1,226 @@
-package main
+package protosort
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
+// configFileNames lists the config file names searched for in each directory,
+// in order of precedence.
+var configFileNames = []string{".protosort.toml", ".protosort.textproto", ".protosort.json"}
+
 // Config represents the .protosort.toml configuration file.
+// The json tags match the field names in config.proto, which is the schema
+// for the text-format and JSON alternatives. The flag, enum, and default
+// tags feed --print-config-schema.
 type Config struct {
-	Ordering ConfigOrdering `toml:"ordering"`
-	Verify   ConfigVerify   `toml:"verify"`
+	// Extends names a parent config file, resolved relative to the file
+	// that declares it. Values set in this file override the parent's.
+	Extends string `toml:"extends" json:"extends"`
+	// Preset names a built-in preset applied underneath this file's values.
+	Preset   string         `toml:"preset" json:"preset" flag:"preset" enum:"aip,uber,buf-default"`
+	Ordering ConfigOrdering `toml:"ordering" json:"ordering"`
+	Verify   ConfigVerify   `toml:"verify" json:"verify"`
+	Lint     ConfigLint     `toml:"lint" json:"lint"`
+	Regions  ConfigRegions  `toml:"regions" json:"regions"`
+	Verbatim ConfigVerbatim `toml:"verbatim" json:"verbatim"`
+	License  ConfigLicense  `toml:"license" json:"license"`
+	RPC      ConfigRPC      `toml:"rpc" json:"rpc"`
+	Imports  ConfigImports  `toml:"imports" json:"imports"`
+	Hooks    ConfigHooks    `toml:"hooks" json:"hooks"`
+	Headers  ConfigHeaders  `toml:"headers" json:"headers"`
+
+	// Exclude lists gitignore-style patterns, relative to the working
+	// directory, for files the CLI never processes.
+	Exclude []string `toml:"exclude" json:"exclude" flag:"exclude"`
+	// Exceptions excuse files from --check until they expire; their File
+	// patterns are resolved relative to the config file.
+	Exceptions []Exception `toml:"exception" json:"exception"`
+}
+
+// Exception excuses the files matching File, a path or glob, from failing
+// --check until the end of Expires, a date such as "2025-12-31". From then
+// on they fail again, with Reason in the message, so that grandfathered
+// files have a deadline.
+type Exception struct {
+	File    string `toml:"file" json:"file"`
+	Reason  string `toml:"reason" json:"reason"`
+	Expires string `toml:"expires" json:"expires"`
+}
+
+// exceptionDateLayout is the format of Exception.Expires.
+const exceptionDateLayout = "2006-01-02"
+
+// Validate reports an exception without a file or with an expiry date that
+// isn't one.
+func (e Exception) Validate() error {
+	if e.File == "" {
+		return fmt.Errorf("exception needs a file")
+	}
+	if _, err := time.Parse(exceptionDateLayout, e.Expires); err != nil {
+		return fmt.Errorf("exception for %s: expires must be a date such as 2025-12-31, got %q", e.File, e.Expires)
+	}
+	return nil
+}
+
+// Expired reports whether the exception no longer applies at now: it
+// lasts through the whole day it expires on, in now's time zone.
+func (e Exception) Expired(now time.Time) bool {
+	expires, err := time.ParseInLocation(exceptionDateLayout, e.Expires, now.Location())
+	return err != nil || !now.Before(expires.AddDate(0, 0, 1))
 }
 
 // ConfigOrdering holds ordering-related config.
 type ConfigOrdering struct {
-	SharedOrder        string `toml:"shared_order"`
-	SortRPCs           string `toml:"sort_rpcs"`
-	PreserveDividers   *bool  `toml:"preserve_dividers"`
-	StripCommentedCode *bool  `toml:"strip_commented_code"`
-	SectionHeaders     *bool  `toml:"section_headers"`
+	SharedOrder        string `toml:"shared_order" json:"shared_order" flag:"shared-order" enum:"alpha,dependency"`
+	KindOrder          string `toml:"kind_order" json:"kind_order" flag:"kind-order" enum:",mixed,enums-first,messages-first"`
+	SortRPCs           string `toml:"sort_rpcs" json:"sort_rpcs" flag:"sort-rpcs" enum:",alpha,grouped"`
+	RPCGroupHeaders    *bool  `toml:"rpc_group_headers" json:"rpc_group_headers" flag:"rpc-group-headers"`
+	RPCFingerprint     *bool  `toml:"rpc_fingerprint" json:"rpc_fingerprint" flag:"rpc-fingerprint"`
+	SortFieldOptions   *bool  `toml:"sort_field_options" json:"sort_field_options" flag:"sort-field-options"`
+	SortNested         *bool  `toml:"sort_nested" json:"sort_nested" flag:"sort-nested"`
+	SortFields         *bool  `toml:"sort_fields" json:"sort_fields" flag:"sort-fields"`
+	PairStrict         *bool  `toml:"pair_strict" json:"pair_strict" flag:"pair-strict"`
+	GroupByService     *bool  `toml:"group_by_service" json:"group_by_service" flag:"group-by-service"`
+	GroupExtends       *bool  `toml:"group_extends" json:"group_extends" flag:"group-extends"`
+	PreserveDividers   *bool  `toml:"preserve_dividers" json:"preserve_dividers" flag:"preserve-dividers"`
+	KeepFloating       *bool  `toml:"keep_floating_comments" json:"keep_floating_comments" flag:"keep-floating-comments"`
+	PreserveSpacing    *bool  `toml:"preserve_spacing" json:"preserve_spacing" flag:"preserve-spacing"`
+	StripCommentedCode *bool  `toml:"strip_commented_code" json:"strip_commented_code" flag:"strip-commented-code"`
+	SectionHeaders     *bool  `toml:"section_headers" json:"section_headers" flag:"section-headers"`
+	SectionStats       *bool  `toml:"section_stats" json:"section_stats" flag:"section-stats"`
+	TOC                *bool  `toml:"toc" json:"toc" flag:"toc"`
+	InlineHelpers      *bool  `toml:"inline_helpers" json:"inline_helpers" flag:"inline-helpers"`
+	CoreMinRefs        *int   `toml:"core_min_refs" json:"core_min_refs" flag:"core-min-refs"`
+	IndentWidth        *int   `toml:"indent_width" json:"indent_width" flag:"indent-width"`
+	EndOfLine          string `toml:"end_of_line" json:"end_of_line" flag:"end-of-line" enum:",lf,crlf,auto"`
+	NoFinalNewline     *bool  `toml:"no_final_newline" json:"no_final_newline" flag:"no-final-newline"`
+	// Indent is a style, or a number of spaces per nesting level; see
+	// Options.
+	Indent ConfigIndent `toml:"indent" json:"indent" flag:"indent"`
+	// Blank lines between body declarations; see Options.
+	BlankLinesBetweenSections *int `toml:"blank_lines_between_sections" json:"blank_lines_between_sections"`
+	BlankLinesWithinSection   *int `toml:"blank_lines_within_section" json:"blank_lines_within_section"`
+	// RemoveUnusedImports drops imports the file doesn't reference; see Options.
+	RemoveUnusedImports *bool `toml:"remove_unused_imports" json:"remove_unused_imports" flag:"remove-unused-imports"`
+	// CodePatterns and ProsePatterns refine strip_commented_code; see Options.
+	CodePatterns  []string `toml:"code_patterns" json:"code_patterns"`
+	ProsePatterns []string `toml:"prose_patterns" json:"prose_patterns"`
+	// DividerPatterns add to the section divider lines; see Options.
+	DividerPatterns []string `toml:"divider_patterns" json:"divider_patterns"`
+	// NormalizeComments and CommentWidth restyle leading comments; see Options.
+	NormalizeComments *bool `toml:"normalize_comments" json:"normalize_comments" flag:"normalize-comments"`
+	CommentWidth      *int  `toml:"comment_width" json:"comment_width" flag:"comment-width"`
+}
+
+// ConfigIndent is the indent key: "spaces", "tabs" or "tab", or a number of
+// spaces per nesting level, which TOML files may give as an integer.
+type ConfigIndent string
+
+// UnmarshalTOML accepts a string or an integer.
+func (i *ConfigIndent) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case string:
+		*i = ConfigIndent(v)
+	case int64:
+		*i = ConfigIndent(strconv.FormatInt(v, 10))
+	default:
+		return fmt.Errorf("indent must be a string or an integer, got %v", v)
+	}
+	return nil
 }
 
 // ConfigVerify holds verification-related config.
 type ConfigVerify struct {
-	Compiler   string   `toml:"compiler"`
-	ProtoPaths []string `toml:"proto_paths"`
-	Verify     *bool    `toml:"verify"`
+	Compiler   string   `toml:"compiler" json:"compiler" flag:"protoc"`
+	ProtoPaths []string `toml:"proto_paths" json:"proto_paths" flag:"proto-path"`
+	Verify     *bool    `toml:"verify" json:"verify" flag:"verify"`
+	Level      string   `toml:"level" json:"level" enum:",grpc-compat"`
+	Verifier   string   `toml:"verifier" json:"verifier" flag:"verifier" enum:"protocompile,protoc"`
+	Require    *bool    `toml:"require" json:"require" flag:"require-verify"`
+	Paranoid   *bool    `toml:"paranoid" json:"paranoid" flag:"paranoid"`
+}
+
+// ConfigLint holds size thresholds reported as warnings during sorting.
+type ConfigLint struct {
+	MaxRPCsPerService   *int `toml:"max_rpcs_per_service" json:"max_rpcs_per_service" flag:"max-rpcs"`
+	MaxFieldsPerMessage *int `toml:"max_fields_per_message" json:"max_fields_per_message" flag:"max-fields"`
+	MaxMessagesPerFile  *int `toml:"max_messages_per_file" json:"max_messages_per_file" flag:"max-messages"`
 }
 
-// findConfigFile walks up from the current directory to find .protosort.toml,
-// stopping at the repository root (directory containing .git).
-func findConfigFile() string {
-	dir, err := os.Getwd()
+// ConfigRegions holds fold-marker settings.
+type ConfigRegions struct {
+	Mode  string `toml:"mode" json:"mode" flag:"regions" enum:",keep,strip"`
+	Begin string `toml:"begin" json:"begin" default:"// region"`
+	End   string `toml:"end" json:"end" default:"// endregion"`
+}
+
+// ConfigVerbatim holds the markers of verbatim regions.
+type ConfigVerbatim struct {
+	Begin string `toml:"begin" json:"begin"`
+	End   string `toml:"end" json:"end"`
+}
+
+// ConfigLicense holds the license header template.
+type ConfigLicense struct {
+	// Template is the path of the template file, resolved relative to the
+	// config file that names it.
+	Template string `toml:"template" json:"template"`
+}
+
+// ConfigRPC holds RPC ordering settings.
+type ConfigRPC struct {
+	Order []string `toml:"order" json:"order"`
+}
+
+// ConfigImports holds import grouping settings.
+type ConfigImports struct {
+	Group *bool    `toml:"group" json:"group" flag:"group-imports"`
+	Local []string `toml:"local" json:"local"`
+}
+
+// ConfigHeaders holds the style of section headers; see HeaderStyle.
+type ConfigHeaders struct {
+	RPC         string `toml:"rpc_header" json:"rpc_header" default:"Types for {{.RPC}}"`
+	Service     string `toml:"service_header" json:"service_header" default:"Service {{.Service}}"`
+	Composite   string `toml:"composite_header" json:"composite_header" default:"Composite Types -- using other types"`
+	Helper      string `toml:"helper_header" json:"helper_header" default:"Helper Types -- used in other types"`
+	Standalone  string `toml:"standalone_header" json:"standalone_header" default:"Standalone Types -- not referenced elsewhere in this file"`
+	Unused      string `toml:"unused_header" json:"unused_header" default:"Types unused by RPCs"`
+	Extends     string `toml:"extends_header" json:"extends_header" default:"Custom Options"`
+	BannerChar  string `toml:"banner_char" json:"banner_char" default:"="`
+	BannerWidth *int   `toml:"banner_width" json:"banner_width"`
+}
+
+// ConfigHooks holds the commands the CLI runs around each file it writes.
+type ConfigHooks struct {
+	PreWrite  string   `toml:"pre_write" json:"pre_write"`
+	PostWrite string   `toml:"post_write" json:"post_write"`
+	Timeout   string   `toml:"timeout" json:"timeout" default:"1m"`
+	Env       []string `toml:"env" json:"env"`
+}
+
+// FindConfigFile walks up from dir to find a config file (see
+// configFileNames), stopping at the repository root (directory containing .git).
+func FindConfigFile(dir string) string {
+	dir, err := filepath.Abs(dir)
 	if err != nil {
 		return ""
 	}
 
 	for {
-		candidate := filepath.Join(dir, ".protosort.toml")
-		if _, err := os.Stat(candidate); err == nil {
-			return candidate
+		for _, name := range configFileNames {
+			candidate := filepath.Join(dir, name)
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate
+			}
 		}
 
 		// Check if we're at a repo root
@@ -56,8 +236,89 @@ func findConfigFile() string {
 	}
 }
 
-// LoadConfig reads and parses a .protosort.toml file.
+// LoadConfig reads and parses a config file, following any extends chain.
+// Files ending in .textproto, .txtpb, or .json are decoded against the
+// config.proto schema; anything else is parsed as TOML.
 func LoadConfig(path string) (*Config, error) {
+	return loadConfigChain(path, "", make(map[string]bool))
+}
+
+// ResolveConfig loads the config at path (which may be empty) and applies
+// preset in place of the file's own preset key. With no path, the result is
+// the preset alone, or nil if neither is given.
+func ResolveConfig(path, preset string) (*Config, error) {
+	if path != "" {
+		return loadConfigChain(path, preset, make(map[string]bool))
+	}
+	if preset != "" {
+		return LookupPreset(preset)
+	}
+	return nil, nil
+}
+
+// loadConfigChain loads path and, if it extends another file, overlays it on
+// top of the parent. A preset (presetOverride, or else the file's preset key)
+// is layered between the parent and the file. visited holds absolute paths
+// already on the chain so that cycles are reported instead of recursing forever.
+func loadConfigChain(path, presetOverride string, visited map[string]bool) (*Config, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if visited[abs] {
+		return nil, fmt.Errorf("config extends cycle at %s", path)
+	}
+	visited[abs] = true
+
+	cfg, err := decodeConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if presetOverride != "" {
+		cfg.Preset = presetOverride
+	}
+	if cfg.License.Template != "" && !filepath.IsAbs(cfg.License.Template) {
+		cfg.License.Template = filepath.Join(filepath.Dir(abs), cfg.License.Template)
+	}
+	for i, e := range cfg.Exceptions {
+		if e.File != "" && !filepath.IsAbs(e.File) {
+			cfg.Exceptions[i].File = filepath.Join(filepath.Dir(abs), e.File)
+		}
+	}
+
+	base := &Config{}
+	if cfg.Extends != "" {
+		parentPath := cfg.Extends
+		if !filepath.IsAbs(parentPath) {
+			parentPath = filepath.Join(filepath.Dir(path), parentPath)
+		}
+		base, err = loadConfigChain(parentPath, "", visited)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s (extended by %s): %w", cfg.Extends, path, err)
+		}
+	}
+	if cfg.Preset != "" {
+		preset, err := LookupPreset(cfg.Preset)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		overlayConfig(base, preset)
+	}
+	overlayConfig(base, cfg)
+	base.Extends = ""
+	base.Preset = ""
+	return base, nil
+}
+
+// decodeConfigFile parses a single config file without following extends.
+func decodeConfigFile(path string) (*Config, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".textproto", ".txtpb":
+		return loadProtoConfig(path, configFormatText)
+	case ".json":
+		return loadProtoConfig(path, configFormatJSON)
+	}
+
 	var cfg Config
 	if _, err := toml.DecodeFile(path, &cfg); err != nil {
 		return nil, err
@@ -65,6 +326,26 @@ func LoadConfig(path string) (*Config, error) {
 	return &cfg, nil
 }
 
+// overlayConfig copies every value set in child onto base. A value counts as
+// set when it is non-zero: a non-nil pointer, a non-empty string or slice.
+// Nested tables are overlaid field by field.
+func overlayConfig(base, child *Config) {
+	overlayValue(reflect.ValueOf(base).Elem(), reflect.ValueOf(child).Elem())
+}
+
+func overlayValue(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		sf, df := src.Field(i), dst.Field(i)
+		if sf.Kind() == reflect.Struct {
+			overlayValue(df, sf)
+			continue
+		}
+		if !sf.IsZero() {
+			df.Set(sf)
+		}
+	}
+}
+
 // MergeConfig applies config file values to opts, but only for fields not
 // explicitly set via CLI flags. The setFlags map contains flag names that
 // were explicitly passed on the command line.
@@ -73,21 +354,115 @@ func MergeConfig(opts *Options, cfg *Config, setFlags map[string]bool) {
 		return
 	}
 
+	if len(cfg.Exclude) > 0 && !setFlags["exclude"] {
+		opts.Exclude = cfg.Exclude
+	}
+	if len(cfg.Exceptions) > 0 {
+		opts.Exceptions = cfg.Exceptions
+	}
+
 	if cfg.Ordering.SharedOrder != "" && !setFlags["shared-order"] {
 		opts.SharedOrder = cfg.Ordering.SharedOrder
 	}
+	if cfg.Ordering.KindOrder != "" && !setFlags["kind-order"] {
+		opts.KindOrder = cfg.Ordering.KindOrder
+	}
 	if cfg.Ordering.SortRPCs != "" && !setFlags["sort-rpcs"] {
 		opts.SortRPCs = cfg.Ordering.SortRPCs
 	}
+	if len(cfg.RPC.Order) > 0 {
+		opts.RPCOrder = cfg.RPC.Order
+		if opts.SortRPCs == "" && !setFlags["sort-rpcs"] {
+			opts.SortRPCs = "alpha" // an order list alone turns RPC sorting on
+		}
+	}
+	if cfg.Ordering.RPCGroupHeaders != nil && !setFlags["rpc-group-headers"] {
+		opts.RPCGroupHeaders = *cfg.Ordering.RPCGroupHeaders
+	}
+	if cfg.Ordering.RPCFingerprint != nil && !setFlags["rpc-fingerprint"] {
+		opts.RPCFingerprint = *cfg.Ordering.RPCFingerprint
+	}
+	if cfg.Ordering.SortFieldOptions != nil && !setFlags["sort-field-options"] {
+		opts.SortFieldOptions = *cfg.Ordering.SortFieldOptions
+	}
+	if cfg.Ordering.SortNested != nil && !setFlags["sort-nested"] {
+		opts.SortNested = *cfg.Ordering.SortNested
+	}
+	if cfg.Ordering.SortFields != nil && !setFlags["sort-fields"] {
+		opts.SortFields = *cfg.Ordering.SortFields
+	}
+	if cfg.Ordering.PairStrict != nil && !setFlags["pair-strict"] {
+		opts.PairStrict = *cfg.Ordering.PairStrict
+	}
+	if cfg.Ordering.GroupByService != nil && !setFlags["group-by-service"] {
+		opts.GroupByService = *cfg.Ordering.GroupByService
+	}
+	if cfg.Ordering.GroupExtends != nil && !setFlags["group-extends"] {
+		opts.GroupExtends = *cfg.Ordering.GroupExtends
+	}
+	if cfg.Ordering.CoreMinRefs != nil && !setFlags["core-min-refs"] {
+		opts.CoreMinRefs = *cfg.Ordering.CoreMinRefs
+	}
+	if cfg.Ordering.RemoveUnusedImports != nil && !setFlags["remove-unused-imports"] {
+		opts.RemoveUnusedImports = *cfg.Ordering.RemoveUnusedImports
+	}
 	if cfg.Ordering.PreserveDividers != nil && !setFlags["preserve-dividers"] {
 		opts.PreserveDividers = *cfg.Ordering.PreserveDividers
 	}
+	if cfg.Ordering.KeepFloating != nil && !setFlags["keep-floating-comments"] {
+		opts.KeepFloatingComments = *cfg.Ordering.KeepFloating
+	}
+	if cfg.Ordering.PreserveSpacing != nil && !setFlags["preserve-spacing"] {
+		opts.PreserveSpacing = *cfg.Ordering.PreserveSpacing
+	}
 	if cfg.Ordering.StripCommentedCode != nil && !setFlags["strip-commented-code"] {
 		opts.StripCommented = *cfg.Ordering.StripCommentedCode
 	}
+	if len(cfg.Ordering.CodePatterns) > 0 {
+		opts.CodePatterns = cfg.Ordering.CodePatterns
+	}
+	if len(cfg.Ordering.ProsePatterns) > 0 {
+		opts.ProsePatterns = cfg.Ordering.ProsePatterns
+	}
+	if len(cfg.Ordering.DividerPatterns) > 0 {
+		opts.DividerPatterns = cfg.Ordering.DividerPatterns
+	}
+	if cfg.Ordering.NormalizeComments != nil && !setFlags["normalize-comments"] {
+		opts.NormalizeComments = *cfg.Ordering.NormalizeComments
+	}
+	if cfg.Ordering.CommentWidth != nil && !setFlags["comment-width"] {
+		opts.CommentWidth = *cfg.Ordering.CommentWidth
+	}
 	if cfg.Ordering.SectionHeaders != nil && !setFlags["section-headers"] {
 		opts.SectionHeaders = *cfg.Ordering.SectionHeaders
 	}
+	if cfg.Ordering.SectionStats != nil && !setFlags["section-stats"] {
+		opts.SectionStats = *cfg.Ordering.SectionStats
+	}
+	if cfg.Ordering.TOC != nil && !setFlags["toc"] {
+		opts.TOC = *cfg.Ordering.TOC
+	}
+	if cfg.Ordering.InlineHelpers != nil && !setFlags["inline-helpers"] {
+		opts.InlineHelpers = *cfg.Ordering.InlineHelpers
+	}
+	if cfg.Ordering.Indent != "" && !setFlags["indent"] {
+		opts.Indent = string(cfg.Ordering.Indent)
+	}
+	if cfg.Ordering.IndentWidth != nil && !setFlags["indent-width"] {
+		opts.IndentWidth = *cfg.Ordering.IndentWidth
+	}
+	if cfg.Ordering.BlankLinesBetweenSections != nil {
+		opts.BlankLinesBetweenSections = *cfg.Ordering.BlankLinesBetweenSections
+	}
+	if cfg.Ordering.BlankLinesWithinSection != nil {
+		opts.BlankLinesWithinSection = *cfg.Ordering.BlankLinesWithinSection
+	}
+	if cfg.Ordering.EndOfLine != "" && !setFlags["end-of-line"] {
+		opts.EndOfLine = cfg.Ordering.EndOfLine
+	}
+	if cfg.Ordering.NoFinalNewline != nil && !setFlags["no-final-newline"] {
+		opts.NoFinalNewline = *cfg.Ordering.NoFinalNewline
+	}
 
 	if cfg.Verify.Compiler != "" && !setFlags["protoc"] {
 		opts.ProtocPath = cfg.Verify.Compiler
@@ -98,4 +473,93 @@ func MergeConfig(opts *Options, cfg *Config, setFlags map[string]bool) {
 	if cfg.Verify.Verify != nil && !setFlags["verify"] {
 		opts.Verify = *cfg.Verify.Verify
 	}
+	if cfg.Verify.Level != "" && !setFlags["verify"] {
+		opts.Verify = true
+		opts.VerifyLevel = cfg.Verify.Level
+	}
+	if cfg.Verify.Verifier != "" && !setFlags["verifier"] {
+		opts.Verifier = cfg.Verify.Verifier
+	}
+	if cfg.Verify.Require != nil && !setFlags["require-verify"] {
+		opts.RequireVerify = *cfg.Verify.Require
+	}
+	if cfg.Verify.Paranoid != nil && !setFlags["paranoid"] {
+		opts.Paranoid = *cfg.Verify.Paranoid
+	}
+
+	if cfg.Regions.Mode != "" && !setFlags["regions"] {
+		opts.Regions = cfg.Regions.Mode
+	}
+	if cfg.Regions.Begin != "" {
+		opts.RegionBegin = cfg.Regions.Begin
+	}
+	if cfg.Regions.End != "" {
+		opts.RegionEnd = cfg.Regions.End
+	}
+
+	if cfg.Verbatim.Begin != "" {
+		opts.VerbatimBegin = cfg.Verbatim.Begin
+	}
+	if cfg.Verbatim.End != "" {
+		opts.VerbatimEnd = cfg.Verbatim.End
+	}
+	if cfg.License.Template != "" {
+		opts.LicenseTemplate = cfg.License.Template
+	}
+	if cfg.Imports.Group != nil && !setFlags["group-imports"] {
+		opts.GroupImports = *cfg.Imports.Group
+	}
+	if len(cfg.Imports.Local) > 0 {
+		opts.LocalImports = cfg.Imports.Local
+	}
+
+	if cfg.Headers.RPC != "" {
+		opts.HeaderStyle.RPC = cfg.Headers.RPC
+	}
+	if cfg.Headers.Service != "" {
+		opts.HeaderStyle.Service = cfg.Headers.Service
+	}
+	if cfg.Headers.Composite != "" {
+		opts.HeaderStyle.Composite = cfg.Headers.Composite
+	}
+	if cfg.Headers.Helper != "" {
+		opts.HeaderStyle.Helper = cfg.Headers.Helper
+	}
+	if cfg.Headers.Standalone != "" {
+		opts.HeaderStyle.Standalone = cfg.Headers.Standalone
+	}
+	if cfg.Headers.Unused != "" {
+		opts.HeaderStyle.Unused = cfg.Headers.Unused
+	}
+	if cfg.Headers.Extends != "" {
+		opts.HeaderStyle.Extends = cfg.Headers.Extends
+	}
+	if cfg.Headers.BannerChar != "" {
+		opts.HeaderStyle.BannerChar = cfg.Headers.BannerChar
+	}
+	if cfg.Headers.BannerWidth != nil {
+		opts.HeaderStyle.BannerWidth = *cfg.Headers.BannerWidth
+	}
+	if cfg.Hooks.PreWrite != "" {
+		opts.PreWrite = cfg.Hooks.PreWrite
+	}
+	if cfg.Hooks.PostWrite != "" {
+		opts.PostWrite = cfg.Hooks.PostWrite
+	}
+	if cfg.Hooks.Timeout != "" {
+		opts.HookTimeout = cfg.Hooks.Timeout
+	}
+	if len(cfg.Hooks.Env) > 0 {
+		opts.HookEnv = cfg.Hooks.Env
+	}
+
+	if cfg.Lint.MaxRPCsPerService != nil && !setFlags["max-rpcs"] {
+		opts.MaxRPCsPerService = *cfg.Lint.MaxRPCsPerService
+	}
+	if cfg.Lint.MaxFieldsPerMessage != nil && !setFlags["max-fields"] {
+		opts.MaxFieldsPerMessage = *cfg.Lint.MaxFieldsPerMessage
+	}
+	if cfg.Lint.MaxMessagesPerFile != nil && !setFlags["max-messages"] {
+		opts.MaxMessagesPerFile = *cfg.Lint.MaxMessagesPerFile
+	}
 }
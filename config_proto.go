@@ -0,0 +1,90 @@
+package protosort
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// configProtoName is the import path under which config.proto is compiled.
+const configProtoName = "protosort/config.proto"
+
+// configProto is the schema for text-format and JSON config files.
+//
+//go:embed config.proto
+var configProto string
+
+type configFormat int
+
+const (
+	configFormatText configFormat = iota
+	configFormatJSON
+)
+
+// configDescriptor compiles the embedded config.proto and returns the
+// descriptor for its top-level Config message.
+func configDescriptor() (protoreflect.MessageDescriptor, error) {
+	compiler := protocompile.Compiler{
+		// Keep comments: they are the field descriptions in --print-config-schema
+		SourceInfoMode: protocompile.SourceInfoStandard,
+		Resolver: &protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(map[string]string{
+				configProtoName: configProto,
+			}),
+		},
+	}
+	files, err := compiler.Compile(context.Background(), configProtoName)
+	if err != nil {
+		return nil, fmt.Errorf("compiling config schema: %w", err)
+	}
+	md := files[0].Messages().ByName("Config")
+	if md == nil {
+		return nil, fmt.Errorf("config schema has no Config message")
+	}
+	return md, nil
+}
+
+// loadProtoConfig decodes a text-format or JSON config file against the
+// config.proto schema. Unknown fields and type mismatches are rejected by
+// the protobuf decoder. The validated message is then converted to a Config
+// via its protojson form, whose field names match Config's json tags.
+func loadProtoConfig(path string, format configFormat) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := configDescriptor()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	switch format {
+	case configFormatText:
+		err = prototext.Unmarshal(data, msg)
+	case configFormatJSON:
+		err = protojson.Unmarshal(data, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(js, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,106 @@
+package protosort
+
+import (
+	"flag"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// ConfigSchema builds a JSON Schema (draft 2020-12) for the config file.
+// Keys and types come from the Config struct, descriptions from the
+// comments in config.proto, and defaults from the flag in fs that each key
+// maps to (recorded under "x-flag").
+func ConfigSchema(fs *flag.FlagSet) (map[string]any, error) {
+	md, err := configDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	schema := objectSchema(reflect.TypeOf(Config{}), md, fs)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "protosort configuration"
+	return schema, nil
+}
+
+// objectSchema describes one config table.
+func objectSchema(rt reflect.Type, md protoreflect.MessageDescriptor, fs *flag.FlagSet) map[string]any {
+	props := make(map[string]any)
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		key := f.Tag.Get("toml")
+		fd := md.Fields().ByName(protoreflect.Name(key))
+
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+
+		var prop map[string]any
+		switch {
+		case ft == reflect.TypeFor[ConfigIndent]():
+			// A style name, or a number of spaces per level
+			prop = map[string]any{"anyOf": []any{
+				map[string]any{"type": "string", "pattern": "^(|spaces|tabs?|[1-9][0-9]*)$"},
+				map[string]any{"type": "integer", "minimum": 1},
+			}}
+		case ft.Kind() == reflect.Struct:
+			prop = objectSchema(ft, fd.Message(), fs)
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct:
+			prop = map[string]any{"type": "array", "items": objectSchema(ft.Elem(), fd.Message(), fs)}
+		case ft.Kind() == reflect.Bool:
+			prop = map[string]any{"type": "boolean"}
+		case ft.Kind() == reflect.Int:
+			prop = map[string]any{"type": "integer"}
+		case ft.Kind() == reflect.Slice:
+			prop = map[string]any{"type": "array", "items": map[string]any{"type": "string"}}
+		default:
+			prop = map[string]any{"type": "string"}
+		}
+
+		if fd != nil {
+			loc := fd.ParentFile().SourceLocations().ByDescriptor(fd)
+			if c := strings.Join(strings.Fields(loc.LeadingComments), " "); c != "" {
+				prop["description"] = c
+			}
+		}
+		if name := f.Tag.Get("flag"); name != "" {
+			prop["x-flag"] = "--" + name
+			if fl := fs.Lookup(name); fl != nil {
+				if d, ok := flagDefault(fl, ft.Kind()); ok {
+					prop["default"] = d
+				}
+			}
+		}
+		if d, ok := f.Tag.Lookup("default"); ok {
+			prop["default"] = d
+		}
+		if e, ok := f.Tag.Lookup("enum"); ok {
+			prop["enum"] = strings.Split(e, ",")
+		}
+		props[key] = prop
+	}
+
+	return map[string]any{
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties":           props,
+	}
+}
+
+// flagDefault converts a flag's default value to the JSON type of its key.
+func flagDefault(fl *flag.Flag, kind reflect.Kind) (any, bool) {
+	switch kind {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(fl.DefValue)
+		return b, err == nil
+	case reflect.Int:
+		n, err := strconv.Atoi(fl.DefValue)
+		return n, err == nil
+	case reflect.Slice:
+		return []string{}, true
+	default:
+		return fl.DefValue, true
+	}
+}
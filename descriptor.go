@@ -0,0 +1,132 @@
+package protosort
+
+import (
+	"fmt"
+	"strings"
+
+	descriptorpb "google.golang.org/protobuf/types/descriptorpb"
+)
+
+// DescriptorSource reconstructs enough of a .proto file from its compiled
+// descriptor for ScanFile and Classify: the syntax or edition, the package,
+// and every message, enum, and service with its fields, values, and RPCs,
+// in descriptor order. Comments, options, imports, and extensions aren't
+// reconstructed. It is for teams that only have compiled images, such as
+// those a schema registry serves, and want the classification without the
+// source.
+func DescriptorSource(fd *descriptorpb.FileDescriptorProto) string {
+	var b strings.Builder
+	switch fd.GetSyntax() {
+	case "editions":
+		fmt.Fprintf(&b, "edition = %q;\n", strings.TrimPrefix(fd.GetEdition().String(), "EDITION_"))
+	case "proto3":
+		b.WriteString("syntax = \"proto3\";\n")
+	default:
+		b.WriteString("syntax = \"proto2\";\n")
+	}
+	if fd.GetPackage() != "" {
+		fmt.Fprintf(&b, "\npackage %s;\n", fd.GetPackage())
+	}
+
+	d := descriptorWriter{b: &b, pkg: fd.GetPackage()}
+	for _, m := range fd.GetMessageType() {
+		b.WriteByte('\n')
+		d.message(m, "")
+	}
+	for _, e := range fd.GetEnumType() {
+		b.WriteByte('\n')
+		d.enum(e, "")
+	}
+	for _, s := range fd.GetService() {
+		b.WriteByte('\n')
+		d.service(s)
+	}
+	return b.String()
+}
+
+// descriptorWriter writes declarations for DescriptorSource.
+type descriptorWriter struct {
+	b   *strings.Builder
+	pkg string
+}
+
+func (d descriptorWriter) message(m *descriptorpb.DescriptorProto, indent string) {
+	fmt.Fprintf(d.b, "%smessage %s {\n", indent, m.GetName())
+	entries := make(map[string]*descriptorpb.DescriptorProto)
+	for _, nested := range m.GetNestedType() {
+		if nested.GetOptions().GetMapEntry() {
+			entries[nested.GetName()] = nested
+		}
+	}
+	for _, f := range m.GetField() {
+		typ := d.fieldType(f)
+		label := ""
+		switch {
+		case f.GetTypeName() != "" && entries[lastComponent(f.GetTypeName())] != nil:
+			entry := entries[lastComponent(f.GetTypeName())]
+			typ = fmt.Sprintf("map<%s, %s>", d.fieldType(entry.GetField()[0]), d.fieldType(entry.GetField()[1]))
+		case f.GetLabel() == descriptorpb.FieldDescriptorProto_LABEL_REPEATED:
+			label = "repeated "
+		case f.GetProto3Optional():
+			label = "optional "
+		}
+		fmt.Fprintf(d.b, "%s  %s%s %s = %d;\n", indent, label, typ, f.GetName(), f.GetNumber())
+	}
+	for _, nested := range m.GetNestedType() {
+		if !nested.GetOptions().GetMapEntry() {
+			d.message(nested, indent+"  ")
+		}
+	}
+	for _, e := range m.GetEnumType() {
+		d.enum(e, indent+"  ")
+	}
+	fmt.Fprintf(d.b, "%s}\n", indent)
+}
+
+func (d descriptorWriter) enum(e *descriptorpb.EnumDescriptorProto, indent string) {
+	fmt.Fprintf(d.b, "%senum %s {\n", indent, e.GetName())
+	for _, v := range e.GetValue() {
+		fmt.Fprintf(d.b, "%s  %s = %d;\n", indent, v.GetName(), v.GetNumber())
+	}
+	fmt.Fprintf(d.b, "%s}\n", indent)
+}
+
+func (d descriptorWriter) service(s *descriptorpb.ServiceDescriptorProto) {
+	fmt.Fprintf(d.b, "service %s {\n", s.GetName())
+	for _, m := range s.GetMethod() {
+		in, out := d.typeName(m.GetInputType()), d.typeName(m.GetOutputType())
+		if m.GetClientStreaming() {
+			in = "stream " + in
+		}
+		if m.GetServerStreaming() {
+			out = "stream " + out
+		}
+		fmt.Fprintf(d.b, "  rpc %s(%s) returns (%s);\n", m.GetName(), in, out)
+	}
+	d.b.WriteString("}\n")
+}
+
+// fieldType returns the type of f as written in a field declaration.
+func (d descriptorWriter) fieldType(f *descriptorpb.FieldDescriptorProto) string {
+	if f.GetTypeName() != "" {
+		return d.typeName(f.GetTypeName())
+	}
+	return strings.ToLower(strings.TrimPrefix(f.GetType().String(), "TYPE_"))
+}
+
+// typeName returns a fully qualified type name (".acme.v1.Trip") as the
+// file would write it: relative to its package when it is in it.
+func (d descriptorWriter) typeName(name string) string {
+	name = strings.TrimPrefix(name, ".")
+	if d.pkg != "" {
+		if rest, ok := strings.CutPrefix(name, d.pkg+"."); ok {
+			return rest
+		}
+	}
+	return name
+}
+
+// lastComponent returns the last dot-separated part of a qualified name.
+func lastComponent(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
@@ -0,0 +1,129 @@
+package protosort
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxHunkNotes caps the declarations named in one hunk header.
+const maxHunkNotes = 3
+
+// DiffSorted is DiffStrings for a file and its sorted output. Each hunk
+// header names the declarations the hunk touches and what happened to
+// them, e.g. "@@ -4,6 +4,6 @@ message UserProfile moved to composite
+// types", so plain-text diff readers see why lines moved. opts are the
+// options the file was sorted with, used to classify the declarations.
+func DiffSorted(original, sorted, nameA, nameB string, opts Options) string {
+	origBlocks, err := ScanFile(original)
+	if err != nil {
+		return DiffStrings(original, sorted, nameA, nameB)
+	}
+	sortedBlocks, err := ScanFile(sorted)
+	if err != nil {
+		return DiffStrings(original, sorted, nameA, nameB)
+	}
+	Classify(sortedBlocks, opts)
+
+	origSpans, sortedSpans := declSpans(origBlocks), declSpans(sortedBlocks)
+	pairs := matchBlocks(declarations(origBlocks), declarations(sortedBlocks))
+
+	return diffStrings(original, sorted, nameA, nameB, func(h hunk) string {
+		var notes []string
+		seen := make(map[string]bool)
+		note := func(b *Block) {
+			if b == nil {
+				return
+			}
+			text := describeSortedBlock(b, pairs[b])
+			if !seen[text] {
+				seen[text] = true
+				notes = append(notes, text)
+			}
+		}
+		// A declaration that moved shows up as lines deleted where it was
+		// and inserted where it went; both hunks describe where it went
+		for _, i := range h.deleted {
+			if b := blockAtLine(origSpans, i); b != nil {
+				note(pairs[b])
+			}
+		}
+		for _, i := range h.inserted {
+			note(blockAtLine(sortedSpans, i))
+		}
+
+		if len(notes) > maxHunkNotes {
+			notes = append(notes[:maxHunkNotes], fmt.Sprintf("%d more", len(notes)-maxHunkNotes))
+		}
+		return strings.Join(notes, "; ")
+	})
+}
+
+// declSpan is the range of 0-based lines a block's declaration text covers.
+type declSpan struct {
+	block       *Block
+	first, last int
+}
+
+// declSpans returns the declaration spans of blocks from ScanFile. Comments
+// are left out, so a hunk that only adds a section header names nothing.
+func declSpans(blocks []*Block) []declSpan {
+	var spans []declSpan
+	for _, b := range blocks {
+		if b.Kind == BlockComment {
+			continue
+		}
+		first := b.Line - 1
+		last := first + strings.Count(strings.TrimSuffix(b.DeclText, "\n"), "\n")
+		spans = append(spans, declSpan{b, first, last})
+	}
+	return spans
+}
+
+// blockAtLine returns the block whose declaration covers line, or nil.
+func blockAtLine(spans []declSpan, line int) *Block {
+	for _, s := range spans {
+		if line >= s.first && line <= s.last {
+			return s.block
+		}
+	}
+	return nil
+}
+
+// blockKey identifies a block across the original and sorted files.
+func blockKey(b *Block) string {
+	return b.Kind.String() + " " + b.Name
+}
+
+// describeSortedBlock says what sorting did to b, given its original
+// version (nil if there is none).
+func describeSortedBlock(b, orig *Block) string {
+	switch b.Kind {
+	case BlockSyntax, BlockPackage, BlockOption, BlockImport:
+		return "header reordered"
+	case BlockExtend:
+		if orig != nil && orig.DeclText != b.DeclText {
+			return "extend " + b.Name + " changed"
+		}
+		return "extend " + b.Name + " moved to the header"
+	}
+	if orig != nil && orig.DeclText != b.DeclText {
+		return blockKey(b) + " changed"
+	}
+	return blockKey(b) + " moved to " + sectionTitle(b.Section)
+}
+
+// sectionTitle names a body section in diff hunk headers.
+func sectionTitle(s Section) string {
+	switch s {
+	case SectionService:
+		return "services"
+	case SectionRequestResponse:
+		return "request/response types"
+	case SectionCore:
+		return "composite types"
+	case SectionHelper:
+		return "helper types"
+	default:
+		return "unreferenced types"
+	}
+}
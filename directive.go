@@ -0,0 +1,153 @@
+package protosort
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ignoreDirectiveRe matches the comment line that pins a declaration in
+// place. Text after the directive, such as a reason, is allowed.
+var ignoreDirectiveRe = regexp.MustCompile(`(?m)^\s*//\s*protosort:ignore\b`)
+
+// hasIgnoreDirective reports whether a block's leading comments include
+// "// protosort:ignore".
+func hasIgnoreDirective(b *Block) bool {
+	return ignoreDirectiveRe.MatchString(b.Comments)
+}
+
+// pinIgnored puts the declarations marked with "// protosort:ignore" back
+// at their index in fileOrder, the body in file order, and fills the other
+// slots with the rest of body in its sorted order. Pinned declarations
+// therefore keep their position relative to the start of the body, and
+// everything else sorts around them.
+func pinIgnored(body, fileOrder []*Block) []*Block {
+	pinned := make(map[*Block]int)
+	for i, b := range fileOrder {
+		if hasIgnoreDirective(b) {
+			pinned[b] = i
+		}
+	}
+	if len(pinned) == 0 {
+		return body
+	}
+
+	result := make([]*Block, len(body))
+	for b, i := range pinned {
+		if i < len(result) {
+			result[i] = b
+		}
+	}
+	next := 0
+	for _, b := range body {
+		if i, ok := pinned[b]; ok && i < len(result) {
+			continue
+		}
+		for result[next] != nil {
+			next++
+		}
+		result[next] = b
+	}
+	return result
+}
+
+// pinDirectiveRe matches the comment line that moves a declaration to an
+// end of the body, capturing the position given with "=", if any.
+var pinDirectiveRe = regexp.MustCompile(`(?m)^\s*//\s*protosort:pin(?:=(\S*))?(?:\s|$)`)
+
+// pinEnds moves the declarations marked "// protosort:pin" (or "pin=top")
+// to the start of body and those marked "pin=bottom" to its end, keeping
+// the sorted order within each group. Other positions are reported and
+// ignored.
+func pinEnds(body []*Block) ([]*Block, []Warning) {
+	var top, rest, bottom []*Block
+	var warnings []Warning
+	for _, b := range body {
+		m := pinDirectiveRe.FindStringSubmatch(b.Comments)
+		switch {
+		case m == nil:
+			rest = append(rest, b)
+		case m[1] == "" || m[1] == "top":
+			top = append(top, b)
+		case m[1] == "bottom":
+			bottom = append(bottom, b)
+		default:
+			warnings = append(warnings, Warning{Code: WarningDirective, Message: fmt.Sprintf("%s %s: unknown protosort:pin position %q (want top or bottom)", b.Kind, b.Name, m[1]), Line: b.Line})
+			rest = append(rest, b)
+		}
+	}
+	if len(top) == 0 && len(bottom) == 0 {
+		return body, warnings
+	}
+	return append(append(top, rest...), bottom...), warnings
+}
+
+// sectionDirectiveRe matches the comment line that overrides a type's
+// classification, capturing the section name.
+var sectionDirectiveRe = regexp.MustCompile(`(?m)^\s*//\s*protosort:section=(\S*)`)
+
+// sectionNames maps the names accepted by "// protosort:section=" to
+// sections.
+var sectionNames = map[string]Section{
+	"core":         SectionCore,
+	"helper":       SectionHelper,
+	"unreferenced": SectionUnreferenced,
+	"rpc":          SectionRequestResponse,
+}
+
+// sectionOverride returns the section a message or enum's
+// "// protosort:section=" directive puts it in. ok is false when it has no
+// directive or an unknown section name (see sectionDirectiveWarnings).
+func sectionOverride(b *Block) (section Section, ok bool) {
+	if b.Kind != BlockMessage && b.Kind != BlockEnum {
+		return 0, false
+	}
+	m := sectionDirectiveRe.FindStringSubmatch(b.Comments)
+	if m == nil {
+		return 0, false
+	}
+	section, ok = sectionNames[m[1]]
+	return section, ok
+}
+
+// sectionDirectiveWarnings reports "// protosort:section=" directives that
+// are ignored: on a service, or naming no known section.
+func sectionDirectiveWarnings(blocks []*Block) []Warning {
+	var warnings []Warning
+	for _, b := range blocks {
+		m := sectionDirectiveRe.FindStringSubmatch(b.Comments)
+		switch {
+		case m == nil:
+		case b.Kind != BlockMessage && b.Kind != BlockEnum:
+			warnings = append(warnings, Warning{Code: WarningDirective, Message: fmt.Sprintf("%s %s: protosort:section only applies to messages and enums", b.Kind, b.Name), Line: b.Line})
+		default:
+			if _, ok := sectionNames[m[1]]; !ok {
+				warnings = append(warnings, Warning{Code: WarningDirective, Message: fmt.Sprintf("%s %s: unknown protosort:section %q (want core, helper, unreferenced, or rpc)", b.Kind, b.Name, m[1]), Line: b.Line})
+			}
+		}
+	}
+	return warnings
+}
+
+// skipFileDirectiveRe matches the comment line that opts a file out.
+var skipFileDirectiveRe = regexp.MustCompile(`^\s*//\s*protosort:skip-file\b`)
+
+// bodyKeywordRe matches the first line of a message, enum, service, or
+// extend declaration.
+var bodyKeywordRe = regexp.MustCompile(`^\s*(message|enum|service|extend)\b`)
+
+// HasSkipFileDirective reports whether content has a "// protosort:skip-file"
+// line near the top, above its first message, enum, service, or extend.
+// Sort returns such files unchanged, whatever their syntax, so generated
+// and vendored protos can live alongside sorted ones.
+func HasSkipFileDirective(content string) bool {
+	for line := range strings.Lines(strings.TrimPrefix(content, utf8BOM)) {
+		if bodyKeywordRe.MatchString(line) {
+			return false
+		}
+		if skipFileDirectiveRe.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
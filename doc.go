@@ -0,0 +1,14 @@
+// Package protosort reorders the top-level declarations of .proto files into
+// a consistent layout: header, services, RPC request/response types,
+// standalone types, composite types, and helper types.
+//
+// Sort is the entry point for most callers. ScanFile and Classify expose the
+// intermediate steps for tools that want the classification without the
+// rewritten file, Parse returns the same declarations as a syntax tree, and
+// ReplaceBlock rewrites a single declaration in place.
+// Sort runs the stages of NewPipeline (scan, classify, order, annotate,
+// emit); a Pipeline can take extra stages, e.g. to add org-specific
+// comments, without changing the built-in ones.
+//
+// The protosort command in cmd/protosort is a thin CLI over this package.
+package protosort
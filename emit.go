@@ -1,11 +1,20 @@
-package main
+package protosort
 
 import (
+	"fmt"
 	"strings"
 )
 
 // Emit produces the final reordered file content from sorted blocks.
 func Emit(headerComments string, syntax *Block, pkg *Block, options []*Block, imports []*Block, extends []*Block, body []*Block) string {
+	return emit(headerComments, syntax, pkg, options, [][]*Block{imports}, extends, body, nil, "")
+}
+
+// emit is Emit with the imports split into groups separated by blank lines.
+// blankLines, if not nil, returns the number of blank lines between two
+// adjacent body blocks instead of one. trailingComments, the comments after
+// the last declaration of the input, end the file as they were written.
+func emit(headerComments string, syntax *Block, pkg *Block, options []*Block, importGroups [][]*Block, extends []*Block, body []*Block, blankLines func(prev, b *Block) int, trailingComments string) string {
 	var out strings.Builder
 
 	// File header comments (license, etc.)
@@ -15,6 +24,9 @@ func Emit(headerComments string, syntax *Block, pkg *Block, options []*Block, im
 		if !strings.HasSuffix(headerComments, "\n") {
 			out.WriteByte('\n')
 		}
+		if syntax != nil && syntax.Floating && !strings.HasSuffix(headerComments, "\n\n") {
+			out.WriteByte('\n')
+		}
 	}
 
 	// Syntax statement
@@ -46,7 +58,10 @@ func Emit(headerComments string, syntax *Block, pkg *Block, options []*Block, im
 	}
 
 	// Imports (sorted)
-	if len(imports) > 0 {
+	for _, imports := range importGroups {
+		if len(imports) == 0 {
+			continue
+		}
 		out.WriteByte('\n')
 		for _, imp := range imports {
 			writeBlockWithComments(&out, imp)
@@ -54,11 +69,21 @@ func Emit(headerComments string, syntax *Block, pkg *Block, options []*Block, im
 	}
 
 	// Body (services, request/response, core, helpers, unreferenced)
-	for _, b := range body {
-		out.WriteByte('\n')
+	for i, b := range body {
+		n := 1
+		if i > 0 && blankLines != nil {
+			n = blankLines(body[i-1], b)
+		}
+		out.WriteString(strings.Repeat("\n", n))
 		writeBlockWithComments(&out, b)
 	}
 
+	// End-of-file comments, such as TODO notes, belong to no declaration;
+	// a blank line keeps protoc from attaching them to the last one
+	if trailing := cleanComments(trailingComments); trailing != "" {
+		out.WriteString("\n" + trailing)
+	}
+
 	result := out.String()
 
 	// Ensure file ends with a single newline
@@ -67,6 +92,68 @@ func Emit(headerComments string, syntax *Block, pkg *Block, options []*Block, im
 	return result
 }
 
+// EmitBlock returns a single block as Emit writes it: its comments, with
+// blank lines around them trimmed, then its declaration text and trailing
+// comments, ending with a newline.
+func EmitBlock(b *Block) string {
+	var out strings.Builder
+	writeBlockWithComments(&out, b)
+	return out.String()
+}
+
+// ReplaceBlock returns content with the declaration of the message, enum,
+// service, or extend named name replaced by newText, a single declaration.
+// Nothing else changes: the declaration's leading comments stay, and so
+// does an inline comment on its closing line unless newText ends with one
+// of its own.
+func ReplaceBlock(content string, name string, newText string) (string, error) {
+	blocks, err := ScanFile(content)
+	if err != nil {
+		return "", &ParseError{Err: err}
+	}
+	replacement, err := ScanFile(newText)
+	if err != nil {
+		return "", &ParseError{Err: err}
+	}
+	if len(replacement) != 1 || replacement[0].Kind == BlockComment || strings.TrimSpace(replacement[0].Comments) != "" {
+		return "", fmt.Errorf("replacement for %s must be a single declaration", name)
+	}
+
+	// Comments and DeclText of successive blocks cover content exactly
+	var target *Block
+	start, pos := 0, 0
+	for _, b := range blocks {
+		pos += len(b.Comments)
+		switch b.Kind {
+		case BlockMessage, BlockEnum, BlockService, BlockExtend:
+			if b.Name == name {
+				if target != nil {
+					return "", fmt.Errorf("more than one declaration named %s", name)
+				}
+				start, target = pos, b
+			}
+		}
+		pos += len(b.DeclText)
+	}
+	if target == nil {
+		return "", fmt.Errorf("no declaration named %s", name)
+	}
+
+	_, oldTrailing := splitTrailingComment(target.DeclText)
+	decl, trailing := splitTrailingComment(replacement[0].DeclText)
+	if trailing == "" {
+		trailing = oldTrailing
+	}
+	text := strings.TrimSuffix(decl+trailing, "\n")
+	// A trailing comment consumes its newline; keep the line break after
+	// the declaration where content had one
+	end := start + len(target.DeclText)
+	if strings.HasSuffix(target.DeclText, "\n") || (trailing != "" && end < len(content) && content[end] != '\n') {
+		text += "\n"
+	}
+	return content[:start] + text + content[end:], nil
+}
+
 // writeBlockWithComments writes a block's comments and declaration text to the builder.
 func writeBlockWithComments(out *strings.Builder, b *Block) {
 	comments := cleanComments(b.Comments)
@@ -75,11 +162,27 @@ func writeBlockWithComments(out *strings.Builder, b *Block) {
 		if !strings.HasSuffix(comments, "\n") {
 			out.WriteByte('\n')
 		}
+		if b.Floating && !strings.HasSuffix(comments, "\n\n") {
+			out.WriteByte('\n')
+		}
 	}
 	out.WriteString(b.DeclText)
 	if !strings.HasSuffix(b.DeclText, "\n") {
 		out.WriteByte('\n')
 	}
+	if b.TrailingComments != "" {
+		out.WriteString(b.TrailingComments)
+		if !strings.HasSuffix(b.TrailingComments, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+}
+
+// endsDetached reports whether comments hold a comment and end with a
+// blank line, which detaches them from the declaration below.
+func endsDetached(comments string) bool {
+	trimmed := strings.TrimRight(comments, " \t\r\n")
+	return trimmed != "" && strings.Count(comments[len(trimmed):], "\n") >= 2
 }
 
 // cleanComments removes leading/trailing blank lines from a comment block
@@ -112,7 +215,7 @@ func cleanComments(s string) string {
 
 	// Check if this ends with a section header banner line
 	preserveOneBlankLine := false
-	if end > 0 && strings.Contains(lines[end-1], "// ==========") && trailingBlanks > 0 {
+	if end > 0 && (strings.Contains(lines[end-1], "// ==========") || isBannerLine(lines[end-1])) && trailingBlanks > 0 {
 		preserveOneBlankLine = true
 	}
 
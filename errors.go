@@ -1,12 +1,15 @@
-package main
+package protosort
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // Proto2Error is returned when the input file uses proto2 syntax.
 type Proto2Error struct{}
 
 func (e *Proto2Error) Error() string {
-	return "proto2 files are not supported"
+	return "proto2 files are not supported (use --allow-proto2 to sort them)"
 }
 
 // ParseError wraps a parsing error from the scanner.
@@ -21,3 +24,64 @@ func (e *ParseError) Error() string {
 func (e *ParseError) Unwrap() error {
 	return e.Err
 }
+
+// Position returns the 1-based line and column the error occurred at, or
+// zeros if it has none. For a file with several errors it is the first's.
+func (e *ParseError) Position() (line, column int) {
+	var se *scanError
+	if errors.As(e.Err, &se) {
+		return se.Line, se.Column
+	}
+	return 0, 0
+}
+
+// UnsupportedError is returned in --strict mode when a file has structure
+// that protosort's single-header layout can't represent without dropping content.
+type UnsupportedError struct {
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return "unsupported file structure: " + e.Reason
+}
+
+// ConflictError is returned for a file that still has merge conflict
+// markers, such as one protosort is run on in the middle of a rebase.
+type ConflictError struct {
+	Line int // 1-based line of the first marker
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("merge conflict marker at line %d; resolve the conflict first", e.Line)
+}
+
+// Warning is a non-fatal problem found while sorting, such as an exceeded
+// size threshold. Sort returns no warnings when Options.Quiet is set.
+type Warning struct {
+	Code    string // one of the Warning* codes below
+	Message string
+	Line    int // 1-based input line of the declaration it concerns, or 0
+}
+
+// Warning codes, which identify the kind of a Warning, e.g. for counting
+// warnings across runs. They don't change once published.
+const (
+	WarningUnsupported       = "unsupported"        // file left unchanged for its structure
+	WarningMixedIndent       = "mixed-indent"       // tabs and spaces mixed in indentation
+	WarningSize              = "size"               // a size threshold was exceeded
+	WarningRegion            = "region"             // a fold marker was dropped or closed
+	WarningDirective         = "directive"          // a protosort: directive was ignored
+	WarningRPCOrder          = "rpc-order"          // an RPC departs from its fingerprint
+	WarningHelperCycle       = "helper-cycle"       // helper types consume each other
+	WarningUnpairedRequest   = "unpaired-request"   // a request not followed by its response
+	WarningUnusedImport      = "unused-import"      // unused imports were removed
+	WarningUnresolvedImport  = "unresolved-import"  // an import couldn't be checked for use
+	WarningDuplicate         = "duplicate"          // a repeated import or option was dropped
+	WarningConflictingOption = "conflicting-option" // an option is set more than once to different values
+	WarningVerbatim          = "verbatim"           // a verbatim region couldn't be kept as written
+	WarningLicense           = "license"            // a copyright notice doesn't match the license template
+)
+
+func (w Warning) String() string {
+	return w.Message
+}
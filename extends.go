@@ -0,0 +1,105 @@
+package protosort
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// groupExtends orders extend blocks for Options.GroupExtends: by extended
+// type name, each followed by the messages and enums that only extends use,
+// such as the enum a custom option's field takes. A type goes with the
+// first extend that uses it, directly or through another such type, and
+// the types follow in the order they are used. It returns the extends with
+// their types, and body without those types.
+//
+// A type that a message or service in body uses stays in body, as does one
+// with a protosort: directive or in a verbatim region, whose placement is
+// decided elsewhere.
+func groupExtends(extends, body []*Block) (grouped, rest []*Block) {
+	sorted := make([]*Block, len(extends))
+	copy(sorted, extends)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	byName := make(map[string]*Block)
+	for _, b := range body {
+		if (b.Kind == BlockMessage || b.Kind == BlockEnum) && b.Name != "" {
+			byName[b.Name] = b
+		}
+	}
+
+	// A type is a candidate until a declaration that isn't one uses it;
+	// dropping one may disqualify the types it uses in turn
+	candidate := make(map[*Block]bool)
+	for _, b := range byName {
+		if !b.Verbatim && !hasIgnoreDirective(b) && !pinDirectiveRe.MatchString(b.Comments) && !sectionDirectiveRe.MatchString(b.Comments) {
+			candidate[b] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range body {
+			if candidate[b] {
+				continue
+			}
+			for _, name := range blockRefs(b) {
+				if t := byName[name]; t != nil && t != b && candidate[t] {
+					delete(candidate, t)
+					changed = true
+				}
+			}
+		}
+	}
+
+	placed := make(map[*Block]bool)
+	var place func(b *Block)
+	place = func(b *Block) {
+		for _, name := range ExtractFieldTypes(b) {
+			if t := byName[name]; t != nil && candidate[t] && !placed[t] {
+				placed[t] = true
+				grouped = append(grouped, t)
+				place(t)
+			}
+		}
+	}
+	for _, ext := range sorted {
+		grouped = append(grouped, ext)
+		place(ext)
+	}
+
+	for _, b := range body {
+		if !placed[b] {
+			rest = append(rest, b)
+		}
+	}
+	return grouped, rest
+}
+
+// blockRefs returns the type names a message uses in its fields, or a
+// service in its RPCs.
+func blockRefs(b *Block) []string {
+	if b.Kind == BlockService {
+		var refs []string
+		for _, rpc := range ExtractRPCs(b) {
+			refs = append(refs, rpc.RequestType, rpc.ResponseType)
+		}
+		return refs
+	}
+	return ExtractFieldTypes(b)
+}
+
+// injectExtendsHeader puts the section header of the extends and their
+// types, HeaderStyle.Extends, above the first of grouped.
+func injectExtendsHeader(grouped []*Block, stats bool, style *sectionHeaderStyle) {
+	if len(grouped) == 0 {
+		return
+	}
+	label := style.label("Extends", headerLabel{Count: len(grouped)})
+	if stats && !style.counted["Extends"] {
+		label += fmt.Sprintf(" (%d)", len(grouped))
+	}
+	b := grouped[0]
+	b.Comments = style.comment(label) + strings.TrimLeft(b.Comments, "\n")
+}
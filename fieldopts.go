@@ -0,0 +1,139 @@
+package protosort
+
+import (
+	"sort"
+	"strings"
+)
+
+// fieldOption is one name = value entry of a bracketed field option list.
+type fieldOption struct {
+	Name  string
+	Value string
+}
+
+// SortFieldOptions rewrites every single-line bracketed option list in a
+// declaration (e.g. `[(gogoproto.nullable)=false,deprecated = true]`) so its
+// entries are sorted by option name and spaced as `[a = 1, b = 2]`. Option
+// lists that span lines or contain comments are left untouched, as is
+// everything inside strings and comments.
+func SortFieldOptions(declText string) string {
+	var out strings.Builder
+	s := &scanner{content: declText}
+
+	for !s.atEnd() {
+		c := s.peek()
+		start := s.pos
+		switch {
+		case c == '"' || c == '\'':
+			s.skipString(c)
+		case c == '/' && s.peekAt(1) == '/':
+			s.skipToEndOfLine()
+		case c == '/' && s.peekAt(1) == '*':
+			s.skipBlockComment()
+		case c == '[' && followsFieldNumber(declText[:s.pos]):
+			end := matchingBracket(declText, s.pos)
+			if end < 0 {
+				s.pos++
+				break
+			}
+			list := declText[s.pos+1 : end]
+			s.pos = end + 1
+			if opts, ok := splitFieldOptions(list); ok {
+				out.WriteString(formatFieldOptions(opts))
+				continue
+			}
+		default:
+			s.pos++
+		}
+		out.WriteString(declText[start:s.pos])
+	}
+
+	return out.String()
+}
+
+// followsFieldNumber reports whether text ends with a field or enum value
+// number (ignoring trailing whitespace), i.e. a '[' here opens field options.
+func followsFieldNumber(text string) bool {
+	text = strings.TrimRight(text, " \t")
+	return text != "" && text[len(text)-1] >= '0' && text[len(text)-1] <= '9'
+}
+
+// matchingBracket returns the index of the ']' closing the '[' at open,
+// skipping strings and nested brackets or braces, or -1 if there is none.
+func matchingBracket(text string, open int) int {
+	s := &scanner{content: text, pos: open + 1}
+	depth := 0
+	for !s.atEnd() {
+		c := s.peek()
+		switch {
+		case c == '"' || c == '\'':
+			s.skipString(c)
+			continue
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' && depth == 0:
+			return s.pos
+		case c == ']' || c == '}':
+			depth--
+		}
+		s.pos++
+	}
+	return -1
+}
+
+// splitFieldOptions splits the contents of an option list at top-level
+// commas. It returns false for lists it won't rewrite: multi-line lists,
+// lists containing comments, and entries without a name = value shape.
+func splitFieldOptions(list string) ([]fieldOption, bool) {
+	if strings.Contains(list, "\n") || strings.Contains(list, "//") || strings.Contains(list, "/*") {
+		return nil, false
+	}
+
+	var entries []string
+	s := &scanner{content: list}
+	depth, start := 0, 0
+	for !s.atEnd() {
+		c := s.peek()
+		switch {
+		case c == '"' || c == '\'':
+			s.skipString(c)
+			continue
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			entries = append(entries, list[start:s.pos])
+			start = s.pos + 1
+		}
+		s.pos++
+	}
+	entries = append(entries, list[start:])
+
+	var opts []fieldOption
+	for _, e := range entries {
+		eq := strings.IndexByte(e, '=')
+		if eq < 0 {
+			return nil, false
+		}
+		name := strings.Join(strings.Fields(e[:eq]), "")
+		value := strings.TrimSpace(e[eq+1:])
+		if name == "" || value == "" {
+			return nil, false
+		}
+		opts = append(opts, fieldOption{Name: name, Value: value})
+	}
+	return opts, true
+}
+
+// formatFieldOptions renders options sorted by name in canonical spacing.
+func formatFieldOptions(opts []fieldOption) string {
+	sort.SliceStable(opts, func(i, j int) bool {
+		return opts[i].Name < opts[j].Name
+	})
+	parts := make([]string, len(opts))
+	for i, o := range opts {
+		parts[i] = o.Name + " = " + o.Value
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
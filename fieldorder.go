@@ -0,0 +1,79 @@
+package protosort
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// fieldNumberRe matches the "= N" that numbers a field, in decimal, hex,
+// or octal.
+var fieldNumberRe = regexp.MustCompile(`=\s*(0[xX][0-9a-fA-F]+|[0-9]+)`)
+
+// nonFieldKeywords start message members that have no field number of
+// their own.
+var nonFieldKeywords = map[string]bool{
+	"message":    true,
+	"enum":       true,
+	"extend":     true,
+	"option":     true,
+	"reserved":   true,
+	"extensions": true,
+	"oneof":      true,
+	"":           true, // empty statement
+}
+
+// SortFields sorts the fields of a message declaration by field number,
+// recursively through its nested messages. Fields and oneofs trade places
+// among the slots they already occupy, so nested declarations, options,
+// reserved statements, and blank lines stay where they are; comments
+// directly above a field move with it. A oneof stays together, ordered by
+// its lowest field number, and its own fields are sorted too.
+func SortFields(declText string) string {
+	body, ok := splitMessageBody(declText)
+	if !ok {
+		return declText
+	}
+	numbers := make(map[int]int64)
+	var slots []int
+	for i, m := range body.members {
+		switch m.keyword {
+		case "message", "oneof":
+			body.members[i].decl = SortFields(m.decl)
+		}
+		if n, ok := memberFieldNumber(body.members[i]); ok {
+			numbers[i] = n
+			slots = append(slots, i)
+		}
+	}
+	body.sortSlots(slots, func(i, j int) bool {
+		return numbers[i] < numbers[j]
+	})
+	return body.join()
+}
+
+// memberFieldNumber returns the field number of a field, or the lowest one
+// of a oneof's fields. ok is false for other members.
+func memberFieldNumber(m messageMember) (n int64, ok bool) {
+	if m.keyword == "oneof" {
+		body, ok := splitMessageBody(m.decl)
+		if !ok {
+			return 0, false
+		}
+		found := false
+		for _, f := range body.members {
+			if fn, ok := memberFieldNumber(f); ok && (!found || fn < n) {
+				n, found = fn, true
+			}
+		}
+		return n, found
+	}
+	if nonFieldKeywords[m.keyword] {
+		return 0, false
+	}
+	match := fieldNumberRe.FindStringSubmatch(m.decl)
+	if match == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(match[1], 0, 64)
+	return n, err == nil
+}
@@ -4,5 +4,8 @@ go 1.25.3
 
 require (
 	github.com/BurntSushi/toml v1.6.0
+	github.com/bufbuild/protocompile v0.14.1
 	google.golang.org/protobuf v1.36.11
 )
+
+require golang.org/x/sync v0.8.0 // indirect
@@ -0,0 +1,159 @@
+package protosort
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcCompatFile is the name both versions are compiled under, so their
+// descriptors agree on file name.
+const grpcCompatFile = "file.proto"
+
+// compileInProcess compiles content as grpcCompatFile with protocompile,
+// resolving imports from opts.ProtoPaths and the well-known types.
+func compileInProcess(content string, opts Options) (protoreflect.FileDescriptor, error) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(protocompile.CompositeResolver{
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				if path == grpcCompatFile {
+					return protocompile.SearchResult{Source: strings.NewReader(content)}, nil
+				}
+				return protocompile.SearchResult{}, protoregistry.NotFound
+			}),
+			&protocompile.SourceResolver{ImportPaths: opts.ProtoPaths},
+		}),
+	}
+	files, err := compiler.Compile(context.Background(), grpcCompatFile)
+	if err != nil {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// verifyGRPCCompat checks that every gRPC method resolves the same way before
+// and after sorting, as seen by reflection clients such as grpcurl: each
+// version is compiled in-process, rebuilt from its FileDescriptorProto into a
+// fresh registry, and each method's input and output must resolve to a
+// message that dynamicpb can instantiate.
+func verifyGRPCCompat(original, sorted string, opts Options) error {
+	origMethods, err := resolveServiceMethods(original, opts)
+	if err != nil {
+		return fmt.Errorf("original: %w", err)
+	}
+	sortedMethods, err := resolveServiceMethods(sorted, opts)
+	if err != nil {
+		return fmt.Errorf("sorted output: %w", err)
+	}
+
+	var problems []string
+	for name, sig := range origMethods {
+		got, ok := sortedMethods[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("method %s missing after sorting", name))
+		case got != sig:
+			problems = append(problems, fmt.Sprintf("method %s changed: %s -> %s", name, sig, got))
+		}
+	}
+	for name := range sortedMethods {
+		if _, ok := origMethods[name]; !ok {
+			problems = append(problems, fmt.Sprintf("method %s added by sorting", name))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// resolveServiceMethods compiles content and returns each method's signature
+// keyed by its gRPC path (/package.Service/Method).
+func resolveServiceMethods(content string, opts Options) (map[string]string, error) {
+	compiled, err := compileInProcess(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := new(protoregistry.Files)
+	if err := registerRebuilt(registry, compiled); err != nil {
+		return nil, err
+	}
+	fd, err := registry.FindFileByPath(grpcCompatFile)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := make(map[string]string)
+	services := fd.Services()
+	for i := 0; i < services.Len(); i++ {
+		svc := services.Get(i)
+		for j := 0; j < svc.Methods().Len(); j++ {
+			m := svc.Methods().Get(j)
+			path := fmt.Sprintf("/%s/%s", svc.FullName(), m.Name())
+			in, err := resolveMessage(registry, m.Input().FullName())
+			if err != nil {
+				return nil, fmt.Errorf("%s input: %w", path, err)
+			}
+			out, err := resolveMessage(registry, m.Output().FullName())
+			if err != nil {
+				return nil, fmt.Errorf("%s output: %w", path, err)
+			}
+			methods[path] = fmt.Sprintf("(%s%s) returns (%s%s)",
+				streamPrefix(m.IsStreamingClient()), in, streamPrefix(m.IsStreamingServer()), out)
+		}
+	}
+	return methods, nil
+}
+
+// registerRebuilt registers fd and its imports in registry, each rebuilt from
+// its FileDescriptorProto the way a reflection client reconstructs them.
+func registerRebuilt(registry *protoregistry.Files, fd protoreflect.FileDescriptor) error {
+	if _, err := registry.FindFileByPath(fd.Path()); err == nil {
+		return nil
+	}
+	imports := fd.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		if err := registerRebuilt(registry, imports.Get(i).FileDescriptor); err != nil {
+			return err
+		}
+	}
+	rebuilt, err := protodesc.NewFile(protodesc.ToFileDescriptorProto(fd), registry)
+	if err != nil {
+		return fmt.Errorf("rebuilding %s: %w", fd.Path(), err)
+	}
+	return registry.RegisterFile(rebuilt)
+}
+
+// resolveMessage looks up a message by name and checks that it can be
+// instantiated and serialized dynamically.
+func resolveMessage(registry *protoregistry.Files, name protoreflect.FullName) (string, error) {
+	d, err := registry.FindDescriptorByName(name)
+	if err != nil {
+		return "", err
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return "", fmt.Errorf("%s is not a message", name)
+	}
+	if _, err := proto.Marshal(dynamicpb.NewMessage(md)); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return string(md.FullName()), nil
+}
+
+func streamPrefix(streaming bool) string {
+	if streaming {
+		return "stream "
+	}
+	return ""
+}
@@ -0,0 +1,200 @@
+package protosort
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// HeaderStyle is the look of the section headers Options.SectionHeaders
+// inserts. Each label is a text/template; the RPC label gets the RPC's name
+// as {{.RPC}}, the Service label the service's as {{.Service}}, and every
+// label gets the number of declarations under its header as {{.Count}}. A
+// label showing {{.Count}} shows it whether or not Options.SectionStats is
+// set, and isn't given another. Empty fields keep the default style, which
+// is:
+//
+//	// ============================================================================
+//	// Types for GetTrip
+//	// ============================================================================
+type HeaderStyle struct {
+	RPC         string // request/response types of one RPC: "Types for {{.RPC}}"
+	Service     string // a service, with Options.GroupByService: "Service {{.Service}}"
+	Composite   string // "Composite Types -- using other types"
+	Helper      string // "Helper Types -- used in other types"
+	Standalone  string // in a file without services: "Standalone Types -- not referenced elsewhere in this file"
+	Unused      string // in a file with services: "Types unused by RPCs"
+	Extends     string // extends and their types, with Options.GroupExtends: "Custom Options"
+	BannerChar  string // a punctuation character repeated to make the banner lines: "="
+	BannerWidth int    // width of a banner line, "// " included: 79
+}
+
+// Default section header style, see HeaderStyle.
+var defaultHeaderStyle = HeaderStyle{
+	RPC:         "Types for {{.RPC}}",
+	Service:     "Service {{.Service}}",
+	Composite:   "Composite Types -- using other types",
+	Helper:      "Helper Types -- used in other types",
+	Standalone:  "Standalone Types -- not referenced elsewhere in this file",
+	Unused:      "Types unused by RPCs",
+	Extends:     "Custom Options",
+	BannerChar:  "=",
+	BannerWidth: len(sectionHeaderBanner),
+}
+
+// Validate reports a label that isn't a valid single-line template, or a
+// banner that couldn't be recognized again.
+func (s HeaderStyle) Validate() error {
+	_, err := newSectionHeaderStyle(s)
+	return err
+}
+
+// headerLabel is what a label template can refer to.
+type headerLabel struct {
+	RPC     string
+	Service string
+	Count   int
+}
+
+// sectionHeaderStyle renders section headers in a HeaderStyle and
+// recognizes them to strip them again.
+type sectionHeaderStyle struct {
+	banner string
+	labels map[string]*template.Template // by HeaderStyle field name
+	// counted holds the labels that show {{.Count}} themselves
+	counted map[string]bool
+	// custom matches the headers of a style other than the default;
+	// sectionHeaderRe always matches the default ones
+	custom *regexp.Regexp
+}
+
+// newSectionHeaderStyle checks style and prepares its templates.
+func newSectionHeaderStyle(style HeaderStyle) (*sectionHeaderStyle, error) {
+	isDefault := true
+	fill := func(field *string, def string) {
+		if *field == "" {
+			*field = def
+		} else if *field != def {
+			isDefault = false
+		}
+	}
+	fill(&style.RPC, defaultHeaderStyle.RPC)
+	fill(&style.Service, defaultHeaderStyle.Service)
+	fill(&style.Composite, defaultHeaderStyle.Composite)
+	fill(&style.Helper, defaultHeaderStyle.Helper)
+	fill(&style.Standalone, defaultHeaderStyle.Standalone)
+	fill(&style.Unused, defaultHeaderStyle.Unused)
+	fill(&style.Extends, defaultHeaderStyle.Extends)
+	fill(&style.BannerChar, defaultHeaderStyle.BannerChar)
+	if style.BannerWidth == 0 {
+		style.BannerWidth = defaultHeaderStyle.BannerWidth
+	} else if style.BannerWidth != defaultHeaderStyle.BannerWidth {
+		isDefault = false
+	}
+	if r := []rune(style.BannerChar); len(r) != 1 || !isBannerRune(r[0]) {
+		return nil, fmt.Errorf("section header banner character must be a single punctuation character, got %q", style.BannerChar)
+	}
+	if style.BannerWidth < len("// ")+minBannerRun {
+		return nil, fmt.Errorf("section header banner must be at least %d wide, got %d", len("// ")+minBannerRun, style.BannerWidth)
+	}
+
+	s := &sectionHeaderStyle{
+		banner:  "// " + strings.Repeat(style.BannerChar, style.BannerWidth-len("// ")),
+		labels:  make(map[string]*template.Template),
+		counted: make(map[string]bool),
+	}
+	var patterns []string
+	for name, text := range map[string]string{
+		"RPC":        style.RPC,
+		"Service":    style.Service,
+		"Composite":  style.Composite,
+		"Helper":     style.Helper,
+		"Standalone": style.Standalone,
+		"Unused":     style.Unused,
+		"Extends":    style.Extends,
+	} {
+		t, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err == nil {
+			err = t.Execute(new(strings.Builder), headerLabel{RPC: "Get", Service: "S", Count: 1})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("section header %s label: %v", name, err)
+		}
+		if strings.Contains(text, "\n") {
+			return nil, fmt.Errorf("section header %s label must be a single line", name)
+		}
+		s.labels[name] = t
+		s.counted[name] = strings.Contains(text, ".Count")
+		patterns = append(patterns, labelPattern(text))
+	}
+	if !isDefault {
+		s.custom = regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(s.banner) + `\n// (?:` + strings.Join(patterns, "|") + `)(?: \(\d+\))?\n` + regexp.QuoteMeta(s.banner) + `\n\n?`)
+	}
+	return s, nil
+}
+
+// minBannerRun is how many times a banner line repeats its character at
+// least.
+const minBannerRun = 10
+
+// isBannerRune reports whether r can make up a banner line.
+func isBannerRune(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// isBannerLine reports whether line is a section header banner line: "//",
+// then one punctuation character repeated at least minBannerRun times.
+func isBannerLine(line string) bool {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), "//")
+	rest = strings.TrimSpace(rest)
+	r, _ := utf8.DecodeRuneInString(rest)
+	return ok && isBannerRune(r) && r != '/' && utf8.RuneCountInString(rest) >= minBannerRun && strings.Trim(rest, string(r)) == ""
+}
+
+// templateActionRe matches the actions of a label template.
+var templateActionRe = regexp.MustCompile(`\{\{.*?\}\}`)
+
+// labelPattern returns a regular expression matching the labels a template
+// can produce.
+func labelPattern(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range templateActionRe.FindAllStringIndex(text, -1) {
+		b.WriteString(regexp.QuoteMeta(text[last:loc[0]]))
+		b.WriteString(`[^\n]+?`)
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(text[last:]))
+	return b.String()
+}
+
+// label renders the label named name (a HeaderStyle field) with data.
+func (s *sectionHeaderStyle) label(name string, data headerLabel) string {
+	var b strings.Builder
+	// Executing succeeded on sample data in newSectionHeaderStyle
+	s.labels[name].Execute(&b, data)
+	return b.String()
+}
+
+// comment returns a 3-line section header comment block for label.
+// Includes a trailing blank line to prevent protoc from treating it as a
+// leading comment.
+func (s *sectionHeaderStyle) comment(label string) string {
+	return s.banner + "\n// " + label + "\n" + s.banner + "\n\n"
+}
+
+// strip removes section headers, in the default style or s's, from a
+// comment string.
+func (s *sectionHeaderStyle) strip(comments string) string {
+	if comments == "" {
+		return ""
+	}
+	comments = sectionHeaderRe.ReplaceAllString(comments, "")
+	if s.custom != nil {
+		comments = s.custom.ReplaceAllString(comments, "")
+	}
+	return comments
+}
@@ -0,0 +1,316 @@
+package protosort
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/bufbuild/protocompile/parser"
+	"github.com/bufbuild/protocompile/reporter"
+	"google.golang.org/protobuf/reflect/protodesc"
+	descriptorpb "google.golang.org/protobuf/types/descriptorpb"
+)
+
+// importModifierRe matches a public or weak import, which is never removed.
+var importModifierRe = regexp.MustCompile(`^import\s+(?:public|weak)\b`)
+
+// removeUnusedImports drops the imports of blocks that define nothing the
+// other blocks reference. Each import is resolved through opts.ProtoPaths
+// and the well-known types; one that can't be resolved is kept, with a
+// warning.
+func removeUnusedImports(blocks []*Block, opts Options) ([]*Block, []Warning) {
+	var pkg string
+	refs := make(map[string]bool)
+	for _, b := range blocks {
+		switch b.Kind {
+		case BlockPackage:
+			pkg = b.Name
+		case BlockImport, BlockSyntax, BlockComment:
+		default:
+			for name := range referencedNames(b.DeclText) {
+				refs[name] = true
+			}
+		}
+	}
+
+	resolver := protocompile.WithStandardImports(&protocompile.SourceResolver{ImportPaths: opts.ProtoPaths})
+	var warnings []Warning
+	var removed []string
+	var kept []*Block
+	for _, b := range blocks {
+		if b.Kind != BlockImport || importModifierRe.MatchString(b.DeclText) {
+			kept = append(kept, b)
+			continue
+		}
+		symbols, err := importedSymbols(resolver, b.Name, make(map[string]bool))
+		if err != nil {
+			warnings = append(warnings, Warning{Code: WarningUnresolvedImport, Message: fmt.Sprintf("import %q kept: %v", b.Name, err), Line: b.Line})
+			kept = append(kept, b)
+			continue
+		}
+		if referencesAny(refs, symbols, pkg) {
+			kept = append(kept, b)
+			continue
+		}
+		removed = append(removed, b.Name)
+	}
+	if len(removed) > 0 {
+		warnings = append(warnings, Warning{Code: WarningUnusedImport, Message: "removed unused imports: " + strings.Join(removed, ", ")})
+	}
+	return kept, warnings
+}
+
+// referencedNames returns the possibly qualified names in declText,
+// outside comments and strings.
+func referencedNames(declText string) map[string]bool {
+	names := make(map[string]bool)
+	s := &scanner{content: declText}
+	for !s.atEnd() {
+		c := s.peek()
+		if c == '"' || c == '\'' || c == '/' {
+			s.skipOneToken()
+			continue
+		}
+		if !isIdentChar(c) && !(c == '.' && isIdentChar(s.peekAt(1))) {
+			s.pos++
+			continue
+		}
+		start := s.pos
+		for !s.atEnd() && (isIdentChar(s.peek()) || s.peek() == '.') {
+			s.pos++
+		}
+		names[strings.TrimSuffix(declText[start:s.pos], ".")] = true
+	}
+	return names
+}
+
+// referencesAny reports whether any name in refs, as written in a file of
+// package pkg, resolves to one of the fully qualified symbols.
+func referencesAny(refs, symbols map[string]bool, pkg string) bool {
+	for ref := range refs {
+		if full, ok := strings.CutPrefix(ref, "."); ok {
+			if symbols[full] {
+				return true
+			}
+			continue
+		}
+		// A relative name is looked up in the package and each enclosing one
+		scope := pkg
+		for {
+			full := ref
+			if scope != "" {
+				full = scope + "." + ref
+			}
+			if symbols[full] {
+				return true
+			}
+			if scope == "" {
+				break
+			}
+			i := strings.LastIndexByte(scope, '.')
+			scope = scope[:max(i, 0)]
+		}
+	}
+	return false
+}
+
+// importedSymbols returns the fully qualified names of the messages,
+// enums, and extensions the file at path defines, along with those of the
+// files it imports publicly. seen holds the paths already visited.
+func importedSymbols(resolver protocompile.Resolver, path string, seen map[string]bool) (map[string]bool, error) {
+	symbols := make(map[string]bool)
+	if seen[path] {
+		return symbols, nil
+	}
+	seen[path] = true
+
+	fd, err := resolveDescriptor(resolver, path)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if fd.GetPackage() != "" {
+		prefix = fd.GetPackage() + "."
+	}
+	for _, md := range fd.GetMessageType() {
+		addMessageSymbols(symbols, prefix, md)
+	}
+	for _, ed := range fd.GetEnumType() {
+		symbols[prefix+ed.GetName()] = true
+	}
+	for _, xd := range fd.GetExtension() {
+		symbols[prefix+xd.GetName()] = true
+	}
+	for _, i := range fd.GetPublicDependency() {
+		public, err := importedSymbols(resolver, fd.GetDependency()[i], seen)
+		if err != nil {
+			return nil, err
+		}
+		for name := range public {
+			symbols[name] = true
+		}
+	}
+	return symbols, nil
+}
+
+// addMessageSymbols adds md's name and those of its nested declarations,
+// each prefixed with prefix.
+func addMessageSymbols(symbols map[string]bool, prefix string, md *descriptorpb.DescriptorProto) {
+	name := prefix + md.GetName()
+	symbols[name] = true
+	for _, nested := range md.GetNestedType() {
+		addMessageSymbols(symbols, name+".", nested)
+	}
+	for _, ed := range md.GetEnumType() {
+		symbols[name+"."+ed.GetName()] = true
+	}
+	for _, xd := range md.GetExtension() {
+		symbols[name+"."+xd.GetName()] = true
+	}
+}
+
+// resolveDescriptor finds the file at path with resolver and parses it,
+// without linking, into a descriptor.
+func resolveDescriptor(resolver protocompile.Resolver, path string) (*descriptorpb.FileDescriptorProto, error) {
+	result, err := resolver.FindFileByPath(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case result.Proto != nil:
+		return result.Proto, nil
+	case result.Desc != nil:
+		return protodesc.ToFileDescriptorProto(result.Desc), nil
+	case result.ParseResult != nil:
+		return result.ParseResult.FileDescriptorProto(), nil
+	}
+
+	ast := result.AST
+	if ast == nil {
+		if closer, ok := result.Source.(io.Closer); ok {
+			defer closer.Close()
+		}
+		handler := reporter.NewHandler(nil)
+		if ast, err = parser.Parse(path, result.Source, handler); err != nil {
+			return nil, err
+		}
+	}
+	parsed, err := parser.ResultFromAST(ast, false, reporter.NewHandler(nil))
+	if err != nil {
+		return nil, err
+	}
+	return parsed.FileDescriptorProto(), nil
+}
+
+// wellKnownImportPrefix is the directory of the protobuf well-known types.
+const wellKnownImportPrefix = "google/protobuf/"
+
+// groupImports splits imports, keeping their order, into the well-known
+// types, third-party imports, and local ones. Local imports are those
+// under one of the local path prefixes or, if there are none, under the
+// directory named for the first component of pkg, e.g. "acme/" for package
+// acme.billing.v1.
+func groupImports(imports []*Block, pkg string, local []string) [][]*Block {
+	if len(local) == 0 && pkg != "" {
+		first, _, _ := strings.Cut(pkg, ".")
+		local = []string{first + "/"}
+	}
+	groups := make([][]*Block, 3)
+	for _, b := range imports {
+		switch {
+		case strings.HasPrefix(b.Name, wellKnownImportPrefix):
+			groups[0] = append(groups[0], b)
+		case slices.ContainsFunc(local, func(prefix string) bool { return strings.HasPrefix(b.Name, prefix) }):
+			groups[2] = append(groups[2], b)
+		default:
+			groups[1] = append(groups[1], b)
+		}
+	}
+	return groups
+}
+
+// dedupeBlocks drops the imports and options that repeat an earlier one,
+// with a warning for each: an import of the same path, with the same
+// modifier, or an option set to the same value, ignoring whitespace. A dropped
+// block's comments are added to the earlier one's, unless it already has
+// the same. Options that are set twice to different values are left alone,
+// since a repeated custom option may legitimately appear more than once,
+// but draw a warning, as they are more often a merge gone wrong.
+func dedupeBlocks(blocks []*Block) ([]*Block, []Warning) {
+	var warnings []Warning
+	var kept []*Block
+	first := make(map[string]*Block)
+	named := make(map[string]*Block) // the first option of each name
+	for _, b := range blocks {
+		key := dedupeKey(b)
+		prev, ok := first[key]
+		if !ok {
+			first[key] = b
+			kept = append(kept, b)
+			if b.Kind != BlockOption {
+				continue
+			}
+			if other, ok := named[b.Name]; ok {
+				warnings = append(warnings, Warning{Code: WarningConflictingOption, Message: fmt.Sprintf("option %s is set to different values (lines %d and %d)", b.Name, other.Line, b.Line), Line: b.Line})
+			} else {
+				named[b.Name] = b
+			}
+			continue
+		}
+		if comments := strings.TrimSpace(b.Comments); comments != "" && comments != strings.TrimSpace(prev.Comments) {
+			if strings.TrimSpace(prev.Comments) == "" {
+				prev.Comments = b.Comments
+			} else {
+				prev.Comments += strings.TrimLeft(b.Comments, "\n")
+			}
+		}
+		name := b.Name
+		if b.Kind == BlockImport {
+			name = strconv.Quote(b.Name)
+		}
+		warnings = append(warnings, Warning{Code: WarningDuplicate, Message: fmt.Sprintf("removed duplicate %s %s (line %d)", b.Kind, name, b.Line), Line: b.Line})
+	}
+	return kept, warnings
+}
+
+// dedupeKey identifies an import or option for dedupeBlocks.
+func dedupeKey(b *Block) string {
+	if b.Kind == BlockImport {
+		return "import:" + importModifierRe.FindString(b.DeclText) + b.Name
+	}
+	_, value, _ := strings.Cut(b.DeclText, "=")
+	value = strings.TrimSuffix(strings.TrimSpace(value), ";")
+	return b.Kind.String() + ":" + b.Name + "=" + strings.Join(strings.Fields(value), " ")
+}
+
+// withoutRemovedImports returns original without the imports that sorted
+// no longer has, so that dropping unused imports isn't reported as a
+// change. Whether they were unused is left to the descriptor comparison:
+// the sorted output fails to compile if they weren't.
+func withoutRemovedImports(original, sorted string) string {
+	origBlocks, err := ScanFile(original)
+	if err != nil {
+		return original
+	}
+	sortedBlocks, err := ScanFile(sorted)
+	if err != nil {
+		return original
+	}
+	kept := make(map[string]bool)
+	for _, b := range sortedBlocks {
+		if b.Kind == BlockImport {
+			kept[b.Name] = true
+		}
+	}
+	for _, b := range origBlocks {
+		if b.Kind == BlockImport && !kept[b.Name] {
+			re := regexp.MustCompile(`(?m)^[ \t]*import\s+["']` + regexp.QuoteMeta(b.Name) + `["']\s*;[^\n]*\n?`)
+			original = re.ReplaceAllString(original, "")
+		}
+	}
+	return original
+}
@@ -0,0 +1,161 @@
+package protosort
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Indent styles for Options.Indent.
+const (
+	IndentSpaces = "spaces"
+	IndentTabs   = "tabs"
+)
+
+// ParseIndent interprets an Options.Indent value: IndentSpaces, IndentTabs
+// (or "tab"), or a number of spaces per nesting level, which is
+// IndentSpaces at that size. ok is false for anything else, including "".
+func ParseIndent(indent string) (style string, size int, ok bool) {
+	switch indent {
+	case IndentSpaces:
+		return IndentSpaces, 0, true
+	case IndentTabs, "tab":
+		return IndentTabs, 0, true
+	}
+	if n, err := strconv.Atoi(indent); err == nil && n > 0 {
+		return IndentSpaces, n, true
+	}
+	return "", 0, false
+}
+
+// defaultIndentWidth is the columns per tab when a file has no
+// space-indented lines to infer it from, as in the protobuf style guide.
+const defaultIndentWidth = 2
+
+// mixedIndentation returns a warning for every declaration whose body
+// indents some lines with tabs and others with spaces, or mixes both within
+// one line's indentation. The warning names the first line that departs
+// from the body's first indented line.
+func mixedIndentation(blocks []*Block) []Warning {
+	var warnings []Warning
+	for _, b := range blocks {
+		if !hasBody(b) {
+			continue
+		}
+		first := ""
+		for i, line := range strings.Split(b.DeclText, "\n") {
+			style := indentStyle(leadingWhitespace(line))
+			if style == "" || i == 0 {
+				continue
+			}
+			if first == "" {
+				first = style
+			}
+			if style == "mixed" || style != first {
+				warnings = append(warnings, Warning{Code: WarningMixedIndent, Message: fmt.Sprintf("%s %s mixes tabs and spaces in its indentation (line %d)", b.Kind, b.Name, b.Line+i), Line: b.Line + i})
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// indentStyle classifies an indentation as IndentTabs, IndentSpaces,
+// "mixed", or "" when it is empty.
+func indentStyle(indent string) string {
+	tabs, spaces := strings.Contains(indent, "\t"), strings.Contains(indent, " ")
+	switch {
+	case tabs && spaces:
+		return "mixed"
+	case tabs:
+		return IndentTabs
+	case spaces:
+		return IndentSpaces
+	}
+	return ""
+}
+
+// normalizeIndentation rewrites the indentation of every declaration body
+// in the style indent names (see ParseIndent). A tab is width columns wide,
+// or with width 0 as wide as the file's smallest space indentation, or
+// defaultIndentWidth if it has none. With a number of spaces, each width
+// columns make one nesting level, indented by that many spaces instead.
+func normalizeIndentation(blocks []*Block, indent string, width int) {
+	style, size, ok := ParseIndent(indent)
+	if !ok {
+		return
+	}
+	if width <= 0 {
+		width = inferIndentWidth(blocks)
+	}
+	for _, b := range blocks {
+		if !hasBody(b) {
+			continue
+		}
+		lines := strings.Split(b.DeclText, "\n")
+		// The first line starts at the keyword and has no indentation
+		for i := 1; i < len(lines); i++ {
+			indent := leadingWhitespace(lines[i])
+			if indent == "" || strings.TrimSpace(lines[i]) == "" {
+				continue
+			}
+			cols := indentColumns(indent, width)
+			var out string
+			switch {
+			case style == IndentTabs:
+				out = strings.Repeat("\t", cols/width) + strings.Repeat(" ", cols%width)
+			case size > 0:
+				out = strings.Repeat(" ", cols/width*size+cols%width)
+			default:
+				out = strings.Repeat(" ", cols)
+			}
+			lines[i] = out + lines[i][len(indent):]
+		}
+		b.DeclText = strings.Join(lines, "\n")
+	}
+}
+
+// inferIndentWidth returns the smallest indentation of the body lines that
+// are indented with spaces only.
+func inferIndentWidth(blocks []*Block) int {
+	width := 0
+	for _, b := range blocks {
+		if !hasBody(b) {
+			continue
+		}
+		for _, line := range strings.Split(b.DeclText, "\n")[1:] {
+			indent := leadingWhitespace(line)
+			if indentStyle(indent) == IndentSpaces && strings.TrimSpace(line) != "" && (width == 0 || len(indent) < width) {
+				width = len(indent)
+			}
+		}
+	}
+	if width == 0 {
+		return defaultIndentWidth
+	}
+	return width
+}
+
+// indentColumns returns the width of indent with tab stops every width
+// columns.
+func indentColumns(indent string, width int) int {
+	cols := 0
+	for _, r := range indent {
+		if r == '\t' {
+			cols += width - cols%width
+		} else {
+			cols++
+		}
+	}
+	return cols
+}
+
+// hasBody reports whether b is a declaration with a braced body.
+func hasBody(b *Block) bool {
+	return b.Kind == BlockMessage || b.Kind == BlockEnum || b.Kind == BlockService || b.Kind == BlockExtend
+}
+
+// leadingWhitespace returns the run of spaces and tabs that starts line.
+func leadingWhitespace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
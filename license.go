@@ -0,0 +1,154 @@
+package protosort
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// licenseHeader is a parsed Options.LicenseTemplate.
+type licenseHeader struct {
+	text string         // the header for the current year
+	re   *regexp.Regexp // matches the header with any year or year range
+	year int
+}
+
+// yearPlaceholder stands in for the year while the matcher is built.
+const yearPlaceholder = "\x00"
+
+// newLicenseHeader reads and parses the license template named by opts, or
+// returns nil when there is none. The template is a Go template that gets
+// the year as {{.Year}}. Lines that aren't comments become // comments.
+func newLicenseHeader(opts Options) (*licenseHeader, error) {
+	if opts.LicenseTemplate == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(opts.LicenseTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("reading license template: %w", err)
+	}
+	tmpl, err := template.New("license").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid license template %s: %w", opts.LicenseTemplate, err)
+	}
+	render := func(year string) (string, error) {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, struct{ Year string }{year}); err != nil {
+			return "", fmt.Errorf("invalid license template %s: %w", opts.LicenseTemplate, err)
+		}
+		return commentLines(b.String()), nil
+	}
+
+	year := opts.LicenseYear
+	if year == 0 {
+		year = time.Now().Year()
+	}
+	text, err := render(strconv.Itoa(year))
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	pattern, err := render(yearPlaceholder)
+	if err != nil {
+		return nil, err
+	}
+
+	// Words must match in order, however they are spaced or wrapped; each
+	// {{.Year}} takes a year or a range of years
+	var words []string
+	for _, field := range strings.Fields(pattern) {
+		parts := strings.Split(field, yearPlaceholder)
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		words = append(words, strings.Join(parts, `(\d{4})(?:\s*[-–]\s*(\d{4}))?`))
+	}
+	return &licenseHeader{text: text, re: regexp.MustCompile(strings.Join(words, `\s+`)), year: year}, nil
+}
+
+// commentLines makes every line of text that isn't already a comment a //
+// comment.
+func commentLines(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" || strings.HasPrefix(trimmed, "//") || strings.HasPrefix(trimmed, "/*") {
+		return strings.TrimRight(text, "\n") + "\n"
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line == "" {
+			b.WriteString("//\n")
+		} else {
+			b.WriteString("// " + line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// licenseCopyrightRe finds a copyright notice that isn't the template's.
+var licenseCopyrightRe = regexp.MustCompile(`(?i)\bcopyright\b|©`)
+
+// apply returns the file header comments with the license in them: an
+// existing license has the current year added to its years, and a missing
+// one is inserted above everything else. A header with some other
+// copyright notice is left as it is, with a warning.
+func (l *licenseHeader) apply(header string) (string, []Warning) {
+	loc := l.re.FindStringSubmatchIndex(header)
+	if loc == nil {
+		if licenseCopyrightRe.MatchString(header) {
+			return header, []Warning{{Code: WarningLicense, Message: "copyright notice doesn't match the license template; left as is"}}
+		}
+		if strings.TrimSpace(header) == "" {
+			return l.text, nil
+		}
+		return l.text + "\n" + strings.TrimLeft(header, "\n"), nil
+	}
+
+	// Each {{.Year}} is a pair of groups: the first year, and the last
+	// year of a range
+	var b strings.Builder
+	pos := loc[0]
+	b.WriteString(header[:pos])
+	for i := 2; i+3 < len(loc); i += 4 {
+		first, last := header[loc[i]:loc[i+1]], ""
+		if loc[i+2] >= 0 {
+			last = header[loc[i+2]:loc[i+3]]
+		}
+		end := loc[i+1]
+		if loc[i+3] >= 0 {
+			end = loc[i+3]
+		}
+		b.WriteString(header[pos:loc[i]])
+		b.WriteString(l.years(first, last, header[loc[i]:end]))
+		pos = end
+	}
+	b.WriteString(header[pos:])
+	return b.String(), nil
+}
+
+// years returns the years of a notice as of l.year: written as it is if it
+// already reaches that year, or else a range from the first year to it.
+func (l *licenseHeader) years(first, last, written string) string {
+	y := strconv.Itoa(l.year)
+	if first == y || last == y {
+		return written
+	}
+	if n, _ := strconv.Atoi(first); n > l.year {
+		return written
+	}
+	return first + "-" + y
+}
+
+// stripLicense removes the license from header, for comparing files
+// whose licenses differ only by apply's changes.
+func (l *licenseHeader) stripLicense(header string) string {
+	if loc := l.re.FindStringIndex(header); loc != nil {
+		return header[:loc[0]] + header[loc[1]:]
+	}
+	return header
+}
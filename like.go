@@ -0,0 +1,44 @@
+package protosort
+
+// DeclarationOrder returns the names of the top-level messages, enums, and
+// services in content, in file order. It is the template order used by
+// Options.LikeOrder.
+func DeclarationOrder(content string) ([]string, error) {
+	blocks, err := ScanFile(content)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	var names []string
+	for _, b := range blocks {
+		switch b.Kind {
+		case BlockMessage, BlockEnum, BlockService:
+			names = append(names, b.Name)
+		}
+	}
+	return names, nil
+}
+
+// orderLike reorders blocks so that those named in template come first, in
+// template order. Blocks the template doesn't mention follow in their
+// existing order.
+func orderLike(blocks []*Block, template []string) []*Block {
+	byName := make(map[string]*Block, len(blocks))
+	for _, b := range blocks {
+		byName[b.Name] = b
+	}
+
+	result := make([]*Block, 0, len(blocks))
+	placed := make(map[string]bool)
+	for _, name := range template {
+		if b, ok := byName[name]; ok && !placed[name] {
+			placed[name] = true
+			result = append(result, b)
+		}
+	}
+	for _, b := range blocks {
+		if !placed[b.Name] {
+			result = append(result, b)
+		}
+	}
+	return result
+}
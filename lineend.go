@@ -0,0 +1,48 @@
+package protosort
+
+import "strings"
+
+// Line ending styles for Options.EndOfLine.
+const (
+	EndOfLineLF   = "lf"
+	EndOfLineCRLF = "crlf"
+	EndOfLineAuto = "auto" // the input's dominant ending, as with ""
+)
+
+// resolveLineEnding returns the line ending eol stands for in content:
+// eol itself, or for "" and EndOfLineAuto the ending most of content's
+// lines have, EndOfLineLF on a tie.
+func resolveLineEnding(content, eol string) string {
+	if eol != "" && eol != EndOfLineAuto {
+		return eol
+	}
+	crlf := strings.Count(content, "\r\n")
+	if crlf > strings.Count(content, "\n")-crlf {
+		return EndOfLineCRLF
+	}
+	return EndOfLineLF
+}
+
+// convertLineEndings rewrites every line ending in text, "\n" or "\r\n", as
+// eol (EndOfLineLF or EndOfLineCRLF). Any other eol leaves text as is.
+func convertLineEndings(text, eol string) string {
+	switch eol {
+	case EndOfLineLF:
+		return strings.ReplaceAll(text, "\r\n", "\n")
+	case EndOfLineCRLF:
+		return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+	}
+	return text
+}
+
+// finishLines applies opts.EndOfLine and opts.NoFinalNewline to emitted
+// output, which ends with a single newline. Every line of the output gets
+// the same ending, by default the one that dominates original: emitting
+// writes "\n" between blocks that keep the input's endings.
+func finishLines(output, original string, opts Options) string {
+	output = convertLineEndings(output, resolveLineEnding(original, opts.EndOfLine))
+	if opts.NoFinalNewline {
+		output = strings.TrimRight(output, "\r\n")
+	}
+	return output
+}
@@ -0,0 +1,58 @@
+package protosort
+
+import (
+	"fmt"
+)
+
+// lintThresholds returns a warning for every service, message, or file that
+// exceeds the size limits in opts. A limit of zero disables that check.
+func lintThresholds(blocks []*Block, opts Options) []Warning {
+	var warnings []Warning
+	messages := 0
+
+	for _, b := range blocks {
+		switch b.Kind {
+		case BlockService:
+			if opts.MaxRPCsPerService == 0 {
+				continue
+			}
+			if n := len(ExtractRPCs(b)); n > opts.MaxRPCsPerService {
+				warnings = append(warnings, Warning{Code: WarningSize, Message: fmt.Sprintf("service %s has %d RPCs (max %d)", b.Name, n, opts.MaxRPCsPerService), Line: b.Line})
+			}
+		case BlockMessage:
+			messages++
+			if opts.MaxFieldsPerMessage == 0 {
+				continue
+			}
+			if n := countMessageFields(b.DeclText); n > opts.MaxFieldsPerMessage {
+				warnings = append(warnings, Warning{Code: WarningSize, Message: fmt.Sprintf("message %s has %d fields (max %d)", b.Name, n, opts.MaxFieldsPerMessage), Line: b.Line})
+			}
+		}
+	}
+
+	if opts.MaxMessagesPerFile > 0 && messages > opts.MaxMessagesPerFile {
+		warnings = append(warnings, Warning{Code: WarningSize, Message: fmt.Sprintf("file has %d messages (max %d)", messages, opts.MaxMessagesPerFile)})
+	}
+
+	return warnings
+}
+
+// countMessageFields counts the fields declared directly in a message,
+// including map fields, groups, and oneof members but not fields of nested
+// messages.
+func countMessageFields(declText string) int {
+	n := 0
+	for _, m := range parseMembers(declText, 1, "message") {
+		switch m.Kind {
+		case "field":
+			n++
+		case "oneof":
+			for _, f := range m.Members {
+				if f.Kind == "field" {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,163 @@
+package protosort
+
+import (
+	"slices"
+	"strings"
+)
+
+// Move is one step of a reordering planned by PlanMoves: the declaration
+// in content[Start:End] is cut and inserted at offset To. The range runs
+// from the end of the declaration before it, so it takes along the blank
+// lines and comments above the declaration and its inline trailing
+// comment. Offsets are bytes into the original content, before any move.
+type Move struct {
+	Kind       BlockKind
+	Name       string
+	Start, End int
+	// To is the offset the declaration is inserted at: the start of the
+	// range of a declaration that stays in place, or the end of the last
+	// one. Declarations inserted at the same offset go in the order of
+	// their moves.
+	To int
+}
+
+// PlanMoves returns the moves that put content's declarations in the order
+// Sort gives them with opts, for editors that apply a sort as text edits,
+// e.g. to keep it undoable one declaration at a time, rather than by
+// replacing the whole buffer. The declarations that are already in order
+// relative to each other, as many as possible, stay in place; the others
+// are moved. Applying the moves (see ApplyMoves) only reorders: anything
+// else Sort changes, such as spacing, section headers, or stripped
+// comments, is left for a diff against Sort's output. A file Sort leaves
+// unchanged needs no moves.
+func PlanMoves(content string, opts Options) ([]Move, error) {
+	sorted, _, err := Sort(content, opts)
+	if err != nil || sorted == content {
+		return nil, err
+	}
+	origBlocks, err := ScanFile(content)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	sortedBlocks, err := ScanFile(sorted)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+
+	// The range of each original block; a byte order mark comes first. A
+	// declaration with an inline trailing comment ends before the newline
+	// after it, as others do, so that the blank lines above a declaration
+	// are in its range whatever the one before it ends with.
+	start := make(map[*Block]int)
+	end := make(map[*Block]int)
+	pos := len(content) - len(strings.TrimPrefix(content, utf8BOM))
+	for _, b := range origBlocks {
+		start[b] = pos
+		decl := strings.TrimSuffix(strings.TrimSuffix(b.DeclText, "\n"), "\r")
+		end[b] = start[b] + len(b.Comments) + len(decl)
+		pos = end[b]
+	}
+
+	// The original declarations in their sorted order
+	origDecls := declarations(origBlocks)
+	pairs := matchBlocks(origDecls, declarations(sortedBlocks))
+	index := make(map[*Block]int)
+	for i, b := range origDecls {
+		index[b] = i
+	}
+	var order []*Block
+	for _, b := range declarations(sortedBlocks) {
+		if o := pairs[b]; o != nil {
+			order = append(order, o)
+		}
+	}
+
+	stays := make(map[*Block]bool)
+	for _, b := range longestIncreasing(order, index) {
+		stays[b] = true
+	}
+	var moves []Move
+	for i, b := range order {
+		if stays[b] {
+			continue
+		}
+		// Insert before the next declaration that stays, or after the last
+		to := -1
+		for _, next := range order[i+1:] {
+			if stays[next] {
+				to = start[next]
+				break
+			}
+		}
+		if to < 0 {
+			for _, prev := range slices.Backward(order[:i]) {
+				if stays[prev] {
+					to = end[prev]
+					break
+				}
+			}
+		}
+		moves = append(moves, Move{Kind: b.Kind, Name: b.Name, Start: start[b], End: end[b], To: to})
+	}
+	return moves, nil
+}
+
+// longestIncreasing returns a longest subsequence of blocks whose index
+// increases, i.e. the most blocks that are already in order.
+func longestIncreasing(blocks []*Block, index map[*Block]int) []*Block {
+	// tails[k] is the position in blocks of the smallest last element of
+	// an increasing run of length k+1; prev links each element to the one
+	// before it in its run
+	var tails []int
+	prev := make([]int, len(blocks))
+	for i, b := range blocks {
+		k, _ := slices.BinarySearchFunc(tails, index[b], func(t, target int) int {
+			return index[blocks[t]] - target
+		})
+		prev[i] = -1
+		if k > 0 {
+			prev[i] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+	if len(tails) == 0 {
+		return nil
+	}
+	run := make([]*Block, len(tails))
+	for k, i := len(tails)-1, tails[len(tails)-1]; k >= 0; k-- {
+		run[k] = blocks[i]
+		i = prev[i]
+	}
+	return run
+}
+
+// ApplyMoves applies the moves PlanMoves planned for content.
+func ApplyMoves(content string, moves []Move) string {
+	cut := make(map[int]int) // start → end of each moved range
+	inserts := make(map[int][]string)
+	for _, m := range moves {
+		cut[m.Start] = m.End
+		inserts[m.To] = append(inserts[m.To], content[m.Start:m.End])
+	}
+	var b strings.Builder
+	for pos := 0; pos <= len(content); {
+		for _, text := range inserts[pos] {
+			b.WriteString(text)
+		}
+		if end, ok := cut[pos]; ok && end > pos {
+			// What's inserted at the start of a cut range takes its place
+			delete(cut, pos)
+			pos = end
+			continue
+		}
+		if pos < len(content) {
+			b.WriteByte(content[pos])
+		}
+		pos++
+	}
+	return b.String()
+}
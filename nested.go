@@ -0,0 +1,183 @@
+package protosort
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// messageMember is one member of a message or oneof body: a field, a
+// nested declaration, an option, a reserved statement, and so on.
+type messageMember struct {
+	gap      string // whitespace before the member up to and including its last newline
+	comments string // the rest of the text before decl: indentation and comments directly above
+	decl     string
+	trailing string // comment on the line decl ends on
+	keyword  string // first word of decl, e.g. "message", "oneof", or a field's type
+}
+
+// text is the member as it appears after its gap.
+func (m messageMember) text() string {
+	return m.comments + m.decl + m.trailing
+}
+
+// messageBody is a message or oneof declaration split into its members.
+type messageBody struct {
+	head    string // through the opening brace and any comment on its line
+	members []messageMember
+	rest    string // everything after the last member
+}
+
+// splitMessageBody splits a message or oneof declaration into its members.
+// ok is false when it has no braced body.
+func splitMessageBody(declText string) (body messageBody, ok bool) {
+	openIdx := strings.IndexByte(declText, '{')
+	if openIdx < 0 {
+		return body, false
+	}
+	s := &scanner{content: declText, pos: openIdx + 1}
+	// A comment on the line of the opening brace stays with it
+	if c := s.consumeTrailingComment(); strings.HasSuffix(c, "\n") {
+		s.pos--
+	}
+	body.head = declText[:s.pos]
+
+	for {
+		start := s.pos
+		s.collectComments()
+		if s.atEnd() {
+			return body, false
+		}
+		if s.peek() == '}' {
+			body.rest = declText[start:]
+			return body, true
+		}
+
+		declStart := s.pos
+		s.readMember()
+		declEnd := s.pos
+		// The newline ending a trailing comment belongs to the next gap
+		trailing := s.consumeTrailingComment()
+		if strings.HasSuffix(trailing, "\n") {
+			s.pos--
+			trailing = trailing[:len(trailing)-1]
+		}
+
+		leading := declText[start:declStart]
+		space := leading[:len(leading)-len(strings.TrimLeft(leading, " \t\r\n"))]
+		cut := start + strings.LastIndexByte(space, '\n') + 1
+		decl := declText[declStart:declEnd]
+		body.members = append(body.members, messageMember{
+			gap:      declText[start:cut],
+			comments: declText[cut:declStart],
+			decl:     decl,
+			trailing: trailing,
+			keyword:  leadingIdent(decl),
+		})
+	}
+}
+
+// join reassembles the declaration.
+func (b messageBody) join() string {
+	var out strings.Builder
+	out.WriteString(b.head)
+	for _, m := range b.members {
+		out.WriteString(m.gap)
+		out.WriteString(m.text())
+	}
+	out.WriteString(b.rest)
+	return out.String()
+}
+
+// sortSlots sorts the members at the indexes in slots among those
+// positions, comparing members by index with less. Each position keeps its
+// gap, so blank lines stay put, while comments and trailing comments move
+// with their member.
+func (b messageBody) sortSlots(slots []int, less func(i, j int) bool) {
+	order := slices.Clone(slots)
+	sort.SliceStable(order, func(x, y int) bool {
+		return less(order[x], order[y])
+	})
+	moved := make([]messageMember, len(order))
+	for k, i := range order {
+		moved[k] = b.members[i]
+	}
+	for i, slot := range slots {
+		gap := b.members[slot].gap
+		b.members[slot] = moved[i]
+		b.members[slot].gap = gap
+	}
+}
+
+// leadingIdent returns the identifier text starts with.
+func leadingIdent(text string) string {
+	i := 0
+	for i < len(text) && isIdentChar(text[i]) {
+		i++
+	}
+	return text[:i]
+}
+
+// SortNested sorts the nested messages and enums of a message declaration
+// by name, recursively. They trade places among the slots nested
+// declarations already occupy, so fields, options, oneofs, and the blank
+// lines between members stay where they are; comments directly above a
+// nested declaration move with it.
+func SortNested(declText string) string {
+	body, ok := splitMessageBody(declText)
+	if !ok {
+		return declText
+	}
+	var slots []int
+	for i, m := range body.members {
+		switch m.keyword {
+		case "message":
+			body.members[i].decl = SortNested(m.decl)
+			slots = append(slots, i)
+		case "enum":
+			slots = append(slots, i)
+		}
+	}
+	if len(slots) == 0 {
+		return declText
+	}
+	name := func(i int) string {
+		m := body.members[i]
+		return extractDeclName(m.keyword, m.decl)
+	}
+	body.sortSlots(slots, func(i, j int) bool {
+		return name(i) < name(j)
+	})
+	return body.join()
+}
+
+// readMember reads a message member: up to a ';' outside braces, or the
+// '}' closing a braced member such as a nested message or a oneof. A '}'
+// followed by ';', as in an aggregate option value, does not end the
+// member.
+func (s *scanner) readMember() {
+	depth := 0
+	for !s.atEnd() {
+		c := s.peek()
+		switch {
+		case c == '"' || c == '\'' || c == '/':
+			s.skipOneToken()
+			continue
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				s.pos++
+				if rest := strings.TrimLeft(s.content[s.pos:], " \t\r\n"); !strings.HasPrefix(rest, ";") {
+					return
+				}
+				continue
+			}
+		case c == ';' && depth <= 0:
+			s.pos++
+			return
+		}
+		s.pos++
+	}
+}
@@ -0,0 +1,75 @@
+package protosort
+
+import "sort"
+
+// Ownership groups the messages and enums of a package by the services
+// whose RPCs reach them, directly as request or response types or through
+// their fields. It guides splitting a package into one per service: each
+// service takes the types it owns, and shared types need a common home.
+type Ownership struct {
+	// Owned maps each service to the types only it reaches.
+	Owned map[string][]string
+	// Shared maps each type reached by two or more services to them.
+	Shared map[string][]string
+	// Unowned lists the types no service reaches.
+	Unowned []string
+}
+
+// ServiceOwnership computes the Ownership of blocks, the top-level
+// declarations of one package, possibly from several files. References are
+// resolved by simple name, as in Classify. All lists are sorted by name.
+func ServiceOwnership(blocks []*Block) Ownership {
+	types := make(map[string]*Block)
+	for _, b := range blocks {
+		if b.Kind == BlockMessage || b.Kind == BlockEnum {
+			types[b.Name] = b
+		}
+	}
+
+	reachedBy := make(map[string][]string) // type -> services, in service order
+	var services []string
+	for _, b := range blocks {
+		if b.Kind != BlockService {
+			continue
+		}
+		services = append(services, b.Name)
+		seen := make(map[string]bool)
+		var visit func(name string)
+		visit = func(name string) {
+			t, ok := types[name]
+			if !ok || seen[name] {
+				return
+			}
+			seen[name] = true
+			reachedBy[name] = append(reachedBy[name], b.Name)
+			for _, ref := range ExtractFieldTypes(t) {
+				visit(ref)
+			}
+		}
+		for _, rpc := range ExtractRPCs(b) {
+			visit(rpc.RequestType)
+			visit(rpc.ResponseType)
+		}
+	}
+
+	o := Ownership{Owned: make(map[string][]string), Shared: make(map[string][]string)}
+	for _, svc := range services {
+		o.Owned[svc] = nil
+	}
+	for name := range types {
+		switch svcs := reachedBy[name]; len(svcs) {
+		case 0:
+			o.Unowned = append(o.Unowned, name)
+		case 1:
+			o.Owned[svcs[0]] = append(o.Owned[svcs[0]], name)
+		default:
+			sort.Strings(svcs)
+			o.Shared[name] = svcs
+		}
+	}
+	for _, names := range o.Owned {
+		sort.Strings(names)
+	}
+	sort.Strings(o.Unowned)
+	return o
+}
@@ -0,0 +1,125 @@
+package protosort
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// verifyCharacters checks that sorting dropped no characters at all: the
+// original and sorted files must contain the same multiset of non-whitespace
+// characters. Comments that protosort injects itself (section headers, the
+// table of contents, annotations, RPC group headers) are set aside on both sides, as is content
+// removed by an explicitly enabled strip option (--strip-commented-code,
+// --regions strip), and the original's comments are restyled as
+// --normalize-comments does. A license header is set aside on both sides,
+// since its years may be updated. Everything else, including divider
+// comments dropped by default, counts.
+func verifyCharacters(original, sorted string, opts Options) error {
+	before, err := significantChars(original, opts, true)
+	if err != nil {
+		return fmt.Errorf("scanning original: %w", err)
+	}
+	after, err := significantChars(sorted, opts, false)
+	if err != nil {
+		return fmt.Errorf("scanning sorted output: %w", err)
+	}
+
+	var diffs []string
+	for r, n := range before {
+		if m := after[r]; m != n {
+			diffs = append(diffs, fmt.Sprintf("%q %d → %d", r, n, m))
+		}
+	}
+	for r, m := range after {
+		if _, ok := before[r]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%q 0 → %d", r, m))
+		}
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	sort.Strings(diffs)
+	if len(diffs) > 5 {
+		diffs = append(diffs[:5], fmt.Sprintf("and %d more", len(diffs)-5))
+	}
+	return fmt.Errorf("character counts differ: %s", strings.Join(diffs, ", "))
+}
+
+// significantChars counts the non-whitespace characters of content that
+// verifyCharacters compares. configured applies the strip options to the
+// comments, as Sort does to the original.
+func significantChars(content string, opts Options, configured bool) (map[rune]int, error) {
+	blocks, err := ScanFile(content)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := newSectionHeaderStyle(opts.HeaderStyle)
+	if err != nil {
+		return nil, err
+	}
+	license, err := newLicenseHeader(opts)
+	if err != nil {
+		return nil, err
+	}
+	var classifier *commentClassifier
+	if configured && opts.StripCommented {
+		if classifier, err = newCommentClassifier(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	counts := make(map[rune]int)
+	for _, b := range blocks {
+		comments := stripAnnotations(stripTOC(headers.strip(b.Comments)))
+		if license != nil && b.Kind == BlockSyntax {
+			comments = license.stripLicense(comments)
+		}
+		decl := b.DeclText
+		if b.Kind == BlockService {
+			decl, _ = stripRPCFingerprint(stripRPCGroupHeaders(decl))
+		}
+		trailing := b.TrailingComments
+		if configured {
+			if classifier != nil {
+				comments = stripCommentedCode(comments, classifier)
+			}
+			if opts.NormalizeComments {
+				comments = normalizeComments(comments, opts.CommentWidth)
+			}
+			if opts.Regions == "strip" {
+				comments = stripRegionMarkers(comments, opts)
+				trailing = stripRegionMarkers(trailing, opts)
+			}
+		}
+		for _, text := range []string{comments, decl, trailing} {
+			for _, r := range text {
+				if !unicode.IsSpace(r) {
+					counts[r]++
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// stripRegionMarkers removes fold marker lines, as --regions strip does.
+func stripRegionMarkers(comments string, opts Options) string {
+	begin, end := opts.RegionBegin, opts.RegionEnd
+	if begin == "" {
+		begin = defaultRegionBegin
+	}
+	if end == "" {
+		end = defaultRegionEnd
+	}
+	var kept []string
+	for _, line := range strings.Split(comments, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, begin) && !strings.HasPrefix(trimmed, end) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
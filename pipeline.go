@@ -0,0 +1,515 @@
+package protosort
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Names of the built-in stages, in the order NewPipeline runs them.
+const (
+	StageScan     = "scan"
+	StageClassify = "classify"
+	StageOrder    = "order"
+	StageAnnotate = "annotate"
+	StageEmit     = "emit"
+)
+
+// File is a proto file moving through a Pipeline. Each built-in stage fills
+// in the fields documented as set by it and reads only those set before it,
+// so a custom stage inserted between two built-in ones can inspect or
+// rewrite that state.
+type File struct {
+	Content  string  // the input, as passed to Run but without a byte order mark
+	Opts     Options // the options passed to Run
+	Warnings []Warning
+
+	// Done ends the pipeline after the current stage with Output as the
+	// result. Scan sets it for files that are returned unchanged.
+	Done   bool
+	Output string // set by Emit
+
+	// Blocks holds every block in file order. Set by Scan, with comments
+	// cleaned up and the per-declaration rewrites (indentation, RPC and
+	// field option order) applied.
+	Blocks []*Block
+
+	// The header and body, set by Classify. Body holds the messages, enums,
+	// and services in output order, with Section and Consumer assigned.
+	// Order finishes ordering them; Annotate adds comments; Emit writes
+	// them out.
+	HeaderComments string
+	Syntax         *Block
+	Package        *Block
+	FileOptions    []*Block
+	Imports        []*Block
+	Extends        []*Block // with Options.GroupExtends, followed each by the types only it uses
+	Body           []*Block
+	Services       []*Block
+	// TrailingComments follow the last declaration, and end the output
+	TrailingComments string
+
+	regions []*region // fold regions extracted by Scan, regrouped by Order
+	// headers renders and strips section headers, set by Scan from
+	// Options.HeaderStyle
+	headers *sectionHeaderStyle
+	// spacing holds the input's spacing above each block, recorded by Scan
+	// for Options.PreserveSpacing
+	spacing map[*Block]inputGap
+}
+
+// Stage is one step of a Pipeline. Run reads and updates f; an error stops
+// the pipeline and is returned by Pipeline.Run as is.
+type Stage interface {
+	Name() string
+	Run(f *File) error
+}
+
+// NewStage returns a Stage named name that calls run.
+func NewStage(name string, run func(f *File) error) Stage {
+	return funcStage{name: name, run: run}
+}
+
+type funcStage struct {
+	name string
+	run  func(f *File) error
+}
+
+func (s funcStage) Name() string      { return s.name }
+func (s funcStage) Run(f *File) error { return s.run(f) }
+
+// Pipeline runs a file through a sequence of stages. NewPipeline returns the
+// stages Sort uses; InsertBefore, InsertAfter, and Replace customize it,
+// e.g. to add org-specific annotations after StageAnnotate.
+type Pipeline struct {
+	stages []Stage
+}
+
+// NewPipeline returns the built-in pipeline: Scan, Classify, Order,
+// Annotate, and Emit.
+func NewPipeline() *Pipeline {
+	return &Pipeline{stages: []Stage{
+		NewStage(StageScan, scanStage),
+		NewStage(StageClassify, classifyStage),
+		NewStage(StageOrder, orderStage),
+		NewStage(StageAnnotate, annotateStage),
+		NewStage(StageEmit, emitStage),
+	}}
+}
+
+// Stages returns the names of the pipeline's stages in order.
+func (p *Pipeline) Stages() []string {
+	names := make([]string, len(p.stages))
+	for i, s := range p.stages {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+// InsertBefore adds s in front of the stage called name.
+func (p *Pipeline) InsertBefore(name string, s Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages = append(p.stages[:i], append([]Stage{s}, p.stages[i:]...)...)
+	return nil
+}
+
+// InsertAfter adds s after the stage called name.
+func (p *Pipeline) InsertAfter(name string, s Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages = append(p.stages[:i+1], append([]Stage{s}, p.stages[i+1:]...)...)
+	return nil
+}
+
+// Replace swaps the stage called name for s.
+func (p *Pipeline) Replace(name string, s Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages[i] = s
+	return nil
+}
+
+func (p *Pipeline) index(name string) (int, error) {
+	for i, s := range p.stages {
+		if s.Name() == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no pipeline stage named %q", name)
+}
+
+// Run sorts content like Sort, using the pipeline's stages. A byte order
+// mark at the start of content is kept out of the stages' way and put back
+// at the start of the output.
+func (p *Pipeline) Run(content string, opts Options) (string, []Warning, error) {
+	body, hasBOM := strings.CutPrefix(content, utf8BOM)
+	f := &File{Content: body, Opts: opts}
+	for _, s := range p.stages {
+		if err := s.Run(f); err != nil {
+			return "", nil, err
+		}
+		if f.Done {
+			break
+		}
+	}
+	if hasBOM {
+		return utf8BOM + f.Output, f.Warnings, nil
+	}
+	return f.Output, f.Warnings, nil
+}
+
+// scanStage parses the file, rejects what can't be sorted, and prepares
+// each block's comments and declaration text.
+func scanStage(f *File) error {
+	opts := f.Opts
+
+	// A file mid-merge would fail to parse at best; say why instead
+	if line := conflictMarkerLine(f.Content); line != 0 {
+		return &ConflictError{Line: line}
+	}
+
+	// Files that opt out are returned as is, even if they couldn't be sorted
+	if HasSkipFileDirective(f.Content) {
+		f.Output, f.Done = f.Content, true
+		return nil
+	}
+
+	// Check for proto2
+	if isProto2(f.Content) && !opts.AllowProto2 {
+		return &Proto2Error{}
+	}
+
+	blocks, err := ScanFile(f.Content)
+	if err != nil {
+		return &ParseError{Err: err}
+	}
+
+	if len(blocks) == 0 {
+		f.Output, f.Done = f.Content, true
+		return nil
+	}
+
+	var classifier *commentClassifier
+	if opts.StripCommented {
+		if classifier, err = newCommentClassifier(opts); err != nil {
+			return err
+		}
+	}
+	if f.headers, err = newSectionHeaderStyle(opts.HeaderStyle); err != nil {
+		return err
+	}
+	dividers, err := newDividerMatcher(opts)
+	if err != nil {
+		return err
+	}
+
+	// The output has exactly one syntax and one package statement; a file
+	// with more can't be reordered without losing content, so leave it as is.
+	if reason := unsupportedStructure(blocks); reason != "" {
+		if opts.Strict {
+			return &UnsupportedError{Reason: reason}
+		}
+		if !opts.Quiet {
+			f.Warnings = append(f.Warnings, Warning{Code: WarningUnsupported, Message: reason + "; file left unchanged"})
+		}
+		f.Output, f.Done = f.Content, true
+		return nil
+	}
+
+	// Verbatim regions become single blocks that later steps leave alone
+	verbatim, err := newVerbatimMarkers(opts)
+	if err != nil {
+		return err
+	}
+	if verbatim != nil {
+		var warnings []Warning
+		blocks, warnings = mergeVerbatim(blocks, verbatim)
+		if !opts.Quiet {
+			f.Warnings = append(f.Warnings, warnings...)
+		}
+	}
+	editable := slices.DeleteFunc(slices.Clone(blocks), func(b *Block) bool { return b.Verbatim })
+
+	if opts.PreserveSpacing {
+		f.spacing = inputSpacing(blocks)
+	}
+
+	// When preserving dividers, attach freestanding divider comments to the
+	// following declaration before any other processing.
+	if opts.PreserveDividers {
+		blocks = attachDividerComments(blocks, dividers)
+	}
+
+	// Pull fold markers out of comments before anything else looks at them.
+	// In keep mode the regions are regrouped after ordering.
+	if opts.Regions != "" {
+		var regionWarnings []Warning
+		f.regions, regionWarnings = extractRegions(blocks, opts)
+		if !opts.Quiet {
+			f.Warnings = append(f.Warnings, regionWarnings...)
+		}
+	}
+
+	// Process comments on all blocks
+	for _, b := range blocks {
+		// Strip section headers first (before divider stripping, since the
+		// banner lines would be caught by the divider regex and break the
+		// 3-line pattern match).
+		b.Comments = f.headers.strip(b.Comments)
+		b.Comments = stripTOC(b.Comments)
+		processComments(b, classifier)
+		// If not preserving dividers, strip section divider comments from block comments
+		if !opts.PreserveDividers {
+			b.Comments = stripDividerComments(b.Comments, dividers)
+		}
+		if opts.NormalizeComments && !b.Verbatim {
+			b.Comments = normalizeComments(b.Comments, opts.CommentWidth)
+		}
+		if opts.KeepFloatingComments {
+			b.Floating = b.Kind != BlockComment && endsDetached(b.Comments)
+		}
+	}
+
+	// Report mixed indentation as found, then normalize it if requested
+	if !opts.Quiet {
+		f.Warnings = append(f.Warnings, mixedIndentation(editable)...)
+	}
+	if opts.Indent != "" {
+		normalizeIndentation(editable, opts.Indent, opts.IndentWidth)
+	}
+
+	// Sort RPCs within services if requested (before extracting RPC info)
+	if opts.SortRPCs != "" {
+		for _, b := range editable {
+			if b.Kind == BlockService {
+				if opts.RPCFingerprint && !opts.Quiet {
+					f.Warnings = append(f.Warnings, misplacedRPCs(b, opts)...)
+				}
+				b.DeclText = sortRPCs(b.DeclText, opts)
+			}
+		}
+	}
+
+	// Normalize bracketed field option lists if requested
+	if opts.SortFieldOptions {
+		for _, b := range editable {
+			if b.Kind == BlockMessage || b.Kind == BlockEnum || b.Kind == BlockExtend {
+				b.DeclText = SortFieldOptions(b.DeclText)
+			}
+		}
+	}
+
+	// Alphabetize nested messages and enums if requested
+	if opts.SortNested {
+		for _, b := range editable {
+			if b.Kind == BlockMessage {
+				b.DeclText = SortNested(b.DeclText)
+			}
+		}
+	}
+
+	// Order message fields by number if requested
+	if opts.SortFields {
+		for _, b := range editable {
+			if b.Kind == BlockMessage {
+				b.DeclText = SortFields(b.DeclText)
+			}
+		}
+	}
+
+	// Drop imports the file doesn't use if requested
+	if opts.RemoveUnusedImports {
+		var warnings []Warning
+		blocks, warnings = removeUnusedImports(blocks, opts)
+		if !opts.Quiet {
+			f.Warnings = append(f.Warnings, warnings...)
+		}
+	}
+
+	// Populate RPC info on service blocks
+	for _, b := range blocks {
+		if b.Kind == BlockService {
+			b.RPCs = ExtractRPCs(b)
+		}
+	}
+
+	if !opts.Quiet {
+		f.Warnings = append(f.Warnings, lintThresholds(editable, opts)...)
+	}
+
+	f.Blocks = blocks
+	return nil
+}
+
+// classifyStage separates the header blocks from the body and classifies
+// the body into sections.
+func classifyStage(f *File) error {
+	var bodyBlocks []*Block
+	for _, b := range f.Blocks {
+		switch b.Kind {
+		case BlockSyntax:
+			f.HeaderComments = b.Comments
+			f.Syntax = b
+		case BlockPackage:
+			f.Package = b
+		case BlockOption:
+			f.FileOptions = append(f.FileOptions, b)
+		case BlockImport:
+			f.Imports = append(f.Imports, b)
+		case BlockExtend:
+			f.Extends = append(f.Extends, b)
+		case BlockMessage, BlockEnum:
+			bodyBlocks = append(bodyBlocks, b)
+		case BlockService:
+			bodyBlocks = append(bodyBlocks, b)
+			f.Services = append(f.Services, b)
+		case BlockComment:
+			// Comments after the last declaration stay at the end, where
+			// one that started on the line of that declaration gets a line
+			// of its own
+			f.TrailingComments += strings.TrimLeft(b.Comments, " \t")
+		}
+	}
+
+	if !f.Opts.Quiet {
+		f.Warnings = append(f.Warnings, sectionDirectiveWarnings(bodyBlocks)...)
+	}
+	if f.Opts.GroupExtends {
+		f.Extends, bodyBlocks = groupExtends(f.Extends, bodyBlocks)
+	}
+
+	// The license goes at the top of the header comments, which Emit
+	// writes before anything else
+	license, err := newLicenseHeader(f.Opts)
+	if err != nil {
+		return err
+	}
+	if license != nil {
+		var warnings []Warning
+		f.HeaderComments, warnings = license.apply(f.HeaderComments)
+		if !f.Opts.Quiet {
+			f.Warnings = append(f.Warnings, warnings...)
+		}
+	}
+	f.Body = Classify(bodyBlocks, f.Opts)
+	return nil
+}
+
+// orderStage drops repeated options and imports and sorts the rest,
+// regroups fold regions in the body in keep mode, and moves pinned and
+// ignored declarations into place.
+func orderStage(f *File) error {
+	// Merged files often repeat an import or option; keep one of each
+	var optionWarnings, importWarnings []Warning
+	f.FileOptions, optionWarnings = dedupeBlocks(f.FileOptions)
+	f.Imports, importWarnings = dedupeBlocks(f.Imports)
+	if !f.Opts.Quiet {
+		f.Warnings = append(f.Warnings, optionWarnings...)
+		f.Warnings = append(f.Warnings, importWarnings...)
+	}
+
+	// Sort options alphabetically by name, with edition features first since
+	// they change how the rest of the file is interpreted
+	sort.Slice(f.FileOptions, func(i, j int) bool {
+		fi, fj := isFeatureOption(f.FileOptions[i].Name), isFeatureOption(f.FileOptions[j].Name)
+		if fi != fj {
+			return fi
+		}
+		return f.FileOptions[i].Name < f.FileOptions[j].Name
+	})
+
+	// Sort imports alphabetically by path
+	sort.Slice(f.Imports, func(i, j int) bool {
+		return f.Imports[i].Name < f.Imports[j].Name
+	})
+
+	if f.Opts.Regions == "keep" {
+		f.Body = regroupRegions(f.Body, f.regions)
+	}
+
+	// Pinned declarations go to the ends of the body, and those marked
+	// "// protosort:ignore" back where they were
+	var warnings []Warning
+	f.Body, warnings = pinEnds(f.Body)
+	if !f.Opts.Quiet {
+		f.Warnings = append(f.Warnings, warnings...)
+	}
+	// Types grouped with the extends aren't in the body
+	grouped := make(map[*Block]bool)
+	for _, b := range f.Extends {
+		grouped[b] = true
+	}
+	var fileOrder []*Block
+	for _, b := range f.Blocks {
+		if (b.Kind == BlockMessage || b.Kind == BlockEnum || b.Kind == BlockService) && !grouped[b] {
+			fileOrder = append(fileOrder, b)
+		}
+	}
+	f.Body = pinIgnored(f.Body, fileOrder)
+
+	if f.Opts.PairStrict && !f.Opts.Quiet {
+		f.Warnings = append(f.Warnings, unpairedRequests(f.Body)...)
+	}
+	return nil
+}
+
+// annotateStage adds the comments protosort generates: classification
+// annotations, section headers, and the table of contents.
+func annotateStage(f *File) error {
+	// Inject classification annotations if requested
+	if f.Opts.Annotate {
+		// Consumers are listed in file order, so build the graph from Blocks
+		var bodyBlocks []*Block
+		for _, b := range f.Blocks {
+			if b.Kind == BlockMessage || b.Kind == BlockEnum || b.Kind == BlockService {
+				bodyBlocks = append(bodyBlocks, b)
+			}
+		}
+		annotateBlocks(f.Body, BuildRefGraph(bodyBlocks))
+	}
+
+	// Inject section headers if requested (stripping was done in Scan)
+	if f.Opts.SectionHeaders {
+		warnings := injectSectionHeaders(f.Body, f.Services, f.Opts.SectionStats, f.Opts.GroupByService, f.headers)
+		if !f.Opts.Quiet {
+			f.Warnings = append(f.Warnings, warnings...)
+		}
+	}
+
+	if f.Opts.SectionHeaders && f.Opts.GroupExtends {
+		injectExtendsHeader(f.Extends, f.Opts.SectionStats, f.headers)
+	}
+
+	// The table of contents goes above everything, including the first header
+	if f.Opts.TOC {
+		injectTOC(f.Body)
+	}
+	return nil
+}
+
+// emitStage builds the output.
+func emitStage(f *File) error {
+	importGroups := [][]*Block{f.Imports}
+	if f.Opts.GroupImports {
+		pkg := ""
+		if f.Package != nil {
+			pkg = f.Package.Name
+		}
+		importGroups = groupImports(f.Imports, pkg, f.Opts.LocalImports)
+	}
+	// Grouped extends and their types open the body, after the imports
+	extends, body := f.Extends, f.Body
+	if f.Opts.GroupExtends {
+		extends, body = nil, append(slices.Clip(f.Extends), f.Body...)
+	}
+	f.Output = finishLines(emit(f.HeaderComments, f.Syntax, f.Package, f.FileOptions, importGroups, extends, body, f.blankLines(), f.TrailingComments), f.Content, f.Opts)
+	return nil
+}
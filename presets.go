@@ -0,0 +1,65 @@
+package protosort
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// presets maps built-in preset names to the config values they apply. A
+// preset sits underneath the config file that selects it: any key the file
+// sets explicitly wins over the preset's value. Presets only set [ordering]
+// keys: the style guides they follow set no size limits for [lint], and
+// header text in [headers] is a matter of house style.
+var presets = map[string]Config{
+	// Google AIP: resource-oriented APIs, so RPCs are grouped by resource
+	// and shared types are listed dependencies-first.
+	"aip": {
+		Ordering: ConfigOrdering{
+			SharedOrder:    "dependency",
+			SortRPCs:       "grouped",
+			SectionHeaders: boolPtr(true),
+		},
+	},
+	// Uber V2: services first, request/response pairs in RPC order, and the
+	// RPCs themselves left in the author's order.
+	"uber": {
+		Ordering: ConfigOrdering{
+			SharedOrder:    "alpha",
+			SectionHeaders: boolPtr(false),
+		},
+	},
+	// buf defaults: plain alphabetical ordering with no injected comments,
+	// matching what buf format users expect.
+	"buf-default": {
+		Ordering: ConfigOrdering{
+			SharedOrder:      "alpha",
+			SortRPCs:         "alpha",
+			PreserveDividers: boolPtr(false),
+			SectionHeaders:   boolPtr(false),
+		},
+	},
+}
+
+// LookupPreset returns a copy of the named built-in preset.
+func LookupPreset(name string) (*Config, error) {
+	p, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(presetNames(), ", "))
+	}
+	return &p, nil
+}
+
+// presetNames returns the built-in preset names in sorted order.
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
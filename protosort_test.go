@@ -1,14 +1,22 @@
-package main
+package protosort
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
-	"runtime"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 var defaultOpts = Options{Quiet: true}
@@ -252,6 +260,67 @@ message Foo {
 	}
 }
 
+func TestScan_StringEscapes(t *testing.T) {
+	for _, tt := range []struct {
+		decl string
+		want []string
+	}{
+		// Escapes that spell braces don't count as braces
+		{`message A { option (x) = "\u007d\U0000007d\x7d\175}"; }`, []string{"A"}},
+		{`message A { string s = 1 [(x) = "\"}\\"]; }`, []string{"A"}},
+		{`message A { option (x) = '\'{'; }`, []string{"A"}},
+		// Multi-byte text in strings and names
+		{`message A { option (x) = "héllo ✓ {"; }`, []string{"A"}},
+		{`message AŁ { }`, []string{"A"}},
+		// An unterminated string ends at the newline
+		{"message A { option (x) = \"{\\\n}\nmessage B {}", []string{"A", "B"}},
+		{`import "a\"b.proto"; message A {}`, []string{`a\"b.proto`, "A"}},
+	} {
+		blocks, err := ScanFile("syntax = \"proto3\";\n" + tt.decl + "\n")
+		if err != nil {
+			t.Errorf("%s: %v", tt.decl, err)
+			continue
+		}
+		var got []string
+		for _, b := range blocks[1:] {
+			got = append(got, b.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got names %q, want %q", tt.decl, got, tt.want)
+		}
+	}
+
+	// A backslash ending the input is not an escape
+	if _, _, err := Sort("syntax = \"proto3\";\noption x = \"\\", defaultOpts); err != nil {
+		t.Error(err)
+	}
+}
+
+// FuzzSort checks that no input makes Sort panic or write output it can't
+// read back. Seeds cover string contents that could throw off brace
+// counting.
+func FuzzSort(f *testing.F) {
+	for _, seed := range []string{
+		`message A { option (x) = "\u007d"; B b = 1; }` + "\nmessage B {}",
+		`message A { string s = 1 [(x) = "\"}", (y) = '\'}']; }`,
+		`message A { option (x) = "\x7d\175\U0000007d}"; }`,
+		`message A { option (x) = "é{"; }` + "\nenum É {}",
+		"message A { option (x) = \"{\nmessage B {}",
+		"option x = \"\\",
+	} {
+		f.Add("syntax = \"proto3\";\n" + seed + "\n")
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		output, _, err := Sort(input, defaultOpts)
+		if err != nil {
+			return
+		}
+		if _, err := ScanFile(output); err != nil {
+			t.Errorf("output doesn't scan: %v\ninput:\n%s\noutput:\n%s", err, input, output)
+		}
+	})
+}
+
 func TestScan_NestedMessages(t *testing.T) {
 	input := `syntax = "proto3";
 
@@ -295,6 +364,77 @@ message Foo {
 	}
 }
 
+func TestScan_Positions(t *testing.T) {
+	input := `syntax = "proto3";
+
+// Foo spans lines 4 to 6.
+message Foo {
+  string val = 1;
+} // trailing
+
+enum E { E_UNSPECIFIED = 0; }
+`
+	blocks, err := ScanFile(input)
+	if err != nil {
+		t.Fatalf("ScanFile: %v", err)
+	}
+	var got [][2]int
+	for _, b := range blocks {
+		got = append(got, [2]int{b.Line, b.EndLine})
+	}
+	if want := [][2]int{{1, 1}, {4, 6}, {8, 8}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %v, want %v", got, want)
+	}
+
+	// Parse errors give the line and column, counted in characters
+	_, _, err = Sort("syntax = \"proto3\";\n\nmessage Foo {}\n  é oops\n", defaultOpts)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected a ParseError, got %v", err)
+	}
+	if line, col := parseErr.Position(); line != 4 || col != 3 {
+		t.Errorf("position = %d:%d, want 4:3", line, col)
+	}
+	if !strings.Contains(err.Error(), "expected declaration keyword at line 4, column 3") {
+		t.Errorf("error should name the line and column: %v", err)
+	}
+}
+
+func TestScan_ErrorRecovery(t *testing.T) {
+	input := `syntax = "proto3";
+
+message A { string a = 1; }
+stray text
+  more stray text
+message B { string b = 1; }
+  enum E { E_UNSPECIFIED = 0; } garbage;
+service S {}
+`
+	_, err := ScanFile(input)
+	if err == nil {
+		t.Fatal("expected parse errors")
+	}
+	for _, want := range []string{
+		"2 errors:",
+		`expected declaration keyword at line 4, column 1: "stray text`,
+		`expected declaration keyword at line 7, column 33: "garbage;`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q:\n%v", want, err)
+		}
+	}
+	var se *scanError
+	if !errors.As(err, &se) || se.Line != 4 {
+		t.Errorf("errors.As should find the first error, got %v", se)
+	}
+
+	// Scanning stops after maxScanErrors
+	_, err = ScanFile(strings.Repeat("message A {}\nstray\n", 50))
+	if n := strings.Count(err.Error(), "expected declaration keyword"); n != maxScanErrors || !strings.HasSuffix(err.Error(), "too many errors") {
+		t.Errorf("want %d errors and a too many errors note, got:\n%v", maxScanErrors, err)
+	}
+}
+
 func TestScan_ImportPublic(t *testing.T) {
 	input := `syntax = "proto3";
 
@@ -580,6 +720,132 @@ func TestExtractFieldTypes_Oneof(t *testing.T) {
 	}
 }
 
+func TestExtractFieldTypes_Nested(t *testing.T) {
+	block := &Block{
+		Kind: BlockMessage, Name: "Outer",
+		DeclText: `message Outer {
+  message Inner { Shared s = 1; oneof o { Deep d = 2; } }
+  message Status { Other o = 1; }
+  Status status = 1;
+  Inner inner = 2;
+  extend Extended { string note = 100; }
+}`,
+	}
+	// Status and Inner are Outer's own; top-level types of the same name
+	// aren't referenced
+	want := []string{"Shared", "Deep", "Other", "Extended"}
+	if types := ExtractFieldTypes(block); !reflect.DeepEqual(types, want) {
+		t.Errorf("want %v, got %v", want, types)
+	}
+
+	input := `syntax = "proto3";
+
+message Outer {
+  message Inner { Shared s = 1; }
+  Inner inner = 1;
+}
+
+message User {
+  message Inner { Shared s = 1; }
+  Inner inner = 1;
+}
+
+message Inner {
+  string v = 1;
+}
+
+message Shared {
+  string v = 1;
+}
+`
+	blocks, err := ScanFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := BuildRefCounts(blocks)
+	if counts["Shared"] != 2 || counts["Inner"] != 0 {
+		t.Errorf("counts: Shared=%d (want 2), Inner=%d (want 0)", counts["Shared"], counts["Inner"])
+	}
+}
+
+func TestExtractFieldTypes_SamePackage(t *testing.T) {
+	input := `syntax = "proto3";
+
+package billing.v1;
+
+service Billing {
+  rpc GetInvoice(billing.v1.GetInvoiceRequest) returns (.billing.v1.Invoice);
+}
+
+message GetInvoiceRequest {
+  string id = 1;
+}
+
+message Invoice {
+  repeated v1.LineItem items = 1;
+  billing.v1.Money total = 2;
+  google.type.Money legacy_total = 3;
+  billing.v2.Money next_total = 4;
+}
+
+message LineItem {
+  Money price = 1;
+}
+
+message Money {
+  string currency = 1;
+}
+`
+	blocks, err := ScanFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var invoice *Block
+	for _, b := range blocks {
+		if b.Name == "Invoice" {
+			invoice = b
+		}
+		if b.Kind == BlockService {
+			if rpcs := ExtractRPCs(b); !reflect.DeepEqual(rpcs, []RPC{{"GetInvoice", "GetInvoiceRequest", "Invoice"}}) {
+				t.Errorf("rpcs = %v", rpcs)
+			}
+		}
+	}
+	if types := ExtractFieldTypes(invoice); !reflect.DeepEqual(types, []string{"LineItem", "Money"}) {
+		t.Errorf("want [LineItem Money], got %v", types)
+	}
+	if counts := BuildRefCounts(blocks); counts["Money"] != 2 {
+		t.Errorf("Money is used by Invoice and LineItem, got count %d", counts["Money"])
+	}
+}
+
+// Field text the regex-based extraction tolerated must still sort, with
+// and without the lint limits, whatever point it is cut off at.
+func TestExtractFieldTypes_MalformedFields(t *testing.T) {
+	fields := []string{
+		`map<string, Foo> m = 1;`,
+		`repeated Bar bars = 2 [(opt) = "x"];`,
+		`optional group G = 3 { int32 y = 1; }`,
+		`oneof o { Baz baz = 4; }`,
+	}
+	for _, field := range fields {
+		for i := 1; i <= len(field); i++ {
+			// Cut off, and cut off but ended with a ;
+			for _, cut := range []string{field[:i], field[:i] + ";"} {
+				input := "syntax = \"proto3\";\n\nmessage A {\n  " + cut + "\n}\n\nmessage Foo {}\n"
+				for _, opts := range []Options{defaultOpts, {MaxFieldsPerMessage: 1, MaxRPCsPerService: 1}} {
+					if _, _, err := Sort(input, opts); err != nil {
+						var parseErr *ParseError
+						if !errors.As(err, &parseErr) {
+							t.Errorf("%q: %v", cut, err)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
 func TestExtractFieldTypes_IgnoresScalars(t *testing.T) {
 	block := &Block{
 		Kind: BlockMessage, Name: "M",
@@ -597,6 +863,37 @@ func TestExtractFieldTypes_IgnoresScalars(t *testing.T) {
 	}
 }
 
+func TestExtractFieldTypes_IgnoresCommentsAndStrings(t *testing.T) {
+	block := &Block{
+		Kind: BlockMessage, Name: "M",
+		DeclText: `message M {
+  string label = 1 [
+    (default_text) = "Foo bar = 1",
+    (other) = "Baz
+  ];
+  // Legacy legacy = 2;
+  /*
+  Removed removed = 3;
+  */
+  Kept kept = 4;
+}`,
+	}
+	if types := ExtractFieldTypes(block); !reflect.DeepEqual(types, []string{"Kept"}) {
+		t.Errorf("want [Kept], got %v", types)
+	}
+
+	svc := &Block{
+		Kind: BlockService, Name: "Svc",
+		DeclText: `service Svc {
+  // rpc Old(OldReq) returns (OldRes);
+  rpc New(NewReq) returns (NewRes) { option (doc) = "rpc Fake(A) returns (B)"; }
+}`,
+	}
+	if rpcs := ExtractRPCs(svc); !reflect.DeepEqual(rpcs, []RPC{{"New", "NewReq", "NewRes"}}) {
+		t.Errorf("want only New, got %v", rpcs)
+	}
+}
+
 // ============================================================
 // Ordering rule tests
 // ============================================================
@@ -725,6 +1022,38 @@ message Y { A a = 1; }
 	assertOrder(t, output, "message A", "message B", "message X", "message Y", "message C")
 }
 
+func TestSort_InlineHelpers(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Zoo {
+  Order o = 1;
+  Money m = 2;
+}
+message Order {
+  OrderStatus status = 1;
+  Money total = 2;
+}
+enum OrderStatus { ORDER_STATUS_UNSPECIFIED = 0; }
+message Money { int64 units = 1; }
+`
+	opts := Options{Quiet: true, InlineHelpers: true, SectionHeaders: true}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// OrderStatus is used only by Order, so it sits directly above it and
+	// shares its section header. Money has two consumers and stays a helper.
+	assertOrder(t, output, "Composite Types", "enum OrderStatus", "message Order", "message Zoo", "Helper Types", "message Money")
+
+	again, _, err := Sort(output, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != output {
+		t.Errorf("not idempotent.\nPass 1:\n%s\nPass 2:\n%s", output, again)
+	}
+}
+
 func TestSort_UnreferencedLast(t *testing.T) {
 	input := `syntax = "proto3";
 
@@ -879,1444 +1208,4055 @@ message B { A a = 1; }
 	assertOrder(t, output, "message A", "message B")
 }
 
-// ============================================================
-// Header sorting tests
-// ============================================================
-
-func TestSort_OptionsAlphabetized(t *testing.T) {
-	input := `syntax = "proto3";
+func TestSort_Like(t *testing.T) {
+	template := `syntax = "proto3";
 
-option java_package = "com.test";
-option go_package = "test/v1";
-option cc_enable_arenas = "true";
+message Zeta { string v = 1; }
+message Retired { string v = 1; }
+enum Alpha { ALPHA_UNSPECIFIED = 0; }
 `
-	output, _, err := Sort(input, defaultOpts)
-	if err != nil {
-		t.Fatal(err)
-	}
-	assertOrder(t, output, "cc_enable_arenas", "go_package", "java_package")
-}
-
-func TestSort_ImportsAlphabetized(t *testing.T) {
 	input := `syntax = "proto3";
 
-import "z/file.proto";
-import "a/file.proto";
-import "m/file.proto";
+enum Alpha { ALPHA_UNSPECIFIED = 0; }
+message Beta { string v = 1; }
+message Zeta { string v = 1; }
+message Added { string v = 1; }
 `
-	output, _, err := Sort(input, defaultOpts)
+	order, err := DeclarationOrder(template)
 	if err != nil {
 		t.Fatal(err)
 	}
-	assertOrder(t, output, `"a/file.proto"`, `"m/file.proto"`, `"z/file.proto"`)
-}
-
-func TestSort_LicenseStaysAtTop(t *testing.T) {
-	input := `// Copyright 2024 Test Corp.
-// All rights reserved.
-
-syntax = "proto3";
-
-message Foo { string v = 1; }
-`
-	output, _, err := Sort(input, defaultOpts)
+	opts := defaultOpts
+	opts.LikeOrder = order
+	output, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.HasPrefix(output, "// Copyright") {
-		t.Errorf("license should be first line, got:\n%s", output[:80])
+	// Template names first in template order, then the rest alphabetically
+	assertOrder(t, output, "message Zeta", "enum Alpha", "message Added", "message Beta")
+
+	if _, err := DeclarationOrder("bogus Foo {}\n"); err == nil {
+		t.Error("expected a parse error for a malformed template")
 	}
-	assertOrder(t, output, "Copyright", "syntax")
 }
 
-func TestSort_SyntaxBeforePackageBeforeOptionsBeforeImports(t *testing.T) {
+func TestClassify_CoreMinRefs(t *testing.T) {
 	input := `syntax = "proto3";
 
-import "foo.proto";
-option go_package = "test";
-package test.v1;
-`
-	output, _, err := Sort(input, defaultOpts)
-	if err != nil {
-		t.Fatal(err)
-	}
-	assertOrder(t, output, "syntax", "package", "option", "import")
+message Root {
+  Pair pair = 1;
+  Money money = 2;
 }
 
-// ============================================================
-// Comment association tests
-// ============================================================
+message Order {
+  Money money = 1;
+  Pair pair = 2;
+}
 
-func TestSort_LeadingCommentTravels(t *testing.T) {
-	input := `syntax = "proto3";
+message Invoice {
+  Money money = 1;
+}
 
-// Bravo's comment.
-message Bravo { string v = 1; }
+message Pair {
+  Money left = 1;
+}
 
-// Alpha's comment.
-message Alpha { string v = 1; }
+message Money {
+  string currency = 1;
+}
+
+message Lonely {
+  string v = 1;
+}
 `
-	output, _, err := Sort(input, defaultOpts)
-	if err != nil {
-		t.Fatal(err)
+	sections := func(opts Options) map[string]string {
+		blocks, err := ScanFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, b := range Classify(blocks, opts) {
+			got[b.Name] = b.Section.String()
+		}
+		return got
+	}
+
+	// By default, types that reference others are core
+	want := map[string]string{"Root": "core", "Order": "core", "Invoice": "core", "Pair": "core", "Money": "helper", "Lonely": "unreferenced"}
+	if got := sections(defaultOpts); !reflect.DeepEqual(got, want) {
+		t.Errorf("default:\ngot  %v\nwant %v", got, want)
+	}
+
+	// Money has four consumers and Pair, which uses Money, only two. Root,
+	// Order, and Invoice have none but reference others.
+	opts := defaultOpts
+	opts.CoreMinRefs = 3
+	want = map[string]string{"Root": "core", "Order": "core", "Invoice": "core", "Pair": "helper", "Money": "core", "Lonely": "unreferenced"}
+	if got := sections(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("core_min_refs = 3:\ngot  %v\nwant %v", got, want)
 	}
-	// Both are unreferenced → alphabetical → Alpha before Bravo
-	assertOrder(t, output, "Alpha's comment", "message Alpha", "Bravo's comment", "message Bravo")
 }
 
-func TestSort_DetachedCommentTravels(t *testing.T) {
+func TestParse(t *testing.T) {
 	input := `syntax = "proto3";
+package a.v1;
 
-// Detached comment.
+service S {
+  rpc Get(GetRequest) returns (stream GetResponse);
+}
 
-// Leading comment.
-message Foo { string v = 1; }
+// Outer doc
+message Outer {
+  // not a field: Fake f = 9;
+  repeated string a = 1 [default = "Foo bar = 1"]; // note
+  map<string, Inner> m = 2;
+  message Inner { Shared s = 1; }
+  oneof o {
+    int32 x = 3;
+  }
+  reserved 4;
+}
+
+enum E { E_UNSPECIFIED = 0; E_NEG = -1; }
+// end
 `
-	output, _, err := Sort(input, defaultOpts)
+	f, err := Parse(input)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("Parse: %v", err)
+	}
+	var got []string
+	var walk func(nodes []*Node, indent string)
+	walk = func(nodes []*Node, indent string) {
+		for _, n := range nodes {
+			got = append(got, fmt.Sprintf("%s%d-%d %s %s %s %s %s %s %s", indent, n.Line, n.EndLine, n.Kind, n.Label, n.Type, n.Name, n.Returns, n.Number, n.TrailingComment))
+			walk(n.Members, indent+"  ")
+		}
 	}
-	if !strings.Contains(output, "Detached comment") {
-		t.Error("detached comment should be preserved")
+	walk(f.Header, "")
+	walk(f.Decls, "")
+	want := []string{
+		"1-1 syntax   proto3   ",
+		"2-2 package   a.v1   ",
+		"4-6 service   S   ",
+		"  5-5 rpc  GetRequest Get stream GetResponse  ",
+		"9-18 message   Outer   ",
+		"  11-11 field repeated string a  1 // note",
+		"  12-12 field  map<string, Inner> m  2 ",
+		"  13-13 message   Inner   ",
+		"    13-13 field  Shared s  1 ",
+		"  14-16 oneof   o   ",
+		"    15-15 field  int32 x  3 ",
+		"  17-17 reserved      ",
+		"20-20 enum   E   ",
+		"  20-20 value   E_UNSPECIFIED  0 ",
+		"  20-20 value   E_NEG  -1 ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tree:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if outer := f.Decls[1]; !strings.Contains(outer.Comments, "// Outer doc") || !strings.Contains(outer.Members[0].Comments, "// not a field") {
+		t.Errorf("comments should stay with their declarations: %q, %q", outer.Comments, outer.Members[0].Comments)
+	}
+	if f.TrailingComments != "\n// end\n" {
+		t.Errorf("trailing comments = %q", f.TrailingComments)
+	}
+
+	// Malformed members parse as far as they go
+	f, err = Parse("message A {\n  map<string, Foo bar = 1;\n  repeated\n;\n  = 2;\n}\n")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
 	}
-	if !strings.Contains(output, "Leading comment") {
-		t.Error("leading comment should be preserved")
+	if m := f.Decls[0].Members[0]; m.Kind != "field" || !strings.HasPrefix(m.Type, "map<string, Foo") || m.Number != "" {
+		t.Errorf("unclosed map parsed as %+v", m)
+	}
+
+	var parseErr *ParseError
+	if _, err := Parse("message A {}\nnonsense\n"); !errors.As(err, &parseErr) {
+		t.Errorf("expected a ParseError, got %v", err)
 	}
 }
 
-func TestSort_InteriorCommentUnchanged(t *testing.T) {
+func TestClassify(t *testing.T) {
 	input := `syntax = "proto3";
 
-message Foo {
-  // Interior comment.
-  string val = 1; // Inline comment.
+message Helper { string v = 1; }
+message Orphan { string v = 1; }
+message Composite {
+  Helper h = 1;
+  Helper h2 = 2;
 }
+service S { rpc Get(Req) returns (Res); }
+message Res { string v = 1; }
+message Req { string v = 1; }
 `
-	output, _, err := Sort(input, defaultOpts)
+	blocks, err := ScanFile(input)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "// Interior comment.") {
-		t.Error("interior comment should be preserved")
+	ordered := Classify(blocks, Options{SharedOrder: "alpha"})
+
+	var got []string
+	for _, b := range ordered {
+		got = append(got, fmt.Sprintf("%s:%d", b.Name, b.Section))
 	}
-	if !strings.Contains(output, "// Inline comment.") {
-		t.Error("inline comment should be preserved")
+	want := []string{
+		fmt.Sprintf("S:%d", SectionService),
+		fmt.Sprintf("Req:%d", SectionRequestResponse),
+		fmt.Sprintf("Res:%d", SectionRequestResponse),
+		fmt.Sprintf("Orphan:%d", SectionUnreferenced),
+		fmt.Sprintf("Composite:%d", SectionCore),
+		fmt.Sprintf("Helper:%d", SectionHelper),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Classify:\ngot  %v\nwant %v", got, want)
 	}
 }
 
-// ============================================================
-// Whitespace tests
-// ============================================================
-
-func TestSort_NormalizesInterBlockSpacing(t *testing.T) {
+func TestServiceOwnership(t *testing.T) {
+	trips := `syntax = "proto3";
+package acme.v1;
+service Trips { rpc GetTrip(GetTripRequest) returns (Trip); }
+message GetTripRequest { string id = 1; }
+message Trip { Money fare = 1; }
+message Orphan { string v = 1; }
+`
+	billing := `syntax = "proto3";
+package acme.v1;
+service Billing { rpc Charge(ChargeRequest) returns (google.protobuf.Empty); }
+service Admin { rpc Ping(google.protobuf.Empty) returns (google.protobuf.Empty); }
+message ChargeRequest { Money amount = 1; }
+message Money { Currency currency = 1; }
+enum Currency { CURRENCY_UNSPECIFIED = 0; }
+`
+	var blocks []*Block
+	for _, content := range []string{trips, billing} {
+		b, err := ScanFile(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b...)
+	}
+
+	got := ServiceOwnership(blocks)
+	want := Ownership{
+		Owned: map[string][]string{
+			"Trips":   {"GetTripRequest", "Trip"},
+			"Billing": {"ChargeRequest"},
+			"Admin":   nil,
+		},
+		Shared: map[string][]string{
+			"Money":    {"Billing", "Trips"},
+			"Currency": {"Billing", "Trips"},
+		},
+		Unowned: []string{"Orphan"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ServiceOwnership:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestEmitBlock(t *testing.T) {
+	blocks, err := ScanFile("syntax = \"proto3\";\n\n\n// A thing.\nmessage A { string v = 1; } // inline\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks[1]
+	b.TrailingComments = "// endregion"
+	want := "// A thing.\nmessage A { string v = 1; } // inline\n// endregion\n"
+	if got := EmitBlock(b); got != want {
+		t.Errorf("EmitBlock = %q, want %q", got, want)
+	}
+}
+
+func TestReplaceBlock(t *testing.T) {
 	input := `syntax = "proto3";
 
+// A thing.
+message A {
+  string v = 1;
+} // keep me
+
+message B { string v = 1; }
+`
+	tests := []struct {
+		name, decl, newText, want string
+	}{
+		{
+			name:    "keeps comments",
+			decl:    "A",
+			newText: "message A {\n  string v = 1;\n  int32 n = 2;\n}\n",
+			want:    "syntax = \"proto3\";\n\n// A thing.\nmessage A {\n  string v = 1;\n  int32 n = 2;\n} // keep me\n\nmessage B { string v = 1; }\n",
+		},
+		{
+			name:    "own trailing comment",
+			decl:    "A",
+			newText: "message A {} // new",
+			want:    "syntax = \"proto3\";\n\n// A thing.\nmessage A {} // new\n\nmessage B { string v = 1; }\n",
+		},
+		{
+			name:    "adds trailing comment",
+			decl:    "B",
+			newText: "message B {} // new",
+			want:    "syntax = \"proto3\";\n\n// A thing.\nmessage A {\n  string v = 1;\n} // keep me\n\nmessage B {} // new\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReplaceBlock(input, tt.decl, tt.newText)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
 
+	for _, c := range []struct{ name, newText string }{
+		{"C", "message C {}"},
+		{"A", "message A {}\nmessage Z {}"},
+		{"A", "// comment\nmessage A {}"},
+	} {
+		if _, err := ReplaceBlock(input, c.name, c.newText); err == nil {
+			t.Errorf("ReplaceBlock(%s, %q): expected an error", c.name, c.newText)
+		}
+	}
+	if _, err := ReplaceBlock(input+"message A {}\n", "A", "message A {}"); err == nil {
+		t.Error("expected an error for a duplicate name")
+	}
+}
 
-message Foo { string v = 1; }
+// ============================================================
+// Header sorting tests
+// ============================================================
 
+func TestSort_OptionsAlphabetized(t *testing.T) {
+	input := `syntax = "proto3";
 
-message Bar { string v = 1; }
-message Baz { string v = 1; }
+option java_package = "com.test";
+option go_package = "test/v1";
+option cc_enable_arenas = "true";
 `
 	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if strings.Contains(output, "\n\n\n") {
-		t.Errorf("should not have triple newlines:\n%q", output)
-	}
+	assertOrder(t, output, "cc_enable_arenas", "go_package", "java_package")
 }
 
-func TestSort_PreservesInteriorWhitespace(t *testing.T) {
+func TestSort_ImportsAlphabetized(t *testing.T) {
 	input := `syntax = "proto3";
 
-message Foo {
-  string   name    = 1;
-
-  int32    age     = 2;
-}
+import "z/file.proto";
+import "a/file.proto";
+import "m/file.proto";
 `
 	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// The interior whitespace should be byte-identical
-	if !strings.Contains(output, "string   name    = 1;") {
-		t.Error("interior whitespace should be preserved")
-	}
-	if !strings.Contains(output, "int32    age     = 2;") {
-		t.Error("interior whitespace should be preserved")
-	}
+	assertOrder(t, output, `"a/file.proto"`, `"m/file.proto"`, `"z/file.proto"`)
 }
 
-func TestSort_FileEndsWithNewline(t *testing.T) {
+func TestSort_DuplicateImportsAndOptions(t *testing.T) {
 	input := `syntax = "proto3";
 
-message Foo { string v = 1; }
+// Shared types.
+import "z/file.proto";
+option java_package = "com.acme";
+import "a/file.proto";
+// Needed for Money.
+import  "z/file.proto" ;
+option java_package = "com.acme";
+option (acme.tag) = "one";
+option (acme.tag) = "two";
 `
-	output, _, err := Sort(input, defaultOpts)
+	output, warnings, err := Sort(input, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.HasSuffix(output, "\n") {
-		t.Error("file should end with newline")
+	if n := strings.Count(output, `"z/file.proto"`); n != 1 {
+		t.Errorf("want one z/file.proto import, got %d:\n%s", n, output)
 	}
-	if strings.HasSuffix(output, "\n\n") {
-		t.Error("file should not end with blank line")
+	if n := strings.Count(output, "java_package"); n != 1 {
+		t.Errorf("want one java_package option, got %d:\n%s", n, output)
+	}
+	// The dropped import's comment joins the kept one's
+	assertOrder(t, output, `"one"`, `"two"`, `"a/file.proto"`, "// Shared types.\n// Needed for Money.\n", `"z/file.proto"`)
+
+	var messages []string
+	for _, w := range warnings {
+		messages = append(messages, w.Message)
+	}
+	want := []string{
+		"removed duplicate option java_package (line 9)",
+		"option (acme.tag) is set to different values (lines 10 and 11)",
+		`removed duplicate import "z/file.proto" (line 8)`,
+	}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("warnings: want %q, got %q", want, messages)
 	}
 }
 
-// ============================================================
-// Edge cases
-// ============================================================
+func TestSort_GroupImports(t *testing.T) {
+	input := `syntax = "proto3";
 
-func TestSort_Proto2Rejected(t *testing.T) {
-	input := `syntax = "proto2";
+package acme.billing.v1;
 
-message Foo {
-  required string name = 1;
-}
+import "acme/common/v1/money.proto";
+import "validate/validate.proto";
+import "google/protobuf/timestamp.proto";
+import "google/api/annotations.proto";
+import "acme/billing/v1/invoice.proto";
+import "google/protobuf/duration.proto";
 `
-	_, _, err := Sort(input, Options{})
-	if err == nil || !strings.Contains(err.Error(), "proto2") {
-		t.Errorf("expected proto2 error, got: %v", err)
+	output, _, err := Sort(input, Options{Quiet: true, GroupImports: true})
+	if err != nil {
+		t.Fatal(err)
 	}
-}
+	want := `syntax = "proto3";
 
-func TestSort_EmptyFile(t *testing.T) {
-	output, _, err := Sort("", defaultOpts)
+package acme.billing.v1;
+
+import "google/protobuf/duration.proto";
+import "google/protobuf/timestamp.proto";
+
+import "google/api/annotations.proto";
+import "validate/validate.proto";
+
+import "acme/billing/v1/invoice.proto";
+import "acme/common/v1/money.proto";
+`
+	if output != want {
+		t.Errorf("got:\n%s\nwant:\n%s", output, want)
+	}
+
+	// Explicit local prefixes replace the one taken from the package
+	output, _, err = Sort(input, Options{Quiet: true, GroupImports: true, LocalImports: []string{"acme/billing/"}})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if output != "" {
-		t.Error("empty input should produce empty output")
-	}
+	assertOrder(t, output, `"validate/validate.proto";`+"\n\n", `"acme/billing/v1/invoice.proto"`)
+	assertOrder(t, output, `"acme/common/v1/money.proto"`, `"google/api/annotations.proto"`)
 }
 
-func TestSort_HeaderOnly(t *testing.T) {
-	input := `syntax = "proto3";
+func TestSort_LicenseStaysAtTop(t *testing.T) {
+	input := `// Copyright 2024 Test Corp.
+// All rights reserved.
 
-package test.v1;
+syntax = "proto3";
+
+message Foo { string v = 1; }
 `
 	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "syntax") || !strings.Contains(output, "package") {
-		t.Error("header should be preserved")
+	if !strings.HasPrefix(output, "// Copyright") {
+		t.Errorf("license should be first line, got:\n%s", output[:80])
 	}
+	assertOrder(t, output, "Copyright", "syntax")
 }
 
-func TestSort_SingleDeclaration(t *testing.T) {
+func TestSort_SyntaxBeforePackageBeforeOptionsBeforeImports(t *testing.T) {
 	input := `syntax = "proto3";
 
-message Only { string v = 1; }
+import "foo.proto";
+option go_package = "test";
+package test.v1;
 `
 	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "message Only") {
-		t.Error("single declaration should be preserved")
-	}
+	assertOrder(t, output, "syntax", "package", "option", "import")
 }
 
 // ============================================================
-// --strip-commented-code tests
+// Comment association tests
 // ============================================================
 
-func TestSort_StripCommentedCode(t *testing.T) {
+func TestSort_LeadingCommentTravels(t *testing.T) {
 	input := `syntax = "proto3";
 
-// rpc OldMethod(OldReq) returns (OldRes);
+// Bravo's comment.
+message Bravo { string v = 1; }
 
-// This is a real comment about Foo.
+// Alpha's comment.
+message Alpha { string v = 1; }
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both are unreferenced → alphabetical → Alpha before Bravo
+	assertOrder(t, output, "Alpha's comment", "message Alpha", "Bravo's comment", "message Bravo")
+}
+
+func TestSort_DetachedCommentTravels(t *testing.T) {
+	input := `syntax = "proto3";
+
+// Detached comment.
+
+// Leading comment.
 message Foo { string v = 1; }
 `
-	output, _, err := Sort(input, Options{Quiet: true, StripCommented: true})
+	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if strings.Contains(output, "OldMethod") {
-		t.Error("commented-out RPC should be stripped")
+	if !strings.Contains(output, "Detached comment") {
+		t.Error("detached comment should be preserved")
 	}
-	if !strings.Contains(output, "real comment about Foo") {
-		t.Error("prose comment should be preserved")
+	if !strings.Contains(output, "Leading comment") {
+		t.Error("leading comment should be preserved")
 	}
 }
 
-func TestSort_StripCommentedCode_PreservesProseComments(t *testing.T) {
+func TestSort_InteriorCommentUnchanged(t *testing.T) {
 	input := `syntax = "proto3";
 
-// This describes the purpose of the message.
-// It has multiple lines of explanation.
-message Foo { string v = 1; }
+message Foo {
+  // Interior comment.
+  string val = 1; // Inline comment.
+}
 `
-	output, _, err := Sort(input, Options{Quiet: true, StripCommented: true})
+	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "purpose of the message") {
-		t.Error("prose comments should not be stripped")
+	if !strings.Contains(output, "// Interior comment.") {
+		t.Error("interior comment should be preserved")
+	}
+	if !strings.Contains(output, "// Inline comment.") {
+		t.Error("inline comment should be preserved")
 	}
 }
 
 // ============================================================
-// Verification tests
+// Whitespace tests
 // ============================================================
 
-func TestVerifyIntegrity_Pass(t *testing.T) {
-	original := `syntax = "proto3";
+func TestSort_NormalizesInterBlockSpacing(t *testing.T) {
+	input := `syntax = "proto3";
+
+
+
 message Foo { string v = 1; }
+
+
 message Bar { string v = 1; }
+message Baz { string v = 1; }
 `
-	sorted := `syntax = "proto3";
-message Bar { string v = 1; }
-message Foo { string v = 1; }
-`
-	if err := verifyContentIntegrity(original, sorted, defaultOpts); err != nil {
-		t.Errorf("should pass: %v", err)
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "\n\n\n") {
+		t.Errorf("should not have triple newlines:\n%q", output)
 	}
 }
 
-func TestVerifyIntegrity_MissingDecl(t *testing.T) {
-	original := `syntax = "proto3";
-message Foo { string v = 1; }
-message Bar { string v = 1; }
-`
-	sorted := `syntax = "proto3";
-message Foo { string v = 1; }
+func TestSort_PreservesInteriorWhitespace(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Foo {
+  string   name    = 1;
+
+  int32    age     = 2;
+}
 `
-	if err := verifyContentIntegrity(original, sorted, defaultOpts); err == nil {
-		t.Error("should fail for missing declaration")
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The interior whitespace should be byte-identical
+	if !strings.Contains(output, "string   name    = 1;") {
+		t.Error("interior whitespace should be preserved")
+	}
+	if !strings.Contains(output, "int32    age     = 2;") {
+		t.Error("interior whitespace should be preserved")
 	}
 }
 
-func TestVerifyIntegrity_AlteredBody(t *testing.T) {
-	original := `syntax = "proto3";
-message Foo { string name = 1; }
-`
-	sorted := `syntax = "proto3";
-message Foo { int32 name = 1; }
-`
-	if err := verifyContentIntegrity(original, sorted, defaultOpts); err == nil {
-		t.Error("should fail for altered body")
-	}
-}
+func TestSort_MixedIndentation(t *testing.T) {
+	input := "syntax = \"proto3\";\n\nmessage Foo {\n  string a = 1;\n\tstring b = 2;\n  message Inner {\n\t  int32 c = 1;\n  }\n}\n\nmessage Bar {\n\tstring v = 1;\n}\n"
 
-func TestVerifyIntegrity_ExtraDecl(t *testing.T) {
-	original := `syntax = "proto3";
-message Foo { string v = 1; }
-`
-	sorted := `syntax = "proto3";
-message Foo { string v = 1; }
-message Bar { string v = 1; }
-`
-	if err := verifyContentIntegrity(original, sorted, defaultOpts); err == nil {
-		t.Error("should fail for extra declaration")
+	output, warnings, err := Sort(input, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Message != "message Foo mixes tabs and spaces in its indentation (line 5)" {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	if !strings.Contains(output, "\tstring b = 2;") {
+		t.Error("indentation should be preserved without --indent")
 	}
-}
-
-// ============================================================
-// Roundtrip property tests (random valid proto3 files)
-// ============================================================
-
-func TestProperty_RandomProtos(t *testing.T) {
-	rng := rand.New(rand.NewSource(42))
-
-	for i := 0; i < 100; i++ {
-		proto := generateRandomProto(rng)
-
-		output, _, err := Sort(proto, defaultOpts)
-		if err != nil {
-			t.Fatalf("iteration %d: Sort failed: %v\nInput:\n%s", i, err, proto)
-		}
 
-		// Must be idempotent
-		output2, _, err := Sort(output, defaultOpts)
-		if err != nil {
-			t.Fatalf("iteration %d: second Sort failed: %v", i, err)
-		}
-		if output != output2 {
-			t.Errorf("iteration %d: not idempotent", i)
-		}
+	opts := defaultOpts
+	opts.Indent = IndentSpaces
+	output, _, err = Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "\t") {
+		t.Errorf("expected no tabs:\n%s", output)
+	}
+	if !strings.Contains(output, "\n  string b = 2;\n") || !strings.Contains(output, "\n    int32 c = 1;\n") {
+		t.Errorf("expected tabs expanded to 2 columns:\n%s", output)
+	}
+	if err := Verify(input, output, opts); err != nil {
+		t.Errorf("normalized output should verify: %v", err)
+	}
 
-		// Content integrity
-		if err := verifyContentIntegrity(proto, output, defaultOpts); err != nil {
-			t.Errorf("iteration %d: integrity check failed: %v", i, err)
-		}
+	opts.Indent = IndentTabs
+	output, _, err = Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "\n\tstring a = 1;\n") || !strings.Contains(output, "\n\t\tint32 c = 1;\n") {
+		t.Errorf("expected 2-column indents as tabs:\n%s", output)
+	}
+	if _, warnings, _ := Sort(output, Options{Indent: IndentTabs}); len(warnings) != 0 {
+		t.Errorf("normalized output should not warn: %v", warnings)
 	}
 }
 
-// generateRandomProto creates a random but valid proto3 file.
-func generateRandomProto(rng *rand.Rand) string {
-	var b strings.Builder
-	b.WriteString("syntax = \"proto3\";\n\npackage test.v1;\n")
-
-	// Random set of type names
-	allNames := []string{"Alpha", "Beta", "Gamma", "Delta", "Epsilon", "Zeta", "Eta", "Theta", "Iota", "Kappa"}
-	numTypes := 3 + rng.Intn(8) // 3-10 types
-	names := allNames[:numTypes]
+func TestSort_IndentWidthAndLineEndings(t *testing.T) {
+	input := "syntax = \"proto3\";\r\n\r\nmessage Foo {\r\n\tstring a = 1;\r\n}\r\n\r\nmessage Bar {\r\n\tFoo foo = 1;\r\n}\r\n"
 
-	// Optionally add enums
-	enumNames := []string{"Status", "Priority", "Category"}
-	numEnums := rng.Intn(3) // 0-2 enums
-	var enums []string
-	for i := 0; i < numEnums; i++ {
-		enums = append(enums, enumNames[i])
+	opts := defaultOpts
+	opts.Indent = IndentSpaces
+	opts.IndentWidth = 4
+	opts.EndOfLine = EndOfLineLF
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	// Optionally add a service
-	hasService := rng.Intn(3) > 0 // 2/3 chance
-	if hasService {
-		numRPCs := 1 + rng.Intn(3)
-		// Optionally add a comment before the service
-		if rng.Intn(2) == 0 {
-			b.WriteString("\n// Service for handling operations.\n")
-		}
-		b.WriteString("service TestSvc {\n")
-		for j := 0; j < numRPCs && j*2+1 < len(names); j++ {
-			req := names[j*2]
-			res := names[j*2+1]
-			// Optionally use streaming
-			streamPrefix := ""
-			streamSuffix := ""
-			switch rng.Intn(4) {
-			case 1:
-				streamSuffix = "stream "
-			case 2:
-				streamPrefix = "stream "
-			case 3:
-				streamPrefix = "stream "
-				streamSuffix = "stream "
-			}
-			b.WriteString("  rpc Method" + req + "(" + streamPrefix + req + ") returns (" + streamSuffix + res + ");\n")
-		}
-		b.WriteString("}\n")
+	if strings.Contains(output, "\r") {
+		t.Errorf("expected LF line endings:\n%q", output)
+	}
+	if !strings.Contains(output, "\n    string a = 1;\n") {
+		t.Errorf("expected tabs expanded to 4 columns:\n%s", output)
+	}
+	if err := verifyContentIntegrity(input, output, opts); err != nil {
+		t.Errorf("content integrity failed: %v", err)
 	}
 
-	// Emit enums
-	for _, name := range enums {
-		if rng.Intn(2) == 0 {
-			b.WriteString("\n// " + name + " enum type.\n")
-		}
-		b.WriteString("enum " + name + " {\n")
-		b.WriteString("  " + strings.ToUpper(name) + "_UNSPECIFIED = 0;\n")
-		b.WriteString("  " + strings.ToUpper(name) + "_VALUE = 1;\n")
-		b.WriteString("}\n")
+	opts = defaultOpts
+	opts.EndOfLine = EndOfLineCRLF
+	opts.NoFinalNewline = true
+	crlf, _, err := Sort(output, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(crlf, "\n") != strings.Count(crlf, "\r\n") || strings.HasSuffix(crlf, "\n") || !strings.HasSuffix(crlf, "}") {
+		t.Errorf("expected CRLF endings and no final newline:\n%q", crlf)
 	}
+	if again, _, _ := Sort(crlf, opts); again != crlf {
+		t.Errorf("not idempotent:\n%q", again)
+	}
+	if err := verifyContentIntegrity(output, crlf, opts); err != nil {
+		t.Errorf("content integrity failed: %v", err)
+	}
+}
 
-	// Emit messages in shuffled order
-	perm := rng.Perm(len(names))
-	for _, idx := range perm {
-		name := names[idx]
+func TestSort_KeepsDominantLineEnding(t *testing.T) {
+	// One line of a CRLF file was edited with an LF-only editor
+	input := "syntax = \"proto3\";\r\n\r\nmessage B {\r\n  A a = 1;\n}\r\n\r\nmessage A {\r\n  string v = 1;\r\n}\r\n\r\nmessage C { string v = 1; }\r\n"
 
-		// Optionally add a leading comment
-		if rng.Intn(3) == 0 {
-			b.WriteString("\n// " + name + " is a message type.\n")
+	for _, eol := range []string{"", EndOfLineAuto} {
+		opts := defaultOpts
+		opts.EndOfLine = eol
+		output, _, err := Sort(input, opts)
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		b.WriteString("message " + name + " {\n")
-		b.WriteString("  string id = 1;\n")
-
-		fieldNum := 2
-
-		// Randomly reference other types as regular fields
-		for _, otherIdx := range rng.Perm(len(names)) {
-			other := names[otherIdx]
-			if other == name {
-				continue
-			}
-			if rng.Intn(4) == 0 { // 25% chance
-				b.WriteString("  " + other + " ref_" + strings.ToLower(other) + " = " + strconv.Itoa(fieldNum) + ";\n")
-				fieldNum++
-			}
-			if fieldNum > 5 {
-				break
-			}
+		if output == input || strings.Count(output, "\n") != strings.Count(output, "\r\n") {
+			t.Errorf("end of line %q: expected sorted output with only CRLF endings:\n%q", eol, output)
 		}
-
-		// Optionally add a map field
-		if fieldNum <= 5 && len(names) > 1 && rng.Intn(4) == 0 {
-			other := names[rng.Intn(len(names))]
-			if other != name {
-				b.WriteString("  map<string, " + other + "> map_" + strings.ToLower(other) + " = " + strconv.Itoa(fieldNum) + ";\n")
-				fieldNum++
-			}
+		if err := Verify(input, output, opts); err != nil {
+			t.Errorf("end of line %q: output should verify: %v", eol, err)
 		}
+	}
 
-		// Optionally add a oneof
-		if fieldNum <= 5 && len(names) > 2 && rng.Intn(4) == 0 {
-			b.WriteString("  oneof payload {\n")
-			count := 0
-			for _, otherIdx := range rng.Perm(len(names)) {
-				other := names[otherIdx]
-				if other == name || count >= 2 {
-					break
-				}
-				b.WriteString("    " + other + " oneof_" + strings.ToLower(other) + " = " + strconv.Itoa(fieldNum) + ";\n")
-				fieldNum++
-				count++
-			}
-			b.WriteString("  }\n")
-		}
+	lf := strings.ReplaceAll(input, "\r\n", "\n")
+	if output, _, _ := Sort(lf, defaultOpts); strings.Contains(output, "\r") {
+		t.Errorf("expected LF endings for an LF file:\n%q", output)
+	}
+}
 
-		// Optionally reference an enum
-		if fieldNum <= 6 && len(enums) > 0 && rng.Intn(3) == 0 {
-			e := enums[rng.Intn(len(enums))]
-			b.WriteString("  " + e + " " + strings.ToLower(e) + " = " + strconv.Itoa(fieldNum) + ";\n")
-		}
+func TestSort_PreserveSpacing(t *testing.T) {
+	// A and B stay adjacent, B and C too; Z moves up
+	input := "syntax = \"proto3\";\n\nmessage A {\n  string v = 1;\n}\n\n\n// Chapter two\nmessage B {\n  string v = 1;\n}\nmessage C {\n  string v = 1;\n}\n\n\n\nmessage Z {\n  string v = 1;\n}\n\n\nmessage D {\n  string v = 1;\n}\n"
+	want := "syntax = \"proto3\";\n\nmessage A {\n  string v = 1;\n}\n\n\n// Chapter two\nmessage B {\n  string v = 1;\n}\nmessage C {\n  string v = 1;\n}\n\nmessage D {\n  string v = 1;\n}\n\nmessage Z {\n  string v = 1;\n}\n"
 
-		b.WriteString("}\n")
+	opts := defaultOpts
+	opts.PreserveSpacing = true
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != want {
+		t.Errorf("unexpected output:\n%s", DiffStrings(want, output, "want", "got"))
+	}
+	if again, _, _ := Sort(output, opts); again != output {
+		t.Errorf("expected sorting to be idempotent:\n%q", again)
 	}
 
-	return b.String()
+	// Without the option every gap is one blank line
+	output, _, _ = Sort(input, defaultOpts)
+	if strings.Contains(output, "}\n\n\n") || strings.Contains(output, "}\nmessage") {
+		t.Errorf("expected normalized spacing:\n%s", output)
+	}
 }
 
-// ============================================================
-// Comment association tests (new)
-// ============================================================
-
-func TestSort_PreserveDividers(t *testing.T) {
-	input := `syntax = "proto3";
-
-// === Messages ===
+func TestSort_VerbatimRegion(t *testing.T) {
+	region := `// BEGIN GENERATED by protoc-gen-islands
+message Island {
+  string b = 2;
+  string a = 1;
+}
 
-message Beta { string v = 1; }
+// Kept below Island.
+enum Coast {
+  COAST_UNSPECIFIED = 0;
+}
+// END GENERATED`
+	input := "syntax = \"proto3\";\n\nmessage Zebra {\n  string b = 2;\n  string a = 1;\n}\n\n" + region + "\n\nmessage Apple {\n  string v = 1;\n}\n"
 
-message Alpha { string v = 1; }
-`
-	opts := Options{Quiet: true, PreserveDividers: true}
+	opts := defaultOpts
+	opts.SortFields = true
+	opts.VerbatimBegin = `^BEGIN GENERATED\b`
+	opts.VerbatimEnd = `^END GENERATED$`
 	output, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Divider should survive and be attached to the first declaration after it
-	if !strings.Contains(output, "=== Messages ===") {
-		t.Error("divider comment should be preserved when --preserve-dividers is set")
+	// The region sorts as Island, between Apple and Zebra, untouched
+	assertOrder(t, output, "message Apple", region+"\n\nmessage Zebra {\n  string a = 1;\n  string b = 2;\n}\n")
+	if err := Verify(input, output, opts); err != nil {
+		t.Errorf("output should verify: %v", err)
+	}
+	if again, _, _ := Sort(output, opts); again != output {
+		t.Errorf("expected sorting to be idempotent:\n%s", DiffStrings(output, again, "first", "second"))
+	}
+
+	// An unclosed region is sorted normally
+	opts.Quiet = false
+	_, warnings, err := Sort(strings.Replace(input, "// END GENERATED", "// end", 1), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0].Code != WarningVerbatim {
+		t.Errorf("expected a verbatim warning, got %v", warnings)
 	}
-	// Alpha should still come before Beta (both unreferenced, alphabetical)
-	assertOrder(t, output, "message Alpha", "message Beta")
 }
 
-func TestSort_DividerDroppedByDefault(t *testing.T) {
-	input := `syntax = "proto3";
+func TestSort_ConflictMarkers(t *testing.T) {
+	input := "syntax = \"proto3\";\n\nmessage A {\n<<<<<<< HEAD\n  string v = 1;\n||||||| base\n=======\n  int32 v = 1;\n>>>>>>> feature\n}\n"
+	var conflictErr *ConflictError
+	if _, _, err := Sort(input, defaultOpts); !errors.As(err, &conflictErr) || conflictErr.Line != 4 {
+		t.Fatalf("expected a ConflictError at line 4, got %v", err)
+	}
 
-// === Messages ===
+	// Look-alikes that aren't markers are left to the scanner
+	for _, line := range []string{"// <<<<<<< HEAD", "<<<<<<<<", "  ======="} {
+		if n := conflictMarkerLine("syntax = \"proto3\";\n" + line + "\n"); n != 0 {
+			t.Errorf("%q: unexpected marker at line %d", line, n)
+		}
+	}
+}
 
-message Beta { string v = 1; }
+func TestSort_ByteOrderMark(t *testing.T) {
+	input := "\ufeff// Copyright 2024 Acme\n\nsyntax = \"proto3\";\n\nmessage B {\n  A a = 1;\n}\n\nmessage A {\n  string v = 1;\n}\n\nmessage C {\n  string v = 1;\n}\n"
+	want := "\ufeff// Copyright 2024 Acme\nsyntax = \"proto3\";\n\nmessage C {\n  string v = 1;\n}\n\nmessage B {\n  A a = 1;\n}\n\nmessage A {\n  string v = 1;\n}\n"
 
-// --- Services ---
-message Alpha { string v = 1; }
-`
 	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if strings.Contains(output, "=== Messages ===") {
-		t.Error("divider should be stripped by default")
+	if output != want {
+		t.Errorf("expected the BOM kept ahead of the license comment:\n%q", output)
 	}
-	if strings.Contains(output, "--- Services ---") {
-		t.Error("divider should be stripped by default")
+	if again, _, _ := Sort(output, defaultOpts); again != output {
+		t.Errorf("expected sorting to be idempotent:\n%q", again)
+	}
+	if err := Verify(input, output, defaultOpts); err != nil {
+		t.Errorf("output should verify: %v", err)
+	}
+
+	proto2 := "\ufeffsyntax = \"proto2\";\n\nmessage A {\n  optional string v = 1;\n}\n"
+	if _, _, err := Sort(proto2, defaultOpts); !errors.As(err, new(*Proto2Error)) {
+		t.Errorf("expected a Proto2Error for a BOM-prefixed proto2 file, got %v", err)
 	}
 }
 
-func TestSort_BlockCommentStyleSurvives(t *testing.T) {
+func TestSort_IndentSize(t *testing.T) {
+	twoSpaces := "syntax = \"proto3\";\n\nmessage Foo {\n  string a = 1;\n  message Inner {\n    int32 c = 1;\n  }\n}\n"
+	fourSpaces := "syntax = \"proto3\";\n\nmessage Foo {\n    string a = 1;\n    message Inner {\n        int32 c = 1;\n    }\n}\n"
+	tabs := "syntax = \"proto3\";\n\nmessage Foo {\n\tstring a = 1;\n\tmessage Inner {\n\t\tint32 c = 1;\n\t}\n}\n"
+
+	for _, tc := range []struct {
+		input, indent, want string
+	}{
+		{twoSpaces, "4", fourSpaces},
+		{fourSpaces, "2", twoSpaces},
+		{tabs, "4", fourSpaces},
+		{fourSpaces, "tab", tabs},
+	} {
+		opts := defaultOpts
+		opts.Indent = tc.indent
+		output, _, err := Sort(tc.input, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != tc.want {
+			t.Errorf("indent %q: got\n%s\nwant\n%s", tc.indent, output, tc.want)
+		}
+		if err := Verify(tc.input, output, opts); err != nil {
+			t.Errorf("indent %q: reindented output should verify: %v", tc.indent, err)
+		}
+	}
+
+	for _, indent := range []string{"", "0", "-2", "tabs2"} {
+		if _, _, ok := ParseIndent(indent); ok {
+			t.Errorf("ParseIndent(%q) should fail", indent)
+		}
+	}
+}
+
+func TestSort_FileEndsWithNewline(t *testing.T) {
 	input := `syntax = "proto3";
 
-/* Block-style comment for Foo. */
 message Foo { string v = 1; }
-
-// Line-style comment for Bar.
-message Bar { string v = 1; }
 `
 	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "/* Block-style comment for Foo. */") {
-		t.Error("block comment style should be preserved")
+	if !strings.HasSuffix(output, "\n") {
+		t.Error("file should end with newline")
 	}
-	if !strings.Contains(output, "// Line-style comment for Bar.") {
-		t.Error("line comment style should be preserved")
-	}
-}
-
-func TestSort_TrailingCommentOnClosingBrace(t *testing.T) {
-	input := `syntax = "proto3";
-
-message Foo {
-  string v = 1;
-} // end Foo
-`
-	output, _, err := Sort(input, defaultOpts)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !strings.Contains(output, "} // end Foo") {
-		t.Error("trailing comment on closing brace should be preserved")
+	if strings.HasSuffix(output, "\n\n") {
+		t.Error("file should not end with blank line")
 	}
 }
 
 // ============================================================
-// Ordering rule tests (new)
+// Edge cases
 // ============================================================
 
-func TestSort_InterleavedRPCRequestResponse_MultipleServices(t *testing.T) {
-	input := `syntax = "proto3";
-
-service Svc1 {
-  rpc A(A1Req) returns (A1Res);
-}
+func TestSort_Proto2Rejected(t *testing.T) {
+	input := `syntax = "proto2";
 
-service Svc2 {
-  rpc B(B1Req) returns (B1Res);
+message Foo {
+  required string name = 1;
 }
-
-message B1Res { string v = 1; }
-message A1Req { string v = 1; }
-message A1Res { string v = 1; }
-message B1Req { string v = 1; }
 `
-	output, _, err := Sort(input, defaultOpts)
-	if err != nil {
-		t.Fatal(err)
+	_, _, err := Sort(input, Options{})
+	if err == nil || !strings.Contains(err.Error(), "proto2") {
+		t.Errorf("expected proto2 error, got: %v", err)
 	}
-	// Services preserve original order, then their RPC messages follow
-	assertOrder(t, output, "service Svc1", "service Svc2",
-		"message A1Req", "message A1Res",
-		"message B1Req", "message B1Res")
 }
 
-func TestSort_Section2MessageAlsoUsedAsFieldType_AppearsOnce(t *testing.T) {
+func TestSort_MultiplePackages(t *testing.T) {
 	input := `syntax = "proto3";
 
-service S { rpc Do(Req) returns (Res); }
-message Req { string v = 1; }
-message Res { Req nested = 1; }
+package a.v1;
+
+message B { string v = 1; }
+
+package b.v1;
+
+message A { string v = 1; }
 `
-	output, _, err := Sort(input, defaultOpts)
+	output, warnings, err := Sort(input, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Req is both an RPC type and referenced as field type — Section 2 wins
-	if strings.Count(output, "message Req") != 1 {
-		t.Error("Req should appear exactly once")
+	if output != input {
+		t.Errorf("file with two packages should be left unchanged, got:\n%s", output)
 	}
-	assertOrder(t, output, "service S", "message Req", "message Res")
-}
-
-// ============================================================
-// Reference counting tests (new)
-// ============================================================
-
-func TestRefCounts_SelfReferencing(t *testing.T) {
-	blocks := []*Block{
-		{Kind: BlockMessage, Name: "TreeNode", DeclText: "message TreeNode { TreeNode child = 1; }"},
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "multiple package statements (a.v1, b.v1)") {
+		t.Errorf("expected multiple-package warning, got %v", warnings)
 	}
-	counts := BuildRefCounts(blocks)
-	if counts["TreeNode"] != 0 {
-		t.Errorf("self-referencing type should have ref_count=0, got %d", counts["TreeNode"])
+
+	_, _, err = Sort(input, Options{Strict: true})
+	var unsupportedErr *UnsupportedError
+	if !errors.As(err, &unsupportedErr) {
+		t.Errorf("strict mode should return UnsupportedError, got %v", err)
 	}
 }
 
-func TestRefCounts_FieldWithOptions(t *testing.T) {
-	// Field options like [(validate.rules).string.min_len = 1] should not confuse type extraction
-	blocks := []*Block{
-		{Kind: BlockMessage, Name: "A", DeclText: `message A {
-  string name = 1 [(validate.rules).string.min_len = 1];
-  Foo foo = 2;
-}`},
-		{Kind: BlockMessage, Name: "Foo", DeclText: "message Foo { string v = 1; }"},
+func TestSort_EmptyFile(t *testing.T) {
+	output, _, err := Sort("", defaultOpts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	counts := BuildRefCounts(blocks)
-	if counts["Foo"] != 1 {
-		t.Errorf("Foo ref_count: want 1, got %d", counts["Foo"])
+	if output != "" {
+		t.Error("empty input should produce empty output")
 	}
 }
 
-// ============================================================
-// Edge case tests (new)
-// ============================================================
-
-func TestSort_ReservedStatements(t *testing.T) {
+func TestSort_HeaderOnly(t *testing.T) {
 	input := `syntax = "proto3";
 
-message Foo {
-  reserved 2, 15, 9 to 11;
-  reserved "bar", "baz";
-  string name = 1;
-}
+package test.v1;
 `
 	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "reserved 2, 15, 9 to 11;") {
-		t.Error("reserved field numbers should be preserved")
-	}
-	if !strings.Contains(output, `reserved "bar", "baz";`) {
-		t.Error("reserved field names should be preserved")
+	if !strings.Contains(output, "syntax") || !strings.Contains(output, "package") {
+		t.Error("header should be preserved")
 	}
 }
 
-func TestSort_UnreferencedTypeWarning(t *testing.T) {
+func TestSort_SingleDeclaration(t *testing.T) {
 	input := `syntax = "proto3";
 
-message Orphan1 { string v = 1; }
-message Orphan2 { string v = 1; }
+message Only { string v = 1; }
 `
-	_, warnings, err := Sort(input, Options{})
+	output, _, err := Sort(input, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(warnings) != 0 {
-		t.Errorf("expected no warnings for unreferenced types, got: %v", warnings)
+	if !strings.Contains(output, "message Only") {
+		t.Error("single declaration should be preserved")
 	}
 }
 
 // ============================================================
-// CLI integration tests (new)
+// --strip-commented-code tests
 // ============================================================
 
-func TestCLI_CheckExitCode(t *testing.T) {
-	// --check should return exit code 1 if file would change
+func TestSort_StripCommentedCode(t *testing.T) {
 	input := `syntax = "proto3";
 
-message B { string v = 1; }
-message A { string v = 1; }
+// rpc OldMethod(OldReq) returns (OldRes);
+
+// This is a real comment about Foo.
+message Foo { string v = 1; }
 `
-	tmpDir := t.TempDir()
-	inputFile := filepath.Join(tmpDir, "test.proto")
-	if err := os.WriteFile(inputFile, []byte(input), 0644); err != nil {
-		t.Fatalf("writing test file: %v", err)
+	output, _, err := Sort(input, Options{Quiet: true, StripCommented: true})
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	code := processFile(inputFile, Options{Check: true, Quiet: true})
-	if code != 1 {
-		t.Errorf("check mode should return 1 for changed file, got %d", code)
+	if strings.Contains(output, "OldMethod") {
+		t.Error("commented-out RPC should be stripped")
+	}
+	if !strings.Contains(output, "real comment about Foo") {
+		t.Error("prose comment should be preserved")
 	}
 }
 
-func TestCLI_CheckExitCode_NoChange(t *testing.T) {
-	// Already sorted — should return 0
+func TestSort_StripCommentedCode_PreservesProseComments(t *testing.T) {
 	input := `syntax = "proto3";
 
-message A { string v = 1; }
-
-message B { string v = 1; }
+// This describes the purpose of the message.
+// It has multiple lines of explanation.
+message Foo { string v = 1; }
 `
-	tmpDir := t.TempDir()
-	inputFile := filepath.Join(tmpDir, "test.proto")
-	if err := os.WriteFile(inputFile, []byte(input), 0644); err != nil {
-		t.Fatalf("writing test file: %v", err)
+	output, _, err := Sort(input, Options{Quiet: true, StripCommented: true})
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	code := processFile(inputFile, Options{Check: true, Quiet: true})
-	if code != 0 {
-		t.Errorf("check mode should return 0 for already-sorted file, got %d", code)
+	if !strings.Contains(output, "purpose of the message") {
+		t.Error("prose comments should not be stripped")
 	}
 }
 
-func TestCLI_WriteInPlace(t *testing.T) {
+func TestSort_StripCommentedCode_Patterns(t *testing.T) {
 	input := `syntax = "proto3";
 
-message B { string v = 1; }
+// workflow Retry { attempts: 3 }
 
-message A { string v = 1; }
+// WHERE user_id = 42
+message Foo { string v = 1; }
 `
-	tmpDir := t.TempDir()
-	inputFile := filepath.Join(tmpDir, "test.proto")
-	if err := os.WriteFile(inputFile, []byte(input), 0644); err != nil {
-		t.Fatalf("writing test file: %v", err)
-	}
-
-	code := processFile(inputFile, Options{Write: true, Quiet: true})
-	if code != 0 {
-		t.Errorf("write mode should return 0, got %d", code)
-	}
-
-	content, err := os.ReadFile(inputFile)
+	// By default the DSL line reads as prose and the SQL line as a field
+	// declaration, so the wrong block goes
+	opts := Options{Quiet: true, StripCommented: true}
+	output, _, err := Sort(input, opts)
 	if err != nil {
-		t.Fatalf("reading back file: %v", err)
+		t.Fatal(err)
 	}
-	if !strings.Contains(string(content), "message A") {
-		t.Error("file should have been written with sorted content")
+	if !strings.Contains(output, "workflow Retry") || strings.Contains(output, "WHERE") {
+		t.Fatalf("unexpected default classification:\n%s", output)
 	}
-	assertOrder(t, string(content), "message A", "message B")
-}
 
-func TestCLI_DiffOutput(t *testing.T) {
-	a := "line1\nline2\nline3\n"
-	b := "line1\nchanged\nline3\n"
-	diff := DiffStrings(a, b, "a", "b")
-	if !strings.Contains(diff, "--- a") {
-		t.Error("diff should contain --- header")
-	}
-	if !strings.Contains(diff, "+++ b") {
-		t.Error("diff should contain +++ header")
+	opts.CodePatterns = []string{`^workflow\s+\w+\s*\{`}
+	opts.ProsePatterns = []string{`^(?i)where\b`}
+	output, _, err = Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(diff, "-line2") {
-		t.Error("diff should show removed line")
+	if strings.Contains(output, "workflow Retry") {
+		t.Error("DSL snippet matching a code pattern should be stripped")
 	}
-	if !strings.Contains(diff, "+changed") {
-		t.Error("diff should show added line")
+	if !strings.Contains(output, "WHERE user_id = 42") {
+		t.Error("block with a line matching a prose pattern should be preserved")
 	}
-	if !strings.Contains(diff, "@@") {
-		t.Error("diff should contain hunk headers")
+
+	opts.CodePatterns = []string{"("}
+	if _, _, err := Sort(input, opts); err == nil {
+		t.Error("expected an error for an invalid pattern")
 	}
 }
 
-func TestCLI_DryRun(t *testing.T) {
-	input := `syntax = "proto3";
+// ============================================================
+// Verification tests
+// ============================================================
 
-message B { string v = 1; }
+func TestVerifyIntegrity_Pass(t *testing.T) {
+	original := `syntax = "proto3";
+message Foo { string v = 1; }
+message Bar { string v = 1; }
+`
+	sorted := `syntax = "proto3";
+message Bar { string v = 1; }
+message Foo { string v = 1; }
+`
+	if err := verifyContentIntegrity(original, sorted, defaultOpts); err != nil {
+		t.Errorf("should pass: %v", err)
+	}
+}
 
-message A { string v = 1; }
+func TestVerifyIntegrity_MissingDecl(t *testing.T) {
+	original := `syntax = "proto3";
+message Foo { string v = 1; }
+message Bar { string v = 1; }
 `
-	tmpDir := t.TempDir()
-	inputFile := filepath.Join(tmpDir, "test.proto")
-	if err := os.WriteFile(inputFile, []byte(input), 0644); err != nil {
-		t.Fatalf("writing test file: %v", err)
+	sorted := `syntax = "proto3";
+message Foo { string v = 1; }
+`
+	if err := verifyContentIntegrity(original, sorted, defaultOpts); err == nil {
+		t.Error("should fail for missing declaration")
 	}
+}
 
-	code := processFile(inputFile, Options{DryRun: true, Quiet: true})
-	if code != 0 {
-		t.Errorf("dry-run should return 0, got %d", code)
+func TestVerifyIntegrity_AlteredBody(t *testing.T) {
+	original := `syntax = "proto3";
+message Foo { string name = 1; }
+`
+	sorted := `syntax = "proto3";
+message Foo { int32 name = 1; }
+`
+	if err := verifyContentIntegrity(original, sorted, defaultOpts); err == nil {
+		t.Error("should fail for altered body")
 	}
+}
 
-	// File should NOT be modified
-	content, err := os.ReadFile(inputFile)
-	if err != nil {
-		t.Fatalf("reading back file: %v", err)
+func TestVerifyIntegrity_ExtraDecl(t *testing.T) {
+	original := `syntax = "proto3";
+message Foo { string v = 1; }
+`
+	sorted := `syntax = "proto3";
+message Foo { string v = 1; }
+message Bar { string v = 1; }
+`
+	if err := verifyContentIntegrity(original, sorted, defaultOpts); err == nil {
+		t.Error("should fail for extra declaration")
+	}
+}
+
+func TestVerify_RequireVerify(t *testing.T) {
+	content := `syntax = "proto3";
+message Foo { string v = 1; }
+`
+	opts := defaultOpts
+	opts.Verify = true
+	opts.Verifier = VerifierProtoc
+	opts.ProtocPath = filepath.Join(t.TempDir(), "no-such-protoc")
+
+	// A missing protoc is skipped by default
+	if err := Verify(content, content, opts); err != nil {
+		t.Errorf("expected skip without --require-verify, got %v", err)
 	}
-	if string(content) != input {
-		t.Error("dry-run should not modify the file")
+
+	opts.RequireVerify = true
+	if err := Verify(content, content, opts); err == nil {
+		t.Error("expected an error when protoc is missing and verification is required")
 	}
 }
 
-func TestCLI_QuietSuppressesWarnings(t *testing.T) {
-	input := `syntax = "proto3";
+func TestVerify_InProcess(t *testing.T) {
+	original := `syntax = "proto3";
 
-message Orphan { string v = 1; }
+import "google/protobuf/timestamp.proto";
+
+message Foo { Bar bar = 1; google.protobuf.Timestamp at = 2; }
+message Bar { string v = 1; }
 `
-	_, warnings, err := Sort(input, Options{Quiet: true})
+	sorted, _, err := Sort(original, defaultOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(warnings) != 0 {
-		t.Errorf("quiet mode should suppress warnings, got %v", warnings)
+	// No protoc needed: the path is never consulted by the default verifier
+	opts := Options{Verify: true, ProtocPath: filepath.Join(t.TempDir(), "no-such-protoc")}
+	if err := verifyDescriptorSets(original, sorted, opts); err != nil {
+		t.Errorf("expected in-process verification to pass: %v", err)
 	}
-}
 
-func TestCLI_ExitCodeMatrix(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		opts     Options
-		wantCode int
-	}{
-		{
-			name:     "proto2 returns 3",
-			input:    `syntax = "proto2"; message Foo { required string v = 1; }`,
-			opts:     Options{},
-			wantCode: 3,
-		},
-		{
-			name:     "success returns 0",
-			input:    "syntax = \"proto3\";\n\nmessage Foo { string v = 1; }\n",
-			opts:     Options{Quiet: true},
-			wantCode: 0,
-		},
+	tampered := strings.Replace(sorted, "string v = 1;", "string v = 3;", 1)
+	err = verifyDescriptorSets(original, tampered, opts)
+	if err == nil || !strings.Contains(err.Error(), "descriptor sets differ") {
+		t.Errorf("expected descriptor mismatch, got %v", err)
 	}
 
-	for _, tt := range tests {
+	err = verifyDescriptorSets(original, strings.Replace(sorted, "Bar bar", "Baz bar", 1), opts)
+	if err == nil || !strings.Contains(err.Error(), "compiling sorted output") {
+		t.Errorf("expected compile error, got %v", err)
+	}
+}
+
+func TestVerifyBatch_Imports(t *testing.T) {
+	// api.proto imports common.proto, which is sorted in the same batch,
+	// and types.proto, which is unchanged and only staged for the import
+	common := `syntax = "proto3";
+
+package api.v1;
+
+message Common { Zed z = 1; }
+message Zed { string v = 1; }
+`
+	api := `syntax = "proto3";
+
+package api.v1;
+
+import "api/v1/common.proto";
+import "api/v1/types.proto";
+
+message Resp { string v = 1; }
+message Req { Common c = 1; T t = 2; }
+`
+	types := "syntax = \"proto3\";\n\npackage api.v1;\n\nmessage T {}\n"
+	batch := []VerifyFile{
+		{Name: "api/v1/common.proto", Original: common},
+		{Name: "api/v1/api.proto", Original: api},
+		{Name: "api/v1/types.proto", Original: types, Sorted: types},
+	}
+	for i := range batch[:2] {
+		sorted, _, err := Sort(batch[i].Original, Options{Quiet: true, SharedOrder: "alpha"})
+		if err != nil || sorted == batch[i].Original {
+			t.Fatalf("%s should sort to something new (err %v)", batch[i].Name, err)
+		}
+		batch[i].Sorted = sorted
+	}
+
+	for _, verifier := range []string{VerifierProtocompile, VerifierProtoc} {
+		opts := Options{Verify: true, Verifier: verifier}
+		if verifier == VerifierProtoc && !ProtocAvailable(opts) {
+			continue
+		}
+		for i, err := range VerifyBatch(batch, opts) {
+			if err != nil {
+				t.Errorf("%s: %s should verify: %v", verifier, batch[i].Name, err)
+			}
+		}
+	}
+
+	// A changed schema is attributed to its own file
+	tampered := append([]VerifyFile(nil), batch...)
+	tampered[1].Sorted = strings.Replace(tampered[1].Sorted, "T t = 2;", "T t = 3;", 1)
+	errs := verifyDescriptorSetsBatch(tampered, Options{Verify: true})
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("only api.proto should fail: %v", errs)
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "descriptor sets differ") {
+		t.Errorf("expected a descriptor mismatch for api.proto, got %v", errs[1])
+	}
+}
+
+func TestVerify_Paranoid(t *testing.T) {
+	input := `syntax = "proto3";
+
+// === Zoo ===
+message Z { string v = 1; }
+
+// message Old { string v = 1; }
+
+message A { string v = 1; }
+`
+	sortAndVerify := func(opts Options) error {
+		t.Helper()
+		output, _, err := Sort(input, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Verify(input, output, opts)
+	}
+
+	// The divider is dropped by default, which only --paranoid notices
+	if err := sortAndVerify(Options{Quiet: true}); err != nil {
+		t.Errorf("integrity check should pass: %v", err)
+	}
+	err := sortAndVerify(Options{Quiet: true, Paranoid: true})
+	if err == nil || !strings.Contains(err.Error(), "'='") {
+		t.Errorf("expected a character count error for the dropped divider, got %v", err)
+	}
+
+	// Kept dividers and injected headers are fine
+	if err := sortAndVerify(Options{Quiet: true, Paranoid: true, PreserveDividers: true, SectionHeaders: true, TOC: true}); err != nil {
+		t.Errorf("preserved dividers: %v", err)
+	}
+
+	// Explicitly stripped commented-out code doesn't count
+	if output, _, _ := Sort(input, Options{Quiet: true, StripCommented: true}); strings.Contains(output, "Old") {
+		t.Fatalf("commented-out code was not stripped:\n%s", output)
+	}
+	if err := sortAndVerify(Options{Quiet: true, Paranoid: true, PreserveDividers: true, StripCommented: true}); err != nil {
+		t.Errorf("strip-commented-code: %v", err)
+	}
+}
+
+func TestVerifyGRPCCompat(t *testing.T) {
+	original := `syntax = "proto3";
+
+package acme.v1;
+
+import "google/protobuf/empty.proto";
+
+message PingResponse { string v = 1; }
+
+service Pinger {
+  rpc Ping(google.protobuf.Empty) returns (PingResponse);
+  rpc Watch(google.protobuf.Empty) returns (stream PingResponse);
+}
+`
+	sorted, _, err := Sort(original, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Verify: true, VerifyLevel: VerifyGRPCCompat, ProtocPath: "protoc-not-installed"}
+	if err := Verify(original, sorted, opts); err != nil {
+		t.Errorf("expected grpc-compat verification to pass: %v", err)
+	}
+
+	// A changed streaming mode is caught even though every name still resolves
+	tampered := strings.Replace(sorted, "returns (stream PingResponse)", "returns (PingResponse)", 1)
+	err = verifyGRPCCompat(original, tampered, opts)
+	if err == nil || !strings.Contains(err.Error(), "/acme.v1.Pinger/Watch changed") {
+		t.Errorf("expected changed-method error, got %v", err)
+	}
+}
+
+// ============================================================
+// Roundtrip property tests (random valid proto3 files)
+// ============================================================
+
+func TestProperty_RandomProtos(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 100; i++ {
+		proto := generateRandomProto(rng)
+
+		output, _, err := Sort(proto, defaultOpts)
+		if err != nil {
+			t.Fatalf("iteration %d: Sort failed: %v\nInput:\n%s", i, err, proto)
+		}
+
+		// Must be idempotent
+		output2, _, err := Sort(output, defaultOpts)
+		if err != nil {
+			t.Fatalf("iteration %d: second Sort failed: %v", i, err)
+		}
+		if output != output2 {
+			t.Errorf("iteration %d: not idempotent", i)
+		}
+
+		// Content integrity
+		if err := verifyContentIntegrity(proto, output, defaultOpts); err != nil {
+			t.Errorf("iteration %d: integrity check failed: %v", i, err)
+		}
+	}
+}
+
+// generateRandomProto creates a random but valid proto3 file.
+func generateRandomProto(rng *rand.Rand) string {
+	var b strings.Builder
+	b.WriteString("syntax = \"proto3\";\n\npackage test.v1;\n")
+
+	// Random set of type names
+	allNames := []string{"Alpha", "Beta", "Gamma", "Delta", "Epsilon", "Zeta", "Eta", "Theta", "Iota", "Kappa"}
+	numTypes := 3 + rng.Intn(8) // 3-10 types
+	names := allNames[:numTypes]
+
+	// Optionally add enums
+	enumNames := []string{"Status", "Priority", "Category"}
+	numEnums := rng.Intn(3) // 0-2 enums
+	var enums []string
+	for i := 0; i < numEnums; i++ {
+		enums = append(enums, enumNames[i])
+	}
+
+	// Optionally add a service
+	hasService := rng.Intn(3) > 0 // 2/3 chance
+	if hasService {
+		numRPCs := 1 + rng.Intn(3)
+		// Optionally add a comment before the service
+		if rng.Intn(2) == 0 {
+			b.WriteString("\n// Service for handling operations.\n")
+		}
+		b.WriteString("service TestSvc {\n")
+		for j := 0; j < numRPCs && j*2+1 < len(names); j++ {
+			req := names[j*2]
+			res := names[j*2+1]
+			// Optionally use streaming
+			streamPrefix := ""
+			streamSuffix := ""
+			switch rng.Intn(4) {
+			case 1:
+				streamSuffix = "stream "
+			case 2:
+				streamPrefix = "stream "
+			case 3:
+				streamPrefix = "stream "
+				streamSuffix = "stream "
+			}
+			b.WriteString("  rpc Method" + req + "(" + streamPrefix + req + ") returns (" + streamSuffix + res + ");\n")
+		}
+		b.WriteString("}\n")
+	}
+
+	// Emit enums
+	for _, name := range enums {
+		if rng.Intn(2) == 0 {
+			b.WriteString("\n// " + name + " enum type.\n")
+		}
+		b.WriteString("enum " + name + " {\n")
+		b.WriteString("  " + strings.ToUpper(name) + "_UNSPECIFIED = 0;\n")
+		b.WriteString("  " + strings.ToUpper(name) + "_VALUE = 1;\n")
+		b.WriteString("}\n")
+	}
+
+	// Emit messages in shuffled order
+	perm := rng.Perm(len(names))
+	for _, idx := range perm {
+		name := names[idx]
+
+		// Optionally add a leading comment
+		if rng.Intn(3) == 0 {
+			b.WriteString("\n// " + name + " is a message type.\n")
+		}
+
+		b.WriteString("message " + name + " {\n")
+		b.WriteString("  string id = 1;\n")
+
+		fieldNum := 2
+
+		// Randomly reference other types as regular fields
+		for _, otherIdx := range rng.Perm(len(names)) {
+			other := names[otherIdx]
+			if other == name {
+				continue
+			}
+			if rng.Intn(4) == 0 { // 25% chance
+				b.WriteString("  " + other + " ref_" + strings.ToLower(other) + " = " + strconv.Itoa(fieldNum) + ";\n")
+				fieldNum++
+			}
+			if fieldNum > 5 {
+				break
+			}
+		}
+
+		// Optionally add a map field
+		if fieldNum <= 5 && len(names) > 1 && rng.Intn(4) == 0 {
+			other := names[rng.Intn(len(names))]
+			if other != name {
+				b.WriteString("  map<string, " + other + "> map_" + strings.ToLower(other) + " = " + strconv.Itoa(fieldNum) + ";\n")
+				fieldNum++
+			}
+		}
+
+		// Optionally add a oneof
+		if fieldNum <= 5 && len(names) > 2 && rng.Intn(4) == 0 {
+			b.WriteString("  oneof payload {\n")
+			count := 0
+			for _, otherIdx := range rng.Perm(len(names)) {
+				other := names[otherIdx]
+				if other == name || count >= 2 {
+					break
+				}
+				b.WriteString("    " + other + " oneof_" + strings.ToLower(other) + " = " + strconv.Itoa(fieldNum) + ";\n")
+				fieldNum++
+				count++
+			}
+			b.WriteString("  }\n")
+		}
+
+		// Optionally reference an enum
+		if fieldNum <= 6 && len(enums) > 0 && rng.Intn(3) == 0 {
+			e := enums[rng.Intn(len(enums))]
+			b.WriteString("  " + e + " " + strings.ToLower(e) + " = " + strconv.Itoa(fieldNum) + ";\n")
+		}
+
+		b.WriteString("}\n")
+	}
+
+	return b.String()
+}
+
+// ============================================================
+// Comment association tests (new)
+// ============================================================
+
+func TestSort_PreserveDividers(t *testing.T) {
+	input := `syntax = "proto3";
+
+// === Messages ===
+
+message Beta { string v = 1; }
+
+message Alpha { string v = 1; }
+`
+	opts := Options{Quiet: true, PreserveDividers: true}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Divider should survive and be attached to the first declaration after it
+	if !strings.Contains(output, "=== Messages ===") {
+		t.Error("divider comment should be preserved when --preserve-dividers is set")
+	}
+	// Alpha should still come before Beta (both unreferenced, alphabetical)
+	assertOrder(t, output, "message Alpha", "message Beta")
+}
+
+func TestSort_DividerDroppedByDefault(t *testing.T) {
+	input := `syntax = "proto3";
+
+// === Messages ===
+
+message Beta { string v = 1; }
+
+// --- Services ---
+message Alpha { string v = 1; }
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "=== Messages ===") {
+		t.Error("divider should be stripped by default")
+	}
+	if strings.Contains(output, "--- Services ---") {
+		t.Error("divider should be stripped by default")
+	}
+}
+
+func TestSort_Regions(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Zeta { string v = 1; }
+
+// region: billing
+message Beta { string v = 1; }
+
+// Invoice doc
+message Alpha { string v = 1; }
+// endregion
+
+message Gamma { string v = 1; }
+`
+	keep, _, err := Sort(input, Options{Quiet: true, Regions: "keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Region members are sorted among themselves and wrapped by both markers
+	assertOrder(t, keep, "// region: billing", "// Invoice doc", "message Alpha", "message Beta", "// endregion", "message Gamma", "message Zeta")
+
+	again, _, err := Sort(keep, Options{Quiet: true, Regions: "keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != keep {
+		t.Errorf("keep mode not idempotent.\nPass 1:\n%s\nPass 2:\n%s", keep, again)
+	}
+
+	strip, _, err := Sort(input, Options{Quiet: true, Regions: "strip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strip, "region") {
+		t.Errorf("strip mode should remove both markers:\n%s", strip)
+	}
+	if !strings.Contains(strip, "// Invoice doc\nmessage Alpha") {
+		t.Errorf("strip mode should keep ordinary comments:\n%s", strip)
+	}
+}
+
+func TestSort_RegionsUnclosedWarns(t *testing.T) {
+	input := `syntax = "proto3";
+
+// region: open
+message B { string v = 1; }
+message A { string v = 1; }
+`
+	output, warnings, err := Sort(input, Options{Regions: "keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "never closed") {
+		t.Errorf("expected unclosed region warning, got %v", warnings)
+	}
+	assertOrder(t, output, "// region: open", "message A", "message B", "// endregion")
+}
+
+func TestSort_IgnoreDirective(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Delta { string v = 1; }
+
+// Reviewed in this order; keep it here.
+// protosort:ignore
+message Pinned { string v = 1; }
+
+message Charlie { string v = 1; }
+
+message Alpha { string v = 1; }
+`
+	for _, opts := range []Options{defaultOpts, {Quiet: true, SectionHeaders: true, StripCommented: true}} {
+		output, _, err := Sort(input, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOrder(t, output, "message Alpha", "// protosort:ignore\nmessage Pinned", "message Charlie", "message Delta")
+
+		// Sorting again leaves it in place
+		again, _, err := Sort(output, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != output {
+			t.Errorf("not idempotent:\n%s\nthen:\n%s", output, again)
+		}
+	}
+}
+
+func TestSort_PinDirective(t *testing.T) {
+	input := `syntax = "proto3";
+
+service TripService { rpc GetTrip(GetTripRequest) returns (Trip); }
+
+message GetTripRequest { string id = 1; }
+
+// The aggregate everything else hangs off.
+// protosort:pin
+message Trip { Leg leg = 1; }
+
+message Leg { string v = 1; }
+
+// protosort:pin=bottom
+message Zeta { string v = 1; }
+
+// protosort:pin=middle
+message Alpha { string v = 1; }
+`
+	output, warnings, err := Sort(input, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, output, "message Trip", "service TripService", "message GetTripRequest", "message Leg", "message Alpha", "message Zeta")
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, `message Alpha: unknown protosort:pin position "middle"`) {
+		t.Errorf("warnings = %v", warnings)
+	}
+
+	again, _, err := Sort(output, Options{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != output {
+		t.Errorf("not idempotent:\n%s\nthen:\n%s", output, again)
+	}
+}
+
+func TestSort_SectionDirective(t *testing.T) {
+	input := `syntax = "proto3";
+
+package acme.trips.v1;
+
+service TripService {
+  rpc GetTrip(GetTripRequest) returns (Trip);
+  rpc ListTrips(acme.trips.v1.ListTripsRequest) returns (Trip);
+}
+
+message GetTripRequest { Money fare = 1; }
+
+message Trip { string id = 1; }
+
+// protosort:section=core
+message Money { Currency currency = 1; }
+
+enum Currency { CURRENCY_UNSPECIFIED = 0; }
+
+// protosort:section=rpc
+message ListTripsRequest { string v = 1; }
+
+// protosort:section=sideways
+message Orphan { string v = 1; }
+`
+	output, warnings, err := Sort(input, Options{SectionHeaders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, output,
+		"service TripService",
+		"message GetTripRequest", "message Trip", "message ListTripsRequest",
+		"message Orphan",
+		"// Composite Types", "message Money",
+		"// Helper Types", "enum Currency")
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, `message Orphan: unknown protosort:section "sideways"`) {
+		t.Errorf("warnings = %v", warnings)
+	}
+
+	again, _, err := Sort(output, Options{Quiet: true, SectionHeaders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != output {
+		t.Errorf("not idempotent:\n%s\nthen:\n%s", output, again)
+	}
+}
+
+func TestSort_SkipFileDirective(t *testing.T) {
+	skipped := `// Code generated by protoc-gen-foo. DO NOT EDIT.
+// protosort:skip-file
+
+syntax = "proto2";
+
+message B { optional string v = 1; }
+
+message A { optional string v = 1; }
+`
+	output, _, err := Sort(skipped, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != skipped {
+		t.Errorf("skipped file changed:\n%s", output)
+	}
+
+	// Only the top of the file counts
+	late := "syntax = \"proto3\";\n\nmessage B { string v = 1; }\n\n// protosort:skip-file\nmessage A { string v = 1; }\n"
+	if HasSkipFileDirective(late) {
+		t.Error("a directive below the first declaration should not skip the file")
+	}
+	if output, _, _ := Sort(late, defaultOpts); output == late {
+		t.Error("expected the file to be sorted")
+	}
+}
+
+func TestSort_BlockCommentStyleSurvives(t *testing.T) {
+	input := `syntax = "proto3";
+
+/* Block-style comment for Foo. */
+message Foo { string v = 1; }
+
+// Line-style comment for Bar.
+message Bar { string v = 1; }
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "/* Block-style comment for Foo. */") {
+		t.Error("block comment style should be preserved")
+	}
+	if !strings.Contains(output, "// Line-style comment for Bar.") {
+		t.Error("line comment style should be preserved")
+	}
+}
+
+func TestSort_TrailingCommentOnClosingBrace(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Foo {
+  string v = 1;
+} // end Foo
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "} // end Foo") {
+		t.Error("trailing comment on closing brace should be preserved")
+	}
+}
+
+func TestSort_NonASCIIPassthrough(t *testing.T) {
+	input := readFileNormalized(t, "testdata/unicode_comments_input.proto")
+	// Every option that rewrites text inside declarations or adds comments
+	opts := Options{
+		Quiet:            true,
+		SortRPCs:         "alpha",
+		SortFieldOptions: true,
+		StripCommented:   true,
+		SectionHeaders:   true,
+		TOC:              true,
+		Annotate:         true,
+		Indent:           IndentTabs,
+	}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utf8.ValidString(output) {
+		t.Fatal("output is not valid UTF-8")
+	}
+	if err := verifyCharacters(input, output, opts); err != nil {
+		t.Errorf("characters were lost: %v", err)
+	}
+	for _, want := range []string{"[deprecated = true, json_name = \"表示名\"]", "} // 🔚 終わり", "combining: e\u0301"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output should contain %q:\n%s", want, output)
+		}
+	}
+
+	// Parse error context is cut at a character boundary
+	_, _, err = Sort("syntax = \"proto3\";\n"+strings.Repeat("x", 38)+"用户资料\n", defaultOpts)
+	if err == nil || !utf8.ValidString(err.Error()) || strings.Contains(err.Error(), `\x`) {
+		t.Errorf("parse error should quote whole characters, got %v", err)
+	}
+}
+
+// ============================================================
+// Ordering rule tests (new)
+// ============================================================
+
+func TestSort_InterleavedRPCRequestResponse_MultipleServices(t *testing.T) {
+	input := `syntax = "proto3";
+
+service Svc1 {
+  rpc A(A1Req) returns (A1Res);
+}
+
+service Svc2 {
+  rpc B(B1Req) returns (B1Res);
+}
+
+message B1Res { string v = 1; }
+message A1Req { string v = 1; }
+message A1Res { string v = 1; }
+message B1Req { string v = 1; }
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Services preserve original order, then their RPC messages follow
+	assertOrder(t, output, "service Svc1", "service Svc2",
+		"message A1Req", "message A1Res",
+		"message B1Req", "message B1Res")
+}
+
+func TestSort_Section2MessageAlsoUsedAsFieldType_AppearsOnce(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S { rpc Do(Req) returns (Res); }
+message Req { string v = 1; }
+message Res { Req nested = 1; }
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Req is both an RPC type and referenced as field type — Section 2 wins
+	if strings.Count(output, "message Req") != 1 {
+		t.Error("Req should appear exactly once")
+	}
+	assertOrder(t, output, "service S", "message Req", "message Res")
+}
+
+// ============================================================
+// Reference counting tests (new)
+// ============================================================
+
+func TestRefCounts_SelfReferencing(t *testing.T) {
+	blocks := []*Block{
+		{Kind: BlockMessage, Name: "TreeNode", DeclText: "message TreeNode { TreeNode child = 1; }"},
+	}
+	counts := BuildRefCounts(blocks)
+	if counts["TreeNode"] != 0 {
+		t.Errorf("self-referencing type should have ref_count=0, got %d", counts["TreeNode"])
+	}
+}
+
+func TestRefCounts_FieldWithOptions(t *testing.T) {
+	// Field options like [(validate.rules).string.min_len = 1] should not confuse type extraction
+	blocks := []*Block{
+		{Kind: BlockMessage, Name: "A", DeclText: `message A {
+  string name = 1 [(validate.rules).string.min_len = 1];
+  Foo foo = 2;
+}`},
+		{Kind: BlockMessage, Name: "Foo", DeclText: "message Foo { string v = 1; }"},
+	}
+	counts := BuildRefCounts(blocks)
+	if counts["Foo"] != 1 {
+		t.Errorf("Foo ref_count: want 1, got %d", counts["Foo"])
+	}
+}
+
+// ============================================================
+// Edge case tests (new)
+// ============================================================
+
+func TestSort_ReservedStatements(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Foo {
+  reserved 2, 15, 9 to 11;
+  reserved "bar", "baz";
+  string name = 1;
+}
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "reserved 2, 15, 9 to 11;") {
+		t.Error("reserved field numbers should be preserved")
+	}
+	if !strings.Contains(output, `reserved "bar", "baz";`) {
+		t.Error("reserved field names should be preserved")
+	}
+}
+
+func TestSort_UnreferencedTypeWarning(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Orphan1 { string v = 1; }
+message Orphan2 { string v = 1; }
+`
+	_, warnings, err := Sort(input, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings for unreferenced types, got: %v", warnings)
+	}
+}
+
+func TestSort_LintThresholds(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S {
+  rpc A(Req) returns (Res);
+  rpc B(Req) returns (Res);
+  rpc C(Req) returns (Res);
+}
+message Req {
+  string a = 1;
+  map<string, Res> b = 2;
+  oneof c {
+    string d = 3;
+    int32 e = 4;
+  }
+  option deprecated = true;
+  message Nested { string x = 1; string y = 2; }
+}
+message Res { string v = 1; }
+`
+	opts := Options{MaxRPCsPerService: 2, MaxFieldsPerMessage: 3, MaxMessagesPerFile: 1}
+	_, warnings, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Warning{
+		{Code: WarningSize, Message: "service S has 3 RPCs (max 2)", Line: 3},
+		{Code: WarningSize, Message: "message Req has 4 fields (max 3)", Line: 8},
+		{Code: WarningSize, Message: "file has 2 messages (max 1)"},
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings:\nwant %q\ngot  %q", want, warnings)
+	}
+
+	opts.Quiet = true
+	if _, warnings, _ := Sort(input, opts); len(warnings) != 0 {
+		t.Errorf("quiet mode should suppress threshold warnings, got %v", warnings)
+	}
+}
+
+func TestSort_Editions(t *testing.T) {
+	input := `// Copyright header
+edition = "2023";
+
+package test;
+
+option go_package = "example.com/test";
+option features.field_presence = IMPLICIT;
+
+message B {
+  A a = 1 [features.field_presence = EXPLICIT];
+}
+
+message A {
+  option features.message_encoding = DELIMITED;
+  string v = 1;
+}
+`
+	want := `// Copyright header
+edition = "2023";
+
+package test;
+
+option features.field_presence = IMPLICIT;
+option go_package = "example.com/test";
+
+message B {
+  A a = 1 [features.field_presence = EXPLICIT];
+}
+
+message A {
+  option features.message_encoding = DELIMITED;
+  string v = 1;
+}
+`
+	got, _, err := Sort(input, Options{Quiet: true, SharedOrder: "alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if err := Verify(input, got, Options{ProtocPath: "protoc-not-installed"}); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+}
+
+func TestSort_AllowProto2(t *testing.T) {
+	input := `syntax = "proto2";
+
+package test;
+
+message Result {
+  required string url = 1;
+}
+
+message Search {
+  required Query query = 1;
+  optional group Page = 2 {
+    repeated Result results = 3;
+  }
+  extensions 100 to 199;
+}
+
+message Query {
+  required string text = 1;
+}
+`
+	want := `syntax = "proto2";
+
+package test;
+
+message Search {
+  required Query query = 1;
+  optional group Page = 2 {
+    repeated Result results = 3;
+  }
+  extensions 100 to 199;
+}
+
+message Query {
+  required string text = 1;
+}
+
+message Result {
+  required string url = 1;
+}
+`
+	got, _, err := Sort(input, Options{Quiet: true, SharedOrder: "alpha", AllowProto2: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	blocks, _ := ScanFile(input)
+	counts := BuildRefCounts(blocks)
+	if counts["Query"] != 1 || counts["Result"] != 1 || counts["group"] != 0 {
+		t.Errorf("ref counts = %v, want Query and Result referenced once", counts)
+	}
+	if n := countMessageFields(blocks[3].DeclText); n != 2 {
+		t.Errorf("Search has %d fields, want 2 (query and the group)", n)
+	}
+}
+
+// ============================================================
+// CLI integration tests (new)
+// ============================================================
+
+func TestCLI_DiffOutput(t *testing.T) {
+	a := "line1\nline2\nline3\n"
+	b := "line1\nchanged\nline3\n"
+	diff := DiffStrings(a, b, "a", "b")
+	if !strings.Contains(diff, "--- a") {
+		t.Error("diff should contain --- header")
+	}
+	if !strings.Contains(diff, "+++ b") {
+		t.Error("diff should contain +++ header")
+	}
+	if !strings.Contains(diff, "-line2") {
+		t.Error("diff should show removed line")
+	}
+	if !strings.Contains(diff, "+changed") {
+		t.Error("diff should show added line")
+	}
+	if !strings.Contains(diff, "@@") {
+		t.Error("diff should contain hunk headers")
+	}
+}
+
+func TestDiffStrings_LineEndings(t *testing.T) {
+	crlf := "a\r\nb\r\nc\r\n"
+
+	// Endings that differ between the inputs are shown on changed lines
+	diff := DiffStrings(crlf, "a\nb\nc\n", "a", "b")
+	if !strings.Contains(diff, "-a^M\n") || !strings.Contains(diff, "+a\n") {
+		t.Errorf("expected the removed carriage returns to be shown:\n%q", diff)
+	}
+
+	// Files that both use CRLF diff as usual
+	diff = DiffStrings(crlf, "a\r\nB\r\nc\r\n", "a", "b")
+	if strings.Contains(diff, "^M") || !strings.Contains(diff, "-b\r\n+B\r\n") {
+		t.Errorf("expected a plain diff of CRLF files:\n%q", diff)
+	}
+}
+
+func TestDiffSorted_HunkHeadings(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Helper { string v = 1; }
+
+service S {
+  rpc B(BRequest) returns (BResponse);
+  rpc A(ARequest) returns (AResponse);
+}
+
+message ARequest { Helper h = 1; }
+
+message AResponse { string v = 1; }
+
+message BRequest { string v = 1; }
+
+message BResponse { string v = 1; }
+`
+	opts := Options{Quiet: true, SortRPCs: "alpha"}
+	sorted, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := DiffSorted(input, sorted, "a", "b", opts)
+	if !strings.Contains(diff, " @@ message Helper moved to request/response types; service S changed\n") {
+		t.Errorf("hunk headers should name the declarations:\n%s", diff)
+	}
+
+	// Without declarations to name, headers are plain
+	plain := DiffSorted("syntax = \"proto3\";\n// a\n", "syntax = \"proto3\";\n// b\n", "a", "b", opts)
+	if !strings.Contains(plain, "@@ -1,2 +1,2 @@\n") {
+		t.Errorf("expected a plain hunk header:\n%s", plain)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	common := `syntax = "proto3";
+
+package acme.fleet.v1;
+
+option go_package = "acme.com/fleet/v1;fleetv1";
+
+// Vehicle status, as reported by the telematics unit.
+enum VehicleStatus {
+  VEHICLE_STATUS_UNSPECIFIED = 0;
+  VEHICLE_STATUS_PARKED = 1;
+}
+`
+	api := `syntax = "proto3";
+
+package acme.fleet.v1;
+
+import "acme/fleet/v1/common.proto";
+import "google/protobuf/timestamp.proto";
+
+// protosort:pin
+service FleetAPI {
+  rpc GetVehicle(GetVehicleRequest) returns (GetVehicleResponse);
+  rpc ListVehicles(ListVehiclesRequest) returns (ListVehiclesResponse);
+}
+
+message Vehicle {
+  string vin = 1 [deprecated = true, json_name = "VIN"];
+  VehicleStatus status = 2;
+  google.protobuf.Timestamp seen = 3;
+}
+
+message GetVehicleRequest { string vin = 1; }
+message GetVehicleResponse { Vehicle vehicle = 1; }
+message ListVehiclesRequest { int32 page_size = 1; }
+message ListVehiclesResponse { repeated Vehicle vehicles = 1; }
+message Depot { string address = 1; }
+`
+	got, err := Anonymize([]string{common, api})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range []string{"acme", "fleet", "Fleet", "Vehicle", "vin", "VIN", "Depot", "telematics", "page_size"} {
+		if strings.Contains(got[0]+got[1], word) {
+			t.Errorf("%q survived anonymizing:\n%s\n%s", word, got[0], got[1])
+		}
+	}
+	assertOrder(t, got[0], "package pkg1.pkg2.pkg3;", `option go_package = "s1";`, "// x x, x x x x x x.\nenum Enum1 {", "VALUE_2 = 0;")
+	assertOrder(t, got[1], `import "dep1.proto";`, `import "google/protobuf/timestamp.proto";`,
+		"// protosort:pin\nservice Svc1 {",
+		"rpc GetMsg2(GetMsg2Request) returns (GetMsg2Response);",
+		"rpc ListMsg2s(ListMsg2sRequest) returns (ListMsg2sResponse);",
+		`string field_7 = 1 [deprecated = true, json_name = "s2"];`, "Enum1 field_4 = 2;", "google.protobuf.Timestamp field_3 = 3;",
+		"message Msg1 { string field_1 = 1; }")
+
+	// The anonymized files sort the way the originals do
+	for i, original := range []string{common, api} {
+		sorted, _, err := Sort(original, defaultOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := Anonymize([]string{common, sorted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output, _, err := Sort(got[i], defaultOpts); err != nil || output != want[i] {
+			t.Errorf("file %d: sorting the anonymized file differs (%v):\n%s", i, err, DiffStrings(want[i], output, "want", "got"))
+		}
+	}
+
+	if _, err := Anonymize([]string{"widget W {}\n"}); err == nil {
+		t.Error("expected a parse error")
+	}
+}
+
+func TestPlanMoves(t *testing.T) {
+	input := "syntax = \"proto3\";\n\n// C.\nmessage C {}\n\nmessage A {}\n\nmessage B {} // b\n\nmessage D {}\n"
+	moves, err := PlanMoves(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A, B, and D are in order already; only C moves, before D
+	c := strings.Index(input, "\n\n// C.")
+	want := []Move{{Kind: BlockMessage, Name: "C", Start: c, End: c + len("\n\n// C.\nmessage C {}"), To: strings.Index(input, "\n\nmessage D")}}
+	if !reflect.DeepEqual(moves, want) {
+		t.Errorf("moves: want %+v, got %+v", want, moves)
+	}
+	sorted, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ApplyMoves(input, moves); got != sorted {
+		t.Errorf("applying the moves differs from sorting:\n%s", DiffStrings(sorted, got, "sorted", "moved"))
+	}
+
+	input = readFileNormalized(t, "testdata/example_input.proto")
+	if moves, err = PlanMoves(input, defaultOpts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ApplyMoves(input, moves), readFileNormalized(t, "testdata/example_expected.proto"); got != want {
+		t.Errorf("applying the moves differs from sorting:\n%s", DiffStrings(want, got, "sorted", "moved"))
+	}
+
+	if moves, err = PlanMoves(sorted, defaultOpts); err != nil || moves != nil {
+		t.Errorf("expected no moves for a sorted file, got %v, %v", moves, err)
+	}
+}
+
+func TestDiffBlocks(t *testing.T) {
+	input := `syntax = "proto3";
+
+import "google/protobuf/empty.proto";
+
+message Helper { string v = 1; }
+
+service S {
+  rpc B(BRequest) returns (BResponse);
+  rpc A(ARequest) returns (AResponse);
+}
+
+message ARequest { Helper h = 1; }
+
+message AResponse { string v = 1; }
+
+message BRequest { string v = 1; }
+
+message BResponse { string v = 1; }
+`
+	sorted, _, err := Sort(input, Options{Quiet: true, SortRPCs: "alpha", RemoveUnusedImports: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves, err := DiffBlocks(input, sorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]BlockMove)
+	for _, m := range moves {
+		got[m.Kind.String()+" "+m.Name] = m
+	}
+	for key, want := range map[string]BlockMove{
+		"syntax proto3":                      {Kind: BlockSyntax, Name: "proto3", OldIndex: 0, NewIndex: 0, OldLine: 1, NewLine: 1},
+		"service S":                          {Kind: BlockService, Name: "S", OldIndex: 3, NewIndex: 1, OldLine: 7, NewLine: 3, Section: SectionService, Changed: true},
+		"message Helper":                     {Kind: BlockMessage, Name: "Helper", OldIndex: 2, NewIndex: 3, OldLine: 5, NewLine: 10, Section: SectionRequestResponse},
+		"import google/protobuf/empty.proto": {Kind: BlockImport, Name: "google/protobuf/empty.proto", OldIndex: 1, NewIndex: -1, OldLine: 3},
+	} {
+		if got[key] != want {
+			t.Errorf("%s: got %+v, want %+v", key, got[key], want)
+		}
+	}
+	if len(moves) != 8 || moves[len(moves)-1].NewIndex != -1 {
+		t.Errorf("expected the 7 sorted declarations, then the removed import: %+v", moves)
+	}
+
+	if _, err := DiffBlocks("widget W {}\n", sorted); !errors.As(err, new(*ParseError)) {
+		t.Errorf("expected a ParseError, got %v", err)
+	}
+}
+
+func TestCLI_QuietSuppressesWarnings(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Orphan { string v = 1; }
+`
+	_, warnings, err := Sort(input, Options{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("quiet mode should suppress warnings, got %v", warnings)
+	}
+}
+
+func TestCLI_Annotate(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S { rpc Do(Req) returns (Res); }
+message Req { string v = 1; }
+message Res { string v = 1; }
+message Shared { string v = 1; }
+message U1 { Shared s = 1; }
+message U2 { Shared s = 1; }
+message Helper { string v = 1; }
+message Consumer { Helper h = 1; U1 u = 1; U2 u2 = 2; }
+message Orphan { string v = 1; }
+`
+	opts := Options{Quiet: true, Annotate: true}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "// (request/response)") {
+		t.Error("request/response annotation missing")
+	}
+	if !strings.Contains(output, "// (core:") {
+		t.Error("core annotation missing")
+	}
+	if !strings.Contains(output, "// (helper:") {
+		t.Error("helper annotation missing")
+	}
+	if !strings.Contains(output, "// (unreferenced)") {
+		t.Error("unreferenced annotation missing")
+	}
+}
+
+// ============================================================
+// Shared-order dependency test
+// ============================================================
+
+func TestSort_SharedOrderDependency(t *testing.T) {
+	// A depends on B, B depends on C. X and Y reference A/B/C.
+	// A, B, X, Y are core (outgoing refs); C is helper (incoming only).
+	input := `syntax = "proto3";
+
+message A { B b = 1; }
+message B { C c = 1; }
+message C { string v = 1; }
+message X { A a = 1; C c = 1; }
+message Y { B b = 1; A a = 1; }
+`
+	opts := Options{Quiet: true, SharedOrder: "dependency"}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In dependency order for core: B before A (B is A's dependency).
+	// C is helper, emitted after core.
+	assertOrder(t, output, "message B", "message A", "message C")
+}
+
+func TestSort_KindOrder(t *testing.T) {
+	// Apple and Zebra stand alone; Order uses the helpers Item and Status
+	input := `syntax = "proto3";
+
+message Zebra { string v = 1; }
+enum Apple { APPLE_UNSPECIFIED = 0; }
+message Order {
+  Item item = 1;
+  Status status = 2;
+}
+message Item { string v = 1; }
+enum Status { STATUS_UNSPECIFIED = 0; }
+`
+	for _, tc := range []struct {
+		kindOrder string
+		want      []string
+	}{
+		{"", []string{"enum Apple", "message Zebra", "message Order", "message Item", "enum Status"}},
+		{"mixed", []string{"enum Apple", "message Zebra", "message Order", "message Item", "enum Status"}},
+		{"enums-first", []string{"enum Apple", "message Zebra", "message Order", "enum Status", "message Item"}},
+		{"messages-first", []string{"message Zebra", "enum Apple", "message Order", "message Item", "enum Status"}},
+	} {
+		output, _, err := Sort(input, Options{Quiet: true, SharedOrder: "alpha", KindOrder: tc.kindOrder})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertOrder(t, output, tc.want...)
+	}
+}
+
+// ============================================================
+// isSectionDivider tightening test
+// ============================================================
+
+func TestIsSectionDivider_FalsePositive(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"// === Messages ===", true},
+		{"// --- Types ---", true},
+		{"// ### Enums", true},
+		{"// === Core Types ===", true},
+		{"// --- See docs for details ---", false}, // prose, not a divider
+		{"// --- This is a long explanatory comment about something ---", false},
+		{"// regular comment", false},
+	}
+	for _, tt := range tests {
+		got := isSectionDivider(tt.line)
+		if got != tt.want {
+			t.Errorf("isSectionDivider(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSort_DividerPatterns(t *testing.T) {
+	input := "syntax = \"proto3\";\n\n// ═══ Zoo ═══\nmessage Zoo { string v = 1; }\n\n// ═══ Animals ═══\n\nmessage Ant { string v = 1; }\n"
+
+	// Without a pattern the banners aren't dividers and stay put
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "// ═══ Zoo ═══\nmessage Zoo") {
+		t.Errorf("expected the banner to be kept as a comment:\n%s", output)
+	}
+
+	opts := defaultOpts
+	opts.DividerPatterns = []string{`^// ═+`}
+	output, _, err = Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "═") {
+		t.Errorf("expected the dividers to be stripped:\n%s", output)
+	}
+
+	// With PreserveDividers they travel with the next declaration
+	opts.PreserveDividers = true
+	output, _, err = Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, output, "// ═══ Animals ═══\nmessage Ant", "// ═══ Zoo ═══\nmessage Zoo")
+
+	opts.DividerPatterns = []string{"("}
+	if _, _, err := Sort(input, opts); err == nil {
+		t.Error("expected an invalid pattern to fail")
+	}
+}
+
+func TestSort_NormalizeComments(t *testing.T) {
+	input := `syntax = "proto3";
+
+/**
+ * A zoo, with
+ *   indented detail.
+ */
+message Zoo { string v = 1; }
+
+/* An ant. */
+message Ant { string v = 1; }
+
+// Kept as it is: a word that is long enough to need wrapping at twenty columns.
+message Bee { string v = 1; }
+`
+	opts := defaultOpts
+	opts.NormalizeComments = true
+	opts.Paranoid = true
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"// An ant.\nmessage Ant",
+		"// A zoo, with\n//   indented detail.\nmessage Zoo",
+		"// Kept as it is: a word that is long enough to need wrapping at twenty columns.\nmessage Bee",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in:\n%s", want, output)
+		}
+	}
+	if err := Verify(input, output, opts); err != nil {
+		t.Errorf("verify failed: %v", err)
+	}
+
+	// A width splits long prose lines at spaces, leaving indented ones
+	opts.CommentWidth = 30
+	output, _, err = Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "// Kept as it is: a word that\n// is long enough to need\n// wrapping at twenty columns.\nmessage Bee"
+	if !strings.Contains(output, want) {
+		t.Errorf("expected %q in:\n%s", want, output)
+	}
+	if !strings.Contains(output, "//   indented detail.\n") {
+		t.Errorf("expected the indented line to be kept:\n%s", output)
+	}
+	if err := Verify(input, output, opts); err != nil {
+		t.Errorf("verify failed: %v", err)
+	}
+
+	// A block comment sharing its line with code is left alone
+	mixed := "syntax = \"proto3\";\n\n/* a */ // b\nmessage A { string v = 1; }\n"
+	if output, _, _ := Sort(mixed, opts); !strings.Contains(output, "/* a */ // b\n") {
+		t.Errorf("expected the mixed line to be kept:\n%s", output)
+	}
+}
+
+func TestSort_LicenseHeader(t *testing.T) {
+	tmpl := filepath.Join(t.TempDir(), "license.txt")
+	if err := os.WriteFile(tmpl, []byte("Copyright {{.Year}} Acme Corp.\nAll rights reserved.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultOpts
+	opts.LicenseTemplate = tmpl
+	opts.LicenseYear = 2026
+	opts.Paranoid = true
+
+	tests := []struct {
+		name, header, want string
+	}{
+		{"missing", "", "// Copyright 2026 Acme Corp.\n// All rights reserved.\nsyntax"},
+		{"missing above other comments", "// The zoo API.\n\n", "// Copyright 2026 Acme Corp.\n// All rights reserved.\n\n// The zoo API.\nsyntax"},
+		{"old year", "// Copyright 2019 Acme Corp.\n// All rights reserved.\n\n", "// Copyright 2019-2026 Acme Corp.\n// All rights reserved.\nsyntax"},
+		{"old range", "// Copyright 2019-2024 Acme Corp.\n// All rights reserved.\n", "// Copyright 2019-2026 Acme Corp.\n// All rights reserved.\nsyntax"},
+		{"current", "// Copyright 2026 Acme Corp.\n// All rights reserved.\n", "// Copyright 2026 Acme Corp.\n// All rights reserved.\nsyntax"},
+	}
+	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tmpDir := t.TempDir()
-			inputFile := filepath.Join(tmpDir, "test.proto")
-			if err := os.WriteFile(inputFile, []byte(tt.input), 0644); err != nil {
-				t.Fatalf("writing test file: %v", err)
+			input := tt.header + "syntax = \"proto3\";\n\nmessage B {}\n\nmessage A {}\n"
+			output, _, err := Sort(input, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(output, tt.want) {
+				t.Errorf("expected output to start with %q:\n%s", tt.want, output)
+			}
+			if err := Verify(input, output, opts); err != nil {
+				t.Errorf("verify failed: %v", err)
+			}
+			if again, _, _ := Sort(output, opts); again != output {
+				t.Errorf("not idempotent:\n%s", again)
+			}
+		})
+	}
+
+	// Someone else's notice is left alone
+	opts.Quiet = false
+	input := "// Copyright 2020 Other Inc.\nsyntax = \"proto3\";\n\nmessage A {}\n"
+	output, warnings, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != input || len(warnings) != 1 || warnings[0].Code != WarningLicense {
+		t.Errorf("expected the file unchanged with a license warning, got %v:\n%s", warnings, output)
+	}
+
+	opts.LicenseTemplate = filepath.Join(t.TempDir(), "missing.txt")
+	if _, _, err := Sort(input, opts); err == nil {
+		t.Error("expected a missing template to fail")
+	}
+}
+
+func TestDescriptorSource(t *testing.T) {
+	content := `syntax = "proto3";
+
+package acme.trips.v1;
+
+service Trips {
+  rpc GetTrip(GetTripRequest) returns (Trip);
+  rpc WatchTrips(stream WatchTripsRequest) returns (stream Trip);
+}
+
+message GetTripRequest { string id = 1; }
+
+message WatchTripsRequest { optional string rider = 1; }
+
+message Trip {
+  repeated Leg legs = 1;
+  map<string, Stop> stops = 2;
+  message Note { string text = 1; }
+  Note note = 3;
+}
+
+message Leg { Stop from = 1; Stop to = 2; }
+
+message Stop { string name = 1; }
+
+enum Unused { UNUSED_UNSPECIFIED = 0; }
+`
+	compiler := protocompile.Compiler{Resolver: &protocompile.SourceResolver{
+		Accessor: protocompile.SourceAccessorFromMap(map[string]string{"trips.proto": content}),
+	}}
+	files, err := compiler.Compile(context.Background(), "trips.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := DescriptorSource(protodesc.ToFileDescriptorProto(files[0]))
+
+	// The reconstruction compiles, and classifies like the source
+	if _, err := (&protocompile.Compiler{Resolver: &protocompile.SourceResolver{
+		Accessor: protocompile.SourceAccessorFromMap(map[string]string{"trips.proto": source}),
+	}}).Compile(context.Background(), "trips.proto"); err != nil {
+		t.Fatalf("reconstructed source doesn't compile: %v\n%s", err, source)
+	}
+	classify := func(content string) []string {
+		blocks, err := ScanFile(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, b := range Classify(blocks, defaultOpts) {
+			got = append(got, fmt.Sprintf("%s %s %s %s", b.Kind, b.Name, b.Section, b.Consumer))
+		}
+		return got
+	}
+	if got, want := classify(source), classify(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("classified as %q, want %q\n%s", got, want, source)
+	}
+}
+
+// ============================================================
+// Config tests
+// ============================================================
+
+func TestConfig_LoadAndMerge(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, ".protosort.toml")
+	os.WriteFile(configFile, []byte(`
+[ordering]
+shared_order = "dependency"
+preserve_dividers = true
+
+[verify]
+verify = true
+proto_paths = ["proto/", "third_party/"]
+`), 0644)
+
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{SharedOrder: "alpha"}
+	MergeConfig(&opts, cfg, map[string]bool{})
+
+	if opts.SharedOrder != "dependency" {
+		t.Errorf("SharedOrder: want dependency, got %s", opts.SharedOrder)
+	}
+	if !opts.PreserveDividers {
+		t.Error("PreserveDividers should be true from config")
+	}
+	if !opts.Verify {
+		t.Error("Verify should be true from config")
+	}
+	if len(opts.ProtoPaths) != 2 {
+		t.Errorf("ProtoPaths: want 2, got %d", len(opts.ProtoPaths))
+	}
+}
+
+func TestConfig_IndentNumberOrStyle(t *testing.T) {
+	tmpDir := t.TempDir()
+	for toml, want := range map[string]string{
+		"indent = 4":      "4",
+		`indent = "tab"`:  "tab",
+		`indent = "4"`:    "4",
+		`indent = "tabs"`: IndentTabs,
+	} {
+		configFile := filepath.Join(tmpDir, ".protosort.toml")
+		os.WriteFile(configFile, []byte("[ordering]\n"+toml+"\n"), 0644)
+		cfg, err := LoadConfig(configFile)
+		if err != nil {
+			t.Fatalf("%s: %v", toml, err)
+		}
+		var opts Options
+		MergeConfig(&opts, cfg, map[string]bool{})
+		if opts.Indent != want {
+			t.Errorf("%s: Indent = %q, want %q", toml, opts.Indent, want)
+		}
+	}
+
+	configFile := filepath.Join(tmpDir, ".protosort.toml")
+	os.WriteFile(configFile, []byte("[ordering]\nindent = true\n"), 0644)
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("expected an error for indent = true")
+	}
+}
+
+func TestSort_BlankLinesBetweenSections(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Unused { string v = 1; }
+
+message GetRequest { string v = 1; }
+
+message GetResponse { string v = 1; }
+
+service S {
+  rpc Get(GetRequest) returns (GetResponse);
+}
+
+message Other { string v = 1; }
+`
+	want := `syntax = "proto3";
+
+service S {
+  rpc Get(GetRequest) returns (GetResponse);
+}
+
+
+message GetRequest { string v = 1; }
+
+message GetResponse { string v = 1; }
+
+
+message Other { string v = 1; }
+
+message Unused { string v = 1; }
+`
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, ".protosort.toml")
+	os.WriteFile(configFile, []byte("[ordering]\nblank_lines_between_sections = 2\nblank_lines_within_section = 1\n"), 0644)
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Quiet: true}
+	MergeConfig(&opts, cfg, map[string]bool{})
+
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != want {
+		t.Errorf("unexpected output:\n%s", DiffStrings(want, output, "want", "got"))
+	}
+	if err := Verify(input, output, opts); err != nil {
+		t.Errorf("output should verify: %v", err)
+	}
+}
+
+func TestConfig_CLIFlagsOverrideConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, ".protosort.toml")
+	os.WriteFile(configFile, []byte(`
+[ordering]
+shared_order = "dependency"
+`), 0644)
+
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{SharedOrder: "alpha"}
+	// Simulate that --shared-order was explicitly set
+	MergeConfig(&opts, cfg, map[string]bool{"shared-order": true})
+
+	if opts.SharedOrder != "alpha" {
+		t.Errorf("CLI flag should override config, got %s", opts.SharedOrder)
+	}
+}
+
+func TestConfig_TextprotoAndJSON(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		".protosort.textproto": `
+ordering { shared_order: "dependency" preserve_dividers: true }
+verify { verify: true proto_paths: "proto/" proto_paths: "third_party/" }
+`,
+		".protosort.json": `{
+  "ordering": {"shared_order": "dependency", "preserve_dividers": true},
+  "verify": {"verify": true, "proto_paths": ["proto/", "third_party/"]}
+}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			configFile := filepath.Join(tmpDir, name)
+			os.WriteFile(configFile, []byte(content), 0644)
+
+			cfg, err := LoadConfig(configFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := Options{SharedOrder: "alpha"}
+			MergeConfig(&opts, cfg, map[string]bool{})
+
+			if opts.SharedOrder != "dependency" {
+				t.Errorf("SharedOrder: want dependency, got %s", opts.SharedOrder)
+			}
+			if !opts.PreserveDividers {
+				t.Error("PreserveDividers should be true from config")
+			}
+			if !opts.Verify {
+				t.Error("Verify should be true from config")
+			}
+			if len(opts.ProtoPaths) != 2 {
+				t.Errorf("ProtoPaths: want 2, got %d", len(opts.ProtoPaths))
+			}
+		})
+	}
+}
+
+func TestConfig_TextprotoRejectsUnknownField(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), ".protosort.textproto")
+	os.WriteFile(configFile, []byte(`ordering { shard_order: "alpha" }`), 0644)
+
+	if _, err := LoadConfig(configFile); err == nil {
+		t.Error("expected error for unknown field shard_order")
+	}
+}
+
+func TestConfig_Extends(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "base.toml"), []byte(`
+[ordering]
+shared_order = "dependency"
+sort_rpcs = "grouped"
+
+[verify]
+proto_paths = ["proto/"]
+`), 0644)
+	os.MkdirAll(filepath.Join(tmpDir, "svc"), 0755)
+	childFile := filepath.Join(tmpDir, "svc", ".protosort.toml")
+	os.WriteFile(childFile, []byte(`
+extends = "../base.toml"
+
+[ordering]
+sort_rpcs = "alpha"
+section_headers = true
+
+[license]
+template = "LICENSE.tmpl"
+
+[[exception]]
+file = "legacy/*.proto"
+reason = "frozen"
+expires = "2025-12-31"
+`), 0644)
+
+	cfg, err := LoadConfig(childFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Ordering.SharedOrder != "dependency" {
+		t.Errorf("SharedOrder should be inherited, got %q", cfg.Ordering.SharedOrder)
+	}
+	if cfg.Ordering.SortRPCs != "alpha" {
+		t.Errorf("SortRPCs should be overridden by child, got %q", cfg.Ordering.SortRPCs)
+	}
+	if want := filepath.Join(tmpDir, "svc", "LICENSE.tmpl"); cfg.License.Template != want {
+		t.Errorf("license template should resolve next to the child, got %q, want %q", cfg.License.Template, want)
+	}
+	want := []Exception{{File: filepath.Join(tmpDir, "svc", "legacy", "*.proto"), Reason: "frozen", Expires: "2025-12-31"}}
+	if !reflect.DeepEqual(cfg.Exceptions, want) {
+		t.Errorf("exceptions should resolve next to the child, got %+v, want %+v", cfg.Exceptions, want)
+	}
+	if e := want[0]; e.Expired(time.Date(2025, 12, 31, 23, 0, 0, 0, time.UTC)) || !e.Expired(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("an exception should last through the day it expires on")
+	}
+	if cfg.Ordering.SectionHeaders == nil || !*cfg.Ordering.SectionHeaders {
+		t.Error("SectionHeaders should be set by child")
+	}
+	if len(cfg.Verify.ProtoPaths) != 1 {
+		t.Errorf("ProtoPaths should be inherited, got %v", cfg.Verify.ProtoPaths)
+	}
+}
+
+func TestConfig_ExtendsCycle(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "a.toml"), []byte(`extends = "b.toml"`), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "b.toml"), []byte(`extends = "a.toml"`), 0644)
+
+	_, err := LoadConfig(filepath.Join(tmpDir, "a.toml"))
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected extends cycle error, got %v", err)
+	}
+}
+
+func TestConfig_FindConfigFile(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "api", "v1")
+	for _, dir := range []string{filepath.Join(root, ".git"), nested} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootConfig := filepath.Join(root, ".protosort.toml")
+	apiConfig := filepath.Join(root, "api", ".protosort.toml")
+	for _, f := range []string{rootConfig, apiConfig} {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := FindConfigFile(nested); got != apiConfig {
+		t.Errorf("from %s: got %q, want nearest %q", nested, got, apiConfig)
+	}
+	if got := FindConfigFile(root); got != rootConfig {
+		t.Errorf("from %s: got %q, want %q", root, got, rootConfig)
+	}
+}
+
+func TestConfig_Preset(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), ".protosort.toml")
+	os.WriteFile(configFile, []byte(`
+preset = "aip"
+
+[ordering]
+shared_order = "alpha"
+`), 0644)
+
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Ordering.SortRPCs != "grouped" {
+		t.Errorf("SortRPCs should come from aip preset, got %q", cfg.Ordering.SortRPCs)
+	}
+	if cfg.Ordering.SharedOrder != "alpha" {
+		t.Errorf("explicit SharedOrder should override preset, got %q", cfg.Ordering.SharedOrder)
+	}
+
+	// A preset passed on the command line replaces the file's preset key.
+	cfg, err = ResolveConfig(configFile, "buf-default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Ordering.SortRPCs != "alpha" {
+		t.Errorf("SortRPCs should come from buf-default preset, got %q", cfg.Ordering.SortRPCs)
+	}
+
+	if _, err := ResolveConfig("", "no-such-style"); err == nil {
+		t.Error("expected error for unknown preset")
+	}
+
+	// Presets only order; lint limits and header text are the file's
+	for _, name := range presetNames() {
+		p, _ := LookupPreset(name)
+		p.Ordering = ConfigOrdering{}
+		if !reflect.ValueOf(*p).IsZero() {
+			t.Errorf("preset %s sets more than [ordering]: %+v", name, *p)
+		}
+	}
+}
+
+// TestConfig_SchemaMatchesStruct keeps config.proto and the Config struct in
+// sync, so every TOML key is also accepted in text-format and JSON configs.
+func TestConfig_SchemaMatchesStruct(t *testing.T) {
+	md, err := configDescriptor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var check func(rt reflect.Type, md protoreflect.MessageDescriptor)
+	check = func(rt reflect.Type, md protoreflect.MessageDescriptor) {
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			key := f.Tag.Get("toml")
+			fd := md.Fields().ByName(protoreflect.Name(key))
+			if fd == nil {
+				t.Errorf("config.proto %s has no field %q", md.FullName(), key)
+				continue
+			}
+			if f.Tag.Get("json") != key {
+				t.Errorf("%s.%s: json tag %q does not match toml tag %q", rt.Name(), f.Name, f.Tag.Get("json"), key)
 			}
+			if fd.Kind() == protoreflect.MessageKind {
+				ft := f.Type
+				for ft.Kind() == reflect.Slice || ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				check(ft, fd.Message())
+			}
+		}
+		if md.Fields().Len() != rt.NumField() {
+			t.Errorf("%s has %d fields, config.proto %s has %d", rt.Name(), rt.NumField(), md.FullName(), md.Fields().Len())
+		}
+	}
+	check(reflect.TypeOf(Config{}), md)
+}
+
+// ============================================================
+// VerboseReport Section 2 classification test
+// ============================================================
+
+func TestVerboseReport_ShowsRequestResponse(t *testing.T) {
+	blocks := []*Block{
+		{Kind: BlockService, Name: "S", DeclText: "service S { rpc Do(Req) returns (Res); }"},
+		{Kind: BlockMessage, Name: "Req", DeclText: "message Req { string v = 1; }"},
+		{Kind: BlockMessage, Name: "Res", DeclText: "message Res { string v = 1; }"},
+		{Kind: BlockMessage, Name: "Other", DeclText: "message Other { string v = 1; }"},
+	}
+	// Populate RPCs
+	for _, b := range blocks {
+		if b.Kind == BlockService {
+			b.RPCs = ExtractRPCs(b)
+		}
+	}
+	report := VerboseReport(blocks)
+	if !strings.Contains(report, "request/response") {
+		t.Errorf("VerboseReport should show request/response classification:\n%s", report)
+	}
+	if !strings.Contains(report, "unreferenced") {
+		t.Errorf("VerboseReport should show unreferenced classification:\n%s", report)
+	}
+}
+
+func TestVerboseReport_ShowsRequestResponse_WithoutPrePopulatedRPCs(t *testing.T) {
+	// Regression: VerboseReport must work even when RPCs are NOT pre-populated
+	// (as happens when called from processFile with a fresh ScanFile result).
+	blocks := []*Block{
+		{Kind: BlockService, Name: "S", DeclText: "service S { rpc Do(Req) returns (Res); }"},
+		{Kind: BlockMessage, Name: "Req", DeclText: "message Req { string v = 1; }"},
+		{Kind: BlockMessage, Name: "Res", DeclText: "message Res { string v = 1; }"},
+		{Kind: BlockMessage, Name: "Other", DeclText: "message Other { string v = 1; }"},
+	}
+	// Deliberately do NOT populate RPCs — VerboseReport should handle this.
+	report := VerboseReport(blocks)
+	if !strings.Contains(report, "request/response") {
+		t.Errorf("VerboseReport should auto-populate RPCs and show request/response:\n%s", report)
+	}
+}
+
+// ============================================================
+// Annotate idempotency regression test
+// ============================================================
+
+func TestAnnotate_Idempotent(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S { rpc Do(Req) returns (Res); }
+message Req { string v = 1; }
+message Res { string v = 1; }
+message Shared { string v = 1; }
+message U1 { Shared s = 1; }
+message U2 { Shared s = 1; }
+message Orphan { string v = 1; }
+`
+	opts := Options{Quiet: true, Annotate: true}
+	pass1, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatalf("first Sort failed: %v", err)
+	}
+	pass2, _, err := Sort(pass1, opts)
+	if err != nil {
+		t.Fatalf("second Sort failed: %v", err)
+	}
+	if pass1 != pass2 {
+		t.Errorf("--annotate is not idempotent.\nPass 1:\n%s\nPass 2:\n%s", pass1, pass2)
+	}
+}
+
+func TestAnnotate_PreservesExistingComments(t *testing.T) {
+	input := `syntax = "proto3";
+
+// Important documentation about Foo.
+message Foo { string v = 1; }
+`
+	opts := Options{Quiet: true, Annotate: true}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "Important documentation about Foo") {
+		t.Error("existing comments should be preserved when annotating")
+	}
+	if !strings.Contains(output, "// (unreferenced)") {
+		t.Error("annotation should be added")
+	}
+}
 
-			code := processFile(inputFile, tt.opts)
-			if code != tt.wantCode {
-				t.Errorf("want exit code %d, got %d", tt.wantCode, code)
-			}
-		})
+// ============================================================
+// Typed errors test
+// ============================================================
+
+func TestSort_TypedErrors(t *testing.T) {
+	// Proto2 should return Proto2Error
+	_, _, err := Sort(`syntax = "proto2"; message Foo {}`, Options{})
+	if err == nil {
+		t.Fatal("expected error for proto2")
+	}
+	var proto2Err *Proto2Error
+	if !errors.As(err, &proto2Err) {
+		t.Errorf("expected Proto2Error, got %T: %v", err, err)
 	}
 }
 
-func TestCLI_Annotate(t *testing.T) {
+// ============================================================
+// Helpers
+// ============================================================
+
+// ============================================================
+// Import/option spacing tests
+// ============================================================
+
+func TestSort_ImportsGroupedWithoutBlankLines(t *testing.T) {
 	input := `syntax = "proto3";
 
-service S { rpc Do(Req) returns (Res); }
-message Req { string v = 1; }
-message Res { string v = 1; }
-message Shared { string v = 1; }
-message U1 { Shared s = 1; }
-message U2 { Shared s = 1; }
-message Helper { string v = 1; }
-message Consumer { Helper h = 1; U1 u = 1; U2 u2 = 2; }
-message Orphan { string v = 1; }
+import "z/file.proto";
+import "a/file.proto";
+import "m/file.proto";
 `
-	opts := Options{Quiet: true, Annotate: true}
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Imports should be grouped together without blank lines between them
+	want := "import \"a/file.proto\";\nimport \"m/file.proto\";\nimport \"z/file.proto\";\n"
+	if !strings.Contains(output, want) {
+		t.Errorf("imports should be grouped without blank lines, got:\n%s", output)
+	}
+}
+
+func TestSort_OptionsGroupedWithoutBlankLines(t *testing.T) {
+	input := `syntax = "proto3";
+
+option java_package = "com.test";
+option go_package = "test/v1";
+option cc_enable_arenas = "true";
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Options should be grouped together without blank lines between them
+	want := "option cc_enable_arenas = \"true\";\noption go_package = \"test/v1\";\noption java_package = \"com.test\";\n"
+	if !strings.Contains(output, want) {
+		t.Errorf("options should be grouped without blank lines, got:\n%s", output)
+	}
+}
+
+// ============================================================
+// RPC sorting tests
+// ============================================================
+
+func TestSort_SortRPCsAlpha(t *testing.T) {
+	input := `syntax = "proto3";
+
+service UserService {
+  rpc DeleteUser(DeleteUserRequest) returns (DeleteUserResponse);
+  rpc CreateUser(CreateUserRequest) returns (CreateUserResponse);
+  rpc GetUser(GetUserRequest) returns (GetUserResponse);
+}
+
+message DeleteUserRequest { string id = 1; }
+message DeleteUserResponse {}
+message CreateUserRequest { string name = 1; }
+message CreateUserResponse { string id = 1; }
+message GetUserRequest { string id = 1; }
+message GetUserResponse { string name = 1; }
+`
+	opts := Options{Quiet: true, SortRPCs: "alpha"}
 	output, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "// (request/response)") {
-		t.Error("request/response annotation missing")
+	// RPCs should be sorted alphabetically: Create, Delete, Get
+	// Request/response pairs should follow new RPC order
+	assertOrder(t, output,
+		"message CreateUserRequest", "message CreateUserResponse",
+		"message DeleteUserRequest", "message DeleteUserResponse",
+		"message GetUserRequest", "message GetUserResponse")
+}
+
+func TestSort_SortRPCsGrouped(t *testing.T) {
+	input := `syntax = "proto3";
+
+service UserService {
+  rpc DeleteUser(DeleteUserRequest) returns (DeleteUserResponse);
+  rpc ListTrips(ListTripsRequest) returns (ListTripsResponse);
+  rpc CreateUser(CreateUserRequest) returns (CreateUserResponse);
+  rpc GetTrip(GetTripRequest) returns (GetTripResponse);
+  rpc GetUser(GetUserRequest) returns (GetUserResponse);
+  rpc CreateTrip(CreateTripRequest) returns (CreateTripResponse);
+}
+
+message DeleteUserRequest { string id = 1; }
+message DeleteUserResponse {}
+message ListTripsRequest { string user_id = 1; }
+message ListTripsResponse { string v = 1; }
+message CreateUserRequest { string name = 1; }
+message CreateUserResponse { string id = 1; }
+message GetTripRequest { string id = 1; }
+message GetTripResponse { string v = 1; }
+message GetUserRequest { string id = 1; }
+message GetUserResponse { string name = 1; }
+message CreateTripRequest { string name = 1; }
+message CreateTripResponse { string id = 1; }
+`
+	opts := Options{Quiet: true, SortRPCs: "grouped"}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(output, "// (core:") {
-		t.Error("core annotation missing")
+	// Grouped: Trip methods together, User methods together
+	// Within groups: alphabetical by full name
+	// Trip group: CreateTrip, GetTrip, ListTrips
+	// User group: CreateUser, DeleteUser, GetUser
+	assertOrder(t, output,
+		"message CreateTripRequest", "message CreateTripResponse",
+		"message GetTripRequest", "message GetTripResponse",
+		"message ListTripsRequest", "message ListTripsResponse",
+		"message CreateUserRequest", "message CreateUserResponse",
+		"message DeleteUserRequest", "message DeleteUserResponse",
+		"message GetUserRequest", "message GetUserResponse")
+}
+
+func TestSort_RPCGroupHeaders(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S {
+  rpc GetUser(GetUserRequest) returns (GetUserResponse);
+
+  // Lists trips.
+  rpc ListTrips(ListTripsRequest) returns (ListTripsResponse);
+  rpc CreateTrip(CreateTripRequest) returns (CreateTripResponse);
+}
+
+message GetUserRequest {}
+message GetUserResponse {}
+message ListTripsRequest {}
+message ListTripsResponse {}
+message CreateTripRequest {}
+message CreateTripResponse {}
+`
+	opts := Options{Quiet: true, SortRPCs: "grouped", RPCGroupHeaders: true}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(output, "// (helper:") {
-		t.Error("helper annotation missing")
+	want := `service S {
+  // Trips
+
+  rpc CreateTrip(CreateTripRequest) returns (CreateTripResponse);
+  // Lists trips.
+  rpc ListTrips(ListTripsRequest) returns (ListTripsResponse);
+
+  // Users
+
+  rpc GetUser(GetUserRequest) returns (GetUserResponse);
+}
+`
+	if !strings.Contains(output, want) {
+		t.Errorf("expected group headers:\n%s", output)
 	}
-	if !strings.Contains(output, "// (unreferenced)") {
-		t.Error("unreferenced annotation missing")
+	if err := Verify(input, output, Options{Verify: true, Paranoid: true, SortRPCs: "grouped"}); err != nil {
+		t.Errorf("output with headers should verify: %v", err)
+	}
+
+	// Idempotent, and sorting without headers strips them
+	if again, _, _ := Sort(output, opts); again != output {
+		t.Errorf("second pass changed the output:\n%s", again)
+	}
+	opts.RPCGroupHeaders = false
+	stripped, _, _ := Sort(output, opts)
+	if strings.Contains(stripped, "// Trips") || strings.Contains(stripped, "// Users") {
+		t.Errorf("expected headers to be stripped:\n%s", stripped)
+	}
+	if !strings.Contains(stripped, "// Lists trips.") {
+		t.Errorf("RPC comments should be kept:\n%s", stripped)
+	}
+}
+
+func TestSort_RPCOrder(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), ".protosort.toml")
+	os.WriteFile(configFile, []byte(`
+[rpc]
+order = ["Create*", "Get*", "List*", "Update*", "Delete*", "*"]
+`), 0644)
+	cfg, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
 	}
+	opts := Options{Quiet: true}
+	MergeConfig(&opts, cfg, map[string]bool{})
+	if opts.SortRPCs != "alpha" {
+		t.Fatalf("an rpc order should turn on RPC sorting, got SortRPCs %q", opts.SortRPCs)
+	}
+
+	input := `syntax = "proto3";
+
+service S {
+  rpc DeleteTrip(Req) returns (Resp);
+  rpc ArchiveTrip(Req) returns (Resp);
+  rpc ListTrips(Req) returns (Resp);
+  rpc GetUser(Req) returns (Resp);
+  rpc CreateUser(Req) returns (Resp);
+  rpc GetTrip(Req) returns (Resp);
+  rpc CreateTrip(Req) returns (Resp);
+}
+
+message Req {}
+message Resp {}
+`
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, output,
+		"rpc CreateTrip", "rpc CreateUser", "rpc GetTrip", "rpc GetUser",
+		"rpc ListTrips", "rpc DeleteTrip", "rpc ArchiveTrip")
+	if err := Verify(input, output, Options{Verify: true, SortRPCs: "alpha"}); err != nil {
+		t.Errorf("reordered RPCs should verify: %v", err)
+	}
+	if err := verifyDescriptorSets(input, output, Options{Verify: true}); err == nil || !strings.Contains(err.Error(), "descriptor sets differ") {
+		t.Errorf("expected reordered RPCs to fail verification without SortRPCs, got %v", err)
+	}
+
+	// In grouped mode the order applies within each resource group
+	opts.SortRPCs = "grouped"
+	output, _, err = Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, output,
+		"rpc ArchiveTrip", "rpc CreateTrip", "rpc GetTrip", "rpc DeleteTrip",
+		"rpc ListTrips", "rpc CreateUser", "rpc GetUser")
+}
+
+func TestSort_RPCFingerprint(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S {
+  rpc Delete(Req) returns (Resp);
+  rpc Create(Req) returns (Resp);
+  rpc Get(Req) returns (Resp);
+}
+
+message Req {}
+message Resp {}
+`
+	opts := Options{SortRPCs: "alpha", RPCFingerprint: true}
+	sorted, warnings, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("a service without a fingerprint shouldn't be checked: %v", warnings)
+	}
+	if !strings.Contains(sorted, "service S {\n  // protosort:rpc-order ") {
+		t.Fatalf("expected a fingerprint line:\n%s", sorted)
+	}
+	if err := Verify(input, sorted, Options{Verify: true, Paranoid: true, SortRPCs: "alpha"}); err != nil {
+		t.Errorf("fingerprinted output should verify: %v", err)
+	}
+	if again, warnings, _ := Sort(sorted, opts); again != sorted || len(warnings) != 0 {
+		t.Errorf("second pass should be a no-op, got warnings %v:\n%s", warnings, again)
+	}
+
+	// An RPC added in place is fine; one added out of place is named
+	edited := strings.Replace(sorted, "  rpc Get(", "  rpc Zap(Req) returns (Resp);\n  rpc Find(Req) returns (Resp);\n  rpc Get(", 1)
+	_, warnings, err = Sort(edited, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "rpc Zap is out of order (line 7); it belongs after Get") {
+		t.Errorf("expected one warning for Zap, got %v", warnings)
+	}
+
+	// Sorting without the option removes the fingerprint
+	plain, _, _ := Sort(sorted, Options{Quiet: true, SortRPCs: "alpha"})
+	if strings.Contains(plain, "protosort:rpc-order") {
+		t.Errorf("expected the fingerprint to be removed:\n%s", plain)
+	}
+}
+
+func TestSort_SortRPCsDisabledByDefault(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S {
+  rpc Zulu(ZReq) returns (ZRes);
+  rpc Alpha(AReq) returns (ARes);
+}
+
+message ZReq { string v = 1; }
+message ZRes { string v = 1; }
+message AReq { string v = 1; }
+message ARes { string v = 1; }
+`
+	output, _, err := Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without --sort-rpcs, original RPC order preserved: Zulu before Alpha
+	assertOrder(t, output, "message ZReq", "message ZRes", "message AReq", "message ARes")
 }
 
-// ============================================================
-// Shared-order dependency test
-// ============================================================
-
-func TestSort_SharedOrderDependency(t *testing.T) {
-	// A depends on B, B depends on C. X and Y reference A/B/C.
-	// A, B, X, Y are core (outgoing refs); C is helper (incoming only).
+func TestSort_SortRPCsIdempotent(t *testing.T) {
 	input := `syntax = "proto3";
 
-message A { B b = 1; }
-message B { C c = 1; }
-message C { string v = 1; }
-message X { A a = 1; C c = 1; }
-message Y { B b = 1; A a = 1; }
+service S {
+  rpc Delete(DReq) returns (DRes);
+  rpc Create(CReq) returns (CRes);
+  rpc Get(GReq) returns (GRes);
+}
+
+message DReq { string v = 1; }
+message DRes { string v = 1; }
+message CReq { string v = 1; }
+message CRes { string v = 1; }
+message GReq { string v = 1; }
+message GRes { string v = 1; }
 `
-	opts := Options{Quiet: true, SharedOrder: "dependency"}
-	output, _, err := Sort(input, opts)
+	opts := Options{Quiet: true, SortRPCs: "alpha"}
+	pass1, _, err := Sort(input, opts)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("first Sort: %v", err)
+	}
+	pass2, _, err := Sort(pass1, opts)
+	if err != nil {
+		t.Fatalf("second Sort: %v", err)
+	}
+	if pass1 != pass2 {
+		t.Errorf("--sort-rpcs alpha not idempotent.\nPass 1:\n%s\nPass 2:\n%s", pass1, pass2)
 	}
-	// In dependency order for core: B before A (B is A's dependency).
-	// C is helper, emitted after core.
-	assertOrder(t, output, "message B", "message A", "message C")
 }
 
-// ============================================================
-// isSectionDivider tightening test
-// ============================================================
-
-func TestIsSectionDivider_FalsePositive(t *testing.T) {
+func TestRPCGroupKey(t *testing.T) {
 	tests := []struct {
-		line string
-		want bool
+		name string
+		want string
 	}{
-		{"// === Messages ===", true},
-		{"// --- Types ---", true},
-		{"// ### Enums", true},
-		{"// === Core Types ===", true},
-		{"// --- See docs for details ---", false}, // prose, not a divider
-		{"// --- This is a long explanatory comment about something ---", false},
-		{"// regular comment", false},
+		{"GetUser", "User"},
+		{"CreateUser", "User"},
+		{"DeleteUser", "User"},
+		{"ListUsers", "Users"},
+		{"UpdateUser", "User"},
+		{"BatchCreateUsers", "Users"},
+		{"BatchGetUsers", "Users"},
+		{"WatchTrip", "Trip"},
+		{"StreamEvents", "Events"},
+		{"SearchProducts", "Products"},
+		{"SetConfig", "Config"},
+		{"AddItem", "Item"},
+		{"RemoveItem", "Item"},
+		{"StartJob", "Job"},
+		{"StopJob", "Job"},
+		{"RunTask", "Task"},
+		{"CheckHealth", "Health"},
+		{"CancelOperation", "Operation"},
+		// No prefix match — return full name
+		{"Healthcheck", "Healthcheck"},
+		{"Getaway", "Getaway"}, // "Get" + lowercase 'a' → no strip
+		// Name equals prefix exactly → return full name
+		{"Get", "Get"},
+		{"Create", "Create"},
 	}
 	for _, tt := range tests {
-		got := isSectionDivider(tt.line)
+		got := rpcGroupKey(tt.name)
 		if got != tt.want {
-			t.Errorf("isSectionDivider(%q) = %v, want %v", tt.line, got, tt.want)
+			t.Errorf("rpcGroupKey(%q) = %q, want %q", tt.name, got, tt.want)
 		}
 	}
 }
 
-// ============================================================
-// Config tests
-// ============================================================
-
-func TestConfig_LoadAndMerge(t *testing.T) {
-	tmpDir := t.TempDir()
-	configFile := filepath.Join(tmpDir, ".protosort.toml")
-	os.WriteFile(configFile, []byte(`
-[ordering]
-shared_order = "dependency"
-preserve_dividers = true
+func TestSort_SortRPCsWithComments(t *testing.T) {
+	input := `syntax = "proto3";
 
-[verify]
-verify = true
-proto_paths = ["proto/", "third_party/"]
-`), 0644)
+service S {
+  // Deletes a user.
+  rpc DeleteUser(DReq) returns (DRes);
+  // Creates a user.
+  rpc CreateUser(CReq) returns (CRes);
+}
 
-	cfg, err := LoadConfig(configFile)
+message DReq { string v = 1; }
+message DRes { string v = 1; }
+message CReq { string v = 1; }
+message CRes { string v = 1; }
+`
+	opts := Options{Quiet: true, SortRPCs: "alpha"}
+	output, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Comments should travel with their RPC
+	assertOrder(t, output, "Creates a user", "rpc CreateUser", "Deletes a user", "rpc DeleteUser")
+}
 
-	opts := Options{SharedOrder: "alpha"}
-	MergeConfig(&opts, cfg, map[string]bool{})
-
-	if opts.SharedOrder != "dependency" {
-		t.Errorf("SharedOrder: want dependency, got %s", opts.SharedOrder)
+func TestSort_SortRPCsSingleLine(t *testing.T) {
+	input := `syntax = "proto3"; service S { rpc Get(GReq) returns (GRes) { option deprecated = true; } rpc Delete(DReq) returns (DRes); /* keep } */ rpc Create(CReq) returns (CRes) {}; }
+message GReq { string v = 1; } message GRes {} message DReq { string v = 1; } message DRes {} message CReq { string v = 1; } message CRes {}
+`
+	opts := Options{Quiet: true, SortRPCs: "alpha"}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !opts.PreserveDividers {
-		t.Error("PreserveDividers should be true from config")
+	want := `service S {
+  rpc Create(CReq) returns (CRes) {};
+  rpc Delete(DReq) returns (DRes); /* keep } */
+  rpc Get(GReq) returns (GRes) { option deprecated = true; }
+}`
+	if !strings.Contains(output, want) {
+		t.Errorf("expected one RPC per line, sorted:\n%s", output)
 	}
-	if !opts.Verify {
-		t.Error("Verify should be true from config")
+	if err := Verify(input, output, opts); err != nil {
+		t.Errorf("output should verify: %v", err)
 	}
-	if len(opts.ProtoPaths) != 2 {
-		t.Errorf("ProtoPaths: want 2, got %d", len(opts.ProtoPaths))
+	if again, _, _ := Sort(output, opts); again != output {
+		t.Errorf("not idempotent:\n%s", again)
 	}
 }
 
-func TestConfig_CLIFlagsOverrideConfig(t *testing.T) {
-	tmpDir := t.TempDir()
-	configFile := filepath.Join(tmpDir, ".protosort.toml")
-	os.WriteFile(configFile, []byte(`
-[ordering]
-shared_order = "dependency"
-`), 0644)
+func TestSort_SortRPCsBracesInStrings(t *testing.T) {
+	input := `syntax = "proto3";
 
-	cfg, err := LoadConfig(configFile)
+service S {
+  rpc Get(GReq) returns (GRes) {
+    option (http) = { get: "/v1/{name" }; // a lone {
+  }
+  rpc Delete(DReq) returns (DRes);
+}
+`
+	output, _, err := Sort(input, Options{Quiet: true, SortRPCs: "alpha"})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	opts := Options{SharedOrder: "alpha"}
-	// Simulate that --shared-order was explicitly set
-	MergeConfig(&opts, cfg, map[string]bool{"shared-order": true})
-
-	if opts.SharedOrder != "alpha" {
-		t.Errorf("CLI flag should override config, got %s", opts.SharedOrder)
-	}
+	assertOrder(t, output, "rpc Delete(DReq) returns (DRes);\n  rpc Get", `"/v1/{name" }; // a lone {`, "  }\n}")
 }
 
-// ============================================================
-// VerboseReport Section 2 classification test
-// ============================================================
-
-func TestVerboseReport_ShowsRequestResponse(t *testing.T) {
-	blocks := []*Block{
-		{Kind: BlockService, Name: "S", DeclText: "service S { rpc Do(Req) returns (Res); }"},
-		{Kind: BlockMessage, Name: "Req", DeclText: "message Req { string v = 1; }"},
-		{Kind: BlockMessage, Name: "Res", DeclText: "message Res { string v = 1; }"},
-		{Kind: BlockMessage, Name: "Other", DeclText: "message Other { string v = 1; }"},
-	}
-	// Populate RPCs
-	for _, b := range blocks {
-		if b.Kind == BlockService {
-			b.RPCs = ExtractRPCs(b)
-		}
-	}
-	report := VerboseReport(blocks)
-	if !strings.Contains(report, "request/response") {
-		t.Errorf("VerboseReport should show request/response classification:\n%s", report)
-	}
-	if !strings.Contains(report, "unreferenced") {
-		t.Errorf("VerboseReport should show unreferenced classification:\n%s", report)
-	}
-}
+func TestSort_SortRPCsWithOptionBody(t *testing.T) {
+	input := `syntax = "proto3";
 
-func TestVerboseReport_ShowsRequestResponse_WithoutPrePopulatedRPCs(t *testing.T) {
-	// Regression: VerboseReport must work even when RPCs are NOT pre-populated
-	// (as happens when called from processFile with a fresh ScanFile result).
-	blocks := []*Block{
-		{Kind: BlockService, Name: "S", DeclText: "service S { rpc Do(Req) returns (Res); }"},
-		{Kind: BlockMessage, Name: "Req", DeclText: "message Req { string v = 1; }"},
-		{Kind: BlockMessage, Name: "Res", DeclText: "message Res { string v = 1; }"},
-		{Kind: BlockMessage, Name: "Other", DeclText: "message Other { string v = 1; }"},
-	}
-	// Deliberately do NOT populate RPCs — VerboseReport should handle this.
-	report := VerboseReport(blocks)
-	if !strings.Contains(report, "request/response") {
-		t.Errorf("VerboseReport should auto-populate RPCs and show request/response:\n%s", report)
-	}
+service S {
+  rpc DeleteUser(DReq) returns (DRes) {
+    option (google.api.http) = {
+      delete: "/v1/users/{id}"
+    };
+  }
+  rpc CreateUser(CReq) returns (CRes);
 }
 
-// ============================================================
-// Annotate idempotency regression test
-// ============================================================
-
-func TestAnnotate_Idempotent(t *testing.T) {
-	input := `syntax = "proto3";
-
-service S { rpc Do(Req) returns (Res); }
-message Req { string v = 1; }
-message Res { string v = 1; }
-message Shared { string v = 1; }
-message U1 { Shared s = 1; }
-message U2 { Shared s = 1; }
-message Orphan { string v = 1; }
+message DReq { string v = 1; }
+message DRes { string v = 1; }
+message CReq { string v = 1; }
+message CRes { string v = 1; }
 `
-	opts := Options{Quiet: true, Annotate: true}
-	pass1, _, err := Sort(input, opts)
-	if err != nil {
-		t.Fatalf("first Sort failed: %v", err)
-	}
-	pass2, _, err := Sort(pass1, opts)
+	opts := Options{Quiet: true, SortRPCs: "alpha"}
+	output, _, err := Sort(input, opts)
 	if err != nil {
-		t.Fatalf("second Sort failed: %v", err)
+		t.Fatal(err)
 	}
-	if pass1 != pass2 {
-		t.Errorf("--annotate is not idempotent.\nPass 1:\n%s\nPass 2:\n%s", pass1, pass2)
+	// CreateUser should come before DeleteUser even though Delete has option body
+	assertOrder(t, output, "rpc CreateUser", "rpc DeleteUser")
+	// The option body should be preserved
+	if !strings.Contains(output, "delete: \"/v1/users/{id}\"") {
+		t.Error("RPC option body should be preserved")
 	}
 }
 
-func TestAnnotate_PreservesExistingComments(t *testing.T) {
+func TestSort_SortRPCsContentIntegrity(t *testing.T) {
 	input := `syntax = "proto3";
 
-// Important documentation about Foo.
-message Foo { string v = 1; }
+service S {
+  rpc Zulu(ZReq) returns (ZRes);
+  rpc Alpha(AReq) returns (ARes);
+}
+
+message ZReq { string v = 1; }
+message ZRes { string v = 1; }
+message AReq { string v = 1; }
+message ARes { string v = 1; }
 `
-	opts := Options{Quiet: true, Annotate: true}
+	opts := Options{Quiet: true, SortRPCs: "alpha"}
 	output, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "Important documentation about Foo") {
-		t.Error("existing comments should be preserved when annotating")
-	}
-	if !strings.Contains(output, "// (unreferenced)") {
-		t.Error("annotation should be added")
+	if err := verifyContentIntegrity(input, output, opts); err != nil {
+		t.Errorf("content integrity failed with --sort-rpcs: %v", err)
 	}
 }
 
 // ============================================================
-// Typed errors test
+// Section header tests
 // ============================================================
 
-func TestSort_TypedErrors(t *testing.T) {
-	// Proto2 should return Proto2Error
-	_, _, err := Sort(`syntax = "proto2"; message Foo {}`, Options{})
-	if err == nil {
-		t.Fatal("expected error for proto2")
+func TestSortFieldOptions(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"sorts and respaces",
+			`string id = 1 [(gogoproto.nullable)=false,deprecated = true];`,
+			`string id = 1 [(gogoproto.nullable) = false, deprecated = true];`},
+		{"enum value",
+			`FOO = 1 [deprecated=true , (x.y) = "a,b]"];`,
+			`FOO = 1 [(x.y) = "a,b]", deprecated = true];`},
+		{"aggregate value kept intact",
+			`Foo f = 2 [(v.rules).string = {min_len: 1, max_len: 5}, json_name="f"];`,
+			`Foo f = 2 [(v.rules).string = {min_len: 1, max_len: 5}, json_name = "f"];`},
+		{"comment untouched",
+			"// string id = 1 [b=1,a=2];\nstring id = 1;",
+			"// string id = 1 [b=1,a=2];\nstring id = 1;"},
+		{"multi-line list untouched",
+			"string id = 1 [\n  b = 1,\n  a = 2\n];",
+			"string id = 1 [\n  b = 1,\n  a = 2\n];"},
 	}
-	var proto2Err *Proto2Error
-	if !errors.As(err, &proto2Err) {
-		t.Errorf("expected Proto2Error, got %T: %v", err, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SortFieldOptions(tt.in); got != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
 	}
 }
 
-// ============================================================
-// File permissions test
-// ============================================================
-
-func TestCLI_WritePreservesPermissions(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("Unix file permissions not supported on Windows")
-	}
+func TestSort_SortFieldOptionsContentIntegrity(t *testing.T) {
 	input := `syntax = "proto3";
 
-message B { string v = 1; }
+message B {
+  string id = 1 [json_name="id",deprecated=true];
+}
 
 message A { string v = 1; }
 `
-	tmpDir := t.TempDir()
-	inputFile := filepath.Join(tmpDir, "test.proto")
-	if err := os.WriteFile(inputFile, []byte(input), 0755); err != nil {
-		t.Fatalf("writing test file: %v", err)
+	opts := Options{Quiet: true, SortFieldOptions: true}
+	output, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, `[deprecated = true, json_name = "id"]`) {
+		t.Errorf("field options not sorted:\n%s", output)
 	}
+	if err := verifyContentIntegrity(input, output, opts); err != nil {
+		t.Errorf("content integrity failed: %v", err)
+	}
+}
 
-	code := processFile(inputFile, Options{Write: true, Quiet: true})
-	if code != 0 {
-		t.Fatalf("write failed with code %d", code)
+func TestSortNested(t *testing.T) {
+	in := `message Outer { // outer
+  // Zed doc
+  message Zed {
+    enum Z { Z_UNSPECIFIED = 0; }
+    enum A { A_UNSPECIFIED = 0; }
+  }
+  string id = 1;
+  option (x) = { a: 1 };
+
+  oneof pick {
+    Zed z = 2;
+    Alpha a = 3;
+  }
+  enum Mode { MODE_UNSPECIFIED = 0; } // trailing
+  message Alpha {}
+  Mode mode = 4;
+}`
+	want := `message Outer { // outer
+  message Alpha {}
+  string id = 1;
+  option (x) = { a: 1 };
+
+  oneof pick {
+    Zed z = 2;
+    Alpha a = 3;
+  }
+  enum Mode { MODE_UNSPECIFIED = 0; } // trailing
+  // Zed doc
+  message Zed {
+    enum A { A_UNSPECIFIED = 0; }
+    enum Z { Z_UNSPECIFIED = 0; }
+  }
+  Mode mode = 4;
+}`
+	got := SortNested(in)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if again := SortNested(got); again != got {
+		t.Errorf("not idempotent:\n%s", again)
 	}
 
-	info, _ := os.Stat(inputFile)
-	if info.Mode().Perm() != 0755 {
-		t.Errorf("file permissions changed: want 0755, got %o", info.Mode().Perm())
+	flat := "message M {\n  string a = 1;\n}"
+	if got := SortNested(flat); got != flat {
+		t.Errorf("message without nested types changed: %q", got)
 	}
 }
 
-// ============================================================
-// Helpers
-// ============================================================
+func TestSortFields(t *testing.T) {
+	in := `message User {
+  reserved 2, 3;
+  // Display name
+  string name = 4;
+  string id = 1;
 
-// ============================================================
-// Import/option spacing tests
-// ============================================================
+  oneof contact {
+    string phone = 7;
+    string email = 5; // preferred
+  }
+  message Address { string zip = 2; string city = 1; }
+  Address address = 0x6;
+  option (x) = { a: 1 };
+  map<string, int32> tags = 0;
+}`
+	want := `message User {
+  reserved 2, 3;
+  map<string, int32> tags = 0;
+  string id = 1;
 
-func TestSort_ImportsGroupedWithoutBlankLines(t *testing.T) {
+  // Display name
+  string name = 4;
+  message Address { string city = 1; string zip = 2; }
+  oneof contact {
+    string email = 5; // preferred
+    string phone = 7;
+  }
+  option (x) = { a: 1 };
+  Address address = 0x6;
+}`
+	got := SortFields(in)
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if again := SortFields(got); again != got {
+		t.Errorf("not idempotent:\n%s", again)
+	}
+}
+
+func TestSort_SortFieldsVerify(t *testing.T) {
 	input := `syntax = "proto3";
 
-import "z/file.proto";
-import "a/file.proto";
-import "m/file.proto";
+message A {
+  oneof second {
+    int32 x = 4;
+    int32 y = 3;
+  }
+  oneof first {
+    int32 z = 2;
+  }
+  optional string name = 5;
+  string id = 1;
+}
 `
-	output, _, err := Sort(input, defaultOpts)
+	opts := Options{Quiet: true, SortFields: true}
+	output, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Imports should be grouped together without blank lines between them
-	want := "import \"a/file.proto\";\nimport \"m/file.proto\";\nimport \"z/file.proto\";\n"
-	if !strings.Contains(output, want) {
-		t.Errorf("imports should be grouped without blank lines, got:\n%s", output)
+	assertOrder(t, output, "string id = 1;", "int32 z = 2;", "int32 y = 3;", "int32 x = 4;", "name = 5;")
+	opts.Verify, opts.Verifier = true, VerifierProtocompile
+	if err := Verify(input, output, opts); err != nil {
+		t.Errorf("sorted fields should verify: %v", err)
+	}
+
+	// Without SortFields, the same reorder is a change
+	opts.SortFields = false
+	if err := verifyDescriptorSets(input, output, opts); err == nil || !strings.Contains(err.Error(), "descriptor sets differ") {
+		t.Errorf("expected reordered fields to fail verification without SortFields, got %v", err)
 	}
 }
 
-func TestSort_OptionsGroupedWithoutBlankLines(t *testing.T) {
+func TestSort_PairStrict(t *testing.T) {
 	input := `syntax = "proto3";
 
-option java_package = "com.test";
-option go_package = "test/v1";
-option cc_enable_arenas = "true";
+package acme.v1;
+
+service Things {
+  rpc GetThing(GetThingRequest) returns (acme.v1.GetThingResponse);
+  rpc First(FirstRequest) returns (SecondResponse);
+  rpc Second(SecondRequest) returns (SecondResponse);
+}
+
+message Filter { string q = 1; }
+
+message GetThingRequest { Filter filter = 1; }
+
+message GetThingResponse { string name = 1; }
+
+message FirstRequest {}
+
+message SecondRequest {}
+
+message SecondResponse {}
 `
-	output, _, err := Sort(input, defaultOpts)
+	output, warnings, err := Sort(input, Options{PairStrict: true})
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Options should be grouped together without blank lines between them
-	want := "option cc_enable_arenas = \"true\";\noption go_package = \"test/v1\";\noption java_package = \"com.test\";\n"
-	if !strings.Contains(output, want) {
-		t.Errorf("options should be grouped without blank lines, got:\n%s", output)
+	assertOrder(t, output, "service Things",
+		"message GetThingRequest", "message GetThingResponse", "message Filter",
+		"message FirstRequest", "message SecondResponse", "message SecondRequest")
+
+	var messages []string
+	for _, w := range warnings {
+		messages = append(messages, w.Message)
+	}
+	want := []string{"message SecondRequest can't be followed directly by SecondResponse"}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("warnings: want %q, got %q", want, messages)
 	}
-}
 
-// ============================================================
-// RPC sorting tests
-// ============================================================
+	// Without it, the request's dependencies come between
+	output, _, err = Sort(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, output, "message GetThingRequest", "message Filter")
+}
 
-func TestSort_SortRPCsAlpha(t *testing.T) {
+func TestSort_GroupByService(t *testing.T) {
 	input := `syntax = "proto3";
 
-service UserService {
-  rpc DeleteUser(DeleteUserRequest) returns (DeleteUserResponse);
-  rpc CreateUser(CreateUserRequest) returns (CreateUserResponse);
-  rpc GetUser(GetUserRequest) returns (GetUserResponse);
+service Users {
+  rpc GetUser(GetUserRequest) returns (User);
 }
 
-message DeleteUserRequest { string id = 1; }
-message DeleteUserResponse {}
-message CreateUserRequest { string name = 1; }
-message CreateUserResponse { string id = 1; }
+service Admin {
+  rpc BanUser(BanUserRequest) returns (User);
+  rpc Audit(AuditRequest) returns (AuditResponse);
+}
+
+message AuditRequest {}
+message AuditResponse {}
+message BanUserRequest { string id = 1; }
 message GetUserRequest { string id = 1; }
-message GetUserResponse { string name = 1; }
+message User { string id = 1; }
 `
-	opts := Options{Quiet: true, SortRPCs: "alpha"}
-	output, _, err := Sort(input, opts)
+	opts := Options{Quiet: true, GroupByService: true, SectionHeaders: true}
+	pass1, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// RPCs should be sorted alphabetically: Create, Delete, Get
-	// Request/response pairs should follow new RPC order
-	assertOrder(t, output,
-		"message CreateUserRequest", "message CreateUserResponse",
-		"message DeleteUserRequest", "message DeleteUserResponse",
-		"message GetUserRequest", "message GetUserResponse")
+	// A type both services use stays with the first
+	assertOrder(t, pass1,
+		"// Service Users\n", "service Users", "// Types for GetUser\n", "message GetUserRequest", "message User",
+		"// Service Admin\n", "service Admin", "// Types for BanUser\n", "message BanUserRequest",
+		"// Types for Audit\n", "message AuditRequest", "message AuditResponse")
+	if err := Verify(input, pass1, opts); err != nil {
+		t.Errorf("output should verify: %v", err)
+	}
+	pass2, _, err := Sort(pass1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pass1 != pass2 {
+		t.Errorf("not idempotent.\nDiff:\n%s", DiffStrings(pass1, pass2, "pass1", "pass2"))
+	}
+
+	// A single service is laid out as usual
+	single, _, err := Sort("syntax = \"proto3\";\n\nservice S { rpc Do(Req) returns (Res); }\nmessage Req {}\nmessage Res {}\n", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(single, "// Service S") {
+		t.Errorf("expected no service header:\n%s", single)
+	}
 }
 
-func TestSort_SortRPCsGrouped(t *testing.T) {
+func TestSort_GroupExtends(t *testing.T) {
 	input := `syntax = "proto3";
 
-service UserService {
-  rpc DeleteUser(DeleteUserRequest) returns (DeleteUserResponse);
-  rpc ListTrips(ListTripsRequest) returns (ListTripsResponse);
-  rpc CreateUser(CreateUserRequest) returns (CreateUserResponse);
-  rpc GetTrip(GetTripRequest) returns (GetTripResponse);
-  rpc GetUser(GetUserRequest) returns (GetUserResponse);
-  rpc CreateTrip(CreateTripRequest) returns (CreateTripResponse);
+package acme.options;
+
+import "google/protobuf/descriptor.proto";
+
+extend google.protobuf.MethodOptions {
+  Auth auth = 50001;
 }
 
-message DeleteUserRequest { string id = 1; }
-message DeleteUserResponse {}
-message ListTripsRequest { string user_id = 1; }
-message ListTripsResponse { string v = 1; }
-message CreateUserRequest { string name = 1; }
-message CreateUserResponse { string id = 1; }
-message GetTripRequest { string id = 1; }
-message GetTripResponse { string v = 1; }
-message GetUserRequest { string id = 1; }
-message GetUserResponse { string name = 1; }
-message CreateTripRequest { string name = 1; }
-message CreateTripResponse { string id = 1; }
+extend google.protobuf.FieldOptions {
+  Sensitivity sensitivity = 50002;
+  Rule rule = 50003;
+}
+
+message Rule {
+  Level level = 1;
+}
+
+enum Level {
+  LEVEL_UNSPECIFIED = 0;
+}
+
+message Auth {
+  string scope = 1;
+}
+
+enum Sensitivity {
+  SENSITIVITY_UNSPECIFIED = 0;
+}
+
+message Policy {
+  Auth default_auth = 1;
+}
 `
-	opts := Options{Quiet: true, SortRPCs: "grouped"}
-	output, _, err := Sort(input, opts)
+	opts := Options{Quiet: true, GroupExtends: true, SectionHeaders: true}
+	pass1, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Grouped: Trip methods together, User methods together
-	// Within groups: alphabetical by full name
-	// Trip group: CreateTrip, GetTrip, ListTrips
-	// User group: CreateUser, DeleteUser, GetUser
-	assertOrder(t, output,
-		"message CreateTripRequest", "message CreateTripResponse",
-		"message GetTripRequest", "message GetTripResponse",
-		"message ListTripsRequest", "message ListTripsResponse",
-		"message CreateUserRequest", "message CreateUserResponse",
-		"message DeleteUserRequest", "message DeleteUserResponse",
-		"message GetUserRequest", "message GetUserResponse")
+	// Auth stays in the body, since Policy uses it too
+	assertOrder(t, pass1,
+		"import \"google/protobuf/descriptor.proto\"", "// Custom Options\n",
+		"extend google.protobuf.FieldOptions", "enum Sensitivity", "message Rule", "enum Level",
+		"extend google.protobuf.MethodOptions", "message Auth", "message Policy")
+	if err := Verify(input, pass1, opts); err != nil {
+		t.Errorf("output should verify: %v", err)
+	}
+	pass2, _, err := Sort(pass1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pass1 != pass2 {
+		t.Errorf("not idempotent.\nDiff:\n%s", DiffStrings(pass1, pass2, "pass1", "pass2"))
+	}
+
+	// Without it, the extends keep their order in the header
+	plain, _, err := Sort(input, Options{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, plain, "extend google.protobuf.MethodOptions", "extend google.protobuf.FieldOptions", "import ")
 }
 
-func TestSort_SortRPCsDisabledByDefault(t *testing.T) {
+func TestSort_KeepFloatingComments(t *testing.T) {
 	input := `syntax = "proto3";
 
-service S {
-  rpc Zulu(ZReq) returns (ZRes);
-  rpc Alpha(AReq) returns (ARes);
-}
+message B {}
 
-message ZReq { string v = 1; }
-message ZRes { string v = 1; }
-message AReq { string v = 1; }
-message ARes { string v = 1; }
+// Architecture note: trips are immutable.
+
+// A is the first type.
+message A {}
+
+// End of the trip types.
 `
-	output, _, err := Sort(input, defaultOpts)
+	opts := Options{Quiet: true, KeepFloatingComments: true}
+	pass1, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Without --sort-rpcs, original RPC order preserved: Zulu before Alpha
-	assertOrder(t, output, "message ZReq", "message ZRes", "message AReq", "message ARes")
-}
+	want := `syntax = "proto3";
 
-func TestSort_SortRPCsIdempotent(t *testing.T) {
-	input := `syntax = "proto3";
+// Architecture note: trips are immutable.
 
-service S {
-  rpc Delete(DReq) returns (DRes);
-  rpc Create(CReq) returns (CRes);
-  rpc Get(GReq) returns (GRes);
-}
+// A is the first type.
+message A {}
 
-message DReq { string v = 1; }
-message DRes { string v = 1; }
-message CReq { string v = 1; }
-message CRes { string v = 1; }
-message GReq { string v = 1; }
-message GRes { string v = 1; }
+message B {}
+
+// End of the trip types.
 `
-	opts := Options{Quiet: true, SortRPCs: "alpha"}
-	pass1, _, err := Sort(input, opts)
+	if pass1 != want {
+		t.Errorf("got:\n%s\nwant:\n%s", pass1, want)
+	}
+	if err := Verify(input, pass1, Options{Quiet: true, KeepFloatingComments: true, Paranoid: true}); err != nil {
+		t.Errorf("output should verify: %v", err)
+	}
+	pass2, _, err := Sort(pass1, opts)
 	if err != nil {
-		t.Fatalf("first Sort: %v", err)
+		t.Fatal(err)
+	}
+	if pass1 != pass2 {
+		t.Errorf("not idempotent.\nDiff:\n%s", DiffStrings(pass1, pass2, "pass1", "pass2"))
+	}
+
+	// By default the note joins A's doc comment, and the last comment still
+	// ends the file
+	plain, _, err := Sort(input, Options{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plain, "immutable.\n\n// A is") || !strings.HasSuffix(plain, "message B {}\n\n// End of the trip types.\n") {
+		t.Errorf("unexpected default output:\n%s", plain)
+	}
+}
+
+// TestTrailingComments_AllFixtures ends every fixture with a block of
+// comments and checks that it ends the output as written.
+func TestTrailingComments_AllFixtures(t *testing.T) {
+	pairs, err := filepath.Glob("testdata/*_input.proto")
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	trailing := "// TODO(ops): split this file by domain.\n//   - trips\n//   - vehicles\n\n/* TODO: drop Legacy*\n   after v3. */\n"
+	for _, inputPath := range pairs {
+		name := strings.TrimSuffix(filepath.Base(inputPath), "_input.proto")
+
+		t.Run(name, func(t *testing.T) {
+			input := readFileNormalized(t, inputPath) + "\n" + trailing
+			sorted, _, err := Sort(input, defaultOpts)
+			if err != nil {
+				t.Fatalf("Sort failed: %v", err)
+			}
+			if !strings.HasSuffix(sorted, "\n\n"+trailing) {
+				t.Errorf("trailing comments not kept as written:\n%s", sorted)
+			}
+			if err := verifyContentIntegrity(input, sorted, defaultOpts); err != nil {
+				t.Errorf("integrity check failed: %v", err)
+			}
+			if again, _, _ := Sort(sorted, defaultOpts); again != sorted {
+				t.Errorf("not idempotent.\nDiff:\n%s", DiffStrings(sorted, again, "pass1", "pass2"))
+			}
+		})
 	}
-	pass2, _, err := Sort(pass1, opts)
+
+	// A comment directly after the last declaration, even on its line,
+	// stays at the end too
+	sorted, _, err := Sort("syntax = \"proto3\";\n\nmessage B {}\nmessage A {} /* last */\n// TODO\n", defaultOpts)
 	if err != nil {
-		t.Fatalf("second Sort: %v", err)
+		t.Fatal(err)
 	}
-	if pass1 != pass2 {
-		t.Errorf("--sort-rpcs alpha not idempotent.\nPass 1:\n%s\nPass 2:\n%s", pass1, pass2)
+	if want := "syntax = \"proto3\";\n\nmessage A {}\n\nmessage B {}\n\n/* last */\n// TODO\n"; sorted != want {
+		t.Errorf("got:\n%s\nwant:\n%s", sorted, want)
 	}
 }
 
-func TestRPCGroupKey(t *testing.T) {
-	tests := []struct {
-		name string
-		want string
-	}{
-		{"GetUser", "User"},
-		{"CreateUser", "User"},
-		{"DeleteUser", "User"},
-		{"ListUsers", "Users"},
-		{"UpdateUser", "User"},
-		{"BatchCreateUsers", "Users"},
-		{"BatchGetUsers", "Users"},
-		{"WatchTrip", "Trip"},
-		{"StreamEvents", "Events"},
-		{"SearchProducts", "Products"},
-		{"SetConfig", "Config"},
-		{"AddItem", "Item"},
-		{"RemoveItem", "Item"},
-		{"StartJob", "Job"},
-		{"StopJob", "Job"},
-		{"RunTask", "Task"},
-		{"CheckHealth", "Health"},
-		{"CancelOperation", "Operation"},
-		// No prefix match — return full name
-		{"Healthcheck", "Healthcheck"},
-		{"Getaway", "Getaway"}, // "Get" + lowercase 'a' → no strip
-		// Name equals prefix exactly → return full name
-		{"Get", "Get"},
-		{"Create", "Create"},
+func TestSort_RemoveUnusedImports(t *testing.T) {
+	dir := t.TempDir()
+	deps := map[string]string{
+		"acme/ext.proto":    "syntax = \"proto3\";\npackage acme;\nimport \"google/protobuf/descriptor.proto\";\nextend google.protobuf.FieldOptions { string label = 50000; }\n",
+		"acme/money.proto":  "syntax = \"proto3\";\npackage acme;\nmessage Money { int64 units = 1; }\n",
+		"acme/unused.proto": "syntax = \"proto3\";\npackage acme;\nmessage Unused {}\n",
 	}
-	for _, tt := range tests {
-		got := rpcGroupKey(tt.name)
-		if got != tt.want {
-			t.Errorf("rpcGroupKey(%q) = %q, want %q", tt.name, got, tt.want)
+	for name, content := range deps {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
 		}
 	}
-}
 
-func TestSort_SortRPCsWithComments(t *testing.T) {
 	input := `syntax = "proto3";
 
-service S {
-  // Deletes a user.
-  rpc DeleteUser(DReq) returns (DRes);
-  // Creates a user.
-  rpc CreateUser(CReq) returns (CRes);
-}
+package acme.shop;
 
-message DReq { string v = 1; }
-message DRes { string v = 1; }
-message CReq { string v = 1; }
-message CRes { string v = 1; }
+import "acme/unused.proto";
+import public "acme/public.proto";
+import "acme/money.proto";
+import "acme/ext.proto";
+import "acme/missing.proto";
+import "google/protobuf/timestamp.proto";
+import "google/protobuf/duration.proto";
+
+message Order {
+  Money total = 1 [(acme.label) = "Unused"];
+  .google.protobuf.Duration ttl = 2; // google.protobuf.Timestamp is unused
+}
 `
-	opts := Options{Quiet: true, SortRPCs: "alpha"}
-	output, _, err := Sort(input, opts)
+	opts := Options{RemoveUnusedImports: true, ProtoPaths: []string{dir}}
+	output, warnings, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Comments should travel with their RPC
-	assertOrder(t, output, "Creates a user", "rpc CreateUser", "Deletes a user", "rpc DeleteUser")
+	for _, gone := range []string{"acme/unused.proto", "google/protobuf/timestamp.proto"} {
+		if strings.Contains(output, `import "`+gone+`"`) {
+			t.Errorf("unused import %s kept:\n%s", gone, output)
+		}
+	}
+	for _, kept := range []string{"acme/public.proto", "acme/money.proto", "acme/ext.proto", "acme/missing.proto", "google/protobuf/duration.proto"} {
+		if !strings.Contains(output, kept) {
+			t.Errorf("import %s removed:\n%s", kept, output)
+		}
+	}
+	var messages []string
+	for _, w := range warnings {
+		messages = append(messages, w.Message)
+	}
+	all := strings.Join(messages, "\n")
+	if !strings.Contains(all, "removed unused imports: acme/unused.proto, google/protobuf/timestamp.proto") {
+		t.Errorf("want the removed imports listed, got:\n%s", all)
+	}
+	if !strings.Contains(all, `import "acme/missing.proto" kept`) {
+		t.Errorf("want a warning for the unresolved import, got:\n%s", all)
+	}
 }
 
-func TestSort_SortRPCsWithOptionBody(t *testing.T) {
+func TestSort_RemoveUnusedImportsVerify(t *testing.T) {
 	input := `syntax = "proto3";
 
-service S {
-  rpc DeleteUser(DReq) returns (DRes) {
-    option (google.api.http) = {
-      delete: "/v1/users/{id}"
-    };
-  }
-  rpc CreateUser(CReq) returns (CRes);
-}
+import "google/protobuf/timestamp.proto";
+import "google/protobuf/duration.proto";
 
-message DReq { string v = 1; }
-message DRes { string v = 1; }
-message CReq { string v = 1; }
-message CRes { string v = 1; }
+message A {
+  google.protobuf.Duration ttl = 1;
+}
 `
-	opts := Options{Quiet: true, SortRPCs: "alpha"}
+	opts := Options{Quiet: true, RemoveUnusedImports: true}
 	output, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// CreateUser should come before DeleteUser even though Delete has option body
-	assertOrder(t, output, "rpc CreateUser", "rpc DeleteUser")
-	// The option body should be preserved
-	if !strings.Contains(output, "delete: \"/v1/users/{id}\"") {
-		t.Error("RPC option body should be preserved")
+	if strings.Contains(output, "timestamp.proto") {
+		t.Fatalf("unused import kept:\n%s", output)
+	}
+	opts.Verify, opts.Verifier = true, VerifierProtocompile
+	if err := Verify(input, output, opts); err != nil {
+		t.Errorf("dropping an unused import should verify: %v", err)
+	}
+
+	// Dropping an import the file uses must not verify
+	broken := strings.Replace(output, "import \"google/protobuf/duration.proto\";\n", "", 1)
+	if err := Verify(input, broken, opts); err == nil {
+		t.Error("dropping a used import verified")
 	}
 }
 
-func TestSort_SortRPCsContentIntegrity(t *testing.T) {
+func TestSort_SortNestedContentIntegrity(t *testing.T) {
 	input := `syntax = "proto3";
 
-service S {
-  rpc Zulu(ZReq) returns (ZRes);
-  rpc Alpha(AReq) returns (ARes);
+message A {
+  enum Kind { KIND_UNSPECIFIED = 0; }
+  message Item { string v = 1; }
+  Item item = 1;
+  Kind kind = 2;
 }
-
-message ZReq { string v = 1; }
-message ZRes { string v = 1; }
-message AReq { string v = 1; }
-message ARes { string v = 1; }
 `
-	opts := Options{Quiet: true, SortRPCs: "alpha"}
+	opts := Options{Quiet: true, SortNested: true}
 	output, _, err := Sort(input, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
+	assertOrder(t, output, "message Item", "enum Kind", "Item item = 1;")
 	if err := verifyContentIntegrity(input, output, opts); err != nil {
-		t.Errorf("content integrity failed with --sort-rpcs: %v", err)
+		t.Errorf("content integrity failed: %v", err)
+	}
+	if err := verifyCharacters(input, output, opts); err != nil {
+		t.Errorf("characters changed: %v", err)
 	}
 }
 
-// ============================================================
-// Section header tests
-// ============================================================
-
 func TestSort_SectionHeaders_Golden(t *testing.T) {
 	input := readFileNormalized(t, "testdata/section_headers_input.proto")
 	expected := readFileNormalized(t, "testdata/section_headers_expected.proto")
@@ -2431,6 +5371,163 @@ message Orphan { string v = 1; }
 	}
 }
 
+func TestSort_SectionHeaders_Stats(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S { rpc Do(Req) returns (Res); }
+message Req {
+  Item item = 1;
+}
+message Res { string v = 1; }
+message Item { string v = 1; }
+message Orphan { string v = 1; }
+`
+	opts := Options{Quiet: true, SectionHeaders: true, SectionStats: true}
+	pass1, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatalf("first Sort: %v", err)
+	}
+	assertOrder(t, pass1,
+		"// Types for Do (3)\n", "message Req", "message Item", "message Res",
+		"// Types unused by RPCs (1)\n", "message Orphan")
+
+	// Counts are stripped and recomputed, not accumulated
+	pass2, _, err := Sort(pass1, opts)
+	if err != nil {
+		t.Fatalf("second Sort: %v", err)
+	}
+	if pass1 != pass2 {
+		t.Errorf("not idempotent.\nDiff:\n%s",
+			DiffStrings(pass1, pass2, "pass1", "pass2"))
+	}
+
+	// Turning stats off leaves the plain labels
+	opts.SectionStats = false
+	plain, _, err := Sort(pass1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(plain, "(3)") || strings.Count(plain, sectionHeaderBanner) != 4 {
+		t.Errorf("expected plain headers, got:\n%s", plain)
+	}
+}
+
+func TestSort_SectionHeaders_Style(t *testing.T) {
+	input := `syntax = "proto3";
+
+service S { rpc Do(Req) returns (Res); }
+message Req { string v = 1; }
+message Res { string v = 1; }
+message Orphan { string v = 1; }
+`
+	banner := "// " + strings.Repeat("-", 37)
+	opts := Options{Quiet: true, SectionHeaders: true, SectionStats: true, Paranoid: true, HeaderStyle: HeaderStyle{
+		RPC:         "{{.RPC}} messages",
+		Unused:      "Other messages",
+		BannerChar:  "-",
+		BannerWidth: 40,
+	}}
+	// Headers left over in the default style are replaced
+	defaultStyle, _, err := Sort(input, Options{Quiet: true, SectionHeaders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []string{input, defaultStyle} {
+		pass1, _, err := Sort(in, opts)
+		if err != nil {
+			t.Fatalf("first Sort: %v", err)
+		}
+		assertOrder(t, pass1,
+			banner+"\n// Do messages (2)\n"+banner+"\n\nmessage Req",
+			banner+"\n// Other messages (1)\n"+banner+"\n\nmessage Orphan")
+		if strings.Contains(pass1, sectionHeaderBanner) {
+			t.Errorf("expected no default-style headers:\n%s", pass1)
+		}
+		if err := Verify(in, pass1, opts); err != nil {
+			t.Errorf("output should verify: %v", err)
+		}
+
+		pass2, _, err := Sort(pass1, opts)
+		if err != nil {
+			t.Fatalf("second Sort: %v", err)
+		}
+		if pass1 != pass2 {
+			t.Errorf("not idempotent.\nDiff:\n%s", DiffStrings(pass1, pass2, "pass1", "pass2"))
+		}
+	}
+
+	// A label showing {{.Count}} places the count itself, even without stats
+	counted := Options{Quiet: true, SectionHeaders: true, HeaderStyle: HeaderStyle{RPC: "{{.RPC}}: {{.Count}} messages"}}
+	pass1, _, err := Sort(input, counted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, pass1, "// Do: 2 messages\n", "message Req", "// Types unused by RPCs\n", "message Orphan")
+	counted.SectionStats = true
+	pass2, _, err := Sort(strings.Replace(pass1, "Do: 2", "Do: 5", 1), counted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, pass2, "// Do: 2 messages\n", "message Req", "// Types unused by RPCs (1)\n", "message Orphan")
+	if strings.Contains(pass2, "Do: 5") {
+		t.Errorf("expected the stale count to be replaced:\n%s", pass2)
+	}
+
+	for _, style := range []HeaderStyle{
+		{RPC: "Types for {{.Method}}"},
+		{RPC: "{{.RPC"},
+		{BannerChar: "ab"},
+		{BannerWidth: 5},
+	} {
+		if _, _, err := Sort(input, Options{Quiet: true, SectionHeaders: true, HeaderStyle: style}); err == nil {
+			t.Errorf("%+v: expected an error", style)
+		}
+	}
+}
+
+func TestSort_TOC(t *testing.T) {
+	input := `syntax = "proto3";
+
+package a;
+
+// The API.
+service S {
+  rpc Do(Req) returns (Res);
+}
+message Req { string v = 1; }
+message Res { string v = 1; }
+enum Orphan { ORPHAN_UNSPECIFIED = 0; }
+`
+	opts := Options{Quiet: true, TOC: true, SectionHeaders: true}
+	pass1, _, err := Sort(input, opts)
+	if err != nil {
+		t.Fatalf("first Sort: %v", err)
+	}
+	assertOrder(t, pass1,
+		"package a;",
+		"// Contents\n//   service S\n//     rpc Do\n//   message Req (request/response)\n//   message Res (request/response)\n//   enum Orphan (unreferenced)\n",
+		"// The API.\nservice S",
+		"// Types for Do")
+
+	pass2, _, err := Sort(pass1, opts)
+	if err != nil {
+		t.Fatalf("second Sort: %v", err)
+	}
+	if pass1 != pass2 {
+		t.Errorf("not idempotent.\nDiff:\n%s",
+			DiffStrings(pass1, pass2, "pass1", "pass2"))
+	}
+
+	opts.TOC = false
+	without, _, err := Sort(pass1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(without, tocLabel) {
+		t.Errorf("table of contents should be stripped when --toc is disabled:\n%s", without)
+	}
+}
+
 func TestSort_SectionHeaders_StrippedWhenDisabled(t *testing.T) {
 	input := `syntax = "proto3";
 
@@ -2545,6 +5642,123 @@ message Orphan { string v = 1; }
 	}
 }
 
+// ============================================================
+// Pipeline tests
+// ============================================================
+
+func TestPipeline_CustomStage(t *testing.T) {
+	input := `syntax = "proto3";
+
+message B { string v = 1; }
+
+message A { string v = 1; }
+`
+	p := NewPipeline()
+	owner := NewStage("owner", func(f *File) error {
+		for _, b := range f.Body {
+			b.Comments = "// Owner: payments\n" + b.Comments
+		}
+		return nil
+	})
+	if err := p.InsertAfter(StageAnnotate, owner); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{StageScan, StageClassify, StageOrder, StageAnnotate, "owner", StageEmit}
+	if got := p.Stages(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stages() = %v, want %v", got, want)
+	}
+
+	output, _, err := p.Run(input, defaultOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, output, "// Owner: payments\nmessage A", "// Owner: payments\nmessage B")
+
+	// The default pipeline is Sort
+	sorted, _, _ := Sort(input, defaultOpts)
+	if got, _, _ := NewPipeline().Run(input, defaultOpts); got != sorted {
+		t.Errorf("NewPipeline().Run differs from Sort:\n%s\nwant:\n%s", got, sorted)
+	}
+
+	// A stage error stops the pipeline
+	failing := NewStage("fail", func(*File) error { return errors.New("boom") })
+	if err := p.Replace("owner", failing); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Run(input, defaultOpts); err == nil || err.Error() != "boom" {
+		t.Errorf("expected the stage error, got %v", err)
+	}
+	if err := p.InsertBefore("no-such-stage", owner); err == nil {
+		t.Error("expected an error for an unknown stage")
+	}
+}
+
+func TestPipeline_HelperCycle(t *testing.T) {
+	input := `syntax = "proto3";
+
+message Mid { Leaf l = 1; }
+
+message Leaf { string v = 1; }
+
+message A { string v = 1; }
+
+message B { string v = 1; }
+
+message C { string v = 1; }
+`
+	// The classifier never produces a cycle, but a custom stage can: A, B,
+	// and C consume each other
+	p := NewPipeline()
+	cycle := NewStage("cycle", func(f *File) error {
+		for _, b := range f.Body {
+			switch b.Name {
+			case "A", "B", "C":
+				b.Section = SectionHelper
+				b.Consumer = map[string]string{"A": "B", "B": "C", "C": "A"}[b.Name]
+			}
+		}
+		return nil
+	})
+	if err := p.InsertAfter(StageOrder, cycle); err != nil {
+		t.Fatal(err)
+	}
+
+	output, warnings, err := p.Run(input, Options{SectionHeaders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cycles []string
+	for _, w := range warnings {
+		if strings.Contains(w.Message, "cycle") {
+			cycles = append(cycles, w.Message)
+		}
+	}
+	want := []string{"helper types A -> B -> C -> A consume each other in a cycle; kept with the shared helpers"}
+	if !reflect.DeepEqual(cycles, want) {
+		t.Errorf("cycle warnings = %q, want %q", cycles, want)
+	}
+	assertOrder(t, output, "// Helper Types -- used in other types", "message A")
+
+	blocks, err := ScanFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classified := Classify(blocks, Options{})
+	if chain, cycle := HelperChain(classified, "Leaf"); cycle || !reflect.DeepEqual(chain, []string{"Leaf", "Mid"}) {
+		t.Errorf("HelperChain(Leaf) = %v, %v", chain, cycle)
+	}
+	for _, b := range classified {
+		switch b.Name {
+		case "A", "B", "C":
+			b.Section = SectionHelper
+			b.Consumer = map[string]string{"A": "B", "B": "C", "C": "A"}[b.Name]
+		}
+	}
+	if chain, cycle := HelperChain(classified, "B"); !cycle || !reflect.DeepEqual(chain, []string{"B", "C", "A", "B"}) {
+		t.Errorf("HelperChain(B) = %v, %v", chain, cycle)
+	}
+}
+
 // assertOrder verifies that the given substrings appear in order within text.
 func assertOrder(t *testing.T, text string, substrs ...string) {
 	t.Helper()
@@ -1,32 +1,31 @@
-package main
+package protosort
 
 import (
-	"regexp"
+	"maps"
 	"strings"
 )
 
-// Pre-compiled regexes for declaration parsing.
-var (
-	rpcRe          = regexp.MustCompile(`rpc\s+(\w+)\s*\(\s*(?:stream\s+)?([\w.]+)\s*\)\s*returns\s*\(\s*(?:stream\s+)?([\w.]+)\s*\)`)
-	fieldRe        = regexp.MustCompile(`(?m)^\s*(?:repeated\s+|optional\s+)?([\w.]+)\s+\w+\s*=\s*\d+`)
-	mapFieldRe     = regexp.MustCompile(`map\s*<\s*[\w.]+\s*,\s*([\w.]+)\s*>\s*\w+\s*=\s*\d+`)
-	oneofRe        = regexp.MustCompile(`(?s)oneof\s+\w+\s*\{([^}]*)\}`)
-	oneofVariantRe = regexp.MustCompile(`(?m)^\s*([\w.]+)\s+\w+\s*=\s*\d+`)
-)
-
 // ExtractRPCs parses RPC declarations from a service block's DeclText.
+// Commented-out RPCs are skipped.
 func ExtractRPCs(block *Block) []RPC {
 	if block.Kind != BlockService {
 		return nil
 	}
 	var rpcs []RPC
-	matches := rpcRe.FindAllStringSubmatch(block.DeclText, -1)
-	for _, m := range matches {
-		rpcs = append(rpcs, RPC{
-			Name:         m[1],
-			RequestType:  m[2],
-			ResponseType: m[3],
-		})
+	for _, d := range blockDecls(block) {
+		if d.Kind != BlockService {
+			continue
+		}
+		for _, n := range parseMembers(d.DeclText, d.Line, "service") {
+			if n.Kind != "rpc" || n.Name == "" || n.Type == "" || n.Returns == "" {
+				continue
+			}
+			rpcs = append(rpcs, RPC{
+				Name:         n.Name,
+				RequestType:  localTypeName(strings.TrimPrefix(n.Type, "stream "), block.Package),
+				ResponseType: localTypeName(strings.TrimPrefix(n.Returns, "stream "), block.Package),
+			})
+		}
 	}
 	return rpcs
 }
@@ -34,46 +33,119 @@ func ExtractRPCs(block *Block) []RPC {
 // ExtractFieldTypes extracts type names referenced by fields in a message or extend block.
 // Each type name is returned at most once per block (per spec: multiple fields referencing
 // the same type from one message count as one reference).
+// The fields are read with the scanner's tokenizer, so comments and the
+// strings of field options can't be mistaken for fields. Fields nested at
+// any depth count, as does the type a nested extend extends.
 func ExtractFieldTypes(block *Block) []string {
 	if block.Kind != BlockMessage && block.Kind != BlockExtend {
 		return nil
 	}
 
-	body := extractBody(block.DeclText)
 	seen := make(map[string]bool)
 	var types []string
 
 	addType := func(t string) {
-		// Package-qualified names (containing dots) are imported types — skip them.
+		// Names qualified by another package (containing dots once the
+		// file's own package is resolved) are imported types — skip them.
 		// Only count references to locally-defined types (simple names).
+		t = localTypeName(t, block.Package)
 		if strings.Contains(t, ".") {
 			return
 		}
-		if t != "" && !isScalarType(t) && !seen[t] {
+		if t != "" && t != "group" && !isScalarType(t) && !seen[t] {
 			seen[t] = true
 			types = append(types, t)
 		}
 	}
 
-	// Match regular fields: [repeated|optional] TypeName field_name = N;
-	for _, m := range fieldRe.FindAllStringSubmatch(body, -1) {
-		addType(m[1])
+	// walk adds the types referenced by nodes and the members nested in
+	// them. A name declared in an enclosing message (nested) refers to
+	// that nested type rather than a top-level one.
+	var walk func(nodes []*Node, nested map[string]bool)
+	walk = func(nodes []*Node, nested map[string]bool) {
+		scope := maps.Clone(nested)
+		if scope == nil {
+			scope = make(map[string]bool)
+		}
+		for _, n := range nodes {
+			if n.Kind == "message" || n.Kind == "enum" || n.Type == "group" {
+				scope[n.Name] = true
+			}
+		}
+		use := func(t string) {
+			if !scope[t] {
+				addType(t)
+			}
+		}
+		for _, n := range nodes {
+			switch n.Kind {
+			case "field":
+				use(mapValueType(n.Type))
+			case "extend":
+				// An extend nested in a message uses the type it extends
+				use(n.Name)
+			case "enum":
+				continue
+			}
+			// Fields of oneofs, groups, and nested messages and extends
+			walk(n.Members, scope)
+		}
 	}
+	for _, d := range blockDecls(block) {
+		if d.Kind == BlockMessage || d.Kind == BlockExtend {
+			walk(parseMembers(d.DeclText, d.Line, "message"), nil)
+		}
+	}
+
+	return types
+}
 
-	// Match map fields: map<KeyType, ValueType> field_name = N;
-	for _, m := range mapFieldRe.FindAllStringSubmatch(body, -1) {
-		addType(m[1])
+// mapValueType returns the value type of a map field's type, and other
+// types as they are.
+func mapValueType(t string) string {
+	if rest, ok := strings.CutPrefix(t, "map<"); ok {
+		if i := strings.LastIndex(rest, ", "); i >= 0 {
+			return strings.TrimSuffix(rest[i+2:], ">")
+		}
 	}
+	return t
+}
 
-	// Match oneof variant types
-	for _, m := range oneofRe.FindAllStringSubmatch(body, -1) {
-		oneofBody := m[1]
-		for _, v := range oneofVariantRe.FindAllStringSubmatch(oneofBody, -1) {
-			addType(v[1])
+// localTypeName returns the name t refers to in package pkg, without the
+// qualification by pkg it may have: fully qualified (.billing.v1.Invoice),
+// or qualified by the package or the end of it (billing.v1.Invoice,
+// v1.Invoice). Other names are returned as they are.
+func localTypeName(t, pkg string) string {
+	if pkg == "" || !strings.Contains(t, ".") {
+		return t
+	}
+	if rest, ok := strings.CutPrefix(t, "."+pkg+"."); ok {
+		return rest
+	}
+	for suffix := pkg; ; {
+		if rest, ok := strings.CutPrefix(t, suffix+"."); ok {
+			return rest
+		}
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			return t
 		}
+		suffix = suffix[i+1:]
 	}
+}
 
-	return types
+// blockDecls returns the declarations b holds: several for a verbatim
+// region, and otherwise b itself.
+func blockDecls(b *Block) []*Block {
+	if b.Verbatim {
+		if blocks, err := ScanFile(b.DeclText); err == nil {
+			for _, d := range blocks {
+				d.Package = b.Package
+			}
+			return blocks
+		}
+	}
+	return []*Block{b}
 }
 
 // BuildRefCounts counts how many distinct declarations reference each type name.
@@ -0,0 +1,138 @@
+package protosort
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Default fold markers recognized by --regions.
+const (
+	defaultRegionBegin = "// region"
+	defaultRegionEnd   = "// endregion"
+)
+
+// region is a pair of fold markers and the body declarations between them.
+type region struct {
+	Begin   string // begin marker line, re-emitted above the first member
+	End     string // end marker line, re-emitted below the last member
+	Members []*Block
+}
+
+// extractRegions removes fold marker lines from block comments and returns
+// the regions they delimited, in file order. Only message, enum, and service
+// blocks become members; a region with no members is dropped. Nested and
+// unterminated regions are reported as warnings.
+func extractRegions(blocks []*Block, opts Options) ([]*region, []Warning) {
+	begin, end := opts.RegionBegin, opts.RegionEnd
+	if begin == "" {
+		begin = defaultRegionBegin
+	}
+	if end == "" {
+		end = defaultRegionEnd
+	}
+
+	var regions []*region
+	var warnings []Warning
+	var current *region
+	currentLine := 0 // line of current's begin marker
+
+	for _, b := range blocks {
+		if b.Comments != "" {
+			lines := strings.Split(b.Comments, "\n")
+			firstLine := b.Line - (len(lines) - 1)
+			var kept []string
+			for i := 0; i < len(lines); i++ {
+				trimmed := strings.TrimSpace(lines[i])
+				isBegin := strings.HasPrefix(trimmed, begin)
+				isEnd := strings.HasPrefix(trimmed, end)
+				if !isBegin && !isEnd {
+					kept = append(kept, lines[i])
+					continue
+				}
+
+				switch {
+				case isBegin && current != nil:
+					warnings = append(warnings, Warning{Code: WarningRegion, Message: fmt.Sprintf("nested region %q inside %q is not supported; marker dropped", trimmed, current.Begin), Line: firstLine + i})
+				case isBegin:
+					current = &region{Begin: trimmed}
+					currentLine = firstLine + i
+				case current != nil:
+					current.End = trimmed
+					if len(current.Members) > 0 {
+						regions = append(regions, current)
+					}
+					current = nil
+				}
+
+				// Don't leave a double blank line where the marker was
+				if i+1 < len(lines) && strings.TrimSpace(lines[i+1]) == "" &&
+					(len(kept) == 0 || strings.TrimSpace(kept[len(kept)-1]) == "") {
+					i++
+				}
+			}
+			b.Comments = strings.Join(kept, "\n")
+		}
+
+		if current != nil && (b.Kind == BlockMessage || b.Kind == BlockEnum || b.Kind == BlockService) {
+			current.Members = append(current.Members, b)
+		}
+	}
+
+	if current != nil {
+		warnings = append(warnings, Warning{Code: WarningRegion, Message: fmt.Sprintf("region %q is never closed; closing at end of file", current.Begin), Line: currentLine})
+		current.End = end
+		if len(current.Members) > 0 {
+			regions = append(regions, current)
+		}
+	}
+
+	return regions, warnings
+}
+
+// regroupRegions moves the members of each region next to each other, at the
+// position of whichever member sorts first, keeping their sorted relative
+// order. The region's markers are re-attached around the group.
+func regroupRegions(ordered []*Block, regions []*region) []*Block {
+	if len(regions) == 0 {
+		return ordered
+	}
+
+	memberOf := make(map[*Block]*region)
+	for _, r := range regions {
+		for _, m := range r.Members {
+			memberOf[m] = r
+		}
+	}
+
+	var result []*Block
+	placed := make(map[*region]bool)
+	for _, b := range ordered {
+		r := memberOf[b]
+		if r == nil {
+			result = append(result, b)
+			continue
+		}
+		if placed[r] {
+			continue
+		}
+		placed[r] = true
+
+		var group []*Block
+		for _, m := range ordered {
+			if memberOf[m] == r {
+				group = append(group, m)
+			}
+		}
+		first, last := group[0], group[len(group)-1]
+		// A blank line keeps the marker out of the first member's doc comment
+		if c := strings.TrimLeft(first.Comments, "\n"); c != "" {
+			first.Comments = r.Begin + "\n\n" + c
+		} else {
+			first.Comments = r.Begin + "\n"
+		}
+		last.TrailingComments = r.End
+		result = append(result, group...)
+	}
+
+	return result
+}
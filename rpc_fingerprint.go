@@ -0,0 +1,129 @@
+package protosort
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rpcFingerprintPrefix starts the comment line that records a sorted
+// service's RPC order (see Options.RPCFingerprint).
+const rpcFingerprintPrefix = "// protosort:rpc-order "
+
+// rpcFingerprintRe matches a fingerprint line written by sortRPCs.
+var rpcFingerprintRe = regexp.MustCompile(`^\s*// protosort:rpc-order ([0-9a-f]+)\s*$`)
+
+// rpcFingerprint returns a short hash of a sequence of RPC names.
+func rpcFingerprint(names []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return hex.EncodeToString(sum[:4])
+}
+
+// stripRPCFingerprint removes fingerprint lines from a service body and
+// returns the body and the fingerprint recorded, or "" if there was none.
+func stripRPCFingerprint(body string) (string, string) {
+	if !strings.Contains(body, rpcFingerprintPrefix) {
+		return body, ""
+	}
+	lines := strings.Split(body, "\n")
+	kept := lines[:0]
+	recorded := ""
+	for _, line := range lines {
+		if m := rpcFingerprintRe.FindStringSubmatch(line); m != nil {
+			recorded = m[1]
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n"), recorded
+}
+
+// misplacedRPCs reports the RPCs of a fingerprinted service that were put
+// out of order since it was last sorted. A service whose RPCs still match
+// its fingerprint, or that has none, is not checked, so only services that
+// were sorted before are held to their order. The RPCs reported are those
+// outside the longest run already in sorted order, so an RPC added in the
+// right place isn't reported, and one added in the wrong place is reported
+// alone rather than with every RPC it displaced.
+func misplacedRPCs(b *Block, opts Options) []Warning {
+	openIdx := strings.IndexByte(b.DeclText, '{')
+	closeIdx := strings.LastIndexByte(b.DeclText, '}')
+	less := rpcLess(opts)
+	if openIdx < 0 || closeIdx <= openIdx || less == nil {
+		return nil
+	}
+	body, recorded := stripRPCFingerprint(stripRPCGroupHeaders(b.DeclText[openIdx+1 : closeIdx]))
+	if recorded == "" {
+		return nil
+	}
+	entries, _ := parseRPCEntries(body)
+	written := make([]string, len(entries))
+	for i, e := range entries {
+		written[i] = e.Name
+	}
+	if rpcFingerprint(written) == recorded {
+		return nil
+	}
+
+	sorted := append([]string(nil), written...)
+	sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	rank := make(map[string]int, len(sorted))
+	for i, name := range sorted {
+		rank[name] = i
+	}
+	ranks := make([]int, len(written))
+	for i, name := range written {
+		ranks[i] = rank[name]
+	}
+	inOrder := longestIncreasingRun(ranks)
+
+	// Lines of the RPCs as written, for the messages
+	lineOf := make(map[string]int)
+	for i, line := range strings.Split(b.DeclText, "\n") {
+		for _, m := range rpcStartRe.FindAllStringSubmatch(line, -1) {
+			if _, ok := lineOf[m[1]]; !ok {
+				lineOf[m[1]] = b.Line + i
+			}
+		}
+	}
+
+	var warnings []Warning
+	for i, name := range written {
+		if inOrder[i] {
+			continue
+		}
+		where := "first"
+		if r := ranks[i]; r > 0 {
+			where = "after " + sorted[r-1]
+		}
+		warnings = append(warnings, Warning{Code: WarningRPCOrder, Message: fmt.Sprintf("service %s: rpc %s is out of order (line %d); it belongs %s", b.Name, name, lineOf[name], where), Line: lineOf[name]})
+	}
+	return warnings
+}
+
+// longestIncreasingRun marks the members of a longest strictly increasing
+// subsequence of seq.
+func longestIncreasingRun(seq []int) []bool {
+	length := make([]int, len(seq)) // longest run ending at i
+	prev := make([]int, len(seq))
+	best := -1
+	for i := range seq {
+		length[i], prev[i] = 1, -1
+		for j := 0; j < i; j++ {
+			if seq[j] < seq[i] && length[j]+1 > length[i] {
+				length[i], prev[i] = length[j]+1, j
+			}
+		}
+		if best < 0 || length[i] > length[best] {
+			best = i
+		}
+	}
+	member := make([]bool, len(seq))
+	for i := best; i >= 0; i = prev[i] {
+		member[i] = true
+	}
+	return member
+}
@@ -1,6 +1,7 @@
-package main
+package protosort
 
 import (
+	"path"
 	"regexp"
 	"sort"
 	"strings"
@@ -19,7 +20,16 @@ type rpcEntry struct {
 // SortRPCsInService reorders RPC declarations within a service block's DeclText.
 // mode is "alpha" (alphabetical by name) or "grouped" (group by resource, then alpha).
 // Non-RPC content (like service-level options) is preserved at the top of the body.
+// Group headers from an earlier run (see Options.RPCGroupHeaders) are removed.
 func SortRPCsInService(declText, mode string) string {
+	return sortRPCs(declText, Options{SortRPCs: mode})
+}
+
+// sortRPCs is SortRPCsInService for opts.SortRPCs, inserting a
+// "// <Resource>s" header above each group when opts.RPCGroupHeaders is set
+// in grouped mode, ranking RPCs by opts.RPCOrder, and recording the order's
+// fingerprint when opts.RPCFingerprint is set.
+func sortRPCs(declText string, opts Options) string {
 	// Find the opening and closing braces
 	openIdx := strings.IndexByte(declText, '{')
 	closeIdx := strings.LastIndexByte(declText, '}')
@@ -28,42 +38,53 @@ func SortRPCsInService(declText, mode string) string {
 	}
 
 	header := declText[:openIdx+1]
-	body := declText[openIdx+1 : closeIdx]
+	body, recorded := stripRPCFingerprint(stripRPCGroupHeaders(declText[openIdx+1 : closeIdx]))
 	trailer := declText[closeIdx:]
 
 	entries, nonRPCLines := parseRPCEntries(body)
 	if len(entries) <= 1 {
+		if recorded != "" {
+			return header + body + trailer // a lone RPC can't be misplaced
+		}
 		return declText
 	}
 
 	// Sort entries
-	switch mode {
-	case "alpha":
-		sort.SliceStable(entries, func(i, j int) bool {
-			return entries[i].Name < entries[j].Name
-		})
-	case "grouped":
-		sort.SliceStable(entries, func(i, j int) bool {
-			gi, gj := rpcGroupKey(entries[i].Name), rpcGroupKey(entries[j].Name)
-			if gi != gj {
-				return gi < gj
-			}
-			return entries[i].Name < entries[j].Name
-		})
-	default:
+	less := rpcLess(opts)
+	if less == nil {
 		return declText
 	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return less(entries[i].Name, entries[j].Name)
+	})
 
 	// Reconstruct body
 	var out strings.Builder
 	out.WriteByte('\n') // newline after opening brace
+	if opts.RPCFingerprint {
+		names := make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = e.Name
+		}
+		out.WriteString(leadingWhitespace(entries[0].RPCText) + rpcFingerprintPrefix + rpcFingerprint(names) + "\n")
+	}
 	// Non-RPC lines (service options) first
 	for _, line := range nonRPCLines {
 		out.WriteString(line)
 		out.WriteByte('\n')
 	}
 	// Then sorted RPCs
-	for _, e := range entries {
+	label := ""
+	for i, e := range entries {
+		if opts.RPCGroupHeaders && opts.SortRPCs == "grouped" {
+			if l := rpcGroupLabel(e.Name); i == 0 || l != label {
+				if i > 0 || len(nonRPCLines) > 0 || opts.RPCFingerprint {
+					out.WriteByte('\n')
+				}
+				out.WriteString(leadingWhitespace(e.RPCText) + "// " + l + "\n\n")
+				label = l
+			}
+		}
 		if e.Comments != "" {
 			out.WriteString(e.Comments)
 		}
@@ -73,13 +94,51 @@ func SortRPCsInService(declText, mode string) string {
 	return header + out.String() + trailer
 }
 
+// rpcLess returns the comparison of RPC names that opts.SortRPCs sorts by,
+// or nil if it names no known mode.
+func rpcLess(opts Options) func(a, b string) bool {
+	byRank := func(a, b string) bool {
+		if ra, rb := rpcOrderRank(a, opts.RPCOrder), rpcOrderRank(b, opts.RPCOrder); ra != rb {
+			return ra < rb
+		}
+		return a < b
+	}
+	switch opts.SortRPCs {
+	case "alpha":
+		return byRank
+	case "grouped":
+		return func(a, b string) bool {
+			if ga, gb := rpcGroupKey(a), rpcGroupKey(b); ga != gb {
+				return ga < gb
+			}
+			return byRank(a, b)
+		}
+	}
+	return nil
+}
+
+// rpcOrderRank returns the index of the first glob in order that name
+// matches, or len(order) if none does.
+func rpcOrderRank(name string, order []string) int {
+	for i, pattern := range order {
+		if ok, _ := path.Match(pattern, name); ok {
+			return i
+		}
+	}
+	return len(order)
+}
+
 // rpcLineRe matches the start of an RPC declaration.
 var rpcLineRe = regexp.MustCompile(`^\s*rpc\s+(\w+)\s*\(`)
 
+// rpcStartRe matches the start of an RPC declaration anywhere on a line:
+// first, or after the brace or semicolon that ends what comes before.
+var rpcStartRe = regexp.MustCompile(`(?:^|[{};])\s*rpc\s+(\w+)\s*\(`)
+
 // parseRPCEntries parses the body of a service block into RPC entries and
 // non-RPC lines (such as service-level options).
 func parseRPCEntries(body string) ([]rpcEntry, []string) {
-	lines := strings.Split(body, "\n")
+	lines := strings.Split(splitStatements(body), "\n")
 	var entries []rpcEntry
 	var nonRPCLines []string
 	var commentBuf strings.Builder
@@ -94,7 +153,7 @@ func parseRPCEntries(body string) ([]rpcEntry, []string) {
 		if inRPC {
 			rpcBuf.WriteString(line)
 			rpcBuf.WriteByte('\n')
-			braceDepth += strings.Count(line, "{") - strings.Count(line, "}")
+			braceDepth += braceDelta(line)
 			if braceDepth <= 0 {
 				// Check if the line ends the RPC (semicolon or closing brace)
 				if strings.Contains(trimmed, ";") || strings.Contains(trimmed, "}") {
@@ -116,7 +175,7 @@ func parseRPCEntries(body string) ([]rpcEntry, []string) {
 		if m := rpcLineRe.FindStringSubmatch(line); m != nil {
 			currentName = m[1]
 			inRPC = true
-			braceDepth = strings.Count(line, "{") - strings.Count(line, "}")
+			braceDepth = braceDelta(line)
 			rpcBuf.WriteString(line)
 			rpcBuf.WriteByte('\n')
 
@@ -175,6 +234,142 @@ func parseRPCEntries(body string) ([]rpcEntry, []string) {
 	return entries, nonRPCLines
 }
 
+// splitStatements moves each statement of a service body that shares a line
+// with the opening brace or with the statement before it, as in minified and
+// generated files, to a line of its own, indented like the body's first
+// indented line. Strings and comments are skipped, so braces and semicolons
+// in them don't end a statement, and a comment stays on its line. A body
+// with one statement per line is returned unchanged.
+func splitStatements(body string) string {
+	indent := strings.Repeat(" ", defaultIndentWidth)
+	for _, line := range strings.Split(body, "\n")[1:] {
+		if strings.TrimSpace(line) != "" {
+			indent = leadingWhitespace(line)
+			break
+		}
+	}
+
+	var out strings.Builder
+	s := &scanner{content: body}
+	last, depth := 0, 0
+	between := true   // no statement has started since the last one ended
+	lineTaken := true // the line has code on it; the first is the brace's
+	for !s.atEnd() {
+		c := s.peek()
+		switch {
+		case c == '\n':
+			lineTaken = false
+			s.pos++
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			s.pos++
+			continue
+		case c == '/' && (s.peekAt(1) == '/' || s.peekAt(1) == '*'):
+			start := s.pos
+			s.skipOneToken()
+			if strings.Contains(body[start:s.pos], "\n") {
+				lineTaken = false
+			}
+			continue
+		}
+
+		if between && depth == 0 && c != ';' {
+			if lineTaken {
+				out.WriteString(strings.TrimRight(body[last:s.pos], " \t"))
+				out.WriteString("\n" + indent)
+				last = s.pos
+			}
+			between = false
+		}
+		lineTaken = true
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			between = depth <= 0
+		case ';':
+			between = depth <= 0
+		}
+		s.skipOneToken()
+	}
+	if last == 0 {
+		return body
+	}
+	// The last statement may end where the closing brace starts
+	rest := body[last:]
+	if !strings.Contains(rest, "\n") {
+		rest = strings.TrimRight(rest, " \t") + "\n"
+	}
+	out.WriteString(rest)
+	return out.String()
+}
+
+// braceDelta returns how many more braces line opens than it closes,
+// outside strings and comments.
+func braceDelta(line string) int {
+	delta := 0
+	s := &scanner{content: line}
+	for !s.atEnd() {
+		switch s.peek() {
+		case '{':
+			delta++
+		case '}':
+			delta--
+		}
+		s.skipOneToken()
+	}
+	return delta
+}
+
+// rpcGroupHeaderRe matches a group header line written by sortRPCs.
+var rpcGroupHeaderRe = regexp.MustCompile(`^\s*// (\w+)$`)
+
+// stripRPCGroupHeaders removes group headers from a service body: a
+// "// <Label>" line followed by a blank line, where the label is the one
+// rpcGroupLabel gives the next RPC. Other comments are never touched.
+func stripRPCGroupHeaders(body string) string {
+	lines := strings.Split(body, "\n")
+	var kept []string
+	for i := 0; i < len(lines); i++ {
+		m := rpcGroupHeaderRe.FindStringSubmatch(lines[i])
+		if m != nil && i+1 < len(lines) && strings.TrimSpace(lines[i+1]) == "" {
+			if name := nextRPCName(lines[i+2:]); name != "" && rpcGroupLabel(name) == m[1] {
+				i++ // skip the blank line too
+				continue
+			}
+		}
+		kept = append(kept, lines[i])
+	}
+	return strings.Join(kept, "\n")
+}
+
+// nextRPCName returns the name of the RPC that lines start with, after any
+// blank and comment lines, or "" if they start with something else.
+func nextRPCName(lines []string) string {
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "//") {
+			continue
+		}
+		if m := rpcLineRe.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+		return ""
+	}
+	return ""
+}
+
+// rpcGroupLabel returns the header label of the group an RPC sorts into:
+// its resource name, pluralized, so GetTrip and ListTrips are both "Trips".
+func rpcGroupLabel(name string) string {
+	key := rpcGroupKey(name)
+	if strings.HasSuffix(key, "s") {
+		return key
+	}
+	return key + "s"
+}
+
 // Known verb prefixes for RPC grouping, ordered longest-first to avoid
 // false prefix matches (e.g., "BatchCreate" before "Create").
 var rpcVerbPrefixes = []string{
@@ -1,19 +1,88 @@
-package main
+package protosort
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
+// conflictMarkers start the lines git writes around a merge conflict.
+var conflictMarkers = []string{"<<<<<<<", "|||||||", "=======", ">>>>>>>"}
+
+// conflictMarkerLine returns the 1-based line of the first merge conflict
+// marker in content, or 0 if it has none.
+func conflictMarkerLine(content string) int {
+	n := 0
+	for line := range strings.Lines(content) {
+		n++
+		for _, m := range conflictMarkers {
+			if rest, ok := strings.CutPrefix(line, m); ok && (strings.TrimSpace(rest) == "" || rest[0] == ' ') {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// utf8BOM is the byte order mark some editors write at the start of UTF-8
+// files.
+const utf8BOM = "\ufeff"
+
 // ScanFile parses a proto file into a sequence of Blocks, preserving raw text.
+// A leading byte order mark is skipped. After a parse error the scanner
+// resumes at the next line that starts with a declaration keyword, so the
+// error it returns covers every problem in the file, up to maxScanErrors.
 func ScanFile(content string) ([]*Block, error) {
-	s := &scanner{content: content}
-	return s.scan()
+	s := &scanner{content: strings.TrimPrefix(content, utf8BOM)}
+	blocks, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.Kind == BlockPackage {
+			for _, other := range blocks {
+				other.Package = b.Name
+			}
+			break
+		}
+	}
+	return blocks, nil
 }
 
 type scanner struct {
 	content string
 	pos     int
+	// line counts the newlines before linePos, so lineAt only scans new text
+	line    int
+	linePos int
+}
+
+// lineAt returns the 1-based line number of pos, which must not be before
+// any position passed earlier.
+func (s *scanner) lineAt(pos int) int {
+	s.line += strings.Count(s.content[s.linePos:pos], "\n")
+	s.linePos = pos
+	return s.line + 1
+}
+
+// position returns the 1-based line and column of pos, counting columns
+// in characters. Like lineAt, pos must not be before earlier positions.
+func (s *scanner) position(pos int) (line, col int) {
+	line = s.lineAt(pos)
+	lineStart := strings.LastIndexByte(s.content[:pos], '\n') + 1
+	return line, utf8.RuneCountInString(s.content[lineStart:pos]) + 1
+}
+
+// scanError is a scanner error at a position in the content; msg
+// already names the position.
+type scanError struct {
+	Line, Column int
+	msg          string
+}
+
+func (e *scanError) Error() string {
+	return e.msg
 }
 
 func (s *scanner) atEnd() bool {
@@ -37,6 +106,7 @@ func (s *scanner) peekAt(offset int) byte {
 
 func (s *scanner) scan() ([]*Block, error) {
 	var blocks []*Block
+	var errs scanErrors
 
 	for !s.atEnd() {
 		// Collect leading whitespace and comments
@@ -56,16 +126,76 @@ func (s *scanner) scan() ([]*Block, error) {
 		// Read a declaration
 		block, err := s.readDeclaration()
 		if err != nil {
-			return nil, err
+			var se *scanError
+			if !errors.As(err, &se) {
+				return nil, err
+			}
+			if len(errs) == maxScanErrors {
+				errs = append(errs, &scanError{Line: se.Line, Column: se.Column, msg: "too many errors"})
+				break
+			}
+			errs = append(errs, se)
+			s.skipToNextDeclaration()
+			continue
 		}
 
 		block.Comments = comments
 		blocks = append(blocks, block)
 	}
 
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
 	return blocks, nil
 }
 
+// maxScanErrors is how many parse errors ScanFile collects before giving
+// up on a file, which may not be a proto file at all.
+const maxScanErrors = 10
+
+// skipToNextDeclaration moves past the rest of the current line and any
+// following lines that don't start with a declaration keyword, leaving pos
+// at the start of the next line that does, or at the end.
+func (s *scanner) skipToNextDeclaration() {
+	for {
+		s.skipToEndOfLine()
+		if s.atEnd() {
+			return
+		}
+		lineStart := s.pos
+		for s.peek() == ' ' || s.peek() == '\t' {
+			s.pos++
+		}
+		if s.matchKeyword() != "" {
+			s.pos = lineStart
+			return
+		}
+	}
+}
+
+// scanErrors are the parse errors of a file, in order. errors.As finds the
+// first.
+type scanErrors []*scanError
+
+func (e scanErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, se := range e {
+		msgs[i] = se.Error()
+	}
+	return fmt.Sprintf("%d errors:\n\t%s", len(e), strings.Join(msgs, "\n\t"))
+}
+
+func (e scanErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, se := range e {
+		errs[i] = se
+	}
+	return errs
+}
+
 // collectComments collects whitespace and comments until we reach a declaration keyword.
 func (s *scanner) collectComments() string {
 	var buf strings.Builder
@@ -132,14 +262,46 @@ func (s *scanner) readDeclaration() (*Block, error) {
 		if end > len(s.content) {
 			end = len(s.content)
 		}
-		return nil, fmt.Errorf("expected declaration keyword at position %d: %q", s.pos, s.content[s.pos:end])
+		// Don't cut a multi-byte character in half
+		for end > s.pos && end < len(s.content) && !utf8.RuneStart(s.content[end]) {
+			end--
+		}
+		line, col := s.position(s.pos)
+		return nil, &scanError{Line: line, Column: col, msg: fmt.Sprintf("expected declaration keyword at line %d, column %d: %q", line, col, s.content[s.pos:end])}
 	}
 
 	start := s.pos
-	var kind BlockKind
+	line := s.lineAt(start)
+	kind, err := s.readBody(keyword)
+	if err != nil {
+		return nil, err
+	}
+
+	declText := s.content[start:s.pos]
+	endLine := s.lineAt(s.pos - 1)
+
+	// Consume optional trailing inline comment on the closing line
+	trailing := s.consumeTrailingComment()
+	declText += trailing
+
+	name := extractDeclName(keyword, declText)
 
+	return &Block{
+		Kind:     kind,
+		Name:     name,
+		DeclText: declText,
+		Line:     line,
+		EndLine:  endLine,
+	}, nil
+}
+
+// readBody reads the rest of a declaration starting with keyword, up to
+// its closing ; or }, and returns its kind.
+func (s *scanner) readBody(keyword string) (BlockKind, error) {
+	var kind BlockKind
 	switch keyword {
-	case "syntax":
+	case "syntax", "edition":
+		// An edition statement takes the place of syntax in the header
 		kind = BlockSyntax
 		s.readUntilSemicolon()
 	case "package":
@@ -164,28 +326,32 @@ func (s *scanner) readDeclaration() (*Block, error) {
 		kind = BlockExtend
 		s.readBracedBlock()
 	default:
-		return nil, fmt.Errorf("unknown keyword %q at position %d", keyword, s.pos)
+		line, col := s.position(s.pos)
+		return 0, &scanError{Line: line, Column: col, msg: fmt.Sprintf("unknown keyword %q at line %d, column %d", keyword, line, col)}
 	}
+	return kind, nil
+}
 
-	declText := s.content[start:s.pos]
-
-	// Consume optional trailing inline comment on the closing line
-	trailing := s.consumeTrailingComment()
-	declText += trailing
-
-	name := extractDeclName(keyword, declText)
-
-	return &Block{
-		Kind:     kind,
-		Name:     name,
-		DeclText: declText,
-	}, nil
+// splitTrailingComment splits a Block's DeclText into the declaration and
+// the inline comment on its closing line, if any, as consumed by
+// readDeclaration. The comment keeps the whitespace before it and its
+// newline.
+func splitTrailingComment(declText string) (string, string) {
+	s := &scanner{content: declText}
+	keyword := s.matchKeyword()
+	if keyword == "" {
+		return declText, ""
+	}
+	if _, err := s.readBody(keyword); err != nil {
+		return declText, ""
+	}
+	return declText[:s.pos], declText[s.pos:]
 }
 
 // matchKeyword checks if the current position starts with a known keyword
 // followed by a non-identifier character.
 func (s *scanner) matchKeyword() string {
-	keywords := []string{"syntax", "package", "import", "option", "message", "enum", "service", "extend"}
+	keywords := []string{"syntax", "edition", "package", "import", "option", "message", "enum", "service", "extend"}
 	rest := s.content[s.pos:]
 	for _, kw := range keywords {
 		if strings.HasPrefix(rest, kw) && len(rest) > len(kw) && !isIdentChar(rest[len(kw)]) {
@@ -195,6 +361,33 @@ func (s *scanner) matchKeyword() string {
 	return ""
 }
 
+// tokens splits text into proto tokens: identifiers, which keep their dots
+// (pkg.Type), numbers, string literals with their quotes, and single
+// punctuation characters. Whitespace and comments are dropped.
+func tokens(text string) []string {
+	s := &scanner{content: text}
+	var toks []string
+	for {
+		s.collectComments()
+		if s.atEnd() {
+			return toks
+		}
+		start := s.pos
+		switch c := s.peek(); {
+		case c == '"' || c == '\'':
+			s.skipString(c)
+		case isIdentChar(c) || c == '.':
+			for !s.atEnd() && (isIdentChar(s.peek()) || s.peek() == '.') {
+				s.pos++
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(text[s.pos:])
+			s.pos += size
+		}
+		toks = append(toks, text[start:s.pos])
+	}
+}
+
 func isIdentChar(c byte) bool {
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
 }
@@ -283,20 +476,30 @@ func (s *scanner) readBracedBlock() {
 	}
 }
 
-func (s *scanner) skipString(quote byte) {
+// skipString skips a string literal opened by quote. Escapes are skipped
+// by their first two bytes, which covers \" and \\; the rest of a longer
+// one, such as \u007d or \175, is plain text that can't end the string or
+// open a brace. Strings can't span lines, so an unterminated one ends at the
+// newline rather than swallowing the rest of the file. skipString reports
+// whether the string was closed.
+func (s *scanner) skipString(quote byte) bool {
 	s.pos++ // skip opening quote
 	for !s.atEnd() {
 		c := s.peek()
-		if c == '\\' {
+		if c == '\\' && s.pos+1 < len(s.content) && s.content[s.pos+1] != '\n' {
 			s.pos += 2 // skip escape sequence
 			continue
 		}
+		if c == '\n' {
+			return false
+		}
 		if c == quote {
 			s.pos++
-			return
+			return true
 		}
 		s.pos++
 	}
+	return false
 }
 
 func (s *scanner) skipOneToken() {
@@ -351,9 +554,8 @@ func extractDeclName(keyword, text string) string {
 			rest = strings.TrimLeft(rest[idx:], " \t")
 		}
 		if len(rest) > 0 && (rest[0] == '"' || rest[0] == '\'') {
-			end := strings.IndexByte(rest[1:], rest[0])
-			if end >= 0 {
-				return rest[1 : end+1]
+			if s := (&scanner{content: rest}); s.skipString(rest[0]) {
+				return rest[1 : s.pos-1]
 			}
 		}
 		return rest
@@ -392,7 +594,7 @@ func extractDeclName(keyword, text string) string {
 	// For message, enum, service, extend: first identifier
 	var name strings.Builder
 	for _, c := range rest {
-		if isIdentChar(byte(c)) || c == '.' {
+		if (c < utf8.RuneSelf && isIdentChar(byte(c))) || c == '.' {
 			name.WriteRune(c)
 		} else {
 			break
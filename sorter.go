@@ -1,105 +1,35 @@
-package main
+package protosort
 
 import (
 	"fmt"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 )
 
-// Sort takes proto file content and returns the reordered content.
-func Sort(content string, opts Options) (string, []string, error) {
-	var warnings []string
-
-	// Check for proto2
-	if isProto2(content) {
-		return "", nil, &Proto2Error{}
-	}
-
-	blocks, err := ScanFile(content)
-	if err != nil {
-		return "", nil, &ParseError{Err: err}
-	}
-
-	if len(blocks) == 0 {
-		return content, nil, nil
-	}
-
-	// When preserving dividers, attach freestanding divider comments to the
-	// following declaration before any other processing.
-	if opts.PreserveDividers {
-		blocks = attachDividerComments(blocks)
-	}
-
-	// Process comments on all blocks
-	for _, b := range blocks {
-		// Strip section headers first (before divider stripping, since the
-		// banner lines would be caught by the divider regex and break the
-		// 3-line pattern match).
-		b.Comments = stripSectionHeaders(b.Comments)
-		processComments(b, opts)
-		// If not preserving dividers, strip section divider comments from block comments
-		if !opts.PreserveDividers {
-			b.Comments = stripDividerComments(b.Comments)
-		}
-	}
-
-	// Sort RPCs within services if requested (before extracting RPC info)
-	if opts.SortRPCs != "" {
-		for _, b := range blocks {
-			if b.Kind == BlockService {
-				b.DeclText = SortRPCsInService(b.DeclText, opts.SortRPCs)
-			}
-		}
-	}
-
-	// Populate RPC info on service blocks
-	for _, b := range blocks {
-		if b.Kind == BlockService {
-			b.RPCs = ExtractRPCs(b)
-		}
-	}
+// Sort takes proto file content and returns the reordered content. It runs
+// the stages of NewPipeline; use a Pipeline directly to add custom stages.
+func Sort(content string, opts Options) (string, []Warning, error) {
+	return NewPipeline().Run(content, opts)
+}
 
-	// Separate header blocks from body blocks
-	var headerComments string
-	var syntaxBlock, packageBlock *Block
-	var optionBlocks, importBlocks []*Block
-	var extendBlocks []*Block
+// Classify assigns each message, enum, and service in blocks to its output
+// section and returns them in output order. Other blocks are ignored. The
+// blocks' Section and Consumer fields are set in place.
+func Classify(blocks []*Block, opts Options) []*Block {
 	var bodyBlocks []*Block
-
 	for _, b := range blocks {
 		switch b.Kind {
-		case BlockSyntax:
-			headerComments = b.Comments
-			syntaxBlock = b
-		case BlockPackage:
-			packageBlock = b
-		case BlockOption:
-			optionBlocks = append(optionBlocks, b)
-		case BlockImport:
-			importBlocks = append(importBlocks, b)
-		case BlockExtend:
-			extendBlocks = append(extendBlocks, b)
-		case BlockMessage, BlockEnum:
+		case BlockMessage, BlockEnum, BlockService:
 			bodyBlocks = append(bodyBlocks, b)
-		case BlockService:
-			bodyBlocks = append(bodyBlocks, b)
-		case BlockComment:
-			// Freestanding comments between declarations are dropped
-			// (they become section dividers that don't survive reordering)
+		}
+		// Blocks straight from ScanFile have no RPC info yet
+		if b.Kind == BlockService && len(b.RPCs) == 0 {
+			b.RPCs = ExtractRPCs(b)
 		}
 	}
 
-	// Sort options alphabetically by name
-	sort.Slice(optionBlocks, func(i, j int) bool {
-		return optionBlocks[i].Name < optionBlocks[j].Name
-	})
-
-	// Sort imports alphabetically by path
-	sort.Slice(importBlocks, func(i, j int) bool {
-		return importBlocks[i].Name < importBlocks[j].Name
-	})
-
 	// Build reference counts and graph
 	refCounts := BuildRefCounts(bodyBlocks)
 	refGraph := BuildRefGraph(bodyBlocks)
@@ -148,6 +78,19 @@ func Sort(content string, opts Options) (string, []string, error) {
 		hasOutgoingRefs := len(outgoingRefs[b.Name]) > 0
 		incomingRefCount := refCounts[b.Name]
 
+		// A "// protosort:section=..." directive overrides the heuristics
+		if section, ok := sectionOverride(b); ok && section != SectionRequestResponse {
+			hasOutgoingRefs = section == SectionCore
+			if section == SectionHelper {
+				incomingRefCount = max(incomingRefCount, 1)
+			} else {
+				incomingRefCount = 0
+			}
+		} else if opts.CoreMinRefs > 0 {
+			// Only types with enough consumers graduate to core
+			hasOutgoingRefs = incomingRefCount >= opts.CoreMinRefs || (hasOutgoingRefs && incomingRefCount == 0)
+		}
+
 		if hasOutgoingRefs {
 			// Composite: references other local types
 			b.Section = SectionCore
@@ -171,15 +114,11 @@ func Sort(content string, opts Options) (string, []string, error) {
 	if opts.SharedOrder == "dependency" {
 		coreBlocks = topoSortBlocks(coreBlocks, bodyBlocks)
 	} else {
-		sort.Slice(coreBlocks, func(i, j int) bool {
-			return coreBlocks[i].Name < coreBlocks[j].Name
-		})
+		sort.Slice(coreBlocks, byKindAndName(coreBlocks, opts.KindOrder))
 	}
 
 	// Sort unreferenced types alphabetically
-	sort.Slice(unrefBlocks, func(i, j int) bool {
-		return unrefBlocks[i].Name < unrefBlocks[j].Name
-	})
+	sort.Slice(unrefBlocks, byKindAndName(unrefBlocks, opts.KindOrder))
 
 	// Build helper map: consumer -> [helpers]
 	helperMap := make(map[string][]*Block)
@@ -187,9 +126,7 @@ func Sort(content string, opts Options) (string, []string, error) {
 		helperMap[h.Consumer] = append(helperMap[h.Consumer], h)
 	}
 	for consumer := range helperMap {
-		sort.Slice(helperMap[consumer], func(i, j int) bool {
-			return helperMap[consumer][i].Name < helperMap[consumer][j].Name
-		})
+		sort.Slice(helperMap[consumer], byKindAndName(helperMap[consumer], opts.KindOrder))
 	}
 
 	// Build final ordered list
@@ -218,27 +155,37 @@ func Sort(content string, opts Options) (string, []string, error) {
 		*collected = append(*collected, b)
 	}
 
-	// Helper function to emit an RPC message and all its dependencies
-	var emitRPCWithDeps func(b *Block, rpcOwner string)
-	emitRPCWithDeps = func(b *Block, rpcOwner string) {
-		if emitted[b.Name] {
-			return
+	// Build map of message name -> RPC name for section headers
+	msgToRPC := buildMessageToRPCMap(serviceBlocks)
+
+	// Helper function to emit RPC messages (the primaries, in order) and
+	// all their dependencies, attributed to the first primary's RPC
+	emitRPCWithDeps := func(primaries ...*Block) {
+		rpcOwner := msgToRPC[primaries[0].Name]
+		if rpcOwner == "" {
+			rpcOwner = primaries[0].Name // fallback
 		}
 
 		// Collect all dependencies in dependency order
 		var collected []*Block
-		seen := make(map[string]bool)
-		collectRPCDeps(b, &collected, seen)
+		for _, b := range primaries {
+			collectRPCDeps(b, &collected, make(map[string]bool))
+		}
 
-		// Emit the primary RPC message first
-		b.Section = SectionRequestResponse
-		b.Consumer = rpcOwner
-		emitted[b.Name] = true
-		ordered = append(ordered, b)
+		// Emit the primary RPC messages first
+		for _, b := range primaries {
+			b.Section = SectionRequestResponse
+			b.Consumer = rpcOwner
+			if rpc := msgToRPC[b.Name]; rpc != "" {
+				b.Consumer = rpc
+			}
+			emitted[b.Name] = true
+			ordered = append(ordered, b)
+		}
 
 		// Then emit dependencies in the order they were collected (dependencies before dependents)
 		for _, dep := range collected {
-			if !emitted[dep.Name] && dep.Name != b.Name {
+			if !emitted[dep.Name] {
 				dep.Section = SectionRequestResponse
 				dep.Consumer = rpcOwner
 				emitted[dep.Name] = true
@@ -252,31 +199,55 @@ func Sort(content string, opts Options) (string, []string, error) {
 		if emitted[b.Name] {
 			return
 		}
-		// Emit helpers for this block first
+		// Emit single-consumer helpers for this block first
 		if helpers, ok := helperMap[b.Name]; ok {
 			for _, h := range helpers {
-				emitWithHelpers(h)
+				if refCounts[h.Name] == 1 {
+					emitWithHelpers(h)
+				}
 			}
 		}
 		emitted[b.Name] = true
 		ordered = append(ordered, b)
 	}
 
-	// Build map of message name -> RPC name for section headers
-	msgToRPC := buildMessageToRPCMap(serviceBlocks)
+	emitRPCMessage := func(msg *Block) {
+		if emitted[msg.Name] {
+			return
+		}
+		// With PairStrict, a request's response follows it directly, even
+		// if an RPC names it by qualified name or it is shared
+		if resp := pairedResponse(msg, bodyBlockMap); opts.PairStrict && resp != nil && !emitted[resp.Name] {
+			emitRPCWithDeps(msg, resp)
+			return
+		}
+		emitRPCWithDeps(msg)
+	}
 
-	// Section 2: Services and request/response pairs
+	// Section 2: Services and request/response pairs. With GroupByService,
+	// each service is followed by the RPC types it uses first.
+	if opts.GroupByService && len(serviceBlocks) > 1 {
+		msgToService := buildMessageToServiceMap(serviceBlocks)
+		for _, svc := range serviceBlocks {
+			svc.Section = SectionService
+			emitted[svc.Name] = true
+			ordered = append(ordered, svc)
+			for _, msg := range rpcMessages {
+				if msgToService[msg.Name] == svc.Name {
+					emitRPCMessage(msg)
+				}
+			}
+		}
+	}
 	for _, svc := range serviceBlocks {
-		svc.Section = SectionService
-		emitted[svc.Name] = true
-		ordered = append(ordered, svc)
+		if !emitted[svc.Name] {
+			svc.Section = SectionService
+			emitted[svc.Name] = true
+			ordered = append(ordered, svc)
+		}
 	}
 	for _, msg := range rpcMessages {
-		rpcName := msgToRPC[msg.Name]
-		if rpcName == "" {
-			rpcName = msg.Name // fallback
-		}
-		emitRPCWithDeps(msg, rpcName)
+		emitRPCMessage(msg)
 	}
 
 	// Section 3: Standalone types (unreferenced) - emit without inline helpers
@@ -287,18 +258,19 @@ func Sort(content string, opts Options) (string, []string, error) {
 		}
 	}
 
-	// Section 4: Composite types (core) - emit without inline helpers
+	// Section 4: Composite types (core) - with --inline-helpers, each is
+	// preceded by the helpers that only it uses
 	for _, core := range coreBlocks {
-		if !emitted[core.Name] {
+		if opts.InlineHelpers {
+			emitWithHelpers(core)
+		} else if !emitted[core.Name] {
 			emitted[core.Name] = true
 			ordered = append(ordered, core)
 		}
 	}
 
 	// Section 5: All helper types (sorted alphabetically for deterministic output)
-	sort.Slice(helperBlocks, func(i, j int) bool {
-		return helperBlocks[i].Name < helperBlocks[j].Name
-	})
+	sort.Slice(helperBlocks, byKindAndName(helperBlocks, opts.KindOrder))
 	for _, h := range helperBlocks {
 		if !emitted[h.Name] {
 			emitted[h.Name] = true
@@ -306,20 +278,32 @@ func Sort(content string, opts Options) (string, []string, error) {
 		}
 	}
 
-	// Inject classification annotations if requested
-	if opts.Annotate {
-		annotateBlocks(ordered, refGraph)
-	}
-
-	// Inject section headers if requested (stripping was done earlier)
-	if opts.SectionHeaders {
-		injectSectionHeaders(ordered, serviceBlocks)
+	// --like: follow the template's order wherever it names a declaration
+	if len(opts.LikeOrder) > 0 {
+		ordered = orderLike(ordered, opts.LikeOrder)
 	}
 
-	// Build the output
-	output := Emit(headerComments, syntaxBlock, packageBlock, optionBlocks, importBlocks, extendBlocks, ordered)
+	return ordered
+}
 
-	return output, warnings, nil
+// byKindAndName returns a sort.Slice less function ordering blocks by name,
+// after putting enums or messages first as kindOrder (Options.KindOrder)
+// asks.
+func byKindAndName(blocks []*Block, kindOrder string) func(i, j int) bool {
+	rank := func(b *Block) int {
+		switch {
+		case kindOrder == "enums-first" && b.Kind != BlockEnum,
+			kindOrder == "messages-first" && b.Kind != BlockMessage:
+			return 1
+		}
+		return 0
+	}
+	return func(i, j int) bool {
+		if ri, rj := rank(blocks[i]), rank(blocks[j]); ri != rj {
+			return ri < rj
+		}
+		return blocks[i].Name < blocks[j].Name
+	}
 }
 
 // topoSortBlocks orders core blocks so that referenced types appear before
@@ -456,6 +440,11 @@ func classifyServiceAndRPC(blocks []*Block) (services []*Block, rpcMessages []*B
 		if !ok {
 			return
 		}
+		// A type moved out of the RPC section by a directive takes the
+		// types that only it references along
+		if section, ok := sectionOverride(b); ok && section != SectionRequestResponse {
+			return
+		}
 		rpcRelatedNames[typeName] = true
 
 		// Recursively collect types this one references
@@ -471,6 +460,9 @@ func classifyServiceAndRPC(blocks []*Block) (services []*Block, rpcMessages []*B
 			for _, typeName := range []string{rpc.RequestType, rpc.ResponseType} {
 				if b, ok := blockMap[typeName]; ok && !emitted[typeName] {
 					emitted[typeName] = true
+					if section, ok := sectionOverride(b); ok && section != SectionRequestResponse {
+						continue
+					}
 					rpcMsgs = append(rpcMsgs, b)
 					collectTransitiveRefs(typeName)
 				}
@@ -478,6 +470,15 @@ func classifyServiceAndRPC(blocks []*Block) (services []*Block, rpcMessages []*B
 		}
 	}
 
+	// Types a directive puts in the RPC section that no RPC reaches, e.g.
+	// because RPCs name them by qualified name, follow the others
+	for _, b := range blocks {
+		if section, ok := sectionOverride(b); ok && section == SectionRequestResponse && !rpcRelatedNames[b.Name] {
+			rpcMsgs = append(rpcMsgs, b)
+			collectTransitiveRefs(b.Name)
+		}
+	}
+
 	// Remaining blocks: everything not a service and not RPC-related
 	var rest []*Block
 	for _, b := range blocks {
@@ -489,20 +490,48 @@ func classifyServiceAndRPC(blocks []*Block) (services []*Block, rpcMessages []*B
 	return svcBlocks, rpcMsgs, rest, rpcRelatedNames
 }
 
-// processComments applies --strip-commented-code to block comments.
-func processComments(b *Block, opts Options) {
+// processComments applies --strip-commented-code to block comments. A nil
+// classifier means the option is off.
+func processComments(b *Block, classifier *commentClassifier) {
 	if b.Comments == "" {
 		return
 	}
-	if opts.StripCommented {
-		b.Comments = stripCommentedCode(b.Comments)
+	if classifier != nil {
+		b.Comments = stripCommentedCode(b.Comments, classifier)
 	}
 }
 
+// commentClassifier extends codeLineRe with Options.CodePatterns and
+// Options.ProsePatterns, matched against the comment text after "//".
+type commentClassifier struct {
+	code  []*regexp.Regexp // lines that also count as code
+	prose []*regexp.Regexp // lines that keep their whole block as prose
+}
+
+// newCommentClassifier compiles the configured comment patterns.
+func newCommentClassifier(opts Options) (*commentClassifier, error) {
+	c := &commentClassifier{}
+	for _, p := range opts.CodePatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid code pattern %q: %w", p, err)
+		}
+		c.code = append(c.code, re)
+	}
+	for _, p := range opts.ProsePatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prose pattern %q: %w", p, err)
+		}
+		c.prose = append(c.prose, re)
+	}
+	return c, nil
+}
+
 // stripCommentedCode removes comment blocks that consist entirely of commented-out
 // protobuf declarations (e.g., "// rpc Foo(...)" or "// message Bar {}") with no other prose.
 // Comment blocks separated by blank lines are evaluated independently.
-func stripCommentedCode(comments string) string {
+func stripCommentedCode(comments string, classifier *commentClassifier) string {
 	lines := strings.Split(comments, "\n")
 	var result []string
 
@@ -524,7 +553,7 @@ func stripCommentedCode(comments string) string {
 		}
 		block := lines[blockStart:i]
 
-		if isCommentedOutCode(block) {
+		if isCommentedOutCode(block, classifier) {
 			// Drop this block
 			continue
 		}
@@ -539,8 +568,9 @@ func stripCommentedCode(comments string) string {
 var codeLineRe = regexp.MustCompile(`^\s*//\s*(` +
 	`(message|enum|service|extend)\s+\w+` + // message Foo, enum Bar
 	`|rpc\s+\w+\s*\(` + // rpc Method(
-	`|(import|option|package|syntax)\s+` + // import "...", option ...
-	`|(repeated|optional)\s+\w+\s+\w+\s*=` + // repeated Foo bar = N
+	`|(import|option|package|syntax|edition)\s+` + // import "...", option ...
+	`|(repeated|optional|required)\s+\w+\s+\w+\s*=` + // repeated Foo bar = N
+	`|extensions\s+\d+` + // extensions 100 to max (proto2)
 	`|\w+\s+\w+\s*=\s*\d+` + // Foo bar = 1 (field declaration)
 	`|[{}();]` + // braces, parens, semicolons alone
 	`|returns\s*\(` + // returns (
@@ -548,7 +578,7 @@ var codeLineRe = regexp.MustCompile(`^\s*//\s*(` +
 
 // isCommentedOutCode checks if every line in a comment block looks like
 // commented-out proto code rather than prose.
-func isCommentedOutCode(lines []string) bool {
+func isCommentedOutCode(lines []string, classifier *commentClassifier) bool {
 	if len(lines) == 0 {
 		return false
 	}
@@ -558,13 +588,26 @@ func isCommentedOutCode(lines []string) bool {
 		if trimmed == "//" {
 			continue // empty comment line is neutral
 		}
-		if !codeLineRe.MatchString(line) {
+		text := strings.TrimSpace(strings.TrimPrefix(trimmed, "//"))
+		if matchesAny(classifier.prose, text) {
+			return false // protected as prose by config
+		}
+		if !codeLineRe.MatchString(line) && !matchesAny(classifier.code, text) {
 			return false // this line looks like prose
 		}
 	}
 	return true
 }
 
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
 // Pre-compiled regexes for section divider detection.
 var (
 	dividerBothSidesRe = regexp.MustCompile(`^//\s*[=\-*#]{3,}\s*(\w+\s*){0,3}[=\-*#]{3,}\s*$`)
@@ -579,15 +622,43 @@ func isSectionDivider(comment string) bool {
 	return dividerBothSidesRe.MatchString(trimmed) || dividerOneSideRe.MatchString(trimmed)
 }
 
+// dividerMatcher recognizes section divider lines: the built-in ones of
+// isSectionDivider and those matching Options.DividerPatterns.
+type dividerMatcher struct {
+	extra []*regexp.Regexp
+}
+
+// newDividerMatcher compiles the configured divider patterns.
+func newDividerMatcher(opts Options) (*dividerMatcher, error) {
+	d := &dividerMatcher{}
+	for _, p := range opts.DividerPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid divider pattern %q: %w", p, err)
+		}
+		d.extra = append(d.extra, re)
+	}
+	return d, nil
+}
+
+// match reports whether line is a section divider.
+func (d *dividerMatcher) match(line string) bool {
+	if isSectionDivider(line) {
+		return true
+	}
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, "//") && matchesAny(d.extra, trimmed)
+}
+
 // stripDividerComments removes lines that look like section dividers from a comment block.
-func stripDividerComments(comments string) string {
+func stripDividerComments(comments string, dividers *dividerMatcher) string {
 	if comments == "" {
 		return ""
 	}
 	lines := strings.Split(comments, "\n")
 	var result []string
 	for _, line := range lines {
-		if !isSectionDivider(line) {
+		if !dividers.match(line) {
 			result = append(result, line)
 		}
 	}
@@ -655,12 +726,12 @@ func stripAnnotations(comments string) string {
 // section divider patterns and prepends their text to the following declaration's
 // Comments field. This ensures divider comments travel with the next declaration
 // when --preserve-dividers is used.
-func attachDividerComments(blocks []*Block) []*Block {
+func attachDividerComments(blocks []*Block, dividers *dividerMatcher) []*Block {
 	var result []*Block
 	var pending string
 
 	for _, b := range blocks {
-		if b.Kind == BlockComment && containsDivider(b.Comments) {
+		if b.Kind == BlockComment && containsDivider(b.Comments, dividers) {
 			// Accumulate divider comment text to prepend to next declaration
 			if pending != "" {
 				pending += "\n"
@@ -693,42 +764,49 @@ func attachDividerComments(blocks []*Block) []*Block {
 }
 
 // containsDivider checks if a comment block contains any section divider lines.
-func containsDivider(comments string) bool {
+func containsDivider(comments string, dividers *dividerMatcher) bool {
 	for _, line := range strings.Split(comments, "\n") {
-		if isSectionDivider(line) {
+		if dividers.match(line) {
 			return true
 		}
 	}
 	return false
 }
 
-// sectionHeaderBanner is the repeated line used in section headers.
-const sectionHeaderBanner = "// ============================================================================"
+// HasSectionDividers reports whether any comment line in content looks
+// like a hand-written section divider, such as "// === Messages ===".
+// Sorting drops dividers unless Options.PreserveDividers is set. The
+// headers Options.SectionHeaders inserts don't count; see
+// HasSectionHeaders.
+func HasSectionDividers(content string) bool {
+	for line := range strings.Lines(sectionHeaderRe.ReplaceAllString(content, "")) {
+		if strings.HasPrefix(strings.TrimSpace(line), "//") && isSectionDivider(line) {
+			return true
+		}
+	}
+	return false
+}
 
-// sectionHeaderComment returns a 3-line section header comment block for the given label.
-// Includes a trailing blank line to prevent protoc from treating it as a leading comment.
-func sectionHeaderComment(label string) string {
-	return sectionHeaderBanner + "\n// " + label + "\n" + sectionHeaderBanner + "\n\n"
+// HasSectionHeaders reports whether content has a section header comment
+// as inserted by Options.SectionHeaders.
+func HasSectionHeaders(content string) bool {
+	return sectionHeaderRe.MatchString(content)
 }
 
+// sectionHeaderBanner is the repeated line used in section headers.
+const sectionHeaderBanner = "// ============================================================================"
+
 // sectionHeaderRe matches the exact 3-line section header blocks that
 // injectSectionHeaders produces. It only strips headers with known labels
 // so that human-written decorative banners are never removed.
 // The \n? at the end optionally matches the trailing blank line.
 var sectionHeaderRe = regexp.MustCompile(
-	`(?m)^` + regexp.QuoteMeta(sectionHeaderBanner) + `\n// (?:Services|Types for \w+|Shared Types|Core Types|Unreferenced Types|Composite Types(?: (?:\([^)]+\)|--[^\n]+))?|Helper Types(?: (?:\([^)]+\)|--[^\n]+))?|Standalone Types(?: (?:\([^)]+\)|--[^\n]+))?|Types unused by RPCs)\n` + regexp.QuoteMeta(sectionHeaderBanner) + `\n\n?`)
+	`(?m)^` + regexp.QuoteMeta(sectionHeaderBanner) + `\n// (?:Services|Service \w+|Types for \w+|Shared Types|Core Types|Unreferenced Types|Composite Types(?: (?:\([^)]+\)|--[^\n]+))?|Helper Types(?: (?:\([^)]+\)|--[^\n]+))?|Standalone Types(?: (?:\([^)]+\)|--[^\n]+))?|Types unused by RPCs|Custom Options)(?: \(\d+\))?\n` + regexp.QuoteMeta(sectionHeaderBanner) + `\n\n?`)
 
 // Note: Old section names (Services, Shared Types, Core Types, Unreferenced Types) are kept
 // in the strip regex so that headers from older runs are cleaned up.
-// The pattern matches optional descriptions in both parentheses or double-dash format.
-
-// stripSectionHeaders removes injected section header blocks from a comment string.
-func stripSectionHeaders(comments string) string {
-	if comments == "" {
-		return ""
-	}
-	return sectionHeaderRe.ReplaceAllString(comments, "")
-}
+// The pattern matches optional descriptions in both parentheses or double-dash format,
+// followed by the optional declaration count added by --section-stats.
 
 // buildMessageToRPCMap builds a map from message name → RPC name using
 // service blocks' RPCs. When a message is used by multiple RPCs, the first
@@ -747,13 +825,192 @@ func buildMessageToRPCMap(serviceBlocks []*Block) map[string]string {
 	return m
 }
 
+// buildMessageToServiceMap builds a map from message name → the name of
+// the first service with an RPC using it.
+func buildMessageToServiceMap(serviceBlocks []*Block) map[string]string {
+	m := make(map[string]string)
+	for _, svc := range serviceBlocks {
+		for _, rpc := range svc.RPCs {
+			for _, typeName := range []string{rpc.RequestType, rpc.ResponseType} {
+				if _, exists := m[typeName]; !exists {
+					m[typeName] = svc.Name
+				}
+			}
+		}
+	}
+	return m
+}
+
+// pairedResponse returns the XxxResponse message in blockMap for the
+// XxxRequest message req, or nil if there is none or a directive keeps it
+// out of the request/response section.
+func pairedResponse(req *Block, blockMap map[string]*Block) *Block {
+	base, ok := strings.CutSuffix(req.Name, "Request")
+	if !ok || req.Kind != BlockMessage {
+		return nil
+	}
+	resp, ok := blockMap[base+"Response"]
+	if !ok || resp.Kind != BlockMessage {
+		return nil
+	}
+	if section, ok := sectionOverride(resp); ok && section != SectionRequestResponse {
+		return nil
+	}
+	return resp
+}
+
+// unpairedRequests warns about each XxxRequest in the request/response
+// section of body that isn't directly followed by its XxxResponse, as
+// happens when an earlier RPC shares the response or the response is
+// pinned elsewhere.
+func unpairedRequests(body []*Block) []Warning {
+	blockMap := make(map[string]*Block)
+	for _, b := range body {
+		blockMap[b.Name] = b
+	}
+	var warnings []Warning
+	for i, b := range body {
+		if b.Section != SectionRequestResponse {
+			continue
+		}
+		resp := pairedResponse(b, blockMap)
+		if resp == nil || (i+1 < len(body) && body[i+1] == resp) {
+			continue
+		}
+		warnings = append(warnings, Warning{Code: WarningUnpairedRequest, Message: fmt.Sprintf("message %s can't be followed directly by %s", b.Name, resp.Name), Line: b.Line})
+	}
+	return warnings
+}
+
+// HelperChain follows the consumers of the helper type name through blocks,
+// as classified by Classify: it returns name, its consumer, that consumer's
+// consumer while it is a helper too, and so on up to the first type that
+// isn't a helper. cycle reports a chain that comes back to a helper already
+// on it; the chain then ends with the repeated name, e.g. [A B A].
+func HelperChain(blocks []*Block, name string) (chain []string, cycle bool) {
+	blockMap := make(map[string]*Block)
+	for _, b := range blocks {
+		blockMap[b.Name] = b
+	}
+	return helperChain(blockMap, name)
+}
+
+func helperChain(blockMap map[string]*Block, name string) ([]string, bool) {
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for {
+		b, ok := blockMap[name]
+		if !ok || b.Section != SectionHelper || b.Consumer == "" {
+			return chain, false
+		}
+		name = b.Consumer
+		chain = append(chain, name)
+		if seen[name] {
+			return chain, true
+		}
+		seen[name] = true
+	}
+}
+
 // injectSectionHeaders walks the ordered block list and prepends section
-// header comments when the section or RPC owner changes.
-func injectSectionHeaders(ordered []*Block, serviceBlocks []*Block) {
+// header comments when the section or RPC owner changes. With stats, each
+// label ends with the number of declarations under it, e.g. "Helper Types
+// -- used in other types (4)", unless its template places the count.
+// Helpers whose consumers form a cycle have no consumer to be placed with,
+// so they stay under the shared helper header and are reported, once per
+// cycle. With byService, each of several services gets a header too.
+func injectSectionHeaders(ordered []*Block, serviceBlocks []*Block, stats, byService bool, style *sectionHeaderStyle) []Warning {
 	if len(ordered) == 0 {
-		return
+		return nil
 	}
 
+	hasServices := len(serviceBlocks) > 0
+	var msgToRPC map[string]string
+	if hasServices {
+		msgToRPC = buildMessageToRPCMap(serviceBlocks)
+	}
+	sections, warnings := displaySections(ordered, serviceBlocks)
+
+	emittedSections := make(map[Section]bool)
+	emittedRPCs := make(map[string]bool)
+	// The HeaderStyle field of the label each header gets, and its data
+	labels := make([]string, len(ordered))
+	data := make([]headerLabel, len(ordered))
+
+	for i, b := range ordered {
+		section := sections[i]
+		var label string
+
+		switch section {
+		case SectionService:
+			// No header — "service Foo" is self-evident — unless the
+			// services are apart, each followed by its RPC types
+			if byService && len(serviceBlocks) > 1 {
+				label = "Service"
+				data[i].Service = b.Name
+			}
+		case SectionRequestResponse:
+			rpcName := msgToRPC[b.Name]
+			// Only inject header on direct RPC request/response messages, not dependencies
+			if rpcName != "" && !emittedRPCs[rpcName] {
+				label = "RPC"
+				data[i].RPC = rpcName
+				emittedRPCs[rpcName] = true
+			}
+		case SectionCore:
+			if !emittedSections[SectionCore] {
+				label = "Composite"
+			}
+		case SectionHelper:
+			if !emittedSections[SectionHelper] {
+				label = "Helper"
+			}
+		case SectionUnreferenced:
+			if !emittedSections[SectionUnreferenced] {
+				if hasServices {
+					label = "Unused"
+				} else {
+					label = "Standalone"
+				}
+			}
+		}
+		emittedSections[section] = true
+		labels[i] = label
+	}
+
+	for i, name := range labels {
+		if name == "" {
+			continue
+		}
+		// A header covers every declaration up to the next one
+		count := 1
+		for count < len(labels)-i && labels[i+count] == "" {
+			count++
+		}
+		data[i].Count = count
+		label := style.label(name, data[i])
+		if stats && !style.counted[name] {
+			label += fmt.Sprintf(" (%d)", count)
+		}
+
+		// Trim leading blank lines from existing comments to avoid
+		// double blank lines between the header and the comment.
+		b := ordered[i]
+		c := b.Comments
+		for strings.HasPrefix(c, "\n") {
+			c = c[1:]
+		}
+		b.Comments = style.comment(label) + c
+	}
+	return warnings
+}
+
+// displaySections returns the section each block of ordered is shown in,
+// which for a helper may be that of its consumer: a helper inlined above its
+// consumer, used by a request or response, or leading only to standalone
+// types goes with them. It warns about helpers that consume each other in a
+// cycle.
+func displaySections(ordered []*Block, serviceBlocks []*Block) ([]Section, []Warning) {
 	hasServices := len(serviceBlocks) > 0
 	var msgToRPC map[string]string
 	if hasServices {
@@ -767,24 +1024,43 @@ func injectSectionHeaders(ordered []*Block, serviceBlocks []*Block) {
 		blockMap[b.Name] = b
 	}
 
-	// Find the ultimate consumer (root of the helper chain)
-	var findUltimateConsumer func(string) string
-	findUltimateConsumer = func(name string) string {
-		if b, ok := blockMap[name]; ok && b.Section == SectionHelper {
-			return findUltimateConsumer(b.Consumer)
+	// Find the ultimate consumer (root of the helper chain), or "" for a
+	// chain that cycles
+	var warnings []Warning
+	reported := make(map[string]bool)
+	findUltimateConsumer := func(name string) string {
+		chain, cycle := helperChain(blockMap, name)
+		if !cycle {
+			return chain[len(chain)-1]
+		}
+		// The same cycle is reached from each of its members, and from
+		// helpers leading into it
+		loop := chain[slices.Index(chain, chain[len(chain)-1]):]
+		key := slices.Min(loop[:len(loop)-1])
+		if !reported[key] {
+			reported[key] = true
+			warnings = append(warnings, Warning{Code: WarningHelperCycle, Message: fmt.Sprintf("helper types %s consume each other in a cycle; kept with the shared helpers", strings.Join(loop, " -> "))})
 		}
-		return name
+		return ""
 	}
 
-	emittedSections := make(map[Section]bool)
-	emittedRPCs := make(map[string]bool)
+	// Position of each block, used to detect helpers inlined before their consumer
+	position := make(map[string]int)
+	for i, b := range ordered {
+		position[b.Name] = i
+	}
 
-	for _, b := range ordered {
+	sections := make([]Section, len(ordered))
+	for i, b := range ordered {
 		section := b.Section
 
 		// Reclassify helpers based on their ultimate consumer
 		if section == SectionHelper {
-			if hasServices {
+			ultimateBlock, ok := blockMap[findUltimateConsumer(b.Name)]
+			if ok && ultimateBlock.Section != SectionHelper && position[ultimateBlock.Name] > i {
+				// Inlined helper (--inline-helpers): belongs to its consumer's section
+				section = ultimateBlock.Section
+			} else if hasServices {
 				// Service files: if primary consumer is RPC message, keep in RPC section
 				if b.Consumer != "" {
 					if _, isRPC := msgToRPC[b.Consumer]; isRPC {
@@ -802,54 +1078,43 @@ func injectSectionHeaders(ordered []*Block, serviceBlocks []*Block) {
 				// Otherwise keep as SectionHelper for its own section
 			}
 		}
+		sections[i] = section
+	}
+	return sections, warnings
+}
 
-		var header string
-
-		switch section {
-		case SectionService:
-			// No header — "service Foo" is self-evident
-		case SectionRequestResponse:
-			rpcName := msgToRPC[b.Name]
-			// Only inject header on direct RPC request/response messages, not dependencies
-			if rpcName != "" && !emittedRPCs[rpcName] {
-				header = sectionHeaderComment("Types for " + rpcName)
-				emittedRPCs[rpcName] = true
-			}
-		case SectionCore:
-			if !emittedSections[SectionCore] {
-				header = sectionHeaderComment("Composite Types -- using other types")
-			}
-		case SectionHelper:
-			if !emittedSections[SectionHelper] {
-				header = sectionHeaderComment("Helper Types -- used in other types")
-			}
-		case SectionUnreferenced:
-			if !emittedSections[SectionUnreferenced] {
-				if hasServices {
-					header = sectionHeaderComment("Types unused by RPCs")
-				} else {
-					header = sectionHeaderComment("Standalone Types -- not referenced elsewhere in this file")
-				}
-			}
-		}
-		emittedSections[section] = true
-
-		if header != "" {
-			// Trim leading blank lines from existing comments to avoid
-			// double blank lines between the header and the comment.
-			c := b.Comments
-			for strings.HasPrefix(c, "\n") {
-				c = c[1:]
-			}
-			b.Comments = header + c
+// unsupportedStructure describes header structure that Emit can't reproduce,
+// or returns "" if the file fits the single-header model.
+func unsupportedStructure(blocks []*Block) string {
+	var packages []string
+	syntaxCount := 0
+	for _, b := range blocks {
+		switch b.Kind {
+		case BlockSyntax:
+			syntaxCount++
+		case BlockPackage:
+			packages = append(packages, b.Name)
 		}
 	}
+	if len(packages) > 1 {
+		return fmt.Sprintf("multiple package statements (%s)", strings.Join(packages, ", "))
+	}
+	if syntaxCount > 1 {
+		return fmt.Sprintf("%d syntax or edition statements", syntaxCount)
+	}
+	return ""
+}
+
+// isFeatureOption reports whether an option name sets an editions feature,
+// e.g. features.field_presence or features.(pb.go).legacy_unmarshal_json_enum.
+func isFeatureOption(name string) bool {
+	return strings.HasPrefix(name, "features.")
 }
 
 // isProto2 checks if the file content declares proto2 syntax.
 func isProto2(content string) bool {
 	// Look for syntax = "proto2"
-	lines := strings.Split(content, "\n")
+	lines := strings.Split(strings.TrimPrefix(content, utf8BOM), "\n")
 	for _, line := range lines {
 		trimmed := strings.TrimSpace(line)
 		if strings.HasPrefix(trimmed, "syntax") {
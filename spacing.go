@@ -0,0 +1,53 @@
+package protosort
+
+import "strings"
+
+// inputGap is the spacing above a block in the input.
+type inputGap struct {
+	prev       *Block // the block right above it
+	blankLines int
+}
+
+// inputSpacing records, for each block after the first, the block above it
+// in the input and the number of blank lines between them. It must run on
+// blocks straight from ScanFile, before their comments are rewritten.
+func inputSpacing(blocks []*Block) map[*Block]inputGap {
+	gaps := make(map[*Block]inputGap)
+	for i := 1; i < len(blocks); i++ {
+		prev, b := blocks[i-1], blocks[i]
+		lead := b.Comments[:len(b.Comments)-len(strings.TrimLeft(b.Comments, " \t\r\n"))]
+		n := strings.Count(lead, "\n")
+		// The first newline ends the line prev's declaration is on, unless
+		// a trailing comment already took it
+		if !strings.HasSuffix(prev.DeclText, "\n") {
+			n--
+		}
+		gaps[b] = inputGap{prev: prev, blankLines: max(n, 0)}
+	}
+	return gaps
+}
+
+// blankLines returns the function emit uses for the number of blank lines
+// between two adjacent body blocks. With Options.PreserveSpacing, blocks
+// that were adjacent in the input keep the blank lines they had; others get
+// BlankLinesBetweenSections or BlankLinesWithinSection, as their display
+// sections differ or not.
+func (f *File) blankLines() func(prev, b *Block) int {
+	between, within := max(f.Opts.BlankLinesBetweenSections, 1), max(f.Opts.BlankLinesWithinSection, 1)
+	section := make(map[*Block]Section)
+	if between != within {
+		sections, _ := displaySections(f.Body, f.Services)
+		for i, b := range f.Body {
+			section[b] = sections[i]
+		}
+	}
+	return func(prev, b *Block) int {
+		if g, ok := f.spacing[b]; ok && g.prev == prev {
+			return g.blankLines
+		}
+		if section[prev] != section[b] {
+			return between
+		}
+		return within
+	}
+}
@@ -0,0 +1,56 @@
+package protosort
+
+import (
+	"regexp"
+	"strings"
+)
+
+// tocLabel is the title line of the table-of-contents comment.
+const tocLabel = "// Contents"
+
+// tocRe matches the table-of-contents block that injectTOC produces: the
+// banner, the title, any number of indented entry lines, and the closing
+// banner. Entries always start with three spaces after "//", so a
+// human-written "Contents" banner with ordinary text is left alone.
+var tocRe = regexp.MustCompile(
+	`(?m)^` + regexp.QuoteMeta(sectionHeaderBanner) + `\n` + regexp.QuoteMeta(tocLabel) + `\n(?://   [^\n]*\n)*` + regexp.QuoteMeta(sectionHeaderBanner) + `\n\n?`)
+
+// stripTOC removes an injected table of contents from a comment string.
+func stripTOC(comments string) string {
+	if comments == "" {
+		return ""
+	}
+	return tocRe.ReplaceAllString(comments, "")
+}
+
+// tocComment returns the table of contents for the ordered body blocks:
+// each service with its RPCs, then every top-level type with its section.
+// Like a section header, it ends with a blank line so protoc keeps it
+// detached from the declaration below.
+func tocComment(ordered []*Block) string {
+	var sb strings.Builder
+	sb.WriteString(sectionHeaderBanner + "\n" + tocLabel + "\n")
+	for _, b := range ordered {
+		switch b.Kind {
+		case BlockService:
+			sb.WriteString("//   service " + b.Name + "\n")
+			for _, rpc := range b.RPCs {
+				sb.WriteString("//     rpc " + rpc.Name + "\n")
+			}
+		case BlockMessage, BlockEnum:
+			sb.WriteString("//   " + b.Kind.String() + " " + b.Name + " (" + b.Section.String() + ")\n")
+		}
+	}
+	sb.WriteString(sectionHeaderBanner + "\n\n")
+	return sb.String()
+}
+
+// injectTOC prepends the table of contents to the first body block, so it
+// sits between the file header and the first declaration.
+func injectTOC(ordered []*Block) {
+	if len(ordered) == 0 {
+		return
+	}
+	first := ordered[0]
+	first.Comments = tocComment(ordered) + strings.TrimLeft(first.Comments, "\n")
+}
@@ -0,0 +1,104 @@
+package protosort
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// verbatimMarkers are the compiled Options.VerbatimBegin and VerbatimEnd.
+type verbatimMarkers struct {
+	begin, end *regexp.Regexp
+}
+
+// newVerbatimMarkers compiles the verbatim region markers of opts, or
+// returns nil if they aren't set.
+func newVerbatimMarkers(opts Options) (*verbatimMarkers, error) {
+	if opts.VerbatimBegin == "" && opts.VerbatimEnd == "" {
+		return nil, nil
+	}
+	if opts.VerbatimBegin == "" || opts.VerbatimEnd == "" {
+		return nil, fmt.Errorf("verbatim regions need both a begin and an end pattern")
+	}
+	begin, err := regexp.Compile(opts.VerbatimBegin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verbatim begin pattern %q: %w", opts.VerbatimBegin, err)
+	}
+	end, err := regexp.Compile(opts.VerbatimEnd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verbatim end pattern %q: %w", opts.VerbatimEnd, err)
+	}
+	return &verbatimMarkers{begin, end}, nil
+}
+
+// markerLine returns the byte offset just past the first comment line of
+// comments that re matches (without its newline), or -1.
+func markerLine(comments string, re *regexp.Regexp) int {
+	pos := 0
+	for line := range strings.Lines(comments) {
+		text, ok := strings.CutPrefix(strings.TrimSpace(line), "//")
+		if ok && re.MatchString(strings.TrimSpace(text)) {
+			return pos + len(strings.TrimRight(line, "\r\n"))
+		}
+		pos += len(line)
+	}
+	return -1
+}
+
+// mergeVerbatim folds each verbatim region in blocks, from the declaration
+// whose comments hold a begin marker through the last one before an end
+// marker, into its first declaration. That block's DeclText becomes the
+// region's text as written, through the end marker, and it is marked
+// Verbatim, so it sorts as its first declaration but nothing inside is
+// rewritten. Regions holding anything but messages, enums, and services,
+// or never closed, are reported and left alone.
+func mergeVerbatim(blocks []*Block, m *verbatimMarkers) ([]*Block, []Warning) {
+	var result []*Block
+	var warnings []Warning
+	for i := 0; i < len(blocks); i++ {
+		first := blocks[i]
+		if first.Kind == BlockComment || markerLine(first.Comments, m.begin) < 0 {
+			result = append(result, first)
+			continue
+		}
+
+		// The end marker is in the comments above the block after the region
+		j, cut := i+1, -1
+		for ; j < len(blocks); j++ {
+			if cut = markerLine(blocks[j].Comments, m.end); cut >= 0 {
+				break
+			}
+		}
+		var problem string
+		switch {
+		case cut < 0:
+			problem = "is never closed"
+		default:
+			for _, b := range blocks[i:j] {
+				if b.Kind != BlockMessage && b.Kind != BlockEnum && b.Kind != BlockService {
+					problem = "holds a " + b.Kind.String() + " declaration"
+					break
+				}
+			}
+		}
+		if problem != "" {
+			warnings = append(warnings, Warning{Code: WarningVerbatim, Message: fmt.Sprintf("verbatim region starting at line %d %s; sorted normally", first.Line, problem), Line: first.Line})
+			result = append(result, first)
+			continue
+		}
+
+		var text strings.Builder
+		text.WriteString(first.DeclText)
+		for _, b := range blocks[i+1 : j] {
+			text.WriteString(b.Comments + b.DeclText)
+		}
+		after := blocks[j]
+		text.WriteString(after.Comments[:cut])
+		after.Comments = after.Comments[cut:]
+		first.DeclText = text.String()
+		first.Verbatim = true
+		result = append(result, first)
+		i = j - 1
+	}
+	return result, warnings
+}
@@ -1,31 +1,116 @@
-package main
+package protosort
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 
+	"github.com/bufbuild/protocompile"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	descriptorpb "google.golang.org/protobuf/types/descriptorpb"
 )
 
 // Verify checks that the sorted output is semantically identical to the original.
 func Verify(original, sorted string, opts Options) error {
+	if opts.RemoveUnusedImports {
+		original = withoutRemovedImports(original, sorted)
+	}
+	return verify(original, sorted, opts, func() error {
+		return verifyDescriptorSets(original, sorted, opts)
+	})
+}
+
+// VerifyFile is one file checked by VerifyBatch.
+type VerifyFile struct {
+	Name     string // path other files import it by, e.g. "api/v1/api.proto"; names must be unique
+	Original string
+	Sorted   string
+	// Opts, if set, replaces VerifyBatch's options for this file's own
+	// checks, such as when the file was sorted with different formatting.
+	Opts *Options
+}
+
+// VerifyBatch runs Verify on several files, typically every file of a run,
+// and returns one result per file. For the descriptor comparison, the
+// originals are staged together under their names, and so are the sorted
+// outputs, so files that import each other compile against each other's
+// original or sorted version. All originals are compiled at once and all
+// sorted outputs at once: with VerifierProtoc, that is two protoc
+// invocations in all rather than two per file. A file whose Sorted equals
+// its Original is only staged for the others to import, and isn't checked.
+func VerifyBatch(files []VerifyFile, opts Options) []error {
+	files = slices.Clone(files)
+	for i, f := range files {
+		if (f.Opts == nil && opts.RemoveUnusedImports) || (f.Opts != nil && f.Opts.RemoveUnusedImports) {
+			files[i].Original = withoutRemovedImports(f.Original, f.Sorted)
+		}
+	}
+	errs := make([]error, len(files))
+	descErrs := make([]error, len(files))
+	if opts.Verify {
+		descErrs = verifyDescriptorSetsBatch(files, opts)
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i, f := range files {
+		if f.Sorted == f.Original {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			fileOpts := opts
+			if f.Opts != nil {
+				fileOpts = *f.Opts
+			}
+			errs[i] = verify(f.Original, f.Sorted, fileOpts, func() error { return descErrs[i] })
+			<-slots
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// verify runs the checks enabled in opts in order, taking the descriptor
+// comparison from descriptors.
+func verify(original, sorted string, opts Options, descriptors func() error) error {
 	// Content integrity check (always runs)
 	if err := verifyContentIntegrity(original, sorted, opts); err != nil {
 		return fmt.Errorf("content integrity check failed: %w", err)
 	}
 
-	// Descriptor set comparison (requires protoc)
+	// Descriptor set comparison (in-process, or protoc with --verifier=protoc)
 	if opts.Verify {
-		if err := verifyDescriptorSets(original, sorted, opts); err != nil {
+		if err := descriptors(); err != nil {
 			return fmt.Errorf("descriptor verification failed: %w", err)
 		}
 	}
 
+	// Character-level check for --paranoid
+	if opts.Paranoid {
+		if err := verifyCharacters(original, sorted, opts); err != nil {
+			return fmt.Errorf("paranoid check failed: %w", err)
+		}
+	}
+
+	// In-process reflection round trip (no protoc needed)
+	if opts.VerifyLevel == VerifyGRPCCompat {
+		if err := verifyGRPCCompat(original, sorted, opts); err != nil {
+			return fmt.Errorf("grpc-compat verification failed: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -41,6 +126,49 @@ func verifyContentIntegrity(original, sorted string, opts Options) error {
 		return fmt.Errorf("scanning sorted output: %w", err)
 	}
 
+	// Compare verbatim regions whole, as they were moved
+	if verbatim, err := newVerbatimMarkers(opts); err == nil && verbatim != nil {
+		origBlocks, _ = mergeVerbatim(origBlocks, verbatim)
+		sortedBlocks, _ = mergeVerbatim(sortedBlocks, verbatim)
+	}
+
+	// Convert the original's line endings the way the output's were
+	eol := resolveLineEnding(original, opts.EndOfLine)
+	for _, b := range origBlocks {
+		b.DeclText = convertLineEndings(b.DeclText, eol)
+	}
+
+	// Normalize the rest of the original the way the output was rewritten;
+	// verbatim regions weren't.
+	editable := slices.DeleteFunc(slices.Clone(origBlocks), func(b *Block) bool { return b.Verbatim })
+
+	// When Indent is set, normalize the original's indentation the same way
+	if opts.Indent != "" {
+		normalizeIndentation(editable, opts.Indent, opts.IndentWidth)
+	}
+
+	// When SortFieldOptions is set, normalize the original's option lists
+	// the same way so the rewrite isn't reported as an altered body.
+	if opts.SortFieldOptions {
+		for _, b := range editable {
+			b.DeclText = SortFieldOptions(b.DeclText)
+		}
+	}
+	if opts.SortNested {
+		for _, b := range editable {
+			if b.Kind == BlockMessage {
+				b.DeclText = SortNested(b.DeclText)
+			}
+		}
+	}
+	if opts.SortFields {
+		for _, b := range editable {
+			if b.Kind == BlockMessage {
+				b.DeclText = SortFields(b.DeclText)
+			}
+		}
+	}
+
 	origDecls := extractDeclarations(origBlocks)
 	sortedDecls := extractDeclarations(sortedBlocks)
 
@@ -78,11 +206,19 @@ func verifyContentIntegrity(original, sorted string, opts Options) error {
 }
 
 // normalizeServiceDecls sorts the lines within service declaration bodies
-// so that RPC reordering doesn't cause a content integrity mismatch.
+// so that RPC reordering doesn't cause a content integrity mismatch. Blank
+// lines and RPC group headers, which reordering adds and drops, are ignored,
+// and statements that share a line are split apart as sorting does.
 func normalizeServiceDecls(decls map[string]string) {
 	for key, body := range decls {
 		if strings.HasPrefix(key, "service:") {
-			lines := strings.Split(body, "\n")
+			var lines []string
+			body, _ = stripRPCFingerprint(stripRPCGroupHeaders(body))
+			for _, line := range strings.Split(splitStatements(body), "\n") {
+				if strings.TrimSpace(line) != "" {
+					lines = append(lines, line)
+				}
+			}
 			sort.Strings(lines)
 			decls[key] = strings.Join(lines, "\n")
 		}
@@ -107,96 +243,300 @@ func extractDeclarations(blocks []*Block) map[string]string {
 	return decls
 }
 
-// verifyDescriptorSets compiles both versions with protoc and compares descriptors.
+// ProtocAvailable reports whether the protoc that Verify would run with
+// VerifierProtoc (opts.ProtocPath, or protoc on PATH) can be found. Without
+// it, Verify skips the descriptor comparison unless opts.RequireVerify is set.
+func ProtocAvailable(opts Options) bool {
+	_, err := exec.LookPath(protocBinary(opts))
+	return err == nil
+}
+
+// protocBinary returns the protoc command named by opts.
+func protocBinary(opts Options) string {
+	if opts.ProtocPath == "" {
+		return "protoc"
+	}
+	return opts.ProtocPath
+}
+
+// verifyDescriptorSets compiles both versions and compares descriptors, with
+// protocompile in-process unless opts.Verifier selects protoc.
 func verifyDescriptorSets(original, sorted string, opts Options) error {
-	protocPath := opts.ProtocPath
-	if protocPath == "" {
-		protocPath = "protoc"
+	if opts.Verifier == VerifierProtoc {
+		files := []VerifyFile{{Name: "file.proto", Original: original, Sorted: sorted}}
+		return verifyDescriptorSetsProtoc(files, []string{"file.proto"}, opts)[0]
+	}
+
+	var sets [2][]byte
+	for i, content := range []string{original, sorted} {
+		fd, err := compileInProcess(content, opts)
+		if err != nil {
+			if i == 0 {
+				return fmt.Errorf("compiling original: %w", err)
+			}
+			return fmt.Errorf("compiling sorted output: %w", err)
+		}
+		fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(fd)}}
+		data, err := proto.Marshal(fds)
+		if err != nil {
+			return err
+		}
+		if sets[i], err = normalizeDescriptorSet(data, opts); err != nil {
+			return err
+		}
 	}
 
+	if string(sets[0]) != string(sets[1]) {
+		return fmt.Errorf("descriptor sets differ after sorting — the reordering changed the compiled schema")
+	}
+	return nil
+}
+
+// verifyDescriptorSetsBatch compares the descriptors of every file in files
+// whose sorted output differs, compiling each side's files together with
+// protocompile in-process or, per opts.Verifier, with protoc.
+func verifyDescriptorSetsBatch(files []VerifyFile, opts Options) []error {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if f.Sorted != f.Original && !seen[f.Name] {
+			seen[f.Name] = true
+			targets = append(targets, f.Name)
+		}
+	}
+	if opts.Verifier == VerifierProtoc {
+		return verifyDescriptorSetsProtoc(files, targets, opts)
+	}
+	return compareDescriptors(files, targets, func(targets []string, sorted bool) (map[string][]byte, error) {
+		descs, err := compileInProcessBatch(files, targets, sorted, opts)
+		if err != nil {
+			return nil, fmt.Errorf("compiling %s: %w", sideLabel(sorted), err)
+		}
+		return descs, nil
+	})
+}
+
+// verifyDescriptorSetsProtoc compares the descriptors of the targets among
+// files with protoc. Each side is staged once in its own temp tree, with the
+// same file names so the descriptors' name fields match.
+func verifyDescriptorSetsProtoc(files []VerifyFile, targets []string, opts Options) []error {
+	errs := make([]error, len(files))
+	protocPath := protocBinary(opts)
+
 	// Check if protoc is available
 	if _, err := exec.LookPath(protocPath); err != nil {
+		if opts.RequireVerify {
+			err = fmt.Errorf("protoc not found and verification is required: %w", err)
+			for i := range errs {
+				errs[i] = err
+			}
+			return errs
+		}
 		fmt.Fprintf(os.Stderr, "warning: protoc not found, skipping descriptor verification\n")
-		return nil
+		return errs
 	}
 
 	tmpDir, err := os.MkdirTemp("", "protosort-verify-*")
+	if err == nil {
+		defer os.RemoveAll(tmpDir)
+		for side := range 2 {
+			if err = stageFiles(filepath.Join(tmpDir, fmt.Sprint(side)), files, side == 1); err != nil {
+				break
+			}
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("creating temp dir: %w", err)
+		for i := range errs {
+			errs[i] = fmt.Errorf("staging files: %w", err)
+		}
+		return errs
 	}
-	defer os.RemoveAll(tmpDir)
 
-	// Use the same filename for both so the descriptor's name field matches
-	protoFile := filepath.Join(tmpDir, "file.proto")
-	origDesc := filepath.Join(tmpDir, "original.pb")
-	sortedDesc := filepath.Join(tmpDir, "sorted.pb")
+	return compareDescriptors(files, targets, func(targets []string, sorted bool) (map[string][]byte, error) {
+		root := filepath.Join(tmpDir, "0")
+		if sorted {
+			root = filepath.Join(tmpDir, "1")
+		}
+		descs, err := compileWithProtoc(protocPath, root, targets, opts)
+		if err != nil {
+			return nil, fmt.Errorf("protoc failed on %s: %w", sideLabel(sorted), err)
+		}
+		return descs, nil
+	})
+}
 
-	// Build protoc arguments
-	baseArgs := []string{"--proto_path=" + tmpDir}
-	for _, p := range opts.ProtoPaths {
-		baseArgs = append(baseArgs, "--proto_path="+p)
+// compareDescriptors compiles the named targets on both sides with compile
+// and compares each one's descriptors, returning one result per file; files
+// that aren't targets get nil. If a side fails to compile, e.g. because two
+// files define the same symbol or one of them is broken, each target is
+// retried on its own so that errors are attributed to the right file; the
+// other files stay available to import.
+func compareDescriptors(files []VerifyFile, targets []string, compile func(targets []string, sorted bool) (map[string][]byte, error)) []error {
+	results := make(map[string]error)
+	var compare func(targets []string)
+	compare = func(targets []string) {
+		var sets [2]map[string][]byte
+		for side := range 2 {
+			var err error
+			if sets[side], err = compile(targets, side == 1); err == nil {
+				continue
+			}
+			if len(targets) > 1 {
+				for _, name := range targets {
+					compare([]string{name})
+				}
+				return
+			}
+			results[targets[0]] = err
+			return
+		}
+		for _, name := range targets {
+			if string(sets[0][name]) != string(sets[1][name]) {
+				results[name] = fmt.Errorf("descriptor sets differ after sorting — the reordering changed the compiled schema")
+			}
+		}
 	}
-
-	// Compile original
-	if err := os.WriteFile(protoFile, []byte(original), 0644); err != nil {
-		return err
+	if len(targets) > 0 {
+		compare(targets)
 	}
-	args1 := append(baseArgs[:len(baseArgs):len(baseArgs)], "--descriptor_set_out="+origDesc, protoFile)
-	if out, err := exec.Command(protocPath, args1...).CombinedOutput(); err != nil {
-		return fmt.Errorf("protoc failed on original: %s: %w", string(out), err)
+
+	errs := make([]error, len(files))
+	for i, f := range files {
+		errs[i] = results[f.Name]
 	}
+	return errs
+}
 
-	// Compile sorted (overwrite same file so descriptor name matches)
-	if err := os.WriteFile(protoFile, []byte(sorted), 0644); err != nil {
-		return err
+// sideLabel names the original or sorted side in error messages.
+func sideLabel(sorted bool) string {
+	if sorted {
+		return "sorted output"
 	}
-	args2 := append(baseArgs[:len(baseArgs):len(baseArgs)], "--descriptor_set_out="+sortedDesc, protoFile)
-	if out, err := exec.Command(protocPath, args2...).CombinedOutput(); err != nil {
-		return fmt.Errorf("protoc failed on sorted output: %s: %w", string(out), err)
+	return "original"
+}
+
+// stageFiles writes the original (or sorted) content of files under root,
+// at their names.
+func stageFiles(root string, files []VerifyFile, sorted bool) error {
+	for _, f := range files {
+		content := f.Original
+		if sorted {
+			content = f.Sorted
+		}
+		path := filepath.Join(root, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Compare descriptor sets (ignoring source_code_info)
-	origBytes, err := os.ReadFile(origDesc)
-	if err != nil {
-		return err
+// compileWithProtoc compiles the targets staged under root in one protoc
+// invocation, resolving other imports from root first, and returns each
+// target's normalized descriptor by name.
+func compileWithProtoc(protocPath, root string, targets []string, opts Options) (map[string][]byte, error) {
+	args := []string{"--proto_path=" + root}
+	for _, p := range opts.ProtoPaths {
+		args = append(args, "--proto_path="+p)
 	}
-	sortedBytes, err := os.ReadFile(sortedDesc)
+	desc, err := os.CreateTemp(filepath.Dir(root), "*.pb")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	desc.Close()
+	args = append(args, "--descriptor_set_out="+desc.Name())
+	for _, name := range targets {
+		args = append(args, filepath.Join(root, filepath.FromSlash(name)))
 	}
 
-	origStripped, err := normalizeDescriptorSet(origBytes)
-	if err != nil {
-		return fmt.Errorf("parsing original descriptor set: %w", err)
+	if out, err := exec.Command(protocPath, args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %w", string(out), err)
 	}
-	sortedStripped, err := normalizeDescriptorSet(sortedBytes)
+	data, err := os.ReadFile(desc.Name())
 	if err != nil {
-		return fmt.Errorf("parsing sorted descriptor set: %w", err)
+		return nil, err
 	}
 
-	if string(origStripped) != string(sortedStripped) {
-		return fmt.Errorf("descriptor sets differ after sorting — the reordering changed the compiled schema")
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, fds); err != nil {
+		return nil, fmt.Errorf("parsing descriptor set: %w", err)
 	}
+	return marshalDescriptors(fds.GetFile(), opts)
+}
 
-	return nil
+// compileInProcessBatch compiles the targets with protocompile, resolving
+// imports from the original (or sorted) content of files first, then from
+// opts.ProtoPaths and the well-known types, and returns each target's
+// normalized descriptor by name.
+func compileInProcessBatch(files []VerifyFile, targets []string, sorted bool, opts Options) (map[string][]byte, error) {
+	sources := make(map[string]string, len(files))
+	for _, f := range files {
+		sources[f.Name] = f.Original
+		if sorted {
+			sources[f.Name] = f.Sorted
+		}
+	}
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(protocompile.CompositeResolver{
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				if content, ok := sources[path]; ok {
+					return protocompile.SearchResult{Source: strings.NewReader(content)}, nil
+				}
+				return protocompile.SearchResult{}, protoregistry.NotFound
+			}),
+			&protocompile.SourceResolver{ImportPaths: opts.ProtoPaths},
+		}),
+	}
+	compiled, err := compiler.Compile(context.Background(), targets...)
+	if err != nil {
+		return nil, err
+	}
+	fds := make([]*descriptorpb.FileDescriptorProto, len(compiled))
+	for i, fd := range compiled {
+		fds[i] = protodesc.ToFileDescriptorProto(fd)
+	}
+	return marshalDescriptors(fds, opts)
+}
+
+// marshalDescriptors normalizes each file descriptor for comparison, as
+// normalizeFileDescriptor does, and returns it serialized, by file name.
+func marshalDescriptors(fds []*descriptorpb.FileDescriptorProto, opts Options) (map[string][]byte, error) {
+	descs := make(map[string][]byte, len(fds))
+	for _, fd := range fds {
+		fd.SourceCodeInfo = nil
+		normalizeFileDescriptor(fd, opts)
+		data, err := proto.Marshal(fd)
+		if err != nil {
+			return nil, err
+		}
+		descs[fd.GetName()] = data
+	}
+	return descs, nil
 }
 
 // normalizeDescriptorSet parses a serialized FileDescriptorSet, clears
-// source_code_info, sorts all descriptor lists by name for order-independent
-// comparison, and re-serializes.
-func normalizeDescriptorSet(data []byte) ([]byte, error) {
+// source_code_info, normalizes each file descriptor for comparison, and
+// re-serializes.
+func normalizeDescriptorSet(data []byte, opts Options) ([]byte, error) {
 	fds := &descriptorpb.FileDescriptorSet{}
 	if err := proto.Unmarshal(data, fds); err != nil {
 		return nil, err
 	}
 	for _, fd := range fds.GetFile() {
 		fd.SourceCodeInfo = nil
-		normalizeFileDescriptor(fd)
+		normalizeFileDescriptor(fd, opts)
 	}
 	return proto.Marshal(fds)
 }
 
-func normalizeFileDescriptor(fd *descriptorpb.FileDescriptorProto) {
+// normalizeFileDescriptor sorts fd's declarations by name, which sorting
+// may reorder, so that descriptors compare regardless of their order. RPCs
+// are put in name order and fields in number order only if opts let sorting
+// reorder them.
+func normalizeFileDescriptor(fd *descriptorpb.FileDescriptorProto, opts Options) {
 	sort.Slice(fd.MessageType, func(i, j int) bool {
 		return fd.MessageType[i].GetName() < fd.MessageType[j].GetName()
 	})
@@ -206,16 +546,32 @@ func normalizeFileDescriptor(fd *descriptorpb.FileDescriptorProto) {
 	sort.Slice(fd.Service, func(i, j int) bool {
 		return fd.Service[i].GetName() < fd.Service[j].GetName()
 	})
+	// Method order is --sort-rpcs's to change; it doesn't affect the wire
+	if opts.SortRPCs != "" {
+		for _, sd := range fd.Service {
+			sort.Slice(sd.Method, func(i, j int) bool {
+				return sd.Method[i].GetName() < sd.Method[j].GetName()
+			})
+		}
+	}
 	sort.Slice(fd.Extension, func(i, j int) bool {
 		return fd.Extension[i].GetName() < fd.Extension[j].GetName()
 	})
 	// Recursively normalize nested messages
 	for _, mt := range fd.MessageType {
-		normalizeMessageDescriptor(mt)
+		normalizeMessageDescriptor(mt, opts)
 	}
 }
 
-func normalizeMessageDescriptor(md *descriptorpb.DescriptorProto) {
+func normalizeMessageDescriptor(md *descriptorpb.DescriptorProto, opts Options) {
+	// Field order is --sort-fields's to change; numbers identify fields on
+	// the wire. Oneofs follow their first field, which it may move too.
+	if opts.SortFields {
+		sort.SliceStable(md.Field, func(i, j int) bool {
+			return md.Field[i].GetNumber() < md.Field[j].GetNumber()
+		})
+		normalizeOneofOrder(md)
+	}
 	sort.Slice(md.NestedType, func(i, j int) bool {
 		return md.NestedType[i].GetName() < md.NestedType[j].GetName()
 	})
@@ -223,13 +579,48 @@ func normalizeMessageDescriptor(md *descriptorpb.DescriptorProto) {
 		return md.EnumType[i].GetName() < md.EnumType[j].GetName()
 	})
 	for _, nt := range md.NestedType {
-		normalizeMessageDescriptor(nt)
+		normalizeMessageDescriptor(nt, opts)
 	}
 }
 
+// normalizeOneofOrder puts md's oneofs in the order their first fields
+// appear, renumbering the fields' oneof indexes to match.
+func normalizeOneofOrder(md *descriptorpb.DescriptorProto) {
+	index := make(map[int32]int32)
+	var oneofs []*descriptorpb.OneofDescriptorProto
+	for _, f := range md.Field {
+		if f.OneofIndex == nil || int(f.GetOneofIndex()) >= len(md.OneofDecl) {
+			continue
+		}
+		old := f.GetOneofIndex()
+		i, ok := index[old]
+		if !ok {
+			i = int32(len(oneofs))
+			index[old] = i
+			oneofs = append(oneofs, md.OneofDecl[old])
+		}
+		f.OneofIndex = proto.Int32(i)
+	}
+	for old, o := range md.OneofDecl {
+		if _, ok := index[int32(old)]; !ok {
+			oneofs = append(oneofs, o)
+		}
+	}
+	md.OneofDecl = oneofs
+}
+
 // DiffStrings produces a unified diff between two strings using an LCS-based
-// diff algorithm with 3 lines of context and proper hunk headers.
+// diff algorithm with 3 lines of context and proper hunk headers. Lines
+// compare with their endings. When a and b mostly end lines differently,
+// the carriage returns of changed lines are shown as "^M", as git does, so
+// that a change of line endings alone is visible.
 func DiffStrings(a, b, nameA, nameB string) string {
+	return diffStrings(a, b, nameA, nameB, nil)
+}
+
+// diffStrings is DiffStrings with an optional heading, the text after the
+// line ranges of each hunk header.
+func diffStrings(a, b, nameA, nameB string, heading func(h hunk) string) string {
 	linesA := strings.Split(a, "\n")
 	linesB := strings.Split(b, "\n")
 
@@ -255,6 +646,8 @@ func DiffStrings(a, b, nameA, nameB string) string {
 		return ""
 	}
 
+	showCR := resolveLineEnding(a, "") != resolveLineEnding(b, "")
+
 	var diff strings.Builder
 	diff.WriteString(fmt.Sprintf("--- %s\n", nameA))
 	diff.WriteString(fmt.Sprintf("+++ %s\n", nameB))
@@ -263,10 +656,21 @@ func DiffStrings(a, b, nameA, nameB string) string {
 	hunks := buildHunks(edits, ctx)
 
 	for _, h := range hunks {
-		diff.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n",
+		diff.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@",
 			h.origStart+1, h.origCount,
 			h.newStart+1, h.newCount))
+		if heading != nil {
+			if text := heading(h); text != "" {
+				diff.WriteString(" " + text)
+			}
+		}
+		diff.WriteByte('\n')
 		for _, line := range h.lines {
+			if showCR && line[0] != ' ' {
+				if text, ok := strings.CutSuffix(line, "\r"); ok {
+					line = text + "^M"
+				}
+			}
 			diff.WriteString(line)
 			diff.WriteByte('\n')
 		}
@@ -290,6 +694,18 @@ type edit struct {
 	idxB int
 }
 
+// MovedLines returns how many lines of original are not part of the longest
+// common subsequence with sorted, i.e. lines that sorting would move.
+func MovedLines(original, sorted string) int {
+	moved := 0
+	for _, e := range lcsDiff(strings.Split(original, "\n"), strings.Split(sorted, "\n")) {
+		if e.op == editDelete {
+			moved++
+		}
+	}
+	return moved
+}
+
 // lcsDiff computes a diff edit script using the LCS (longest common subsequence) algorithm.
 func lcsDiff(a, b []string) []edit {
 	n := len(a)
@@ -343,6 +759,8 @@ type hunk struct {
 	newStart  int
 	newCount  int
 	lines     []string
+	deleted   []int // indices of the deleted lines in a
+	inserted  []int // indices of the inserted lines in b
 }
 
 // buildHunks groups edits into unified diff hunks with context lines.
@@ -419,9 +837,11 @@ func buildHunks(edits []edit, ctx int) []hunk {
 				h.newCount++
 			case editDelete:
 				h.lines = append(h.lines, "-"+e.line)
+				h.deleted = append(h.deleted, e.idxA)
 				h.origCount++
 			case editInsert:
 				h.lines = append(h.lines, "+"+e.line)
+				h.inserted = append(h.inserted, e.idxB)
 				h.newCount++
 			}
 		}
@@ -455,9 +875,11 @@ func VerboseReport(blocks []*Block) string {
 	report.WriteString("Type classification:\n")
 
 	var names []string
+	lineOf := make(map[string]int)
 	for _, b := range blocks {
 		if (b.Kind == BlockMessage || b.Kind == BlockEnum) && b.Name != "" {
 			names = append(names, b.Name)
+			lineOf[b.Name] = b.Line
 		}
 	}
 	sort.Strings(names)
@@ -479,7 +901,7 @@ func VerboseReport(blocks []*Block) string {
 			classification = "unreferenced"
 		}
 
-		report.WriteString(fmt.Sprintf("  %-30s refs=%-3d %s", name, count, classification))
+		report.WriteString(fmt.Sprintf("  %-30s line=%-5d refs=%-3d %s", name, lineOf[name], count, classification))
 		if len(refs) > 0 {
 			report.WriteString(fmt.Sprintf("  [%s]", strings.Join(refs, ", ")))
 		}